@@ -0,0 +1,297 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat 访问日志格式
+type AccessLogFormat int
+
+const (
+	// AccessLogCombined Apache Combined格式
+	AccessLogCombined AccessLogFormat = iota
+	// AccessLogJSON 每行一个JSON对象
+	AccessLogJSON
+)
+
+// 访问日志记录类型
+const (
+	AccessLogTypeHTTP   = "http"
+	AccessLogTypeHTTPS  = "https"
+	AccessLogTypeTunnel = "tunnel"
+)
+
+// AccessLogEntry 一条访问日志, 每个HTTP请求、隧道、HTTPS解密后的请求各一条
+type AccessLogEntry struct {
+	// Time 开始时间
+	Time time.Time `json:"time"`
+	// Duration 耗时
+	Duration time.Duration `json:"-"`
+	// RequestID 同Context.RequestID
+	RequestID string `json:"request_id"`
+	// Type http、https(HTTPS解密后的请求)、tunnel(CONNECT, 包括HTTPS解密的连接)
+	Type     string `json:"type"`
+	ClientIP string `json:"client_ip"`
+	User     string `json:"user,omitempty"`
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Host     string `json:"host"`
+	Proto    string `json:"proto"`
+	// Status 返回给客户端的状态码, 未返回时为0
+	Status int `json:"status"`
+	// BytesIn 从客户端接收的字节数
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut 发送到客户端的字节数
+	BytesOut         int64 `json:"bytes_out"`
+	UpstreamBytesIn  int64 `json:"upstream_bytes_in"`
+	UpstreamBytesOut int64 `json:"upstream_bytes_out"`
+	// Route 直连为DIRECT, 否则为上级代理地址(不含密码)
+	Route     string `json:"route"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Categories URL分类
+	Categories []string `json:"categories,omitempty"`
+	// ErrorClass 错误分类, 没有错误时为空
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// MarshalJSON 耗时以毫秒输出
+func (e *AccessLogEntry) MarshalJSON() ([]byte, error) {
+	type entry AccessLogEntry
+	return json.Marshal(&struct {
+		*entry
+		DurationMs float64 `json:"duration_ms"`
+	}{
+		entry:      (*entry)(e),
+		DurationMs: float64(e.Duration) / float64(time.Millisecond),
+	})
+}
+
+// AccessLogSink 接收访问日志记录, 如写入文件、发送到日志服务, 在请求结束时同步调用
+type AccessLogSink interface {
+	Log(entry *AccessLogEntry)
+}
+
+// AccessLogSinkFunc 函数形式的AccessLogSink
+type AccessLogSinkFunc func(entry *AccessLogEntry)
+
+func (f AccessLogSinkFunc) Log(entry *AccessLogEntry) {
+	f(entry)
+}
+
+// AccessLogFormatter 将一条记录格式化为一行, 不包含换行符
+type AccessLogFormatter interface {
+	Format(entry *AccessLogEntry) []byte
+}
+
+// AccessLogFormatterFunc 函数形式的AccessLogFormatter
+type AccessLogFormatterFunc func(entry *AccessLogEntry) []byte
+
+func (f AccessLogFormatterFunc) Format(entry *AccessLogEntry) []byte {
+	return f(entry)
+}
+
+// Format 使用内置格式
+func (f AccessLogFormat) Format(entry *AccessLogEntry) []byte {
+	switch f {
+	case AccessLogJSON:
+		line, _ := json.Marshal(entry)
+		return line
+	}
+
+	return []byte(formatCombined(entry))
+}
+
+// WithAccessLog 访问日志, 每条记录一行写入w, 可多次调用写入多个目标
+func WithAccessLog(w io.Writer, format AccessLogFormat) Option {
+	return WithAccessLogSink(NewAccessLogWriter(w, format))
+}
+
+// WithAccessLogSink 自定义访问日志的处理, 可多次调用
+func WithAccessLogSink(sink AccessLogSink) Option {
+	return func(opt *options) {
+		opt.accessLogSinks = append(opt.accessLogSinks, sink)
+	}
+}
+
+// NewAccessLogWriter 使用formatter格式化后每条记录一行写入w, 并发安全
+func NewAccessLogWriter(w io.Writer, formatter AccessLogFormatter) AccessLogSink {
+	return &accessLogWriter{w: w, formatter: formatter}
+}
+
+type accessLogWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	formatter AccessLogFormatter
+}
+
+func (l *accessLogWriter) Log(entry *AccessLogEntry) {
+	line := append(l.formatter.Format(entry), '\n')
+	l.mu.Lock()
+	l.w.Write(line)
+	l.mu.Unlock()
+}
+
+// complete 一个请求或隧道结束, 调用Delegate.Complete并记录访问日志, bytes为本条记录的字节数
+func (p *Proxy) complete(ctx *Context, req *http.Request, typ string, start time.Time, status int, bytes ByteCounters) {
+	p.hostStats.record(hostname(req.URL.Host), typ, ctx.err != nil || status >= http.StatusInternalServerError, &bytes)
+	if ctx.quota != nil {
+		ctx.quota.request()
+	}
+	p.callComplete(ctx, &Outcome{
+		Type:       typ,
+		StatusCode: status,
+		Err:        ctx.err,
+		ErrorClass: ctx.errorClass,
+		Duration:   time.Since(start),
+		Bytes:      bytes,
+	})
+	if len(p.accessLogSinks) > 0 {
+		p.logAccess(newAccessLogEntry(ctx, req, typ, start, status, bytes))
+	}
+}
+
+// logAccess 发送到所有AccessLogSink
+func (p *Proxy) logAccess(entry *AccessLogEntry) {
+	for _, sink := range p.accessLogSinks {
+		sink.Log(entry)
+	}
+}
+
+// formatCombined %h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+func formatCombined(e *AccessLogEntry) string {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if e.BytesOut > 0 {
+		size = strconv.FormatInt(e.BytesOut, 10)
+	}
+
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s %q %q`,
+		e.ClientIP, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URL, e.Proto, e.Status, size, dash(e.Referer), dash(e.UserAgent))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// newAccessLogEntry 根据Context生成访问日志, bytes为本条记录的字节数
+func newAccessLogEntry(ctx *Context, req *http.Request, typ string, start time.Time, status int, bytes ByteCounters) *AccessLogEntry {
+	entry := &AccessLogEntry{
+		Time:             start,
+		Duration:         time.Since(start),
+		RequestID:        ctx.RequestID,
+		Type:             typ,
+		User:             ctx.User,
+		Method:           req.Method,
+		URL:              req.URL.String(),
+		Host:             req.URL.Host,
+		Proto:            req.Proto,
+		Status:           status,
+		BytesIn:          bytes.ClientRead,
+		BytesOut:         bytes.ClientWritten,
+		UpstreamBytesIn:  bytes.UpstreamRead,
+		UpstreamBytesOut: bytes.UpstreamWritten,
+		Route:            "DIRECT",
+		Referer:          req.Referer(),
+		UserAgent:        req.UserAgent(),
+		Categories:       ctx.Categories,
+	}
+	if req.Method == http.MethodConnect {
+		entry.URL = req.URL.Host
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		entry.ClientIP = ip
+	} else {
+		entry.ClientIP = req.RemoteAddr
+	}
+	if ctx.parentProxy != nil {
+		entry.Route = parentStatsKey(ctx.parentProxy)
+	}
+	if ctx.err != nil {
+		entry.ErrorClass = ctx.errorClass.String()
+		entry.Error = ctx.err.Error()
+	}
+
+	return entry
+}
+
+func (b ByteCounters) sub(o ByteCounters) ByteCounters {
+	return ByteCounters{
+		ClientRead:      b.ClientRead - o.ClientRead,
+		ClientWritten:   b.ClientWritten - o.ClientWritten,
+		UpstreamRead:    b.UpstreamRead - o.UpstreamRead,
+		UpstreamWritten: b.UpstreamWritten - o.UpstreamWritten,
+	}
+}
+
+// responseRecorder 记录写入客户端的状态码
+type responseRecorder struct {
+	http.ResponseWriter
+	ctx *Context
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.ctx.status == 0 {
+		r.ctx.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.ctx.status == 0 {
+		r.ctx.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("web server不支持Hijacker")
+	}
+
+	return h.Hijack()
+}
+
+// Unwrap 用于http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ACLAction 访问控制规则的处理方式
+type ACLAction int
+
+const (
+	// ACLDeny 拒绝
+	ACLDeny ACLAction = iota
+	// ACLAllow 放行, 用于在拒绝规则前添加例外
+	ACLAllow
+)
+
+// ACLRule 按目标地址匹配的访问控制规则
+type ACLRule struct {
+	// Hosts 目标主机, 支持精确匹配、*.example.com匹配所有子域名、*匹配所有, IP目标还支持CIDR如10.0.0.0/8
+	// 为空时匹配所有主机
+	Hosts []string
+	// Ports 目标端口, 为空时匹配所有端口
+	Ports []int
+	// Geo 按目标和客户端的地理位置匹配, 需要开启WithGeoIP, 与Hosts、Ports同时满足时匹配
+	Geo    GeoMatch
+	Action ACLAction
+	// Message 拦截页面的说明
+	Message string
+
+	networks []*net.IPNet
+	patterns []string
+}
+
+// ACLConfig 访问控制设置
+type ACLConfig struct {
+	// Rules 按顺序匹配第一条规则
+	Rules []ACLRule
+	// DefaultDeny 没有匹配的规则时拒绝, 用于白名单模式, 默认放行
+	DefaultDeny bool
+	// StatusCode 拒绝时的状态码, 默认403
+	StatusCode int
+}
+
+// WithACL 按目标主机和端口拦截, 拦截时调用Delegate.Blocked, 可在其中修改拦截页面
+// CONNECT在Auth之后按隧道目标检查, HTTP请求和HTTPS解密后的请求在Host、URL重写之后、BeforeRequest之前检查
+func WithACL(config ACLConfig) Option {
+	return func(opt *options) {
+		opt.acl = &config
+	}
+}
+
+type acl struct {
+	rules       []ACLRule
+	defaultDeny bool
+	statusCode  int
+}
+
+func newACL(config ACLConfig) *acl {
+	a := &acl{
+		rules:       make([]ACLRule, len(config.Rules)),
+		defaultDeny: config.DefaultDeny,
+		statusCode:  config.StatusCode,
+	}
+	if a.statusCode == 0 {
+		a.statusCode = http.StatusForbidden
+	}
+	for i, rule := range config.Rules {
+		rule.networks, rule.patterns = nil, nil
+		for _, h := range rule.Hosts {
+			if _, n, err := net.ParseCIDR(h); err == nil {
+				rule.networks = append(rule.networks, n)
+				continue
+			}
+			rule.patterns = append(rule.patterns, h)
+		}
+		a.rules[i] = rule
+	}
+
+	return a
+}
+
+// match 返回匹配的规则, 没有匹配时返回nil
+func (a *acl) match(ctx *Context, host string, port int) *ACLRule {
+	ip := net.ParseIP(host)
+	for i := range a.rules {
+		if a.rules[i].match(host, ip, port) && a.rules[i].Geo.match(ctx) {
+			return &a.rules[i]
+		}
+	}
+
+	return nil
+}
+
+func (r *ACLRule) match(host string, ip net.IP, port int) bool {
+	if len(r.Ports) > 0 && !containsPort(r.Ports, port) {
+		return false
+	}
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	if ip != nil {
+		for _, n := range r.networks {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range r.patterns {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkACL 检查请求目标, 返回nil时放行
+func (p *Proxy) checkACL(ctx *Context) *BlockPage {
+	a := p.runtime().acl
+	if ctx.listener != nil && ctx.listener.acl != nil {
+		a = ctx.listener.acl
+	}
+	if a == nil {
+		return nil
+	}
+	host, port := aclTarget(ctx.Req)
+	rule := a.match(ctx, host, port)
+	if rule == nil && !a.defaultDeny || rule != nil && rule.Action == ACLAllow {
+		return nil
+	}
+	page := &BlockPage{StatusCode: a.statusCode}
+	if rule != nil {
+		page.Message = rule.Message
+	}
+	p.callBlocked(ctx, rule, page)
+
+	return page
+}
+
+// aclTarget 请求的目标主机和端口, 没有端口时按scheme取默认端口
+func aclTarget(req *http.Request) (string, int) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := defaultPort(req.URL.Scheme)
+		if req.Method == http.MethodConnect {
+			port = "443"
+		}
+		addr = ensurePort(addr, port)
+	}
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+
+	return strings.TrimSuffix(strings.ToLower(host), "."), port
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestACLMatchIPv6(t *testing.T) {
+	a := newACL(ACLConfig{Rules: []ACLRule{
+		{Hosts: []string{"2001:db8::/32"}, Ports: []int{443}},
+		{Hosts: []string{"::1"}},
+		{Hosts: []string{"10.0.0.0/8"}},
+	}})
+	tests := []struct {
+		method string
+		url    string
+		rule   int
+	}{
+		{http.MethodConnect, "//[2001:db8::1]:443", 0},
+		{http.MethodConnect, "//[2001:db8::1]", 0},
+		{http.MethodGet, "https://[2001:db8:ffff::1]/", 0},
+		{http.MethodGet, "http://[2001:db8::1]/", -1},
+		{http.MethodGet, "http://[2001:db9::1]:443/", -1},
+		{http.MethodGet, "http://[::1]:8080/", 1},
+		{http.MethodConnect, "//[::ffff:10.1.2.3]:443", 2},
+		{http.MethodGet, "http://10.1.2.3/", 2},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, port := aclTarget(&http.Request{Method: tt.method, URL: u})
+		rule := a.match(&Context{}, host, port)
+		want := (*ACLRule)(nil)
+		if tt.rule >= 0 {
+			want = &a.rules[tt.rule]
+		}
+		if rule != want {
+			t.Errorf("%s %s 匹配的规则不符, 期望第%d条", tt.method, tt.url, tt.rule)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package acme 反向代理对外提供服务时, 通过ACME(如Let's Encrypt)自动申请和续期证书
+// 支持HTTP-01(HTTPHandler)和TLS-ALPN-01(TLSConfig)验证
+//
+//	m := acme.New([]string{"example.com", "*.example.com"}, acme.WithDirCache("/var/lib/goproxy/acme"))
+//	go http.ListenAndServe(":80", m.HTTPHandler(nil))
+//	server := &http.Server{Addr: ":443", Handler: handler, TLSConfig: m.TLSConfig()}
+//	server.ListenAndServeTLS("", "")
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type options struct {
+	cache        autocert.Cache
+	email        string
+	directoryURL string
+	renewBefore  time.Duration
+}
+
+type Option func(*options)
+
+// WithCache 证书存储, 多个实例共享同一存储(如数据库、对象存储)时只需申请一次证书
+func WithCache(c autocert.Cache) Option {
+	return func(opt *options) {
+		opt.cache = c
+	}
+}
+
+// WithDirCache 证书保存到本地目录
+func WithDirCache(dir string) Option {
+	return WithCache(autocert.DirCache(dir))
+}
+
+// WithEmail ACME账户联系邮箱, 用于接收证书到期提醒
+func WithEmail(email string) Option {
+	return func(opt *options) {
+		opt.email = email
+	}
+}
+
+// WithDirectoryURL ACME服务地址, 默认Let's Encrypt正式环境
+func WithDirectoryURL(url string) Option {
+	return func(opt *options) {
+		opt.directoryURL = url
+	}
+}
+
+// WithRenewBefore 证书到期前多久续期, 默认30天
+func WithRenewBefore(d time.Duration) Option {
+	return func(opt *options) {
+		opt.renewBefore = d
+	}
+}
+
+// Manager 自动申请证书
+type Manager struct {
+	m *autocert.Manager
+}
+
+// New 创建Manager, hosts为允许申请证书的域名, 支持*.example.com匹配所有子域名(每个子域名单独申请证书)
+// 未设置存储时证书只保存在内存中, 重启后重新申请, 容易触发ACME服务的频率限制
+func New(hosts []string, opt ...Option) *Manager {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  HostPolicy(hosts...),
+		Cache:       opts.cache,
+		Email:       opts.email,
+		RenewBefore: opts.renewBefore,
+	}
+	if opts.directoryURL != "" {
+		m.Client = &xacme.Client{DirectoryURL: opts.directoryURL}
+	}
+
+	return &Manager{m: m}
+}
+
+// TLSConfig 服务端TLS配置, 支持TLS-ALPN-01验证
+func (m *Manager) TLSConfig() *tls.Config {
+	return m.m.TLSConfig()
+}
+
+// GetCertificate 用于自定义tls.Config
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.m.GetCertificate(hello)
+}
+
+// HTTPHandler 处理HTTP-01验证请求, 其他请求交给fallback, fallback为nil时重定向到HTTPS
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.m.HTTPHandler(fallback)
+}
+
+// Autocert 底层的autocert.Manager, 用于高级配置
+func (m *Manager) Autocert() *autocert.Manager {
+	return m.m
+}
+
+// HostPolicy 只允许为匹配的域名申请证书, 支持精确匹配和*.example.com
+func HostPolicy(hosts ...string) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		for _, pattern := range hosts {
+			pattern = strings.ToLower(pattern)
+			if pattern == host {
+				return nil
+			}
+			if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("acme: 域名%s不允许申请证书", host)
+	}
+}
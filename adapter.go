@@ -0,0 +1,77 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// ContentAdapter 请求和响应的内容适配, 如ICAP、病毒扫描、DLP
+type ContentAdapter interface {
+	// AdaptRequest 在BeforeRequest和请求body转换之后调用, 返回修改后的请求
+	// 返回的响应不为nil时直接返回给客户端, 不再请求目标服务器
+	AdaptRequest(ctx *Context, req *http.Request) (*http.Request, *http.Response, error)
+	// AdaptResponse 收到目标服务器的响应后、BeforeResponse之前调用, 返回修改后的响应
+	AdaptResponse(ctx *Context, resp *http.Response) (*http.Response, error)
+}
+
+// WithContentAdapters 按顺序执行内容适配, 返回错误时响应502
+func WithContentAdapters(adapters ...ContentAdapter) Option {
+	return func(opt *options) {
+		opt.contentAdapters = append(opt.contentAdapters, adapters...)
+	}
+}
+
+// adaptRequest 按顺序执行AdaptRequest, 任一返回响应时停止
+func (p *Proxy) adaptRequest(ctx *Context, req *http.Request) (*http.Request, *http.Response, error) {
+	for i, a := range p.contentAdapters {
+		start := time.Now()
+		newReq, resp, err := a.AdaptRequest(ctx, req)
+		p.adapterRequestStats[i].since(start)
+		if err != nil {
+			return nil, nil, err
+		}
+		if newReq != nil {
+			req = newReq
+		}
+		if resp != nil {
+			if resp.Request == nil {
+				resp.Request = req
+			}
+			return req, resp, nil
+		}
+	}
+
+	return req, nil, nil
+}
+
+// adaptResponse 按顺序执行AdaptResponse
+func (p *Proxy) adaptResponse(ctx *Context, resp *http.Response) (*http.Response, error) {
+	for i, a := range p.contentAdapters {
+		start := time.Now()
+		newResp, err := a.AdaptResponse(ctx, resp)
+		p.adapterResponseStats[i].since(start)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if newResp != nil {
+			resp = newResp
+		}
+	}
+
+	return resp, nil
+}
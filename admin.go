@@ -0,0 +1,333 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 按域名统计的最大域名数, 超过后新的域名计入otherHost
+const maxHostStats = 1024
+
+const otherHost = "*"
+
+// 连接类型, 见TunnelInfo.Type
+const (
+	TunnelTypeTunnel    = "tunnel"
+	TunnelTypeMITM      = "mitm"
+	TunnelTypeWebSocket = "websocket"
+)
+
+// TunnelInfo 正在转发的隧道、HTTPS解密连接或WebSocket连接
+type TunnelInfo struct {
+	// ID 建立连接的请求的Context.RequestID, 用于CloseTunnel
+	ID string `json:"id"`
+	// Type tunnel、mitm、websocket
+	Type     string    `json:"type"`
+	ClientIP string    `json:"client_ip"`
+	User     string    `json:"user,omitempty"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	// BytesIn 从客户端接收的字节数, BytesOut 发送到客户端的字节数
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// Tunnels 返回正在转发的连接, 按建立时间排序
+func (p *Proxy) Tunnels() []TunnelInfo {
+	p.conns.mu.Lock()
+	list := make([]TunnelInfo, 0, len(p.conns.conns))
+	for _, tc := range p.conns.conns {
+		list = append(list, TunnelInfo{
+			ID:       tc.id,
+			Type:     tc.typ,
+			ClientIP: tc.clientIP,
+			User:     tc.user,
+			Target:   tc.target,
+			Start:    tc.start,
+			BytesIn:  atomic.LoadInt64(&tc.bytes.ClientRead),
+			BytesOut: atomic.LoadInt64(&tc.bytes.ClientWritten),
+		})
+	}
+	p.conns.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.Before(list[j].Start)
+	})
+
+	return list
+}
+
+// CloseTunnel 关闭指定ID的连接, 连接不存在时返回false
+func (p *Proxy) CloseTunnel(id string) bool {
+	p.conns.mu.Lock()
+	defer p.conns.mu.Unlock()
+	for conn, tc := range p.conns.conns {
+		if tc.id == id {
+			conn.Close()
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientInfo 有正在处理的请求或隧道的客户端
+type ClientInfo struct {
+	IP string `json:"ip"`
+	// Active 正在处理的请求和隧道数
+	Active int `json:"active"`
+	// Since 本次连续活跃的开始时间
+	Since time.Time `json:"since"`
+}
+
+// Clients 返回当前的客户端, 按IP排序
+func (p *Proxy) Clients() []ClientInfo {
+	return p.clients.snapshot()
+}
+
+// clientTracker 按客户端IP统计正在处理的请求
+type clientTracker struct {
+	mu      sync.Mutex
+	clients map[string]*ClientInfo
+}
+
+func (t *clientTracker) add(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[string]*ClientInfo)
+	}
+	c := t.clients[ip]
+	if c == nil {
+		c = &ClientInfo{IP: ip, Since: time.Now()}
+		t.clients[ip] = c
+	}
+	c.Active++
+}
+
+func (t *clientTracker) remove(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.clients[ip]; c != nil {
+		if c.Active--; c.Active <= 0 {
+			delete(t.clients, ip)
+		}
+	}
+}
+
+func (t *clientTracker) snapshot() []ClientInfo {
+	t.mu.Lock()
+	list := make([]ClientInfo, 0, len(t.clients))
+	for _, c := range t.clients {
+		list = append(list, *c)
+	}
+	t.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IP < list[j].IP
+	})
+
+	return list
+}
+
+// HostStats 按目标域名统计的请求
+type HostStats struct {
+	// Host 目标域名, 域名数超过限制后的其他域名为*
+	Host string `json:"host"`
+	// Requests 请求数, CONNECT和HTTPS解密后的请求分别计数
+	Requests int64 `json:"requests"`
+	// Errors 出错或返回5xx的请求数
+	Errors int64 `json:"errors"`
+	// ErrorRate Errors/Requests
+	ErrorRate float64 `json:"error_rate"`
+	// BytesIn 从客户端接收的字节数, BytesOut 发送到客户端的字节数, HTTPS解密的连接按隧道统计
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// HostStats 返回按目标域名的统计, 按字节数从大到小排序
+func (p *Proxy) HostStats() []HostStats {
+	return p.hostStats.snapshot()
+}
+
+type hostStatsRecorder struct {
+	mu    sync.Mutex
+	hosts map[string]*HostStats
+}
+
+// record 请求结束时记录, HTTPS解密后的请求不记录字节数, 已计入隧道
+func (r *hostStatsRecorder) record(host, typ string, failed bool, bytes *ByteCounters) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[string]*HostStats)
+	}
+	s := r.hosts[host]
+	if s == nil {
+		if len(r.hosts) >= maxHostStats {
+			host = otherHost
+			s = r.hosts[host]
+		}
+		if s == nil {
+			s = &HostStats{Host: host}
+			r.hosts[host] = s
+		}
+	}
+	s.Requests++
+	if failed {
+		s.Errors++
+	}
+	if typ != AccessLogTypeHTTPS {
+		s.BytesIn += atomic.LoadInt64(&bytes.ClientRead)
+		s.BytesOut += atomic.LoadInt64(&bytes.ClientWritten)
+	}
+}
+
+func (r *hostStatsRecorder) snapshot() []HostStats {
+	r.mu.Lock()
+	list := make([]HostStats, 0, len(r.hosts))
+	for _, s := range r.hosts {
+		st := *s
+		st.ErrorRate = float64(st.Errors) / float64(st.Requests)
+		list = append(list, st)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].BytesIn+list[i].BytesOut, list[j].BytesIn+list[j].BytesOut
+		if a != b {
+			return a > b
+		}
+		return list[i].Host < list[j].Host
+	})
+
+	return list
+}
+
+// CircuitStates 返回WithCircuitBreaker记录的有失败的目标服务器, 未开启时返回nil
+func (p *Proxy) CircuitStates() []CircuitStatus {
+	if p.breaker == nil {
+		return nil
+	}
+
+	return p.breaker.snapshot()
+}
+
+// FlushDNSCache 清空WithResolver设置的resolver.Cache, resolver不支持清空时返回false
+func (p *Proxy) FlushDNSCache() bool {
+	f, ok := p.resolver.(interface{ Flush() })
+	if ok {
+		f.Flush()
+	}
+
+	return ok
+}
+
+// FlushCertCache 清空HTTPS解密的证书缓存, 缓存不支持清空时返回false
+func (p *Proxy) FlushCertCache() bool {
+	if p.cert == nil {
+		return false
+	}
+
+	return p.cert.FlushCache()
+}
+
+// AdminHandler 管理接口, 返回JSON, 不要挂载到代理端口, 如
+// mux.Handle("/admin/", http.StripPrefix("/admin", proxy.AdminHandler()))
+//
+//	GET    /stats              运行状态, 同Snapshot
+//	GET    /hosts              按目标域名的请求数、错误率和字节数
+//	GET    /clients            当前的客户端
+//	GET    /tunnels            正在转发的隧道、HTTPS解密和WebSocket连接
+//	DELETE /tunnels/{id}       关闭连接
+//	GET    /circuits           熔断状态
+//	GET    /users/{user}       用户当天和当月的用量, 需开启WithUserQuota
+//	POST   /cache/dns/flush    清空DNS缓存
+//	POST   /cache/certs/flush  清空证书缓存
+//	GET    /metrics            Prometheus指标, 同MetricsHandler
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", func(rw http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(rw, http.StatusOK, p.Snapshot())
+	})
+	mux.HandleFunc("GET /hosts", func(rw http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(rw, http.StatusOK, p.HostStats())
+	})
+	mux.HandleFunc("GET /clients", func(rw http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(rw, http.StatusOK, p.Clients())
+	})
+	mux.HandleFunc("GET /tunnels", func(rw http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(rw, http.StatusOK, p.Tunnels())
+	})
+	mux.HandleFunc("DELETE /tunnels/{id}", func(rw http.ResponseWriter, req *http.Request) {
+		if !p.CloseTunnel(req.PathValue("id")) {
+			writeAdminJSON(rw, http.StatusNotFound, adminResult{Error: "连接不存在"})
+			return
+		}
+		writeAdminJSON(rw, http.StatusOK, adminResult{OK: true})
+	})
+	mux.HandleFunc("GET /circuits", func(rw http.ResponseWriter, req *http.Request) {
+		states := p.CircuitStates()
+		if states == nil {
+			states = []CircuitStatus{}
+		}
+		writeAdminJSON(rw, http.StatusOK, states)
+	})
+	mux.HandleFunc("GET /users/{user}", func(rw http.ResponseWriter, req *http.Request) {
+		if p.quota == nil {
+			writeAdminJSON(rw, http.StatusNotImplemented, adminResult{Error: "未开启用户配额"})
+			return
+		}
+		daily, monthly, err := p.UserUsage(req.PathValue("user"))
+		if err != nil {
+			writeAdminJSON(rw, http.StatusInternalServerError, adminResult{Error: err.Error()})
+			return
+		}
+		writeAdminJSON(rw, http.StatusOK, map[string]UserUsage{"daily": daily, "monthly": monthly})
+	})
+	mux.HandleFunc("POST /cache/dns/flush", func(rw http.ResponseWriter, req *http.Request) {
+		if !p.FlushDNSCache() {
+			writeAdminJSON(rw, http.StatusNotImplemented, adminResult{Error: "未使用支持清空的DNS缓存"})
+			return
+		}
+		writeAdminJSON(rw, http.StatusOK, adminResult{OK: true})
+	})
+	mux.HandleFunc("POST /cache/certs/flush", func(rw http.ResponseWriter, req *http.Request) {
+		if !p.FlushCertCache() {
+			writeAdminJSON(rw, http.StatusNotImplemented, adminResult{Error: "证书缓存不支持清空"})
+			return
+		}
+		writeAdminJSON(rw, http.StatusOK, adminResult{OK: true})
+	})
+	mux.Handle("GET /metrics", p.MetricsHandler())
+
+	return mux
+}
+
+type adminResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func writeAdminJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull 等待发送到上游的请求已达WithAdmissionControl的队列上限
+	ErrQueueFull = errors.New("请求队列已满")
+	// ErrQueueTimeout 请求排队超过WithAdmissionControl的等待时间
+	ErrQueueTimeout = errors.New("请求排队超时")
+)
+
+// AdmissionConfig 准入控制配置
+type AdmissionConfig struct {
+	// MaxConcurrent 同时处理的上游请求数, 从发送请求到响应body写完
+	MaxConcurrent int
+	// MaxQueue 排队等待的请求数上限, 超出时立即返回503, 为0时不排队
+	MaxQueue int
+	// QueueTimeout 最长排队时间, 超时返回503, 为0时一直等待到客户端断开
+	QueueTimeout time.Duration
+}
+
+// AdmissionStats 准入控制的状态
+type AdmissionStats struct {
+	// Active 正在处理的上游请求数
+	Active int64
+	// Queued 正在排队的请求数
+	Queued int64
+	// Rejected 因队列已满或排队超时拒绝的请求数
+	Rejected int64
+}
+
+// WithAdmissionControl 限制同时发送到上游的HTTP请求数(包括HTTPS解密后的请求), 超出的请求在有界队列中等待
+// 队列已满或排队超时返回503并带上Retry-After(见WithRetryAfter), 避免大量慢速源站时goroutine和内存无限增长
+// 在BeforeRequest之后、连接目标服务器之前排队, 隧道不受限制, 队列深度见Stats.Admission和MetricsHandler
+func WithAdmissionControl(config AdmissionConfig) Option {
+	return func(opt *options) {
+		opt.admission = &config
+	}
+}
+
+type admission struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+	queued   int64
+	rejected int64
+}
+
+func newAdmission(config AdmissionConfig) *admission {
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = 1
+	}
+
+	return &admission{
+		slots:    make(chan struct{}, config.MaxConcurrent),
+		maxQueue: int64(config.MaxQueue),
+		timeout:  config.QueueTimeout,
+	}
+}
+
+// acquire 获取处理名额, 没有空闲名额时排队
+func (a *admission) acquire(ctx context.Context) (release func(), err error) {
+	release = func() {
+		<-a.slots
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if atomic.AddInt64(&a.queued, 1) > a.maxQueue {
+		atomic.AddInt64(&a.queued, -1)
+		atomic.AddInt64(&a.rejected, 1)
+		return nil, ErrQueueFull
+	}
+	defer atomic.AddInt64(&a.queued, -1)
+	var timeout <-chan time.Time
+	if a.timeout > 0 {
+		timer := time.NewTimer(a.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		atomic.AddInt64(&a.rejected, 1)
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func (a *admission) stats() AdmissionStats {
+	return AdmissionStats{
+		Active:   int64(len(a.slots)),
+		Queued:   atomic.LoadInt64(&a.queued),
+		Rejected: atomic.LoadInt64(&a.rejected),
+	}
+}
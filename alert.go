@@ -0,0 +1,343 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAlertQuotaRatio      = 0.8
+	defaultAlertBandwidthWindow = time.Minute
+	defaultAlertRetries         = 3
+	defaultAlertTimeout         = 10 * time.Second
+	// 每个webhook待发送告警的队列长度, 队列满时丢弃
+	alertQueueSize = 256
+)
+
+// AlertType 告警类型
+type AlertType string
+
+const (
+	// AlertQuota 用户用量达到配额的指定比例
+	AlertQuota AlertType = "quota"
+	// AlertBandwidth 单个目标主机在时间窗口内的流量超过阈值
+	AlertBandwidth AlertType = "bandwidth"
+	// AlertParentDown 上级代理连续失败, 变为不健康
+	AlertParentDown AlertType = "parent_down"
+	// AlertParentUp 不健康的上级代理恢复
+	AlertParentUp AlertType = "parent_up"
+)
+
+// Alert 告警内容, 以JSON格式POST到webhook
+type Alert struct {
+	Type    AlertType `json:"type"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	// User 和 Period 用于AlertQuota, Period为2006-01-02或2006-01
+	User   string `json:"user,omitempty"`
+	Period string `json:"period,omitempty"`
+	// Host 用于AlertBandwidth
+	Host string `json:"host,omitempty"`
+	// Parent 用于AlertParentDown、AlertParentUp, 不含密码
+	Parent string `json:"parent,omitempty"`
+	// Value 当前值, 字节数或连续失败次数
+	Value int64 `json:"value,omitempty"`
+	// Threshold 触发告警的阈值
+	Threshold int64 `json:"threshold,omitempty"`
+}
+
+// AlertWebhook 接收告警的地址
+// 设置Secret时请求带上签名头:
+//
+//	X-Goproxy-Timestamp: unix时间戳
+//	X-Goproxy-Signature: sha256=hex(HMAC-SHA256(Secret, 时间戳 + "." + body))
+type AlertWebhook struct {
+	URL    string
+	Secret string
+	// Types 接收的告警类型, 为空时接收所有告警
+	Types []AlertType
+	// Header 额外的请求头
+	Header http.Header
+}
+
+// AlertConfig 告警阈值和发送设置
+type AlertConfig struct {
+	// QuotaRatio 用量达到配额的比例时告警, 默认0.8, 每个用户每个周期只告警一次
+	QuotaRatio float64
+	// BandwidthBytes 单个主机在BandwidthWindow内的流量(客户端收发字节数)超过时告警, 为0时不检查
+	// 请求或隧道结束时计入流量
+	BandwidthBytes int64
+	// BandwidthWindow 流量统计窗口, 默认1分钟, 每个主机每个窗口只告警一次
+	BandwidthWindow time.Duration
+	// Retries 发送失败(网络错误、429、5xx)后的重试次数, 默认3次, 间隔1秒起按倍数增长
+	Retries int
+	// Timeout 单次发送超时时间, 默认10秒
+	Timeout time.Duration
+	// Client 发送告警使用的http.Client, 默认使用http.DefaultClient的Transport
+	Client *http.Client
+}
+
+// WithAlertWebhooks 超过阈值时发送告警到webhook(用户用量超过配额比例、主机流量突增、上级代理不可用)
+// 告警异步发送, 不影响请求处理
+func WithAlertWebhooks(config AlertConfig, hooks ...AlertWebhook) Option {
+	return func(opt *options) {
+		opt.alertConfig = config
+		opt.alertWebhooks = append(opt.alertWebhooks, hooks...)
+	}
+}
+
+// alerter 检查阈值并分发告警
+type alerter struct {
+	config  AlertConfig
+	senders []*webhookSender
+	errLog  func(error)
+
+	mu sync.Mutex
+	// 用户+周期类型 -> 已告警的周期
+	quotaAlerted map[string]string
+	windowStart  time.Time
+	hostBytes    map[string]int64
+}
+
+func newAlerter(config AlertConfig, hooks []AlertWebhook, errLog func(error)) *alerter {
+	if config.QuotaRatio <= 0 {
+		config.QuotaRatio = defaultAlertQuotaRatio
+	}
+	if config.BandwidthWindow <= 0 {
+		config.BandwidthWindow = defaultAlertBandwidthWindow
+	}
+	if config.Retries <= 0 {
+		config.Retries = defaultAlertRetries
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultAlertTimeout
+	}
+	client := config.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	client = &http.Client{
+		Transport:     client.Transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       config.Timeout,
+	}
+	a := &alerter{
+		config:       config,
+		errLog:       errLog,
+		quotaAlerted: make(map[string]string),
+		hostBytes:    make(map[string]int64),
+	}
+	for _, hook := range hooks {
+		s := &webhookSender{
+			hook:    hook,
+			client:  client,
+			retries: config.Retries,
+			errLog:  errLog,
+			queue:   make(chan *Alert, alertQueueSize),
+		}
+		go s.run()
+		a.senders = append(a.senders, s)
+	}
+
+	return a
+}
+
+// send 放入各webhook的发送队列
+func (a *alerter) send(alert *Alert) {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+	for _, s := range a.senders {
+		if !s.accepts(alert.Type) {
+			continue
+		}
+		select {
+		case s.queue <- alert:
+		default:
+			a.errLog(fmt.Errorf("%s - 告警队列已满, 丢弃告警: %s", s.hook.URL, alert.Message))
+		}
+	}
+}
+
+// quota 用量更新后检查是否达到告警比例
+func (a *alerter) quota(user, period string, used, limit int64) {
+	if limit <= 0 {
+		return
+	}
+	threshold := int64(float64(limit) * a.config.QuotaRatio)
+	if used < threshold {
+		return
+	}
+	key := user + "\x00" + strconv.Itoa(len(period))
+	a.mu.Lock()
+	alerted := a.quotaAlerted[key] == period
+	a.quotaAlerted[key] = period
+	a.mu.Unlock()
+	if alerted {
+		return
+	}
+	a.send(&Alert{
+		Type:      AlertQuota,
+		Message:   fmt.Sprintf("用户%s在%s的用量%d字节已达到配额%d字节的%.0f%%", user, period, used, limit, a.config.QuotaRatio*100),
+		User:      user,
+		Period:    period,
+		Value:     used,
+		Threshold: limit,
+	})
+}
+
+// bandwidth 累计主机流量, 当前窗口内首次超过阈值时告警
+func (a *alerter) bandwidth(host string, n int64) {
+	if a.config.BandwidthBytes <= 0 || n <= 0 {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	if now.Sub(a.windowStart) >= a.config.BandwidthWindow {
+		a.windowStart = now
+		a.hostBytes = make(map[string]int64)
+	}
+	before := a.hostBytes[host]
+	total := before + n
+	a.hostBytes[host] = total
+	a.mu.Unlock()
+	if before > a.config.BandwidthBytes || total <= a.config.BandwidthBytes {
+		return
+	}
+	a.send(&Alert{
+		Type:      AlertBandwidth,
+		Message:   fmt.Sprintf("%s在%s内的流量%d字节超过阈值%d字节", host, a.config.BandwidthWindow, total, a.config.BandwidthBytes),
+		Host:      host,
+		Value:     total,
+		Threshold: a.config.BandwidthBytes,
+	})
+}
+
+// parent 上级代理健康状态变化
+func (a *alerter) parent(st ParentProxyStatus, healthy bool) {
+	alert := &Alert{
+		Type:      AlertParentDown,
+		Message:   fmt.Sprintf("上级代理%s连续失败%d次: %s", st.URL, st.ConsecutiveErrors, st.LastError),
+		Parent:    st.URL,
+		Value:     st.ConsecutiveErrors,
+		Threshold: parentUnhealthyErrors,
+	}
+	if healthy {
+		alert.Type = AlertParentUp
+		alert.Message = fmt.Sprintf("上级代理%s已恢复", st.URL)
+		alert.Value = 0
+	}
+	a.send(alert)
+}
+
+// webhookSender 按顺序发送告警到单个webhook, 失败时重试
+type webhookSender struct {
+	hook    AlertWebhook
+	client  *http.Client
+	retries int
+	errLog  func(error)
+	queue   chan *Alert
+}
+
+func (s *webhookSender) accepts(typ AlertType) bool {
+	if len(s.hook.Types) == 0 {
+		return true
+	}
+	for _, t := range s.hook.Types {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *webhookSender) run() {
+	for alert := range s.queue {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			s.errLog(fmt.Errorf("%s - 告警序列化失败: %s", s.hook.URL, err))
+			continue
+		}
+		err = postWebhook(s.client, s.hook.URL, s.hook.Secret, s.hook.Header, string(alert.Type), body, s.retries)
+		if err != nil {
+			s.errLog(fmt.Errorf("%s - 发送告警失败: %s", s.hook.URL, err))
+		}
+	}
+}
+
+// postWebhook POST JSON到url, 网络错误、429、5xx时重试, 间隔1秒起按倍数增长
+func postWebhook(client *http.Client, url, secret string, header http.Header, event string, body []byte, retries int) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := postWebhookOnce(client, url, secret, header, event, body)
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postWebhookOnce 发送一次, 返回是否可以重试
+func postWebhookOnce(client *http.Client, url, secret string, header http.Header, event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	CopyHeader(req.Header, header)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goproxy-Event", event)
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Goproxy-Timestamp", timestamp)
+		req.Header.Set("X-Goproxy-Signature", "sha256="+SignWebhook(secret, timestamp, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+
+	return retry, fmt.Errorf("响应状态码: %d", resp.StatusCode)
+}
+
+// SignWebhook 计算webhook签名, 接收方用于校验X-Goproxy-Signature
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package antivirus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ouqiang/goproxy"
+)
+
+const defaultMaxSize = 20 << 20
+
+var errTooLarge = errors.New("antivirus: body超过MaxSize")
+
+// Config Adapter配置
+type Config struct {
+	// MinSize 小于该大小的响应不扫描, Content-Length未知时总是扫描
+	MinSize int64
+	// MaxSize 超过该大小的响应不扫描直接放行, 默认20MB, 扫描期间最多缓存MaxSize
+	MaxSize int64
+	// ContentTypes 需要扫描的Content-Type, 支持前缀如application/, 为空时扫描所有类型
+	ContentTypes []string
+	// SkipContentTypes 不扫描的Content-Type, 优先于ContentTypes, 如text/、image/
+	SkipContentTypes []string
+	// Bypass 扫描出错时放行, 否则响应502
+	Bypass bool
+	// BlockPage 检测到病毒时的拦截页面, 为nil时返回403
+	BlockPage func(ctx *goproxy.Context, result Result) *goproxy.BlockPage
+	// ErrorLog 记录放行的错误
+	ErrorLog func(error)
+}
+
+// Adapter 扫描响应body, 检测到病毒时替换为拦截页面并上报malware事件, 实现goproxy.ContentAdapter
+// body边下载边发送给扫描引擎, 扫描完成前不返回给客户端
+type Adapter struct {
+	scanner Scanner
+	config  Config
+}
+
+// NewAdapter 创建Adapter, 用于goproxy.WithContentAdapters
+func NewAdapter(scanner Scanner, config Config) *Adapter {
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultMaxSize
+	}
+
+	return &Adapter{scanner: scanner, config: config}
+}
+
+// AdaptRequest 不处理请求
+func (a *Adapter) AdaptRequest(ctx *goproxy.Context, req *http.Request) (*http.Request, *http.Response, error) {
+	return nil, nil, nil
+}
+
+// AdaptResponse 扫描响应
+func (a *Adapter) AdaptResponse(ctx *goproxy.Context, resp *http.Response) (*http.Response, error) {
+	if !a.shouldScan(resp) {
+		return nil, nil
+	}
+	body := resp.Body
+	var buf bytes.Buffer
+	limited := &limitReader{r: io.TeeReader(body, &buf), n: a.config.MaxSize}
+	result, err := a.scanner.Scan(resp.Request.Context(), limited)
+	if err == nil && !limited.eof && limited.err == nil {
+		// 扫描引擎未读完body
+		_, err = io.Copy(ioutil.Discard, limited)
+	}
+	if limited.err != nil {
+		// 读取目标服务器响应出错
+		body.Close()
+		return nil, limited.err
+	}
+	if err != nil && !errors.Is(err, errTooLarge) {
+		err = fmt.Errorf("病毒扫描错误: %s", err)
+		if !a.config.Bypass {
+			body.Close()
+			return nil, err
+		}
+		if a.config.ErrorLog != nil {
+			a.config.ErrorLog(fmt.Errorf("%s - 放行, %s", resp.Request.URL, err))
+		}
+	}
+	if err != nil {
+		// 超过MaxSize或放行, 已读取的部分和剩余部分一起返回
+		resp.Body = &readCloser{Reader: io.MultiReader(&buf, body), Closer: body}
+		return resp, nil
+	}
+	body.Close()
+	if result.Infected {
+		return ctx.BlockPageResponse(a.blockPage(ctx, result)), nil
+	}
+	resp.Body = ioutil.NopCloser(&buf)
+
+	return resp, nil
+}
+
+func (a *Adapter) blockPage(ctx *goproxy.Context, result Result) *goproxy.BlockPage {
+	var page *goproxy.BlockPage
+	if a.config.BlockPage != nil {
+		page = a.config.BlockPage(ctx, result)
+	}
+	if page == nil {
+		page = &goproxy.BlockPage{
+			StatusCode: http.StatusForbidden,
+			Message:    "检测到病毒: " + result.Signature,
+			Category:   "malware",
+		}
+	}
+	if page.EventType == "" {
+		page.EventType = goproxy.PolicyEventMalware
+	}
+	if page.Fields == nil {
+		page.Fields = map[string]string{"signature": result.Signature}
+	}
+
+	return page
+}
+
+// shouldScan 根据状态码、大小和Content-Type判断是否扫描
+func (a *Adapter) shouldScan(resp *http.Response) bool {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.ContentLength == 0 {
+		return false
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Request == nil || resp.Request.Method == http.MethodHead {
+		return false
+	}
+	if resp.ContentLength > a.config.MaxSize {
+		return false
+	}
+	if resp.ContentLength > 0 && resp.ContentLength < a.config.MinSize {
+		return false
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if matchContentType(a.config.SkipContentTypes, contentType) {
+		return false
+	}
+
+	return len(a.config.ContentTypes) == 0 || matchContentType(a.config.ContentTypes, contentType)
+}
+
+func matchContentType(patterns []string, contentType string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if contentType == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(contentType, p)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limitReader 读取超过n字节时返回errTooLarge, 记录底层reader的错误
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+	eof bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errTooLarge
+	}
+	if err == io.EOF {
+		l.eof = true
+	} else if err != nil {
+		l.err = err
+	}
+
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package antivirus 下载内容病毒扫描, 内置clamd协议, 其他扫描引擎实现Scanner即可
+package antivirus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout   = 30 * time.Second
+	defaultChunkSize = 64 << 10
+)
+
+// Result 扫描结果
+type Result struct {
+	// Infected 是否检测到病毒
+	Infected bool
+	// Signature 病毒名称
+	Signature string
+}
+
+// Scanner 扫描引擎, Scan读取r直到EOF后返回结果
+// r返回的错误需要原样(或使用%w包装)返回
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+type options struct {
+	timeout   time.Duration
+	chunkSize int
+}
+
+type Option func(*options)
+
+// WithTimeout 连接和单次扫描的超时时间, 默认30秒
+func WithTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.timeout = d
+	}
+}
+
+// WithChunkSize INSTREAM每个chunk的大小, 默认64KB
+func WithChunkSize(n int) Option {
+	return func(opt *options) {
+		opt.chunkSize = n
+	}
+}
+
+// Clamd clamd客户端, 使用INSTREAM边读边发送, 每次扫描建立新连接
+type Clamd struct {
+	network string
+	addr    string
+	opts    *options
+}
+
+// NewClamd 创建clamd客户端, network为tcp或unix
+func NewClamd(network, addr string, opt ...Option) *Clamd {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+	if opts.timeout <= 0 {
+		opts.timeout = defaultTimeout
+	}
+	if opts.chunkSize <= 0 {
+		opts.chunkSize = defaultChunkSize
+	}
+
+	return &Clamd{network: network, addr: addr, opts: opts}
+}
+
+// Ping 检查clamd是否可用
+func (c *Clamd) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: 无效的回复: %q", reply)
+	}
+
+	return nil
+}
+
+// Scan 扫描r的内容
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	reply, err := c.command(ctx, "zINSTREAM\x00", r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseReply(reply)
+}
+
+// command 发送命令, r不为nil时以INSTREAM格式发送数据
+func (c *Clamd) command(ctx context.Context, cmd string, r io.Reader) (string, error) {
+	dialer := &net.Dialer{Timeout: c.opts.timeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.opts.timeout))
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	if _, err := io.WriteString(conn, cmd); err != nil {
+		return "", err
+	}
+	if r != nil {
+		if err := c.stream(conn, r); err != nil {
+			return "", err
+		}
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// stream 发送4字节长度(网络字节序)+数据, 以长度0结束
+func (c *Clamd) stream(conn net.Conn, r io.Reader) error {
+	buf := make([]byte, 4+c.opts.chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+
+	return err
+}
+
+// parseReply 解析"stream: OK"、"stream: Eicar-Signature FOUND"、"... ERROR"
+func parseReply(reply string) (Result, error) {
+	_, status, ok := strings.Cut(reply, ": ")
+	if !ok {
+		status = reply
+	}
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.HasSuffix(status, " ERROR"):
+		return Result{}, errors.New("clamd: " + strings.TrimSuffix(status, " ERROR"))
+	}
+
+	return Result{}, fmt.Errorf("clamd: 无效的回复: %q", reply)
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package audit 防篡改审计日志, 每条记录包含上一条记录的哈希, 可选ed25519签名
+// 删除、修改、插入任意记录都会导致Verify失败
+//
+//	w, _ := rotate.New("/var/log/goproxy/audit.log")
+//	auditLog := audit.New(w, audit.WithSigner(privateKey))
+//	proxy := goproxy.New(goproxy.WithAccessLog(auditLog, goproxy.AccessLogJSON))
+package audit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record 一条审计记录, 每条一行JSON
+type Record struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Event 事件类型, Write写入的记录为access
+	Event string `json:"event"`
+	// Data 事件内容, 必须是JSON
+	Data json.RawMessage `json:"data"`
+	// PrevHash 上一条记录的哈希, 第一条为空
+	PrevHash string `json:"prev_hash"`
+	// Hash sha256(PrevHash + 不含Hash和Sig的记录JSON)
+	Hash string `json:"hash"`
+	// Sig 对Hash的ed25519签名, base64编码
+	Sig string `json:"sig,omitempty"`
+}
+
+// digest 计算记录的哈希
+func (r *Record) digest() (string, error) {
+	c := *r
+	c.Hash = ""
+	c.Sig = ""
+	body, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(r.PrevHash))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type options struct {
+	signer   ed25519.PrivateKey
+	seq      uint64
+	prevHash string
+}
+
+type Option func(*options)
+
+// WithSigner 使用ed25519私钥签名每条记录
+func WithSigner(key ed25519.PrivateKey) Option {
+	return func(opt *options) {
+		opt.signer = key
+	}
+}
+
+// WithChain 从已有日志的最后一条记录继续, 重启后保持哈希链连续, last可通过Last获取
+func WithChain(last *Record) Option {
+	return func(opt *options) {
+		if last != nil {
+			opt.seq = last.Seq
+			opt.prevHash = last.Hash
+		}
+	}
+}
+
+// Logger 审计日志, 并发安全
+type Logger struct {
+	w    io.Writer
+	opts *options
+
+	mu       sync.Mutex
+	seq      uint64
+	prevHash string
+}
+
+// New 创建审计日志
+func New(w io.Writer, opt ...Option) *Logger {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+
+	return &Logger{
+		w:        w,
+		opts:     opts,
+		seq:      opts.seq,
+		prevHash: opts.prevHash,
+	}
+}
+
+// Log 写入一条记录, data序列化为JSON
+func (l *Logger) Log(event string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return l.append(event, raw)
+}
+
+// Write 每次写入作为一条access记录, 内容是JSON时原样保存, 否则保存为JSON字符串, 实现io.Writer
+func (l *Logger) Write(p []byte) (int, error) {
+	text := strings.TrimRight(string(p), "\r\n")
+	raw := json.RawMessage(text)
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(text)
+	}
+	if err := l.append("access", raw); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (l *Logger) append(event string, data json.RawMessage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := &Record{
+		Seq:      l.seq + 1,
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Data:     data,
+		PrevHash: l.prevHash,
+	}
+	hash, err := r.digest()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	if l.opts.signer != nil {
+		r.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(l.opts.signer, []byte(hash)))
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.seq = r.Seq
+	l.prevHash = r.Hash
+
+	return nil
+}
+
+// ErrChainBroken 哈希链校验失败
+var ErrChainBroken = errors.New("audit: 哈希链校验失败")
+
+// Verify 校验日志的哈希链和签名, pub为nil时不校验签名, 返回校验通过的记录数和最后一条记录
+// 日志从中间开始(如切割后的文件)时, 第一条记录的PrevHash不做校验
+func Verify(r io.Reader, pub ed25519.PublicKey) (int, *Record, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var last *Record
+	n := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return n, last, fmt.Errorf("audit: 第%d条记录解析失败: %s", n+1, err)
+		}
+		if last != nil && (record.PrevHash != last.Hash || record.Seq != last.Seq+1) {
+			return n, last, fmt.Errorf("%w: 第%d条记录(seq=%d)与上一条不连续", ErrChainBroken, n+1, record.Seq)
+		}
+		hash, err := record.digest()
+		if err != nil {
+			return n, last, err
+		}
+		if hash != record.Hash {
+			return n, last, fmt.Errorf("%w: 第%d条记录(seq=%d)内容被修改", ErrChainBroken, n+1, record.Seq)
+		}
+		if pub != nil {
+			sig, err := base64.StdEncoding.DecodeString(record.Sig)
+			if err != nil || !ed25519.Verify(pub, []byte(record.Hash), sig) {
+				return n, last, fmt.Errorf("%w: 第%d条记录(seq=%d)签名无效", ErrChainBroken, n+1, record.Seq)
+			}
+		}
+		last = record
+		n++
+	}
+
+	return n, last, scanner.Err()
+}
+
+// Last 返回日志最后一条记录, 用于WithChain, 不校验哈希链
+func Last(r io.Reader) (*Record, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var last []byte
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+	record := &Record{}
+	if err := json.Unmarshal(last, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
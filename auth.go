@@ -0,0 +1,81 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// BasicAuthFunc 校验代理认证的用户名和密码
+type BasicAuthFunc func(user, password string) bool
+
+// WithBasicAuth 代理Basic认证, 在Delegate.Auth之前执行
+// 未携带或校验失败时返回407和Proxy-Authenticate: Basic, 通过后设置Context.User, HTTPS解密后的请求沿用CONNECT的认证结果
+func WithBasicAuth(realm string, validate BasicAuthFunc) Option {
+	return func(opt *options) {
+		opt.basicAuth = &basicAuth{realm: realm, validate: validate}
+	}
+}
+
+// BasicAuthUsers 使用固定的用户名和密码校验, 比较时间与密码内容无关
+func BasicAuthUsers(users map[string]string) BasicAuthFunc {
+	return func(user, password string) bool {
+		expected, ok := users[user]
+		if !ok {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	}
+}
+
+// ProxyBasicAuth 解析请求的Proxy-Authorization
+func ProxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	user, password, ok = strings.Cut(string(decoded), ":")
+
+	return user, password, ok
+}
+
+type basicAuth struct {
+	realm    string
+	validate BasicAuthFunc
+}
+
+// authenticate 认证失败时返回407并中断执行
+func (a *basicAuth) authenticate(ctx *Context, rw http.ResponseWriter) {
+	user, password, ok := ProxyBasicAuth(ctx.Req)
+	if ok && a.validate(user, password) {
+		ctx.User = user
+		return
+	}
+	realm := a.realm
+	if realm == "" {
+		realm = "goproxy"
+	}
+	header := make(http.Header)
+	header.Set("Proxy-Authenticate", `Basic realm="`+strings.ReplaceAll(realm, `"`, `\"`)+`", charset="UTF-8"`)
+	ctx.WriteBlockPage(rw, &BlockPage{StatusCode: http.StatusProxyAuthRequired, Header: header})
+}
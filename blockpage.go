@@ -0,0 +1,213 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BlockPage 拦截或认证页面的内容
+type BlockPage struct {
+	// StatusCode 状态码, 默认403
+	StatusCode int `json:"status"`
+	// Title 标题, 为空时根据状态码和Accept-Language生成
+	Title string `json:"title"`
+	// Message 说明
+	Message string `json:"message,omitempty"`
+	// Category 拦截的分类, 如广告、恶意网站
+	Category string `json:"category,omitempty"`
+	// Contact 联系方式, 如管理员邮箱或工单链接
+	Contact string `json:"contact,omitempty"`
+	// Fields 其他动态字段
+	Fields map[string]string `json:"fields,omitempty"`
+	// Header 额外的响应头, 如407需要的Proxy-Authenticate
+	Header http.Header `json:"-"`
+	// EventType 生成的策略事件类型, 为空时根据状态码确定
+	EventType PolicyEventType `json:"-"`
+}
+
+// BlockPageRenderer 生成拦截页面
+type BlockPageRenderer interface {
+	Render(ctx *Context, page *BlockPage) (contentType string, body []byte)
+}
+
+// WithBlockPageRenderer 自定义拦截页面, 默认使用NewBlockPageRenderer(nil)
+func WithBlockPageRenderer(r BlockPageRenderer) Option {
+	return func(opt *options) {
+		opt.blockPageRenderer = r
+	}
+}
+
+// WriteBlockPage 返回拦截页面并中断执行, 用于在Connect、Auth中拒绝请求
+func (c *Context) WriteBlockPage(rw http.ResponseWriter, page *BlockPage) {
+	code, header, body := c.renderBlockPage(page)
+	CopyHeader(rw.Header(), header)
+	rw.WriteHeader(code)
+	rw.Write(body)
+	c.Abort()
+}
+
+// BlockPageResponse 生成拦截页面的响应, 用于HTTPS解密后的请求或在BeforeResponse中替换响应
+func (c *Context) BlockPageResponse(page *BlockPage) *http.Response {
+	code, header, body := c.renderBlockPage(page)
+	return &http.Response{
+		StatusCode:    code,
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       c.Req,
+	}
+}
+
+func (c *Context) renderBlockPage(page *BlockPage) (int, http.Header, []byte) {
+	if page.StatusCode == 0 {
+		page.StatusCode = http.StatusForbidden
+	}
+	c.reportBlockPage(page)
+
+	return c.renderPage(page)
+}
+
+// renderPage 使用WithBlockPageRenderer生成页面
+func (c *Context) renderPage(page *BlockPage) (int, http.Header, []byte) {
+	renderer := c.blockPageRenderer
+	if renderer == nil {
+		renderer = defaultBlockPageRenderer
+	}
+	contentType, body := renderer.Render(c, page)
+	header := make(http.Header)
+	if page.Header != nil {
+		CopyHeader(header, page.Header)
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "no-store")
+
+	return page.StatusCode, header, body
+}
+
+var defaultBlockPageRenderer = NewBlockPageRenderer(nil)
+
+// 默认标题
+var blockPageTitles = map[string]map[int]string{
+	"zh": {
+		http.StatusForbidden:                  "访问被拒绝",
+		http.StatusProxyAuthRequired:          "需要代理身份认证",
+		http.StatusRequestEntityTooLarge:      "请求内容过大",
+		http.StatusTooManyRequests:            "请求过多",
+		http.StatusBadGateway:                 "无法连接目标服务器",
+		http.StatusServiceUnavailable:         "服务暂不可用",
+		http.StatusGatewayTimeout:             "目标服务器响应超时",
+		http.StatusUnavailableForLegalReasons: "因法律原因不可访问",
+	},
+	"en": {
+		http.StatusForbidden:                  "Access Denied",
+		http.StatusProxyAuthRequired:          "Proxy Authentication Required",
+		http.StatusRequestEntityTooLarge:      "Payload Too Large",
+		http.StatusTooManyRequests:            "Too Many Requests",
+		http.StatusBadGateway:                 "Bad Gateway",
+		http.StatusServiceUnavailable:         "Service Unavailable",
+		http.StatusGatewayTimeout:             "Gateway Timeout",
+		http.StatusUnavailableForLegalReasons: "Unavailable For Legal Reasons",
+	},
+}
+
+var defaultBlockPageTemplate = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="utf-8"><title>{{.Page.Title}}</title></head>
+<body>
+<h1>{{.Page.Title}}</h1>
+{{if .Page.Message}}<p>{{.Page.Message}}</p>{{end}}
+{{if .Page.Category}}<p>{{if eq .Lang "zh"}}分类{{else}}Category{{end}}: {{.Page.Category}}</p>{{end}}
+{{if .URL}}<p>URL: {{.URL}}</p>{{end}}
+{{range $k, $v := .Page.Fields}}<p>{{$k}}: {{$v}}</p>
+{{end}}{{if .Page.Contact}}<p>{{if eq .Lang "zh"}}联系方式{{else}}Contact{{end}}: {{.Page.Contact}}</p>{{end}}
+</body>
+</html>
+`))
+
+// BlockPageData 模板数据
+type BlockPageData struct {
+	Page *BlockPage
+	// Lang 根据Accept-Language选择的语言, zh或en
+	Lang string
+	// URL 被拦截的地址
+	URL string
+}
+
+type blockPageRenderer struct {
+	tmpl *template.Template
+}
+
+// NewBlockPageRenderer 根据Accept返回JSON或HTML页面, tmpl为nil时使用默认模板
+// 模板数据为BlockPageData, 标题为空时使用中文或英文的默认标题
+func NewBlockPageRenderer(tmpl *template.Template) BlockPageRenderer {
+	if tmpl == nil {
+		tmpl = defaultBlockPageTemplate
+	}
+
+	return &blockPageRenderer{tmpl: tmpl}
+}
+
+func (r *blockPageRenderer) Render(ctx *Context, page *BlockPage) (string, []byte) {
+	lang := "en"
+	accept := ""
+	data := &BlockPageData{Page: page}
+	if ctx.Req != nil {
+		accept = ctx.Req.Header.Get("Accept")
+		lang = preferredLang(ctx.Req.Header.Get("Accept-Language"))
+		data.URL = ctx.Req.URL.String()
+	}
+	data.Lang = lang
+	if page.Title == "" {
+		page.Title = blockPageTitles[lang][page.StatusCode]
+		if page.Title == "" {
+			page.Title = http.StatusText(page.StatusCode)
+		}
+	}
+	if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+		body, _ := json.Marshal(page)
+		return "application/json; charset=utf-8", body
+	}
+	var buf bytes.Buffer
+	if err := r.tmpl.Execute(&buf, data); err != nil {
+		return "text/plain; charset=utf-8", []byte(page.Title)
+	}
+
+	return "text/html; charset=utf-8", buf.Bytes()
+}
+
+// preferredLang 按Accept-Language的顺序选择支持的语言, 忽略q值
+func preferredLang(acceptLanguage string) string {
+	for _, item := range strings.Split(acceptLanguage, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(item, ";", 2)[0]))
+		switch {
+		case strings.HasPrefix(tag, "zh"):
+			return "zh"
+		case strings.HasPrefix(tag, "en"):
+			return "en"
+		}
+	}
+
+	return "en"
+}
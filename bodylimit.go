@@ -0,0 +1,111 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+var (
+	// ErrRequestBodyTooLarge 请求body超过WithMaxRequestBodySize, 返回413
+	ErrRequestBodyTooLarge = errors.New("请求body超过大小限制")
+	// ErrResponseBodyTooLarge 响应body超过WithMaxResponseBodySize, 响应头发送前返回502, 发送后中断连接
+	ErrResponseBodyTooLarge = errors.New("响应body超过大小限制")
+)
+
+// WithMaxRequestBodySize 请求body的最大字节数, 包括HTTPS解密后的请求, 为0时不限制
+// Content-Length超过限制时不请求目标服务器, 分块传输的body在转发中超过限制时中断上传, 都返回413并调用Delegate.BodyLimitExceeded
+func WithMaxRequestBodySize(n int64) Option {
+	return func(opt *options) {
+		opt.maxRequestBody = n
+	}
+}
+
+// WithMaxResponseBodySize 响应body的最大字节数, 为0时不限制, 不限制协议升级后的连接
+// Content-Length超过限制时返回502, 长度未知的body在转发中超过限制时中断连接, 客户端收到不完整的响应
+func WithMaxResponseBodySize(n int64) Option {
+	return func(opt *options) {
+		opt.maxResponseBody = n
+	}
+}
+
+// limitRequestBody 检查请求body大小, Content-Length超过限制时返回错误
+func (p *Proxy) limitRequestBody(ctx *Context, req *http.Request) error {
+	if p.maxRequestBody <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.ContentLength > p.maxRequestBody {
+		p.callBodyLimitExceeded(ctx, ErrRequestBodyTooLarge, p.maxRequestBody)
+		return ErrRequestBodyTooLarge
+	}
+	req.Body = p.newLimitBody(ctx, req.Body, p.maxRequestBody, ErrRequestBodyTooLarge)
+
+	return nil
+}
+
+// limitResponseBody 检查响应body大小, Content-Length超过限制时关闭body并返回错误
+func (p *Proxy) limitResponseBody(ctx *Context, resp *http.Response) error {
+	if p.maxResponseBody <= 0 || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	if resp.ContentLength > p.maxResponseBody {
+		resp.Body.Close()
+		p.callBodyLimitExceeded(ctx, ErrResponseBodyTooLarge, p.maxResponseBody)
+		return ErrResponseBodyTooLarge
+	}
+	resp.Body = p.newLimitBody(ctx, resp.Body, p.maxResponseBody, ErrResponseBodyTooLarge)
+
+	return nil
+}
+
+func (p *Proxy) newLimitBody(ctx *Context, rc io.ReadCloser, limit int64, err error) io.ReadCloser {
+	return &limitBody{rc: rc, remaining: limit, err: err, exceeded: func() {
+		p.callBodyLimitExceeded(ctx, err, limit)
+	}}
+}
+
+// limitBody 读取超过limit字节时返回err, 只通知一次
+type limitBody struct {
+	rc        io.ReadCloser
+	remaining int64
+	err       error
+	exceeded  func()
+	once      sync.Once
+}
+
+func (b *limitBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.err
+	}
+	// 多读1个字节, 恰好等于限制的body可以正常读到EOF
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.rc.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.once.Do(b.exceeded)
+		return 0, b.err
+	}
+
+	return n, err
+}
+
+func (b *limitBody) Close() error {
+	return b.rc.Close()
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitOpenTimeout      = 30 * time.Second
+)
+
+// ErrCircuitOpen 目标服务器连续连接失败, 熔断期间不再连接
+var ErrCircuitOpen = errors.New("目标服务器连接失败次数过多, 暂停连接")
+
+// CircuitState 熔断器状态
+type CircuitState int
+
+const (
+	// CircuitClosed 正常连接
+	CircuitClosed CircuitState = iota
+	// CircuitOpen 熔断, 快速失败
+	CircuitOpen
+	// CircuitHalfOpen 熔断时间结束, 允许一个请求试探
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+// MarshalText 实现encoding.TextMarshaler
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitStatus 目标服务器的熔断状态
+type CircuitStatus struct {
+	// Host 目标服务器, 主机:端口
+	Host  string       `json:"host"`
+	State CircuitState `json:"state"`
+	// Failures 连续失败次数
+	Failures int `json:"failures"`
+	// OpenedAt 最近一次熔断的时间
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+}
+
+// CircuitBreakerConfig 按目标服务器熔断的配置
+type CircuitBreakerConfig struct {
+	// FailureThreshold 连续连接失败多少次后熔断, 默认5
+	FailureThreshold int
+	// OpenTimeout 熔断时间, 默认30秒, 之后允许一个请求试探, 成功后恢复, 失败后继续熔断
+	OpenTimeout time.Duration
+}
+
+// WithCircuitBreaker 按目标服务器(主机:端口)熔断, 直连目标服务器连续失败后, 熔断期间HTTP请求和隧道直接返回503
+// 只统计建立连接的错误, 经过上级代理的请求不统计, 状态变化时调用Delegate.CircuitStateChanged
+func WithCircuitBreaker(config CircuitBreakerConfig) Option {
+	return func(opt *options) {
+		opt.circuitBreaker = &config
+	}
+}
+
+type circuitBreaker struct {
+	config   CircuitBreakerConfig
+	onChange func(host string, state CircuitState)
+
+	mu    sync.Mutex
+	hosts map[string]*hostCircuit
+}
+
+// hostCircuit 只保存有失败记录的目标服务器, 恢复后删除
+type hostCircuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig, onChange func(string, CircuitState)) *circuitBreaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaultCircuitFailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = defaultCircuitOpenTimeout
+	}
+
+	return &circuitBreaker{config: config, onChange: onChange, hosts: make(map[string]*hostCircuit)}
+}
+
+// allow 是否允许连接, 返回true时需要调用observe
+func (b *circuitBreaker) allow(host string) bool {
+	b.mu.Lock()
+	c := b.hosts[host]
+	if c == nil || c.state == CircuitClosed {
+		b.mu.Unlock()
+		return true
+	}
+	if c.state == CircuitHalfOpen || time.Since(c.openedAt) < b.config.OpenTimeout {
+		b.mu.Unlock()
+		return false
+	}
+	c.state = CircuitHalfOpen
+	b.mu.Unlock()
+	b.onChange(host, CircuitHalfOpen)
+
+	return true
+}
+
+// observe 记录连接结果
+func (b *circuitBreaker) observe(host string, failed bool) {
+	b.mu.Lock()
+	c := b.hosts[host]
+	if !failed {
+		if c == nil {
+			b.mu.Unlock()
+			return
+		}
+		delete(b.hosts, host)
+		b.mu.Unlock()
+		if c.state != CircuitClosed {
+			b.onChange(host, CircuitClosed)
+		}
+		return
+	}
+	if c == nil {
+		c = &hostCircuit{}
+		b.hosts[host] = c
+	}
+	c.failures++
+	opened := c.state == CircuitHalfOpen || c.state == CircuitClosed && c.failures >= b.config.FailureThreshold
+	if opened {
+		c.state = CircuitOpen
+		c.openedAt = time.Now()
+	}
+	b.mu.Unlock()
+	if opened {
+		b.onChange(host, CircuitOpen)
+	}
+}
+
+// snapshot 有失败记录的目标服务器, 按Host排序
+func (b *circuitBreaker) snapshot() []CircuitStatus {
+	b.mu.Lock()
+	list := make([]CircuitStatus, 0, len(b.hosts))
+	for host, c := range b.hosts {
+		list = append(list, CircuitStatus{Host: host, State: c.state, Failures: c.failures, OpenedAt: c.openedAt})
+	}
+	b.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Host < list[j].Host
+	})
+
+	return list
+}
+
+// isDialError 建立连接阶段的错误
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
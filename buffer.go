@@ -0,0 +1,93 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultBufferSize = 32 * 1024
+
+// WithBufferSize 隧道转发和响应body复制使用的缓冲区大小, 默认32KB, 缓冲区通过sync.Pool复用
+func WithBufferSize(n int) Option {
+	return func(opt *options) {
+		opt.bufferSize = n
+	}
+}
+
+// BufferPoolStats 缓冲区池的使用情况
+type BufferPoolStats struct {
+	// Size 缓冲区大小
+	Size int
+	// Gets 取出缓冲区的次数
+	Gets int64
+	// Allocs 新分配的缓冲区数, 与Gets差距越大复用率越高
+	Allocs int64
+	// InUse 正在使用的缓冲区数
+	InUse int64
+}
+
+type bufferPool struct {
+	size   int
+	pool   sync.Pool
+	gets   int64
+	allocs int64
+	inUse  int64
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	b := &bufferPool{size: size}
+	b.pool.New = func() interface{} {
+		atomic.AddInt64(&b.allocs, 1)
+		buf := make([]byte, b.size)
+		return &buf
+	}
+
+	return b
+}
+
+func (b *bufferPool) get() *[]byte {
+	atomic.AddInt64(&b.gets, 1)
+	atomic.AddInt64(&b.inUse, 1)
+
+	return b.pool.Get().(*[]byte)
+}
+
+func (b *bufferPool) put(buf *[]byte) {
+	atomic.AddInt64(&b.inUse, -1)
+	b.pool.Put(buf)
+}
+
+// copy 使用池中的缓冲区复制, dst实现了io.ReaderFrom或src实现了io.WriterTo时不使用缓冲区
+func (b *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := b.get()
+	defer b.put(buf)
+
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+func (b *bufferPool) stats() BufferPoolStats {
+	return BufferPoolStats{
+		Size:   b.size,
+		Gets:   atomic.LoadInt64(&b.gets),
+		Allocs: atomic.LoadInt64(&b.allocs),
+		InUse:  atomic.LoadInt64(&b.inUse),
+	}
+}
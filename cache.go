@@ -0,0 +1,563 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认缓存总大小
+	defaultCacheSize = 64 << 20
+	// 默认单个响应的最大缓存大小
+	defaultCacheMaxObject = 10 << 20
+	// 只有Last-Modified时按其10%估算新鲜期, 最多1天
+	maxHeuristicFreshness = 24 * time.Hour
+)
+
+// 缓存状态, Context.CacheStatus
+const (
+	// CacheHit 使用新鲜的缓存, 没有请求目标服务器
+	CacheHit = "HIT"
+	// CacheRevalidated 缓存过期, 条件请求返回304后使用缓存
+	CacheRevalidated = "REVALIDATED"
+	// CacheMiss 没有可用的缓存, 请求了目标服务器
+	CacheMiss = "MISS"
+)
+
+// 默认可以缓存的状态码, RFC 7231 6.1
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// CachedResponse 缓存的响应, 字段均可导出, 便于磁盘、Redis等存储序列化
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Vary 响应Vary指定的请求头在缓存时的值, 请求头不同时不使用缓存
+	Vary http.Header
+	// RequestTime 发送请求的时间, ResponseTime 收到响应的时间, 用于计算Age
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// size 占用的字节数, 用于限制缓存总大小
+func (c *CachedResponse) size() int64 {
+	n := int64(len(c.Body))
+	for k, vv := range c.Header {
+		for _, v := range vv {
+			n += int64(len(k) + len(v))
+		}
+	}
+
+	return n
+}
+
+// CacheStore 缓存存储, 需要并发安全, Get返回的响应不能被修改
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+}
+
+// CacheConfig HTTP缓存配置
+type CacheConfig struct {
+	// Store 存储, 默认NewMemoryCacheStore(64MB)
+	Store CacheStore
+	// MaxObjectSize 单个响应body的最大缓存大小, 默认10MB
+	MaxObjectSize int64
+	// Private 作为私有缓存, 允许缓存Cache-Control: private和带Authorization请求的响应, 默认作为共享缓存
+	Private bool
+}
+
+// WithCache 缓存GET响应, 按RFC 7234处理Cache-Control、Expires、Age和Vary, 过期后使用ETag、Last-Modified发送条件请求
+// 在请求body转换之后发送前查找缓存, 命中时不请求目标服务器, BeforeResponse和响应转换仍然执行
+// POST、PUT、DELETE等请求成功后删除该URL的缓存, 带Set-Cookie的响应不缓存
+func WithCache(config CacheConfig) Option {
+	return func(opt *options) {
+		opt.cache = &config
+	}
+}
+
+type httpCache struct {
+	store   CacheStore
+	maxSize int64
+	private bool
+}
+
+func newHTTPCache(config CacheConfig) *httpCache {
+	c := &httpCache{store: config.Store, maxSize: config.MaxObjectSize, private: config.Private}
+	if c.store == nil {
+		c.store = NewMemoryCacheStore(defaultCacheSize)
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultCacheMaxObject
+	}
+
+	return c
+}
+
+func cacheKey(req *http.Request) string {
+	return req.URL.String()
+}
+
+// roundTrip 使用缓存或发送请求, 可缓存的响应在body读取完成后存储
+func (c *httpCache) roundTrip(ctx *Context, req *http.Request, fetch func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp, err := fetch(req)
+		if err == nil && !isSafeMethod(req.Method) && resp.StatusCode < http.StatusBadRequest {
+			c.store.Delete(cacheKey(req))
+		}
+		return resp, err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok || req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" {
+		return fetch(req)
+	}
+	key := cacheKey(req)
+	entry, ok := c.store.Get(key)
+	if ok && !entry.matchVary(req) {
+		entry, ok = nil, false
+	}
+	if ok && c.fresh(entry, reqCC) {
+		ctx.CacheStatus = CacheHit
+		return entry.response(req), nil
+	}
+	outReq := req
+	if ok && entry.hasValidator() {
+		outReq = conditionalRequest(req, entry)
+	}
+	reqTime := time.Now()
+	resp, err := fetch(outReq)
+	if err != nil {
+		return nil, err
+	}
+	respTime := time.Now()
+	if ok && resp.StatusCode == http.StatusNotModified && outReq != req {
+		resp.Body.Close()
+		updated := entry.update(resp.Header, reqTime, respTime)
+		c.store.Set(key, updated)
+		ctx.CacheStatus = CacheRevalidated
+		return updated.response(req), nil
+	}
+	ctx.CacheStatus = CacheMiss
+	if req.Method != http.MethodGet || !c.storable(req, resp) {
+		return resp, nil
+	}
+	stored := &CachedResponse{
+		StatusCode:   resp.StatusCode,
+		Header:       CloneHeader(resp.Header),
+		Vary:         varyValues(req, resp.Header),
+		RequestTime:  reqTime,
+		ResponseTime: respTime,
+	}
+	resp.Body = &cacheBody{
+		rc:  resp.Body,
+		max: c.maxSize,
+		done: func(body []byte) {
+			stored.Body = body
+			c.store.Set(key, stored)
+		},
+	}
+
+	return resp, nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+// storable 响应是否可以缓存, RFC 7234 3
+func (c *httpCache) storable(req *http.Request, resp *http.Response) bool {
+	if !cacheableStatus[resp.StatusCode] || resp.ContentLength > c.maxSize {
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	_, public := cc["public"]
+	if !c.private {
+		if _, ok := cc["private"]; ok {
+			return false
+		}
+		if req.Header.Get("Authorization") != "" && !public {
+			if _, ok := cc["s-maxage"]; !ok {
+				return false
+			}
+		}
+	}
+	if len(resp.Header["Set-Cookie"]) > 0 || headerContainsToken(resp.Header, "Vary", "*") {
+		return false
+	}
+	entry := &CachedResponse{Header: resp.Header}
+	if entry.hasValidator() || public {
+		return true
+	}
+
+	return c.lifetime(entry) > 0
+}
+
+// fresh 缓存是否可以直接使用
+func (c *httpCache) fresh(entry *CachedResponse, reqCC map[string]string) bool {
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	respCC := parseCacheControl(entry.Header)
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+	lifetime := c.lifetime(entry)
+	age := entry.age(time.Now())
+	if v, ok := reqCC["max-age"]; ok {
+		if d, ok := parseSeconds(v); ok && d < lifetime {
+			lifetime = d
+		}
+	}
+	if v, ok := reqCC["min-fresh"]; ok {
+		if d, ok := parseSeconds(v); ok {
+			age += d
+		}
+	}
+	if age < lifetime {
+		return true
+	}
+	if _, ok := respCC["must-revalidate"]; ok {
+		return false
+	}
+	if v, ok := reqCC["max-stale"]; ok {
+		if v == "" {
+			return true
+		}
+		if d, ok := parseSeconds(v); ok && age < lifetime+d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lifetime 新鲜期, RFC 7234 4.2.1
+func (c *httpCache) lifetime(entry *CachedResponse) time.Duration {
+	cc := parseCacheControl(entry.Header)
+	if !c.private {
+		if d, ok := parseSeconds(cc["s-maxage"]); ok {
+			return d
+		}
+	}
+	if d, ok := parseSeconds(cc["max-age"]); ok {
+		return d
+	}
+	date := entry.ResponseTime
+	if t, err := http.ParseTime(entry.Header.Get("Date")); err == nil {
+		date = t
+	}
+	if v := entry.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lm, err := http.ParseTime(entry.Header.Get("Last-Modified")); err == nil && entry.StatusCode == http.StatusOK {
+		d := date.Sub(lm) / 10
+		if d > maxHeuristicFreshness {
+			d = maxHeuristicFreshness
+		}
+		return d
+	}
+
+	return 0
+}
+
+// age 缓存的当前年龄, RFC 7234 4.2.3
+func (c *CachedResponse) age(now time.Time) time.Duration {
+	apparent := time.Duration(0)
+	if date, err := http.ParseTime(c.Header.Get("Date")); err == nil && c.ResponseTime.After(date) {
+		apparent = c.ResponseTime.Sub(date)
+	}
+	if d, ok := parseSeconds(c.Header.Get("Age")); ok {
+		d += c.ResponseTime.Sub(c.RequestTime)
+		if d > apparent {
+			apparent = d
+		}
+	}
+
+	return apparent + now.Sub(c.ResponseTime)
+}
+
+func (c *CachedResponse) hasValidator() bool {
+	return c.Header.Get("Etag") != "" || c.Header.Get("Last-Modified") != ""
+}
+
+// matchVary 请求中Vary指定的请求头与缓存时相同
+func (c *CachedResponse) matchVary(req *http.Request) bool {
+	for k, vv := range c.Vary {
+		if strings.Join(req.Header[k], ",") != strings.Join(vv, ",") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func varyValues(req *http.Request, header http.Header) http.Header {
+	vary := make(http.Header)
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				vary[name] = append([]string(nil), req.Header[name]...)
+			}
+		}
+	}
+
+	return vary
+}
+
+// update 收到304后用新的响应头更新缓存, RFC 7234 4.3.4
+func (c *CachedResponse) update(header http.Header, reqTime, respTime time.Time) *CachedResponse {
+	updated := *c
+	updated.Header = CloneHeader(c.Header)
+	for k, vv := range header {
+		if k == "Content-Length" {
+			continue
+		}
+		updated.Header[k] = append([]string(nil), vv...)
+	}
+	updated.RequestTime = reqTime
+	updated.ResponseTime = respTime
+
+	return &updated
+}
+
+// response 生成返回给客户端的响应, 客户端的条件请求匹配时返回304
+func (c *CachedResponse) response(req *http.Request) *http.Response {
+	header := CloneHeader(c.Header)
+	header.Set("Age", strconv.FormatInt(int64(c.age(time.Now())/time.Second), 10))
+	resp := &http.Response{
+		Status:        strconv.Itoa(c.StatusCode) + " " + http.StatusText(c.StatusCode),
+		StatusCode:    c.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+	if notModified(req, c.Header) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 Not Modified"
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Length")
+	}
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+
+	return resp
+}
+
+// notModified 客户端的If-None-Match、If-Modified-Since是否匹配缓存
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("Etag"), "W/")
+		for _, v := range strings.Split(inm, ",") {
+			if v = strings.TrimSpace(v); v == "*" || etag != "" && strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+
+	return err == nil && !lm.After(ims)
+}
+
+// conditionalRequest 使用缓存的ETag、Last-Modified验证, 客户端自己的条件请求头被替换
+func conditionalRequest(req *http.Request, entry *CachedResponse) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	if etag := entry.Header.Get("Etag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lm := entry.Header.Get("Last-Modified"); lm != "" {
+		r.Header.Set("If-Modified-Since", lm)
+	}
+
+	return r
+}
+
+// parseCacheControl 解析Cache-Control, 指令名转换为小写, 值去掉引号
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			name, value := item, ""
+			if i := strings.IndexByte(item, '='); i >= 0 {
+				name, value = item[:i], strings.Trim(strings.TrimSpace(item[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	if len(h["Cache-Control"]) == 0 && headerContainsToken(h, "Pragma", "no-cache") {
+		cc["no-cache"] = ""
+	}
+
+	return cc
+}
+
+func parseSeconds(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheBody 读取完整body后存储, 超过上限或未读完就关闭时不存储
+type cacheBody struct {
+	rc       io.ReadCloser
+	max      int64
+	buf      bytes.Buffer
+	done     func([]byte)
+	overflow bool
+	stored   bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if n > 0 && !b.overflow {
+		if int64(b.buf.Len()+n) > b.max {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow && !b.stored {
+		b.stored = true
+		b.done(b.buf.Bytes())
+	}
+
+	return n, err
+}
+
+func (b *cacheBody) Close() error {
+	return b.rc.Close()
+}
+
+// NewMemoryCacheStore 内存缓存, 总大小超过maxBytes时淘汰最久未使用的响应, maxBytes<=0时为64MB
+func NewMemoryCacheStore(maxBytes int64) CacheStore {
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheSize
+	}
+
+	return &memoryCacheStore{max: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+type memoryCacheStore struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key  string
+	resp *CachedResponse
+	size int64
+}
+
+func (s *memoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.ll.MoveToFront(e)
+
+	return e.Value.(*memoryCacheItem).resp, true
+}
+
+func (s *memoryCacheStore) Set(key string, resp *CachedResponse) {
+	size := resp.size()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+	if size > s.max {
+		return
+	}
+	s.items[key] = s.ll.PushFront(&memoryCacheItem{key: key, resp: resp, size: size})
+	s.size += size
+	for s.size > s.max {
+		s.remove(s.ll.Back())
+	}
+}
+
+func (s *memoryCacheStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+}
+
+func (s *memoryCacheStore) remove(e *list.Element) {
+	item := s.ll.Remove(e).(*memoryCacheItem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
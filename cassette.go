@@ -0,0 +1,275 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCassetteMiss 回放模式下没有与请求匹配的记录
+var ErrCassetteMiss = errors.New("cassette中没有匹配的记录")
+
+// CassetteMode 记录和回放模式
+type CassetteMode int
+
+const (
+	// CassetteRecord 请求目标服务器并保存响应, 覆盖已有的记录
+	CassetteRecord CassetteMode = iota
+	// CassetteReplay 只使用记录的响应, 不访问网络, 没有记录时返回ErrCassetteMiss(502)
+	CassetteReplay
+	// CassetteReplayOrRecord 有记录时回放, 否则请求目标服务器并保存
+	CassetteReplayOrRecord
+)
+
+// CassetteEntry 记录的请求和响应, 字段均可导出, 便于序列化
+type CassetteEntry struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	RequestBody   []byte      `json:"request_body,omitempty"`
+	StatusCode    int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	RecordedAt    time.Time   `json:"recorded_at"`
+}
+
+// response 生成回放的响应
+func (e *CassetteEntry) response(req *http.Request) *http.Response {
+	resp := &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        CloneHeader(e.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+
+	return resp
+}
+
+// CassetteStore 记录的存储, 需要并发安全, 没有记录时Load返回nil, nil
+type CassetteStore interface {
+	Load(key string) (*CassetteEntry, error)
+	Save(key string, entry *CassetteEntry) error
+}
+
+// CassetteFingerprint 计算请求的key, body为完整的请求body
+type CassetteFingerprint func(req *http.Request, body []byte) string
+
+// CassetteConfig 记录和回放配置
+type CassetteConfig struct {
+	Mode CassetteMode
+	// Store 存储, 如NewFileCassetteStore
+	Store CassetteStore
+	// Fingerprint 请求的key, 默认由方法、URL、MatchHeaders指定的请求头和body的SHA-256组成
+	Fingerprint CassetteFingerprint
+	// MatchHeaders 默认key包含的请求头, 如Accept、Authorization
+	MatchHeaders []string
+}
+
+// WithCassette 记录目标服务器的响应并在之后回放, 用于测试时不依赖网络
+// 在请求body转换之后发送前处理, 回放的响应仍经过BeforeResponse和响应转换, HTTPS请求需要开启HTTPS解密, CONNECT隧道不处理
+func WithCassette(config CassetteConfig) Option {
+	return func(opt *options) {
+		opt.cassette = &config
+	}
+}
+
+type cassette struct {
+	config CassetteConfig
+}
+
+func newCassette(config CassetteConfig) *cassette {
+	if config.Fingerprint == nil {
+		headers := config.MatchHeaders
+		config.Fingerprint = func(req *http.Request, body []byte) string {
+			return defaultCassetteFingerprint(req, body, headers)
+		}
+	}
+
+	return &cassette{config: config}
+}
+
+// defaultCassetteFingerprint 方法 URL [请求头] body的SHA-256
+func defaultCassetteFingerprint(req *http.Request, body []byte, headers []string) string {
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteByte(' ')
+	b.WriteString(req.URL.String())
+	names := append([]string(nil), headers...)
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(" ")
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteString("=")
+		b.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		b.WriteString(" body=")
+		b.WriteString(hex.EncodeToString(sum[:8]))
+	}
+
+	return b.String()
+}
+
+// roundTrip 回放或发送请求并记录
+func (c *cassette) roundTrip(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	key := c.config.Fingerprint(req, body)
+	if c.config.Mode != CassetteRecord {
+		entry, err := c.config.Store.Load(key)
+		if err != nil {
+			return nil, fmt.Errorf("读取cassette记录错误: %s", err)
+		}
+		if entry != nil {
+			return entry.response(req), nil
+		}
+		if c.config.Mode == CassetteReplay {
+			return nil, fmt.Errorf("%w: %s", ErrCassetteMiss, key)
+		}
+	}
+	resp, err := send(req)
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	entry := &CassetteEntry{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: CloneHeader(req.Header),
+		RequestBody:   body,
+		StatusCode:    resp.StatusCode,
+		Header:        CloneHeader(resp.Header),
+		Body:          respBody,
+		RecordedAt:    time.Now(),
+	}
+	if err := c.config.Store.Save(key, entry); err != nil {
+		return nil, fmt.Errorf("保存cassette记录错误: %s", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	resp.ContentLength = int64(len(respBody))
+
+	return resp, nil
+}
+
+// NewFileCassetteStore 每条记录保存为dir下的一个JSON文件, 文件名为key的SHA-256, 可提交到代码仓库供CI使用
+func NewFileCassetteStore(dir string) CassetteStore {
+	return &fileCassetteStore{dir: dir}
+}
+
+type fileCassetteStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (s *fileCassetteStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *fileCassetteStore) Load(key string) (*CassetteEntry, error) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &CassetteEntry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.path(key), err)
+	}
+
+	return entry, nil
+}
+
+// Save 先写入临时文件再重命名, 避免并发读取到不完整的文件
+func (s *fileCassetteStore) Save(key string, entry *CassetteEntry) error {
+	b, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	path := s.path(key)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// NewMemoryCassetteStore 保存在内存中, 用于单个测试内录制后回放
+func NewMemoryCassetteStore() CassetteStore {
+	return &memoryCassetteStore{entries: make(map[string]*CassetteEntry)}
+}
+
+type memoryCassetteStore struct {
+	mu      sync.RWMutex
+	entries map[string]*CassetteEntry
+}
+
+func (s *memoryCassetteStore) Load(key string) (*CassetteEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.entries[key], nil
+}
+
+func (s *memoryCassetteStore) Save(key string, entry *CassetteEntry) error {
+	s.mu.Lock()
+	s.entries[key] = entry
+	s.mu.Unlock()
+
+	return nil
+}
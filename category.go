@@ -0,0 +1,374 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCategoryCacheTTL  = 10 * time.Minute
+	defaultCategoryCacheSize = 10000
+)
+
+// CategoryProvider URL分类, 如本地分类库或第三方分类API
+type CategoryProvider interface {
+	// Categorize 返回URL的分类, CONNECT隧道只有域名和端口
+	Categorize(ctx context.Context, u *url.URL) ([]string, error)
+}
+
+// CategoryAction 分类规则的处理方式
+type CategoryAction int
+
+const (
+	// CategoryBlock 拦截
+	CategoryBlock CategoryAction = iota
+	// CategoryAllow 放行, 用于在拦截规则前添加例外
+	CategoryAllow
+)
+
+// CategoryRule 分类规则, 如"禁止X组访问博彩类网站"
+type CategoryRule struct {
+	// Categories 匹配任一分类
+	Categories []string
+	// Users 限定用户, Users和Groups都为空时匹配所有用户
+	Users []string
+	// Groups 限定用户组, 用户所属的组由CategoryConfig.Groups获取
+	Groups []string
+	Action CategoryAction
+	// Message 拦截页面的说明
+	Message string
+}
+
+// CategoryConfig URL分类设置
+type CategoryConfig struct {
+	Provider CategoryProvider
+	// Rules 按顺序匹配第一条规则, 没有匹配的规则时放行
+	Rules []CategoryRule
+	// Groups 返回用户所属的组
+	Groups func(user string) []string
+	// StatusCode 拦截时的状态码, 默认403
+	StatusCode int
+	// CacheTTL 分类结果缓存时间, 默认10分钟, 小于0时不缓存
+	CacheTTL time.Duration
+	// CacheSize 最多缓存的URL数量, 默认10000
+	CacheSize int
+}
+
+// WithCategorization URL分类, 在Auth之后获取分类并设置Context.Categories, 再按规则拦截
+// HTTP请求和HTTPS解密后的请求按完整URL分类, CONNECT隧道按域名分类
+// 获取分类失败时记录错误并放行
+func WithCategorization(config CategoryConfig) Option {
+	return func(opt *options) {
+		opt.categorization = &config
+	}
+}
+
+type categorizer struct {
+	config CategoryConfig
+	cache  *categoryCache
+}
+
+func newCategorizer(config CategoryConfig) *categorizer {
+	if config.StatusCode == 0 {
+		config.StatusCode = http.StatusForbidden
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = defaultCategoryCacheTTL
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultCategoryCacheSize
+	}
+	c := &categorizer{config: config}
+	if config.CacheTTL > 0 {
+		c.cache = &categoryCache{ttl: config.CacheTTL, size: config.CacheSize, items: make(map[string]*categoryCacheItem)}
+	}
+
+	return c
+}
+
+// categorize 获取分类并匹配规则, 返回nil时放行
+func (p *Proxy) categorize(ctx *Context) *BlockPage {
+	c := p.categorizer
+	u := ctx.Req.URL
+	if ctx.Req.Method == http.MethodConnect {
+		u = &url.URL{Host: ctx.Req.URL.Host}
+	}
+	key := u.Host + u.EscapedPath()
+	categories, ok := c.cache.get(key)
+	if !ok {
+		var err error
+		categories, err = c.config.Provider.Categorize(ctx.Req.Context(), u)
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("%s - 获取URL分类错误: %s", u.Host, err))
+			return nil
+		}
+		c.cache.set(key, categories)
+	}
+	ctx.Categories = categories
+	if len(categories) == 0 {
+		return nil
+	}
+	var groups []string
+	if c.config.Groups != nil && ctx.User != "" {
+		groups = c.config.Groups(ctx.User)
+	}
+	for _, rule := range c.config.Rules {
+		category := rule.match(categories, ctx.User, groups)
+		if category == "" {
+			continue
+		}
+		if rule.Action == CategoryAllow {
+			return nil
+		}
+		return &BlockPage{StatusCode: c.config.StatusCode, Message: rule.Message, Category: category}
+	}
+
+	return nil
+}
+
+// match 返回匹配的分类, 不匹配时返回空
+func (r *CategoryRule) match(categories []string, user string, groups []string) string {
+	if len(r.Users) > 0 || len(r.Groups) > 0 {
+		if !containsString(r.Users, user) && !intersects(r.Groups, groups) {
+			return ""
+		}
+	}
+	for _, c := range categories {
+		if containsString(r.Categories, c) {
+			return c
+		}
+	}
+
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func intersects(a, b []string) bool {
+	for _, s := range b {
+		if containsString(a, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type categoryCacheItem struct {
+	categories []string
+	expires    time.Time
+}
+
+type categoryCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	items map[string]*categoryCacheItem
+}
+
+func (c *categoryCache) get(key string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if !ok || time.Now().After(item.expires) {
+		return nil, false
+	}
+
+	return item.categories, true
+}
+
+func (c *categoryCache) set(key string, categories []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.items) >= c.size {
+		for k, item := range c.items {
+			if now.After(item.expires) {
+				delete(c.items, k)
+			}
+		}
+		if len(c.items) >= c.size {
+			c.items = make(map[string]*categoryCacheItem)
+		}
+	}
+	c.items[key] = &categoryCacheItem{categories: categories, expires: now.Add(c.ttl)}
+}
+
+// CategoryDB 本地分类库, 并发安全
+// 域名条目匹配该域名及所有子域名, 带路径的条目(如example.com/games/)按前缀匹配, 优先于域名条目
+type CategoryDB struct {
+	mu    sync.RWMutex
+	hosts map[string][]string
+	paths map[string][]categoryPath
+}
+
+type categoryPath struct {
+	prefix     string
+	categories []string
+}
+
+// NewCategoryDB 创建空的分类库
+func NewCategoryDB() *CategoryDB {
+	return &CategoryDB{
+		hosts: make(map[string][]string),
+		paths: make(map[string][]categoryPath),
+	}
+}
+
+// LoadCategoryDB 从r读取分类库, 每行"域名[/路径] 分类1,分类2", #开头为注释
+func LoadCategoryDB(r io.Reader) (*CategoryDB, error) {
+	db := NewCategoryDB()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("分类库第%d行格式错误: %s", n, line)
+		}
+		db.Add(fields[0], strings.Split(fields[1], ",")...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Add 添加条目, pattern为域名或域名+路径前缀
+func (db *CategoryDB) Add(pattern string, categories ...string) {
+	pattern = strings.ToLower(strings.TrimPrefix(pattern, "*."))
+	host, path := pattern, ""
+	if i := strings.IndexByte(pattern, '/'); i >= 0 {
+		host, path = pattern[:i], pattern[i:]
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if path == "" {
+		db.hosts[host] = categories
+		return
+	}
+	db.paths[host] = append(db.paths[host], categoryPath{prefix: path, categories: categories})
+}
+
+// Categorize 从完整域名开始依次查找上级域名
+func (db *CategoryDB) Categorize(ctx context.Context, u *url.URL) ([]string, error) {
+	host := strings.TrimSuffix(strings.ToLower(hostname(u.Host)), ".")
+	path := strings.ToLower(u.Path)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for h := host; h != ""; {
+		if path != "" {
+			var best *categoryPath
+			for i, p := range db.paths[h] {
+				if strings.HasPrefix(path, p.prefix) && (best == nil || len(p.prefix) > len(best.prefix)) {
+					best = &db.paths[h][i]
+				}
+			}
+			if best != nil {
+				return best.categories, nil
+			}
+		}
+		if categories, ok := db.hosts[h]; ok {
+			return categories, nil
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+
+	return nil, nil
+}
+
+// CategoryAPI 通过HTTP接口获取分类
+// 请求GET endpoint?url=<URL>, 响应JSON {"categories": ["..."]}
+type CategoryAPI struct {
+	endpoint string
+	client   *http.Client
+	header   http.Header
+}
+
+// NewCategoryAPI 创建分类API客户端, client为nil时使用10秒超时的默认client, header为每个请求附加的头(如API Key)
+func NewCategoryAPI(endpoint string, client *http.Client, header http.Header) *CategoryAPI {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &CategoryAPI{endpoint: endpoint, client: client, header: header}
+}
+
+func (a *CategoryAPI) Categorize(ctx context.Context, u *url.URL) ([]string, error) {
+	target := u.String()
+	if u.Scheme == "" {
+		target = u.Host
+	}
+	sep := "?"
+	if strings.Contains(a.endpoint, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.endpoint+sep+"url="+url.QueryEscape(target), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range a.header {
+		req.Header[k] = v
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("分类API返回%s", resp.Status)
+	}
+	var result struct {
+		Categories []string `json:"categories"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("解析分类API响应错误: %s", err)
+	}
+
+	return result.Categories, nil
+}
@@ -15,10 +15,50 @@
 // Package cert HTTPS证书
 package cert
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"sync"
+)
 
 // Cache 证书缓存接口
 type Cache interface {
 	Set(host string, c *tls.Certificate)
 	Get(host string) *tls.Certificate
 }
+
+// NewMemoryCache 内存证书缓存, 最多保存size个证书, 超过时随机淘汰一个, size<=0时不限制
+func NewMemoryCache(size int) Cache {
+	return &memoryCache{size: size, certs: make(map[string]*tls.Certificate)}
+}
+
+type memoryCache struct {
+	mu    sync.RWMutex
+	size  int
+	certs map[string]*tls.Certificate
+}
+
+func (m *memoryCache) Set(host string, c *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.certs[host]; !ok && m.size > 0 && len(m.certs) >= m.size {
+		for k := range m.certs {
+			delete(m.certs, k)
+			break
+		}
+	}
+	m.certs[host] = c
+}
+
+// Flush 清空缓存
+func (m *memoryCache) Flush() {
+	m.mu.Lock()
+	m.certs = make(map[string]*tls.Certificate)
+	m.mu.Unlock()
+}
+
+func (m *memoryCache) Get(host string) *tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.certs[host]
+}
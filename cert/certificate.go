@@ -16,9 +16,14 @@
 package cert
 
 import (
+	"bytes"
+	"crypto"
 	crand "crypto/rand"
+	"errors"
+	"io/ioutil"
 	"math/rand"
 	"strings"
+	"sync"
 
 	"crypto/rsa"
 	"crypto/tls"
@@ -143,6 +148,11 @@ func init() {
 // Certificate 证书管理
 type Certificate struct {
 	cache Cache
+
+	mu     sync.RWMutex
+	rootCA *x509.Certificate
+	// 根证书私钥
+	rootKey crypto.Signer
 }
 
 type Pair struct {
@@ -154,8 +164,179 @@ type Pair struct {
 
 func NewCertificate(cache Cache) *Certificate {
 	return &Certificate{
-		cache: cache,
+		cache:   cache,
+		rootCA:  defaultRootCA,
+		rootKey: defaultRootKey,
+	}
+}
+
+// FlushCache 清空证书缓存, 缓存实现了Flush()时有效, 否则返回false
+func (c *Certificate) FlushCache() bool {
+	f, ok := c.cache.(interface{ Flush() })
+	if ok {
+		f.Flush()
+	}
+
+	return ok
+}
+
+// SetCA 替换签发证书的根证书, 立即生效, 正在握手的连接继续使用原证书
+// 缓存中由原根证书签发的证书在下次使用时重新生成
+func (c *Certificate) SetCA(ca *x509.Certificate, key *rsa.PrivateKey) {
+	var signer crypto.Signer
+	if key != nil {
+		signer = key
+	}
+	c.setCA(ca, signer)
+}
+
+// SetCAKeyPair 使用tls.Certificate替换根证书, 私钥支持RSA、ECDSA和Ed25519
+// 证书链的第一个证书作为根证书, 必须是CA证书且与私钥匹配
+func (c *Certificate) SetCAKeyPair(pair *tls.Certificate) error {
+	if pair == nil || len(pair.Certificate) == 0 {
+		return errors.New("根证书为空")
+	}
+	ca := pair.Leaf
+	if ca == nil {
+		var err error
+		if ca, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return fmt.Errorf("解析根证书失败: %s", err)
+		}
+	}
+	if !ca.IsCA {
+		return errors.New("证书不是CA证书")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("根证书私钥不支持签名")
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(ca.PublicKey) {
+		return errors.New("根证书与私钥不匹配")
+	}
+	c.setCA(ca, key)
+
+	return nil
+}
+
+func (c *Certificate) setCA(ca *x509.Certificate, key crypto.Signer) {
+	c.mu.Lock()
+	c.rootCA = ca
+	c.rootKey = key
+	c.mu.Unlock()
+}
+
+// CA 返回当前的根证书
+func (c *Certificate) CA() *x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.rootCA
+}
+
+// LoadCA 从PEM加载根证书和RSA私钥(PKCS1或PKCS8)并替换当前根证书
+func (c *Certificate) LoadCA(certPEM, keyPEM []byte) error {
+	ca, key, err := ParseCA(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	c.SetCA(ca, key)
+
+	return nil
+}
+
+// WatchCAFiles 从文件加载根证书, 之后每interval检查文件修改时间, 变化时重新加载
+// 重新加载失败时保留当前根证书并调用errLog, 返回的stop用于停止检查
+func (c *Certificate) WatchCAFiles(certFile, keyFile string, interval time.Duration, errLog func(error)) (stop func(), err error) {
+	load := func() error {
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		return c.LoadCA(certPEM, keyPEM)
 	}
+	if err := load(); err != nil {
+		return nil, err
+	}
+
+	return watchFiles([]string{certFile, keyFile}, interval, func() {
+		if err := load(); err != nil && errLog != nil {
+			errLog(fmt.Errorf("重新加载根证书失败: %s", err))
+		}
+	}), nil
+}
+
+// ParseCA 解析PEM格式的根证书和RSA私钥
+func ParseCA(certPEM, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, errors.New("根证书不是PEM格式")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析根证书失败: %s", err)
+	}
+	if !ca.IsCA {
+		return nil, nil, errors.New("证书不是CA证书")
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, errors.New("根证书私钥不是PEM格式")
+	}
+	var key *rsa.PrivateKey
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("解析根证书私钥失败: %s", err)
+		}
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return nil, nil, errors.New("根证书私钥不是RSA私钥")
+		}
+	}
+	if !key.PublicKey.Equal(ca.PublicKey) {
+		return nil, nil, errors.New("根证书与私钥不匹配")
+	}
+
+	return ca, key, nil
+}
+
+// expired 证书是否已过期, 提前一小时视为过期, 避免握手时过期
+func expired(cert *tls.Certificate) bool {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return true
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return true
+		}
+	}
+
+	return time.Now().Add(time.Hour).After(leaf.NotAfter)
+}
+
+// issuedBy 证书是否由ca签发
+func issuedBy(cert *tls.Certificate, ca *x509.Certificate) bool {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return false
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false
+		}
+	}
+	if len(leaf.AuthorityKeyId) > 0 && len(ca.SubjectKeyId) > 0 {
+		return bytes.Equal(leaf.AuthorityKeyId, ca.SubjectKeyId)
+	}
+
+	return leaf.CheckSignatureFrom(ca) == nil
 }
 
 // GenerateTlsConfig 生成TLS配置
@@ -163,9 +344,17 @@ func (c *Certificate) GenerateTlsConfig(host string) (*tls.Config, error) {
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
 	}
+	// IPv6地址去掉方括号
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	c.mu.RLock()
+	rootCA, rootKey := c.rootCA, c.rootKey
+	c.mu.RUnlock()
+	if rootCA == nil || rootKey == nil {
+		return nil, errors.New("未设置根证书")
+	}
 	if c.cache != nil {
-		// 先从缓存中查找证书
-		if cert := c.cache.Get(host); cert != nil {
+		// 先从缓存中查找证书, 根证书替换或证书过期后重新生成
+		if cert := c.cache.Get(host); cert != nil && issuedBy(cert, rootCA) && !expired(cert) {
 			tlsConf := &tls.Config{
 				Certificates: []tls.Certificate{*cert},
 			}
@@ -173,7 +362,7 @@ func (c *Certificate) GenerateTlsConfig(host string) (*tls.Config, error) {
 			return tlsConf, nil
 		}
 	}
-	pair, err := c.GeneratePem(host, 1, defaultRootCA, defaultRootKey)
+	pair, err := c.generatePem(host, 1, rootCA, rootKey)
 	if err != nil {
 		return nil, err
 	}
@@ -195,6 +384,10 @@ func (c *Certificate) GenerateTlsConfig(host string) (*tls.Config, error) {
 
 // Generate 生成证书
 func (c *Certificate) GeneratePem(host string, expireDays int, rootCA *x509.Certificate, rootKey *rsa.PrivateKey) (*Pair, error) {
+	return c.generatePem(host, expireDays, rootCA, rootKey)
+}
+
+func (c *Certificate) generatePem(host string, expireDays int, rootCA *x509.Certificate, rootKey crypto.Signer) (*Pair, error) {
 	priv, err := rsa.GenerateKey(crand.Reader, 2048)
 	if err != nil {
 		return nil, err
@@ -292,7 +485,7 @@ func (c *Certificate) template(host string, expireYears int) *x509.Certificate {
 	}
 	hosts := strings.Split(host, ",")
 	for _, item := range hosts {
-		if ip := net.ParseIP(host); ip != nil {
+		if ip := net.ParseIP(item); ip != nil {
 			cert.IPAddresses = append(cert.IPAddresses, ip)
 		} else {
 			cert.DNSNames = append(cert.DNSNames, item)
@@ -0,0 +1,62 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cert
+
+import (
+	"crypto/x509"
+	"net"
+	"testing"
+)
+
+func TestGenerateTlsConfigSAN(t *testing.T) {
+	tests := []struct {
+		host     string
+		ip       string
+		dnsNames []string
+	}{
+		{"example.com", "", []string{"example.com"}},
+		{"example.com:443", "", []string{"example.com"}},
+		{"192.0.2.1:443", "192.0.2.1", nil},
+		{"[2001:db8::1]:443", "2001:db8::1", nil},
+		{"[2001:db8::1]", "2001:db8::1", nil},
+		{"2001:db8::1", "2001:db8::1", nil},
+		{"::1", "::1", nil},
+	}
+	c := NewCertificate(nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(c.CA())
+	for _, tt := range tests {
+		config, err := c.GenerateTlsConfig(tt.host)
+		if err != nil {
+			t.Fatalf("%s: 生成证书失败: %s", tt.host, err)
+		}
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatalf("%s: 解析证书失败: %s", tt.host, err)
+		}
+		if len(leaf.DNSNames) != len(tt.dnsNames) || len(tt.dnsNames) > 0 && leaf.DNSNames[0] != tt.dnsNames[0] {
+			t.Errorf("%s: DNSNames = %v, 期望 %v", tt.host, leaf.DNSNames, tt.dnsNames)
+		}
+		name := tt.ip
+		if name == "" {
+			name = tt.dnsNames[0]
+		} else if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP(tt.ip)) {
+			t.Errorf("%s: IPAddresses = %v, 期望 [%s]", tt.host, leaf.IPAddresses, tt.ip)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("%s: 按%s校验证书失败: %s", tt.host, name, err)
+		}
+	}
+}
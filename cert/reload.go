@@ -0,0 +1,129 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cert
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPairReloader 可在运行时替换的证书, 用于监听TLS(GetCertificate)和连接上级时的客户端证书(GetClientCertificate)
+// 替换后新的握手使用新证书, 已建立或正在握手的连接不受影响
+type KeyPairReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewKeyPairReloader 从文件加载证书和私钥
+func NewKeyPairReloader(certFile, keyFile string) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload 重新加载文件, 失败时保留当前证书
+func (r *KeyPairReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("加载证书%s失败: %s", r.certFile, err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Watch 每interval检查文件修改时间, 变化时重新加载, 返回的stop用于停止检查
+func (r *KeyPairReloader) Watch(interval time.Duration, errLog func(error)) (stop func()) {
+	return watchFiles([]string{r.certFile, r.keyFile}, interval, func() {
+		if err := r.Reload(); err != nil && errLog != nil {
+			errLog(err)
+		}
+	})
+}
+
+// Certificate 返回当前证书
+func (r *KeyPairReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert
+}
+
+// GetCertificate 用于tls.Config.GetCertificate
+func (r *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate 用于tls.Config.GetClientCertificate
+func (r *KeyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// watchFiles 定期检查文件修改时间, 任一文件变化时调用onChange
+// 证书和私钥通常先后写入, 两次检查之间都发生变化时只调用一次
+func watchFiles(files []string, interval time.Duration, onChange func()) (stop func()) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	modTimes := func() []time.Time {
+		times := make([]time.Time, len(files))
+		for i, f := range files {
+			if info, err := os.Stat(f); err == nil {
+				times[i] = info.ModTime()
+			}
+		}
+		return times
+	}
+	done := make(chan struct{})
+	go func() {
+		last := modTimes()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			current := modTimes()
+			changed := false
+			for i := range current {
+				if !current[i].Equal(last[i]) {
+					changed = true
+				}
+			}
+			last = current
+			if changed {
+				onChange()
+			}
+		}
+	}()
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+)
+
+// ClientCertConfig 代理监听TLS时的客户端证书认证
+type ClientCertConfig struct {
+	// CAs 签发客户端证书的CA
+	CAs *x509.CertPool
+	// Optional 为true时客户端可以不提供证书, 提供的证书仍需验证通过
+	Optional bool
+	// User 根据证书确定Context.User, 默认使用Subject.CommonName
+	User func(cert *x509.Certificate) string
+}
+
+// WithClientCertAuth ListenAndServeTLS要求客户端提供证书, 验证通过的证书设置到Context.ClientCert
+// 并作为Context.User, 证书认证通过时不再要求Basic认证, Auth中可根据证书的Subject、SAN授权
+// 自行创建http.Server时需在tls.Config中设置ClientAuth和ClientCAs, Context.ClientCert同样会设置
+func WithClientCertAuth(config ClientCertConfig) Option {
+	return func(opt *options) {
+		opt.clientCert = &config
+	}
+}
+
+type tlsConnKey struct{}
+
+// tlsServerConfig ListenAndServeTLS使用的TLS配置
+func (p *Proxy) tlsServerConfig() *tls.Config {
+	config := &tls.Config{}
+	if p.clientCert == nil {
+		return config
+	}
+	config.ClientCAs = p.clientCert.CAs
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if p.clientCert.Optional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config
+}
+
+// saveTLSConn 保存TLS连接到context, HTTP/2的CONNECT请求没有设置req.TLS
+func saveTLSConn(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		return context.WithValue(ctx, tlsConnKey{}, tc)
+	}
+
+	return ctx
+}
+
+// listenerTLS 客户端到代理的TLS连接状态
+func listenerTLS(req *http.Request) *tls.ConnectionState {
+	if req.TLS != nil {
+		return req.TLS
+	}
+	if tc, ok := req.Context().Value(tlsConnKey{}).(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+
+	return nil
+}
+
+// verifiedClientCert 验证通过的客户端证书
+func verifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
+
+// clientCertUser 证书对应的用户名
+func (p *Proxy) clientCertUser(cert *x509.Certificate) string {
+	if p.clientCert != nil && p.clientCert.User != nil {
+		return p.clientCert.User(cert)
+	}
+
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type clientConnKey struct{}
+
+// ConnContext 保存客户端连接到请求context, 设置为http.Server.ConnContext后可通过Context.ClientConn获取
+//
+//	server := &http.Server{Handler: proxy, ConnContext: goproxy.ConnContext}
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, c)
+}
+
+// ClientConn 客户端连接, 隧道和HTTPS解密时为劫持的连接, 其他情况需设置http.Server.ConnContext为ConnContext
+// 用于获取地址、设置TCP参数或标记连接, 不要直接读写, 监听TLS时为*tls.Conn, 可通过NetConn获取TCP连接
+// 无法获取时返回nil
+func (c *Context) ClientConn() net.Conn {
+	if c.clientConn != nil {
+		return c.clientConn
+	}
+	if c.Req == nil {
+		return nil
+	}
+	conn, _ := c.Req.Context().Value(clientConnKey{}).(net.Conn)
+
+	return conn
+}
+
+// LocalAddr 客户端连接的代理本地地址
+func (c *Context) LocalAddr() net.Addr {
+	if conn := c.ClientConn(); conn != nil {
+		return conn.LocalAddr()
+	}
+	if c.Req == nil {
+		return nil
+	}
+	addr, _ := c.Req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	return addr
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ouqiang/goproxy/cert"
+)
+
+// storedCert 保存在Store中的证书
+type storedCert struct {
+	Chain [][]byte `json:"chain"`
+	Key   []byte   `json:"key"`
+}
+
+// CertCache 所有实例共享HTTPS解密生成的证书, 先查询local, 未命中时从Store加载
+// ttl为Store中证书的保存时间, 应小于证书有效期
+func (n *Node) CertCache(local cert.Cache, ttl time.Duration) cert.Cache {
+	return &certCache{n: n, local: local, ttl: ttl}
+}
+
+type certCache struct {
+	n     *Node
+	local cert.Cache
+	ttl   time.Duration
+}
+
+func (c *certCache) Get(host string) *tls.Certificate {
+	if crt := c.local.Get(host); crt != nil {
+		return crt
+	}
+	value, err := c.n.store.Get(keyCert + strings.ToLower(host))
+	if err != nil {
+		c.n.opts.errLog(fmt.Errorf("%s - 读取共享证书失败: %s", host, err))
+		return nil
+	}
+	if value == nil {
+		return nil
+	}
+	var stored storedCert
+	if err := json.Unmarshal(value, &stored); err != nil {
+		c.n.opts.errLog(fmt.Errorf("%s - 解析共享证书失败: %s", host, err))
+		return nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(stored.Key)
+	if err != nil {
+		c.n.opts.errLog(fmt.Errorf("%s - 解析共享证书私钥失败: %s", host, err))
+		return nil
+	}
+	crt := &tls.Certificate{Certificate: stored.Chain, PrivateKey: key}
+	c.local.Set(host, crt)
+
+	return crt
+}
+
+func (c *certCache) Set(host string, crt *tls.Certificate) {
+	c.local.Set(host, crt)
+	key, err := x509.MarshalPKCS8PrivateKey(crt.PrivateKey)
+	if err != nil {
+		c.n.opts.errLog(fmt.Errorf("%s - 序列化证书私钥失败: %s", host, err))
+		return
+	}
+	value, err := json.Marshal(&storedCert{Chain: crt.Certificate, Key: key})
+	if err != nil {
+		return
+	}
+	if err := c.n.store.Set(keyCert+strings.ToLower(host), value, c.ttl); err != nil {
+		c.n.opts.errLog(fmt.Errorf("%s - 保存共享证书失败: %s", host, err))
+	}
+}
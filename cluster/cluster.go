@@ -0,0 +1,401 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package cluster 多个goproxy实例共享动态状态: 域名黑名单、上级代理健康状态、HTTPS解密证书、会话亲和
+// 状态保存在Store中, 变更通过发布订阅通知其他实例, 并定期全量同步
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ouqiang/goproxy"
+)
+
+const (
+	defaultSyncInterval = 30 * time.Second
+
+	keyBlocklist = "blocklist"
+	keyParents   = "parents"
+	keyCert      = "cert:"
+	keyAffinity  = "affinity:"
+	eventChannel = "events"
+)
+
+// Store 共享状态存储, 实现方负责为key和频道加上命名空间前缀
+// 可基于Redis(NewRedisStore)、etcd或gossip协议实现
+type Store interface {
+	// Get 不存在时返回nil, nil
+	Get(key string) ([]byte, error)
+	// Set ttl为0时不过期
+	Set(key string, value []byte, ttl time.Duration) error
+	// SetNX key不存在时设置, 返回是否设置成功
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	HSet(key, field string, value []byte) error
+	HDel(key, field string) error
+	HGetAll(key string) (map[string][]byte, error)
+	Publish(channel string, msg []byte) error
+	// Subscribe 订阅频道, handler按顺序调用
+	Subscribe(channel string, handler func(msg []byte)) (stop func(), err error)
+}
+
+type options struct {
+	nodeID       string
+	syncInterval time.Duration
+	errLog       func(error)
+}
+
+type Option func(*options)
+
+// WithNodeID 实例ID, 用于忽略自己发布的消息, 默认使用主机名和进程ID
+func WithNodeID(id string) Option {
+	return func(opt *options) {
+		opt.nodeID = id
+	}
+}
+
+// WithSyncInterval 全量同步间隔, 默认30秒, 用于恢复订阅断开期间丢失的变更
+func WithSyncInterval(d time.Duration) Option {
+	return func(opt *options) {
+		opt.syncInterval = d
+	}
+}
+
+// WithErrorLog 同步错误处理, 默认使用log.Println
+func WithErrorLog(f func(error)) Option {
+	return func(opt *options) {
+		opt.errLog = f
+	}
+}
+
+// event 实例间的变更通知
+type event struct {
+	Node    string `json:"node"`
+	Type    string `json:"type"`
+	Pattern string `json:"pattern,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Parent  string `json:"parent,omitempty"`
+	Healthy bool   `json:"healthy,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	eventBlock   = "block"
+	eventUnblock = "unblock"
+	eventParent  = "parent"
+)
+
+// parentHealth 保存在Store中的上级代理健康状态
+type parentHealth struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Node 集群中的一个实例
+type Node struct {
+	store  Store
+	opts   *options
+	stop   func()
+	closed chan struct{}
+
+	mu        sync.RWMutex
+	blocklist map[string]string
+	parents   map[string]parentHealth
+	proxies   []*goproxy.Proxy
+}
+
+// New 加入集群, 加载当前状态并订阅变更
+func New(store Store, opt ...Option) (*Node, error) {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+	if opts.nodeID == "" {
+		host, _ := os.Hostname()
+		opts.nodeID = host + "-" + strconv.Itoa(os.Getpid())
+	}
+	if opts.syncInterval <= 0 {
+		opts.syncInterval = defaultSyncInterval
+	}
+	if opts.errLog == nil {
+		opts.errLog = func(err error) {
+			log.Println(err)
+		}
+	}
+	n := &Node{
+		store:     store,
+		opts:      opts,
+		closed:    make(chan struct{}),
+		blocklist: make(map[string]string),
+		parents:   make(map[string]parentHealth),
+	}
+	stop, err := store.Subscribe(eventChannel, n.handle)
+	if err != nil {
+		return nil, fmt.Errorf("订阅集群事件失败: %s", err)
+	}
+	n.stop = stop
+	if err := n.sync(); err != nil {
+		stop()
+		return nil, err
+	}
+	go n.syncLoop()
+
+	return n, nil
+}
+
+// Close 退出集群, 不删除共享状态
+func (n *Node) Close() {
+	select {
+	case <-n.closed:
+	default:
+		close(n.closed)
+		n.stop()
+	}
+}
+
+func (n *Node) syncLoop() {
+	ticker := time.NewTicker(n.opts.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+			if err := n.sync(); err != nil {
+				n.opts.errLog(err)
+			}
+		}
+	}
+}
+
+// sync 从Store加载全部黑名单和上级代理状态
+func (n *Node) sync() error {
+	blocklist, err := n.store.HGetAll(keyBlocklist)
+	if err != nil {
+		return fmt.Errorf("同步黑名单失败: %s", err)
+	}
+	parents, err := n.store.HGetAll(keyParents)
+	if err != nil {
+		return fmt.Errorf("同步上级代理状态失败: %s", err)
+	}
+	n.mu.Lock()
+	n.blocklist = make(map[string]string, len(blocklist))
+	for pattern, reason := range blocklist {
+		n.blocklist[pattern] = string(reason)
+	}
+	n.mu.Unlock()
+	for parent, value := range parents {
+		var h parentHealth
+		if json.Unmarshal(value, &h) == nil {
+			n.applyParent(parent, h)
+		}
+	}
+
+	return nil
+}
+
+func (n *Node) handle(msg []byte) {
+	var ev event
+	if err := json.Unmarshal(msg, &ev); err != nil {
+		n.opts.errLog(fmt.Errorf("解析集群事件失败: %s", err))
+		return
+	}
+	if ev.Node == n.opts.nodeID {
+		return
+	}
+	switch ev.Type {
+	case eventBlock:
+		n.mu.Lock()
+		n.blocklist[ev.Pattern] = ev.Reason
+		n.mu.Unlock()
+	case eventUnblock:
+		n.mu.Lock()
+		delete(n.blocklist, ev.Pattern)
+		n.mu.Unlock()
+	case eventParent:
+		n.applyParent(ev.Parent, parentHealth{Healthy: ev.Healthy, Error: ev.Error})
+	}
+}
+
+func (n *Node) publish(ev *event) error {
+	ev.Node = n.opts.nodeID
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	return n.store.Publish(eventChannel, msg)
+}
+
+// Block 所有实例拦截匹配pattern的域名, pattern支持*.example.com
+func (n *Node) Block(pattern, reason string) error {
+	pattern = strings.ToLower(pattern)
+	if err := n.store.HSet(keyBlocklist, pattern, []byte(reason)); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.blocklist[pattern] = reason
+	n.mu.Unlock()
+
+	return n.publish(&event{Type: eventBlock, Pattern: pattern, Reason: reason})
+}
+
+// Unblock 从黑名单删除
+func (n *Node) Unblock(pattern string) error {
+	pattern = strings.ToLower(pattern)
+	if err := n.store.HDel(keyBlocklist, pattern); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	delete(n.blocklist, pattern)
+	n.mu.Unlock()
+
+	return n.publish(&event{Type: eventUnblock, Pattern: pattern})
+}
+
+// Blocked 域名是否在黑名单中, 返回拦截原因
+func (n *Node) Blocked(host string) (string, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for pattern, reason := range n.blocklist {
+		if goproxy.MatchHost(pattern, host) {
+			return reason, true
+		}
+	}
+
+	return "", false
+}
+
+// Blocklist 返回黑名单副本, key为域名规则, value为原因
+func (n *Node) Blocklist() map[string]string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	list := make(map[string]string, len(n.blocklist))
+	for pattern, reason := range n.blocklist {
+		list[pattern] = reason
+	}
+
+	return list
+}
+
+// Attach 同步proxy的上级代理健康状态: 本实例检测到的变化通知其他实例, 其他实例的变化应用到proxy
+func (n *Node) Attach(p *goproxy.Proxy) {
+	n.mu.Lock()
+	n.proxies = append(n.proxies, p)
+	parents := make(map[string]parentHealth, len(n.parents))
+	for parent, h := range n.parents {
+		parents[parent] = h
+	}
+	n.mu.Unlock()
+	for parent, h := range parents {
+		p.SetParentProxyHealth(parent, h.Healthy, h.Error)
+	}
+	p.OnParentProxyHealthChange(func(st goproxy.ParentProxyStatus, healthy bool) {
+		h := parentHealth{Healthy: healthy}
+		if !healthy {
+			h.Error = st.LastError
+		}
+		if err := n.reportParent(st.URL, h); err != nil {
+			n.opts.errLog(fmt.Errorf("同步上级代理%s状态失败: %s", st.URL, err))
+		}
+	})
+}
+
+func (n *Node) reportParent(parent string, h parentHealth) error {
+	value, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := n.store.HSet(keyParents, parent, value); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.parents[parent] = h
+	n.mu.Unlock()
+
+	return n.publish(&event{Type: eventParent, Parent: parent, Healthy: h.Healthy, Error: h.Error})
+}
+
+// applyParent 应用其他实例同步的上级代理状态
+func (n *Node) applyParent(parent string, h parentHealth) {
+	n.mu.Lock()
+	n.parents[parent] = h
+	proxies := n.proxies
+	n.mu.Unlock()
+	for _, p := range proxies {
+		p.SetParentProxyHealth(parent, h.Healthy, h.Error)
+	}
+}
+
+// Affinity 返回key(如用户名、客户端IP)绑定的上级代理, 未绑定时调用choose选择并在所有实例间共享, ttl后过期
+// 多个实例同时选择时以先写入的为准, choose返回nil表示直连, 同样会被绑定
+func (n *Node) Affinity(key string, ttl time.Duration, choose func() (*url.URL, error)) (*url.URL, error) {
+	value, err := n.store.Get(keyAffinity + key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		u, err := choose()
+		if err != nil {
+			return nil, err
+		}
+		value = []byte("DIRECT")
+		if u != nil {
+			value = []byte(u.String())
+		}
+		ok, err := n.store.SetNX(keyAffinity+key, value, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return u, nil
+		}
+		if value, err = n.store.Get(keyAffinity + key); err != nil || value == nil {
+			return u, err
+		}
+	}
+	if string(value) == "DIRECT" {
+		return nil, nil
+	}
+
+	return url.Parse(string(value))
+}
+
+// Delegate 包装next, 在Connect之后拦截黑名单中的域名
+func (n *Node) Delegate(next goproxy.Delegate) goproxy.Delegate {
+	return &delegate{Delegate: next, n: n}
+}
+
+type delegate struct {
+	goproxy.Delegate
+	n *Node
+}
+
+func (d *delegate) Connect(ctx *goproxy.Context, rw http.ResponseWriter) {
+	d.Delegate.Connect(ctx, rw)
+	if ctx.IsAborted() {
+		return
+	}
+	if reason, ok := d.n.Blocked(ctx.Req.URL.Host); ok {
+		ctx.WriteBlockPage(rw, &goproxy.BlockPage{Message: reason, Category: "blocklist"})
+	}
+}
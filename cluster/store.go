@@ -0,0 +1,266 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ouqiang/goproxy/redis"
+)
+
+// RedisStore 基于Redis的Store
+type RedisStore struct {
+	c      *redis.Client
+	prefix string
+}
+
+var _ Store = &RedisStore{}
+
+// NewRedisStore key和频道加上prefix, 为空时使用goproxy:
+func NewRedisStore(c *redis.Client, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = "goproxy:"
+	}
+
+	return &RedisStore{c: c, prefix: prefix}
+}
+
+// Get 实现Store接口
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	reply, err := s.c.Do("GET", s.prefix+key)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, _ := reply.(string)
+
+	return []byte(v), nil
+}
+
+// Set 实现Store接口
+func (s *RedisStore) Set(key string, value []byte, ttl time.Duration) error {
+	args := []interface{}{"SET", s.prefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+	_, err := s.c.Do(args...)
+
+	return err
+}
+
+// SetNX 实现Store接口
+func (s *RedisStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	args := []interface{}{"SET", s.prefix + key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+	_, err := s.c.Do(args...)
+	if err == redis.ErrNil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// HSet 实现Store接口
+func (s *RedisStore) HSet(key, field string, value []byte) error {
+	_, err := s.c.Do("HSET", s.prefix+key, field, value)
+
+	return err
+}
+
+// HDel 实现Store接口
+func (s *RedisStore) HDel(key, field string) error {
+	_, err := s.c.Do("HDEL", s.prefix+key, field)
+
+	return err
+}
+
+// HGetAll 实现Store接口
+func (s *RedisStore) HGetAll(key string) (map[string][]byte, error) {
+	reply, err := s.c.Do("HGETALL", s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	m := make(map[string][]byte, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		field, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		m[field] = []byte(value)
+	}
+
+	return m, nil
+}
+
+// Publish 实现Store接口
+func (s *RedisStore) Publish(channel string, msg []byte) error {
+	_, err := s.c.Do("PUBLISH", s.prefix+channel, msg)
+
+	return err
+}
+
+// Subscribe 实现Store接口
+func (s *RedisStore) Subscribe(channel string, handler func(msg []byte)) (func(), error) {
+	return s.c.Subscribe(s.prefix+channel, handler)
+}
+
+// MemoryStore 进程内Store, 用于单实例或多个Node共用同一进程(如测试)
+type MemoryStore struct {
+	mu       sync.Mutex
+	values   map[string]memoryValue
+	hashes   map[string]map[string][]byte
+	handlers map[string]map[int]func([]byte)
+	nextID   int
+}
+
+type memoryValue struct {
+	value    []byte
+	expireAt time.Time
+}
+
+var _ Store = &MemoryStore{}
+
+// NewMemoryStore 创建进程内Store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		values:   make(map[string]memoryValue),
+		hashes:   make(map[string]map[string][]byte),
+		handlers: make(map[string]map[int]func([]byte)),
+	}
+}
+
+// get 调用方需持有mu
+func (s *MemoryStore) get(key string) []byte {
+	v, ok := s.values[key]
+	if !ok {
+		return nil
+	}
+	if !v.expireAt.IsZero() && time.Now().After(v.expireAt) {
+		delete(s.values, key)
+		return nil
+	}
+
+	return v.value
+}
+
+// set 调用方需持有mu
+func (s *MemoryStore) set(key string, value []byte, ttl time.Duration) {
+	v := memoryValue{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		v.expireAt = time.Now().Add(ttl)
+	}
+	s.values[key] = v
+}
+
+// Get 实现Store接口
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(key), nil
+}
+
+// Set 实现Store接口
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	s.set(key, value, ttl)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SetNX 实现Store接口
+func (s *MemoryStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.get(key) != nil {
+		return false, nil
+	}
+	s.set(key, value, ttl)
+
+	return true, nil
+}
+
+// HSet 实现Store接口
+func (s *MemoryStore) HSet(key, field string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hashes[key]
+	if !ok {
+		h = make(map[string][]byte)
+		s.hashes[key] = h
+	}
+	h[field] = append([]byte(nil), value...)
+
+	return nil
+}
+
+// HDel 实现Store接口
+func (s *MemoryStore) HDel(key, field string) error {
+	s.mu.Lock()
+	delete(s.hashes[key], field)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// HGetAll 实现Store接口
+func (s *MemoryStore) HGetAll(key string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string][]byte, len(s.hashes[key]))
+	for field, value := range s.hashes[key] {
+		m[field] = value
+	}
+
+	return m, nil
+}
+
+// Publish 实现Store接口, 同步调用所有订阅者
+func (s *MemoryStore) Publish(channel string, msg []byte) error {
+	s.mu.Lock()
+	handlers := make([]func([]byte), 0, len(s.handlers[channel]))
+	for _, h := range s.handlers[channel] {
+		handlers = append(handlers, h)
+	}
+	s.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+
+	return nil
+}
+
+// Subscribe 实现Store接口
+func (s *MemoryStore) Subscribe(channel string, handler func(msg []byte)) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlers[channel] == nil {
+		s.handlers[channel] = make(map[int]func([]byte))
+	}
+	id := s.nextID
+	s.nextID++
+	s.handlers[channel][id] = handler
+
+	return func() {
+		s.mu.Lock()
+		delete(s.handlers[channel], id)
+		s.mu.Unlock()
+	}, nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// goproxy-bench 代理压测工具, 按比例混合发送HTTP请求和CONNECT隧道请求, 输出吞吐量和延迟分位数
+//
+// 未指定-proxy时在进程内启动代理和源站:
+//
+//	goproxy-bench -c 50 -d 10s -mix 0.3
+//	goproxy-bench -proxy 127.0.0.1:8080 -target http://127.0.0.1:9000/ -connect 127.0.0.1:9443
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ouqiang/goproxy"
+)
+
+var (
+	proxyAddr   = flag.String("proxy", "", "代理地址host:port, 为空时启动进程内代理")
+	targetURL   = flag.String("target", "", "HTTP请求地址, 为空时启动进程内源站")
+	connectAddr = flag.String("connect", "", "CONNECT隧道目标host:port(TLS), 为空时启动进程内源站")
+	mix         = flag.Float64("mix", 0, "CONNECT请求所占比例, 0-1")
+	concurrency = flag.Int("c", 10, "并发数")
+	total       = flag.Int("n", 0, "总请求数, 为0时以-d为准")
+	duration    = flag.Duration("d", 10*time.Second, "压测时长")
+	bodySize    = flag.Int("body", 1024, "进程内源站响应body大小")
+	decrypt     = flag.Bool("mitm", false, "进程内代理开启HTTPS解密")
+)
+
+type result struct {
+	connect bool
+	latency time.Duration
+	bytes   int64
+	err     error
+}
+
+func main() {
+	flag.Parse()
+	body := bytes.Repeat([]byte("x"), *bodySize)
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	if *targetURL == "" {
+		srv := httptest.NewServer(origin)
+		defer srv.Close()
+		*targetURL = srv.URL + "/"
+	}
+	if *connectAddr == "" && *mix > 0 {
+		srv := httptest.NewTLSServer(origin)
+		defer srv.Close()
+		*connectAddr = srv.Listener.Addr().String()
+	}
+	if *proxyAddr == "" {
+		var opts []goproxy.Option
+		opts = append(opts, goproxy.WithDelegate(&benchDelegate{}))
+		if *decrypt {
+			opts = append(opts, goproxy.WithDecryptHTTPS(nil))
+		}
+		srv := httptest.NewServer(goproxy.New(opts...))
+		defer srv.Close()
+		*proxyAddr = srv.Listener.Addr().String()
+	}
+
+	proxyURL := &url.URL{Scheme: "http", Host: *proxyAddr}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyURL(proxyURL),
+			MaxIdleConnsPerHost: *concurrency,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: 30 * time.Second,
+	}
+
+	results := make(chan result, *concurrency*4)
+	var issued int64
+	deadline := time.Now().Add(*duration)
+	next := func() bool {
+		if *total > 0 {
+			return atomic.AddInt64(&issued, 1) <= int64(*total)
+		}
+		return time.Now().Before(deadline)
+	}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for next() {
+				if rnd.Float64() < *mix {
+					results <- doConnect(*proxyAddr, *connectAddr)
+				} else {
+					results <- doHTTP(client, *targetURL)
+				}
+			}
+		}(int64(i))
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var httpLatencies, connectLatencies []time.Duration
+	var bytesTotal int64
+	errs := make(map[string]int)
+	for r := range results {
+		if r.err != nil {
+			errs[r.err.Error()]++
+			continue
+		}
+		bytesTotal += r.bytes
+		if r.connect {
+			connectLatencies = append(connectLatencies, r.latency)
+		} else {
+			httpLatencies = append(httpLatencies, r.latency)
+		}
+	}
+	elapsed := time.Since(start)
+	ok := len(httpLatencies) + len(connectLatencies)
+	fmt.Printf("耗时: %s, 成功: %d, 失败: %d\n", elapsed.Round(time.Millisecond), ok, sumErrors(errs))
+	fmt.Printf("吞吐量: %.1f req/s, %.2f MB/s\n", float64(ok)/elapsed.Seconds(), float64(bytesTotal)/elapsed.Seconds()/1024/1024)
+	report("HTTP", httpLatencies)
+	report("CONNECT", connectLatencies)
+	for msg, n := range errs {
+		fmt.Printf("错误 %d次: %s\n", n, msg)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func doHTTP(client *http.Client, target string) result {
+	start := time.Now()
+	resp, err := client.Get(target)
+	if err != nil {
+		return result{err: err}
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("状态码: %d", resp.StatusCode)
+	}
+
+	return result{latency: time.Since(start), bytes: n, err: err}
+}
+
+// doConnect 建立隧道, TLS握手后发送一个请求
+func doConnect(proxy, target string) result {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", proxy, 10*time.Second)
+	if err != nil {
+		return result{connect: true, err: err}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return result{connect: true, err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return result{connect: true, err: fmt.Errorf("CONNECT状态码: %d", resp.StatusCode)}
+	}
+	tlsConn := tls.Client(&bufferedConn{Conn: conn, r: br}, &tls.Config{InsecureSkipVerify: true})
+	req, _ := http.NewRequest(http.MethodGet, "https://"+target+"/", nil)
+	req.Close = true
+	if err := req.Write(tlsConn); err != nil {
+		return result{connect: true, err: err}
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		return result{connect: true, err: err}
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return result{connect: true, latency: time.Since(start), bytes: n, err: err}
+}
+
+func report(name string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p := func(q float64) time.Duration {
+		return latencies[int(q*float64(len(latencies)-1))]
+	}
+	fmt.Printf("%-8s 请求数: %-8d p50: %-10s p90: %-10s p99: %-10s max: %s\n",
+		name, len(latencies), p(0.5), p(0.9), p(0.99), latencies[len(latencies)-1])
+}
+
+func sumErrors(errs map[string]int) int {
+	n := 0
+	for _, v := range errs {
+		n += v
+	}
+
+	return n
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// benchDelegate 不使用环境变量中的上级代理, 不输出错误日志
+type benchDelegate struct {
+	goproxy.DefaultDelegate
+}
+
+func (d *benchDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+func (d *benchDelegate) ErrorLog(err error) {}
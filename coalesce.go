@@ -0,0 +1,180 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// 合并请求时缓存的响应body默认上限
+const defaultCoalesceMaxBody = 10 << 20
+
+// 影响响应内容的请求头, 不同时不合并
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Range"}
+
+// WithRequestCoalescing 合并同时进行的相同GET请求, 只请求一次目标服务器, 响应复制给所有等待的请求
+// 响应body超过maxBodySize(为0时10MB)或不可共享(Set-Cookie、Cache-Control: private/no-store)时, 等待的请求各自重新请求
+func WithRequestCoalescing(maxBodySize int64) Option {
+	return func(opt *options) {
+		if maxBodySize <= 0 {
+			maxBodySize = defaultCoalesceMaxBody
+		}
+		opt.coalesceMaxBody = maxBodySize
+	}
+}
+
+type coalescer struct {
+	maxBody int64
+
+	mu    sync.Mutex
+	calls map[string]*coalesceCall
+}
+
+type coalesceCall struct {
+	done   chan struct{}
+	resp   *http.Response
+	body   []byte
+	err    error
+	shared bool
+	// err由发起请求的客户端取消导致
+	canceled bool
+}
+
+func newCoalescer(maxBody int64) *coalescer {
+	return &coalescer{
+		maxBody: maxBody,
+		calls:   make(map[string]*coalesceCall),
+	}
+}
+
+// coalesceKey 可合并时返回请求的key
+func coalesceKey(req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet || (req.Body != nil && req.Body != http.NoBody) || req.Header.Get("Upgrade") != "" {
+		return "", false
+	}
+	if headerContainsToken(req.Header, "Cache-Control", "no-cache") || headerContainsToken(req.Header, "Pragma", "no-cache") {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(req.URL.String())
+	for _, h := range coalesceKeyHeaders {
+		b.WriteString("\n")
+		b.WriteString(strings.Join(req.Header[h], ","))
+	}
+
+	return b.String(), true
+}
+
+// shareable 响应是否可以给其他请求使用
+func shareable(resp *http.Response) bool {
+	if len(resp.Header["Set-Cookie"]) > 0 {
+		return false
+	}
+	for _, token := range []string{"private", "no-store"} {
+		if headerContainsToken(resp.Header, "Cache-Control", token) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// roundTrip 相同的请求正在进行时等待其结果, 否则发送请求
+func (c *coalescer) roundTrip(req *http.Request, fetch func() (*http.Response, error)) (*http.Response, error) {
+	key, ok := coalesceKey(req)
+	if !ok {
+		return fetch()
+	}
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if call.err != nil && !call.canceled {
+			return nil, call.err
+		}
+		if !call.shared {
+			return fetch()
+		}
+		return call.response(req), nil
+	}
+	call := &coalesceCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	resp, err := fetch()
+	call.err = err
+	// 发起请求的客户端取消时, 等待的请求各自重新请求, 不使用取消导致的错误
+	call.canceled = err != nil && req.Context().Err() != nil
+	if err == nil {
+		resp = c.buffer(call, resp)
+	}
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return resp, err
+}
+
+// buffer 读取可共享的响应body, 超过上限时不共享, 已读取的部分与剩余部分拼接后返回给发起请求的客户端
+func (c *coalescer) buffer(call *coalesceCall, resp *http.Response) *http.Response {
+	if !shareable(resp) || resp.ContentLength > c.maxBody {
+		return resp
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxBody+1))
+	if err != nil || int64(len(body)) > c.maxBody {
+		var rest io.Reader = resp.Body
+		if err != nil {
+			rest = errReader{err}
+		}
+		resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), rest), Closer: resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+	call.resp = resp
+	call.body = body
+	call.shared = true
+
+	return call.response(resp.Request)
+}
+
+// response 复制响应, 每个请求使用独立的header和body
+func (call *coalesceCall) response(req *http.Request) *http.Response {
+	resp := new(http.Response)
+	*resp = *call.resp
+	resp.Header = CloneHeader(call.resp.Header)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(call.body))
+	resp.ContentLength = int64(len(call.body))
+	resp.Request = req
+
+	return resp
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
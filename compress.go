@@ -0,0 +1,199 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const defaultCompressionMinSize = 1024
+
+// 默认压缩的Content-Type
+var defaultCompressionTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// CompressionConfig 响应压缩设置
+type CompressionConfig struct {
+	// MinSize 小于该大小的响应不压缩, Content-Length未知时总是压缩, 默认1024
+	MinSize int64
+	// ContentTypes 压缩的Content-Type, 以/结尾时按前缀匹配, 默认为文本、JSON、JavaScript、XML、SVG等
+	ContentTypes []string
+	// GzipLevel gzip压缩级别, 默认gzip.DefaultCompression
+	GzipLevel int
+	// BrotliQuality brotli压缩质量, 默认4
+	BrotliQuality int
+	// DisableBrotli 只使用gzip
+	DisableBrotli bool
+}
+
+// WithResponseCompression 目标服务器返回未压缩的响应而客户端支持gzip或br时, 由代理压缩后返回客户端
+// 不压缩HEAD、206、带Cache-Control: no-transform的响应
+func WithResponseCompression(config CompressionConfig) Option {
+	return func(opt *options) {
+		opt.compression = &config
+	}
+}
+
+type compressor struct {
+	config CompressionConfig
+}
+
+func newCompressor(config CompressionConfig) *compressor {
+	if config.MinSize <= 0 {
+		config.MinSize = defaultCompressionMinSize
+	}
+	if len(config.ContentTypes) == 0 {
+		config.ContentTypes = defaultCompressionTypes
+	}
+	if config.GzipLevel == 0 {
+		config.GzipLevel = gzip.DefaultCompression
+	}
+	if config.BrotliQuality == 0 {
+		config.BrotliQuality = 4
+	}
+
+	return &compressor{config: config}
+}
+
+// compress 按客户端的Accept-Encoding压缩响应
+func (c *compressor) compress(req *http.Request, resp *http.Response) {
+	if !c.compressible(req, resp) {
+		return
+	}
+	encoding := c.negotiate(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return
+	}
+	resp.Body = compressBody(resp.Body, func(w io.Writer) io.WriteCloser {
+		if encoding == "br" {
+			return brotli.NewWriterLevel(w, c.config.BrotliQuality)
+		}
+		gw, _ := gzip.NewWriterLevel(w, c.config.GzipLevel)
+		return gw
+	})
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if !strings.Contains(strings.ToLower(strings.Join(resp.Header.Values("Vary"), ",")), "accept-encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+	weakenETag(resp.Header)
+}
+
+// compressBody 在goroutine中压缩body, 关闭返回的body时关闭原body
+func compressBody(body io.ReadCloser, newWriter func(io.Writer) io.WriteCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := newWriter(pw)
+		_, err := io.Copy(w, body)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return &readCloser{Reader: pr, Closer: closerFunc(func() error {
+		pr.Close()
+		return body.Close()
+	})}
+}
+
+// weakenETag 压缩后内容不同, 强校验ETag改为弱校验
+func weakenETag(h http.Header) {
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+}
+
+func (c *compressor) compressible(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent, http.StatusSwitchingProtocols:
+		return false
+	}
+	if len(contentEncodings(resp.Header)) > 0 || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < c.config.MinSize {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "text/event-stream" {
+		// 压缩会缓冲事件流
+		return false
+	}
+	for _, t := range c.config.ContentTypes {
+		if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiate 选择客户端支持的编码, q值相同时优先br
+func (c *compressor) negotiate(acceptEncoding string) string {
+	var best string
+	bestQ := 0.0
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		switch name {
+		case "br":
+			if c.config.DisableBrotli {
+				continue
+			}
+		case "gzip":
+		default:
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == "br") {
+			best, bestQ = name, q
+		}
+	}
+
+	return best
+}
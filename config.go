@@ -0,0 +1,383 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 配置文件默认检查间隔
+const defaultConfigWatchInterval = 2 * time.Second
+
+// Config 可在运行时替换的配置, 字段为nil时保留当前配置
+// 替换后新的请求和隧道使用新配置, 已建立的连接不受影响
+type Config struct {
+	// ACL 访问控制, 没有规则的ACLConfig相当于关闭
+	ACL *ACLConfig
+	// UpstreamPool 上级代理池, Upstreams为空时关闭, 恢复调用Delegate.ParentProxy
+	UpstreamPool *UpstreamPoolConfig
+	// HostRewriteRules Host重写规则, 空切片清除所有规则
+	HostRewriteRules []HostRewriteRule
+	// URLRewriteRules URL重写规则, 空切片清除所有规则
+	URLRewriteRules []URLRewriteRule
+	// Routes 路由规则, 已有WithRoutes的路由表时替换其中的规则
+	Routes []RouteRule
+	// RateLimit 进程内限流, Rate不大于0时关闭
+	RateLimit *RateLimitConfig
+}
+
+// RateLimitConfig 进程内令牌桶限流设置, 见NewMemoryRateLimiter
+type RateLimitConfig struct {
+	Rate  float64
+	Burst int
+}
+
+// runtimeConfig 当前使用的配置快照, 替换时整体替换, 不修改已有的快照
+type runtimeConfig struct {
+	acl              *acl
+	upstreams        *upstreamPool
+	hostRewriteRules []HostRewriteRule
+	urlRewriteRules  []URLRewriteRule
+	routes           *RouteTable
+	rateLimiter      RateLimiter
+}
+
+// runtime 返回当前的配置快照
+func (p *Proxy) runtime() *runtimeConfig {
+	return p.config.Load()
+}
+
+// ApplyConfig 原子替换配置, 配置无效时返回错误, 不修改当前配置
+// 替换上级代理池时停止旧的健康检查, 正在进行的请求和隧道继续使用旧的上级代理
+func (p *Proxy) ApplyConfig(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	old := p.runtime()
+	rc := *old
+	if cfg.ACL != nil {
+		rc.acl = newACL(*cfg.ACL)
+	}
+	if cfg.UpstreamPool != nil {
+		rc.upstreams = nil
+		if len(cfg.UpstreamPool.Upstreams) > 0 {
+			rc.upstreams = newUpstreamPool(*cfg.UpstreamPool, p.checkUpstream, p.delegate.ErrorLog)
+		}
+	}
+	if cfg.HostRewriteRules != nil {
+		rc.hostRewriteRules = append([]HostRewriteRule(nil), cfg.HostRewriteRules...)
+	}
+	if cfg.URLRewriteRules != nil {
+		rc.urlRewriteRules = append([]URLRewriteRule(nil), cfg.URLRewriteRules...)
+	}
+	if cfg.Routes != nil {
+		if rc.routes != nil {
+			rc.routes.SetRules(cfg.Routes)
+		} else {
+			rc.routes = NewRouteTable(cfg.Routes...)
+		}
+	}
+	if cfg.RateLimit != nil {
+		rc.rateLimiter = nil
+		if cfg.RateLimit.Rate > 0 {
+			rc.rateLimiter = NewMemoryRateLimiter(cfg.RateLimit.Rate, cfg.RateLimit.Burst)
+		}
+	}
+	p.config.Store(&rc)
+	if old.upstreams != nil && old.upstreams != rc.upstreams {
+		old.upstreams.stop()
+	}
+
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.UpstreamPool != nil {
+		for i, u := range cfg.UpstreamPool.Upstreams {
+			if u.URL == nil {
+				return fmt.Errorf("第%d个上级代理地址为空", i+1)
+			}
+		}
+	}
+	for i, rule := range cfg.URLRewriteRules {
+		if rule.Pattern == nil {
+			return fmt.Errorf("第%d条URL重写规则缺少Pattern", i+1)
+		}
+	}
+	for i, rule := range cfg.Routes {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("第%d条路由规则错误: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// ParseConfig 解析JSON格式的配置, 时间使用"10s"格式, 不允许未知字段
+//
+//	{
+//	  "acl": {"rules": [{"hosts": ["10.0.0.0/8"], "ports": [22], "action": "deny", "message": "禁止访问"}, {"geo": {"countries": ["KP"]}, "action": "deny"}], "default_deny": false, "status_code": 403},
+//	  "upstream_pool": {"upstreams": [{"url": "http://10.0.0.1:8080", "weight": 2}], "strategy": "weighted", "health_check_interval": "10s"},
+//	  "host_rewrite_rules": [{"match": "api.example.com", "host": "127.0.0.1:8080", "rewrite_url": true}],
+//	  "url_rewrite_rules": [{"host": "example.com", "pattern": "^/old/(.*)", "replacement": "/new/$1"}],
+//	  "routes": [{"host": "api.internal", "to": "staging.internal"}],
+//	  "rate_limit": {"rate": 10, "burst": 20}
+//	}
+func ParseConfig(data []byte) (Config, error) {
+	var f configFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return Config{}, fmt.Errorf("解析配置错误: %s", err)
+	}
+	cfg, err := f.config()
+	if err != nil {
+		return Config{}, err
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// LoadConfigFile 读取并应用配置文件
+func (p *Proxy) LoadConfigFile(path string) error {
+	return p.loadConfigFile(path, nil)
+}
+
+func (p *Proxy) loadConfigFile(path string, convert func([]byte) ([]byte, error)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if convert != nil {
+		if data, err = convert(data); err != nil {
+			return fmt.Errorf("转换配置文件%s错误: %s", path, err)
+		}
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	return p.ApplyConfig(cfg)
+}
+
+// ConfigWatchConfig 配置文件监视设置
+type ConfigWatchConfig struct {
+	// Interval 检查文件是否修改的间隔, 默认2秒
+	Interval time.Duration
+	// Convert 解析前将文件内容转换为JSON, 如YAML文件可使用sigs.k8s.io/yaml的YAMLToJSON
+	Convert func([]byte) ([]byte, error)
+}
+
+// WatchConfig 加载配置文件并定时检查, 文件修改后重新加载, 返回的stop停止监视
+// 首次加载失败时返回错误, 之后加载失败时通过Delegate.ErrorLog记录并保留当前配置
+func (p *Proxy) WatchConfig(path string, config ConfigWatchConfig) (stop func(), err error) {
+	if config.Interval <= 0 {
+		config.Interval = defaultConfigWatchInterval
+	}
+	last, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.loadConfigFile(path, config.Convert); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				p.delegate.ErrorLog(fmt.Errorf("读取配置文件错误: %s", err))
+				continue
+			}
+			if bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+			if err := p.loadConfigFile(path, config.Convert); err != nil {
+				p.delegate.ErrorLog(fmt.Errorf("重新加载配置失败, 保留当前配置: %s", err))
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}, nil
+}
+
+// 配置文件格式
+type configFile struct {
+	ACL              *aclFile          `json:"acl"`
+	UpstreamPool     *upstreamPoolFile `json:"upstream_pool"`
+	HostRewriteRules []hostRewriteFile `json:"host_rewrite_rules"`
+	URLRewriteRules  []urlRewriteFile  `json:"url_rewrite_rules"`
+	Routes           []RouteRule       `json:"routes"`
+	RateLimit        *rateLimitFile    `json:"rate_limit"`
+}
+
+type aclFile struct {
+	Rules       []aclRuleFile `json:"rules"`
+	DefaultDeny bool          `json:"default_deny"`
+	StatusCode  int           `json:"status_code"`
+}
+
+type aclRuleFile struct {
+	Hosts   []string `json:"hosts"`
+	Ports   []int    `json:"ports"`
+	Geo     GeoMatch `json:"geo"`
+	Action  string   `json:"action"`
+	Message string   `json:"message"`
+}
+
+type upstreamPoolFile struct {
+	Upstreams           []upstreamFile `json:"upstreams"`
+	Strategy            string         `json:"strategy"`
+	HealthCheckInterval configDuration `json:"health_check_interval"`
+	HealthCheckTimeout  configDuration `json:"health_check_timeout"`
+	FailureThreshold    int            `json:"failure_threshold"`
+	OpenTimeout         configDuration `json:"open_timeout"`
+}
+
+type upstreamFile struct {
+	URL    string   `json:"url"`
+	Weight int      `json:"weight"`
+	Geo    GeoMatch `json:"geo"`
+}
+
+type hostRewriteFile struct {
+	Match      string `json:"match"`
+	Host       string `json:"host"`
+	RewriteURL bool   `json:"rewrite_url"`
+}
+
+type urlRewriteFile struct {
+	Host        string `json:"host"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	DryRun      bool   `json:"dry_run"`
+}
+
+type rateLimitFile struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// configDuration 字符串格式的时间, 如"10s"
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("时间应为字符串, 如\"10s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(v)
+
+	return nil
+}
+
+var upstreamStrategies = map[string]UpstreamStrategy{
+	"":            UpstreamRoundRobin,
+	"round_robin": UpstreamRoundRobin,
+	"weighted":    UpstreamWeighted,
+	"least_conn":  UpstreamLeastConn,
+}
+
+func (f *configFile) config() (Config, error) {
+	var cfg Config
+	if f.ACL != nil {
+		cfg.ACL = &ACLConfig{DefaultDeny: f.ACL.DefaultDeny, StatusCode: f.ACL.StatusCode}
+		for i, r := range f.ACL.Rules {
+			rule := ACLRule{Hosts: r.Hosts, Ports: r.Ports, Geo: r.Geo, Message: r.Message}
+			switch strings.ToLower(r.Action) {
+			case "", "deny":
+				rule.Action = ACLDeny
+			case "allow":
+				rule.Action = ACLAllow
+			default:
+				return Config{}, fmt.Errorf("第%d条访问控制规则的action无效: %s", i+1, r.Action)
+			}
+			cfg.ACL.Rules = append(cfg.ACL.Rules, rule)
+		}
+	}
+	if f.UpstreamPool != nil {
+		strategy, ok := upstreamStrategies[strings.ToLower(f.UpstreamPool.Strategy)]
+		if !ok {
+			return Config{}, fmt.Errorf("无效的上级代理池策略: %s", f.UpstreamPool.Strategy)
+		}
+		cfg.UpstreamPool = &UpstreamPoolConfig{
+			Strategy:            strategy,
+			HealthCheckInterval: time.Duration(f.UpstreamPool.HealthCheckInterval),
+			HealthCheckTimeout:  time.Duration(f.UpstreamPool.HealthCheckTimeout),
+			FailureThreshold:    f.UpstreamPool.FailureThreshold,
+			OpenTimeout:         time.Duration(f.UpstreamPool.OpenTimeout),
+		}
+		for _, up := range f.UpstreamPool.Upstreams {
+			u, err := url.Parse(up.URL)
+			if err != nil || u.Host == "" {
+				return Config{}, fmt.Errorf("无效的上级代理地址: %s", up.URL)
+			}
+			cfg.UpstreamPool.Upstreams = append(cfg.UpstreamPool.Upstreams, Upstream{URL: u, Weight: up.Weight, Geo: up.Geo})
+		}
+	}
+	if f.HostRewriteRules != nil {
+		cfg.HostRewriteRules = []HostRewriteRule{}
+		for _, r := range f.HostRewriteRules {
+			cfg.HostRewriteRules = append(cfg.HostRewriteRules, HostRewriteRule{Match: r.Match, Host: r.Host, RewriteURL: r.RewriteURL})
+		}
+	}
+	if f.URLRewriteRules != nil {
+		cfg.URLRewriteRules = []URLRewriteRule{}
+		for i, r := range f.URLRewriteRules {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return Config{}, fmt.Errorf("第%d条URL重写规则的pattern无效: %s", i+1, err)
+			}
+			cfg.URLRewriteRules = append(cfg.URLRewriteRules, URLRewriteRule{Host: r.Host, Pattern: re, Replacement: r.Replacement, DryRun: r.DryRun})
+		}
+	}
+	cfg.Routes = f.Routes
+	if f.RateLimit != nil {
+		cfg.RateLimit = &RateLimitConfig{Rate: f.RateLimit.Rate, Burst: f.RateLimit.Burst}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// watchClose 在后台读取客户端连接, 客户端关闭连接或读取出错时调用cancel
+// 返回的stop结束读取并返回连接, 已读取的数据会重新发送
+func watchClose(conn net.Conn, cancel context.CancelFunc) (stop func() net.Conn) {
+	type result struct {
+		n   int
+		err error
+	}
+	var b [1]byte
+	done := make(chan result, 1)
+	go func() {
+		n, err := conn.Read(b[:])
+		if n == 0 && err != nil && !isTimeout(err) {
+			cancel()
+		}
+		done <- result{n, err}
+	}()
+
+	return func() net.Conn {
+		conn.SetReadDeadline(time.Unix(1, 0))
+		r := <-done
+		conn.SetReadDeadline(time.Time{})
+		if r.n == 0 {
+			return conn
+		}
+		return &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(b[:r.n]), conn)}
+	}
+}
+
+// idleTimeoutConn 每次读写成功后延长deadline, 连接空闲超过timeout才会超时
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func newIdleTimeoutConn(conn net.Conn, timeout time.Duration) net.Conn {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	return &idleTimeoutConn{
+		Conn:    conn,
+		timeout: timeout,
+	}
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	return n, err
+}
+
+// countConn 累加读写的字节数
+type countConn struct {
+	net.Conn
+	read    []*int64
+	written []*int64
+}
+
+func newCountConn(c net.Conn, read, written []*int64) net.Conn {
+	return &countConn{Conn: c, read: read, written: written}
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	addCounters(c.read, n)
+
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	addCounters(c.written, n)
+
+	return n, err
+}
+
+// countReader 累加读取的字节数
+type countReader struct {
+	rc io.ReadCloser
+	n  []*int64
+}
+
+// newCountBody 统计body字节数, 没有body时不包装, 避免transport把请求当作长度未知
+func newCountBody(rc io.ReadCloser, n ...*int64) io.ReadCloser {
+	if rc == nil || rc == http.NoBody {
+		return rc
+	}
+
+	return &countReader{rc: rc, n: n}
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.rc.Read(b)
+	addCounters(r.n, n)
+
+	return n, err
+}
+
+func (r *countReader) Close() error {
+	return r.rc.Close()
+}
+
+func addCounters(counters []*int64, n int) {
+	if n <= 0 {
+		return
+	}
+	for _, c := range counters {
+		atomic.AddInt64(c, int64(n))
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen 按内容识别类型读取的字节数, 同http.DetectContentType
+const sniffLen = 512
+
+// ContentAction 响应内容规则的动作
+type ContentAction int
+
+const (
+	// ContentBlock 返回拦截页面
+	ContentBlock ContentAction = iota
+	// ContentStrip 保留状态码和header, 删除body
+	ContentStrip
+	// ContentAllow 放行, 用于在其他规则之前设置例外
+	ContentAllow
+)
+
+// ContentRule 按响应的Content-Type或内容识别的类型过滤响应
+type ContentRule struct {
+	// Hosts 适用的域名, 规则同MatchHost, 为空时适用于所有请求
+	Hosts []string
+	// ContentTypes 匹配的类型, 以/结尾时按前缀匹配, 如"video/"、"application/x-msdownload"
+	ContentTypes []string
+	// Sniff 响应声明的Content-Type不匹配时按body开头的内容识别类型再匹配, 防止伪造Content-Type
+	// 在http.DetectContentType的基础上识别Windows、Linux、macOS可执行文件
+	Sniff bool
+	// Action 匹配时的动作, 默认ContentBlock
+	Action ContentAction
+	// Message 拦截页面的说明
+	Message string
+}
+
+// ContentFilterConfig 响应内容过滤配置, 规则按顺序匹配, 使用第一个匹配的规则
+type ContentFilterConfig struct {
+	Rules []ContentRule
+	// StatusCode 拦截时的状态码, 默认403
+	StatusCode int
+}
+
+// WithContentFilter 按Content-Type或内容识别的类型拦截HTTP响应(包括HTTPS解密后的响应), 如可执行文件、按流量计费线路上的视频
+// 在解压之后、BeforeResponse之前检查, 识别内容只读取body开头的512字节, 不缓存完整body
+// 拦截时调用Delegate.ContentBlocked
+func WithContentFilter(config ContentFilterConfig) Option {
+	return func(opt *options) {
+		opt.contentFilter = &config
+	}
+}
+
+type contentFilter struct {
+	rules      []ContentRule
+	statusCode int
+}
+
+func newContentFilter(config ContentFilterConfig) *contentFilter {
+	if config.StatusCode == 0 {
+		config.StatusCode = http.StatusForbidden
+	}
+
+	return &contentFilter{rules: config.Rules, statusCode: config.StatusCode}
+}
+
+// filterContent 按规则检查响应, 拦截时返回拦截页面, 删除body时修改resp
+func (p *Proxy) filterContent(ctx *Context, resp *http.Response) *http.Response {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp
+	}
+	declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	sniffed := ""
+	for i := range p.contentFilter.rules {
+		rule := &p.contentFilter.rules[i]
+		if !rule.appliesTo(ctx.Req.URL.Host) {
+			continue
+		}
+		contentType := declared
+		matched := rule.matchType(declared)
+		if !matched && rule.Sniff {
+			if sniffed == "" {
+				sniffed = sniffContentType(resp)
+			}
+			contentType = sniffed
+			matched = rule.matchType(sniffed)
+		}
+		if !matched {
+			continue
+		}
+		switch rule.Action {
+		case ContentAllow:
+			return resp
+		case ContentStrip:
+			p.callContentBlocked(ctx, rule, contentType, nil)
+			stripBody(resp)
+			return resp
+		}
+		page := &BlockPage{StatusCode: p.contentFilter.statusCode, Message: rule.Message}
+		p.callContentBlocked(ctx, rule, contentType, page)
+		resp.Body.Close()
+		return ctx.BlockPageResponse(page)
+	}
+
+	return resp
+}
+
+func (r *ContentRule) appliesTo(host string) bool {
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range r.Hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *ContentRule) matchType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	for _, t := range r.ContentTypes {
+		t = strings.ToLower(t)
+		if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sniffContentType 读取body开头识别类型, 读取的内容仍由resp.Body返回
+func sniffContentType(resp *http.Response) string {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return ""
+	}
+	br := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	resp.Body = &readCloser{Reader: br, Closer: resp.Body}
+	if len(head) == 0 {
+		return ""
+	}
+	if t := executableType(head); t != "" {
+		return t
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+
+	return contentType
+}
+
+// executableType 识别PE、ELF和Mach-O可执行文件
+func executableType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return "application/x-mach-binary"
+	}
+
+	return ""
+}
+
+// stripBody 删除响应body和描述body的header
+func stripBody(resp *http.Response) {
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Range")
+	resp.Header.Set("Content-Length", "0")
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// expectsContinue 请求带有Expect: 100-continue并且有body
+func expectsContinue(req *http.Request) bool {
+	return req.ContentLength != 0 && req.ProtoAtLeast(1, 1) &&
+		strings.EqualFold(strings.TrimSpace(req.Header.Get("Expect")), "100-continue")
+}
+
+// interimWriter 将目标服务器的1xx响应(如103 Early Hints)转发给客户端
+// 100 Continue由读取请求body时发送: http.Server自动发送, HTTPS解密的HTTP/1.1请求由expectContinueBody发送,
+// 目标服务器返回100、ExpectContinueTimeout超时或代理需要读取body时客户端才开始发送body
+type interimWriter func(code int, header http.Header)
+
+// responseInterim 通过http.ResponseWriter发送1xx响应, 发送后恢复已设置的header
+func responseInterim(rw http.ResponseWriter) interimWriter {
+	return func(code int, header http.Header) {
+		h := rw.Header()
+		saved := h.Clone()
+		clear(h)
+		CopyHeader(h, header)
+		rw.WriteHeader(code)
+		clear(h)
+		CopyHeader(h, saved)
+	}
+}
+
+// connInterim 在HTTPS解密的HTTP/1.1连接上发送1xx响应
+func connInterim(w io.Writer) interimWriter {
+	return func(code int, header http.Header) {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+		header.Write(&b)
+		b.WriteString("\r\n")
+		w.Write(b.Bytes())
+	}
+}
+
+// relayInterim 过滤后转发1xx响应, HTTP/1.0客户端不支持1xx响应
+func (c *Context) relayInterim(code int, header http.Header) {
+	if c.interim == nil || code == http.StatusContinue || !c.Req.ProtoAtLeast(1, 1) {
+		return
+	}
+	header = CloneHeader(header)
+	removeConnectionHeaders(header)
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	c.interim(code, header)
+}
+
+// expectContinueBody 首次读取时向客户端发送100 Continue, 与http.Server相同
+type expectContinueBody struct {
+	io.ReadCloser
+	w io.Writer
+
+	mu sync.Mutex
+	// sent 已发送100 Continue, done 已开始发送最终响应, 不再发送100 Continue
+	sent bool
+	done bool
+	err  error
+}
+
+func (b *expectContinueBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if !b.sent && !b.done {
+		b.sent = true
+		_, b.err = io.WriteString(b.w, "HTTP/1.1 100 Continue\r\n\r\n")
+	}
+	err := b.err
+	b.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	return b.ReadCloser.Read(p)
+}
+
+// finish 开始发送最终响应, 返回是否发送过100 Continue
+// 没有发送时客户端可能不会发送body, 连接不能继续使用
+func (b *expectContinueBody) finish() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = true
+
+	return b.sent
+}
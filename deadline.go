@@ -0,0 +1,150 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDeadlineExceeded 超过端到端截止时间, 返回504
+var ErrDeadlineExceeded = errors.New("超过请求截止时间")
+
+// 截止时间的来源, 记录在Context.DeadlineSource
+const (
+	// DeadlineSourceDefault DeadlineConfig.Timeout
+	DeadlineSourceDefault = "default"
+	// DeadlineSourceRule 匹配的DeadlineRule
+	DeadlineSourceRule = "rule"
+	// DeadlineSourceHeader 可信客户端的请求头
+	DeadlineSourceHeader = "header"
+)
+
+// DeadlineRule 按目标域名设置截止时间
+type DeadlineRule struct {
+	// Hosts 目标域名, 规则同MatchHost
+	Hosts []string
+	// Timeout 从收到请求开始计算的时间
+	Timeout time.Duration
+}
+
+// DeadlineConfig 端到端截止时间设置
+// 从收到请求开始计算, 包括排队、扩展点、重试、重定向和读取响应body, 超过时取消上游请求并返回504
+// 隧道为拨号和转发的总时间, 超过时关闭连接; HTTPS解密时作用于每个解密后的请求
+type DeadlineConfig struct {
+	// Timeout 默认截止时间, 为0时只使用Rules和Header
+	Timeout time.Duration
+	// Rules 按目标域名的截止时间, 使用第一个匹配的规则, 优先于Timeout
+	Rules []DeadlineRule
+	// Header 客户端指定截止时间的请求头, 如X-Proxy-Timeout, 值为秒数或time.ParseDuration格式, 优先于Rules
+	// 只接受TrustedClients的请求头, 转发前总是删除
+	Header string
+	// TrustedClients 可以通过Header指定截止时间的客户端, IP或CIDR
+	TrustedClients []string
+	// MaxTimeout Header指定的截止时间上限, 为0时不限制
+	MaxTimeout time.Duration
+}
+
+// WithRequestDeadline 按DeadlineConfig为请求和隧道设置端到端截止时间
+// 也可在Connect、Auth中直接设置Context.Deadline
+func WithRequestDeadline(config DeadlineConfig) Option {
+	return func(opt *options) {
+		opt.deadline = &config
+	}
+}
+
+type deadlines struct {
+	config  DeadlineConfig
+	trusted []*net.IPNet
+}
+
+func newDeadlines(config DeadlineConfig) *deadlines {
+	return &deadlines{config: config, trusted: parseIPNets(config.TrustedClients)}
+}
+
+// apply 设置Context.Deadline, 已设置时不修改
+func (d *deadlines) apply(ctx *Context) {
+	if d == nil {
+		return
+	}
+	var header string
+	if d.config.Header != "" {
+		header = ctx.Req.Header.Get(d.config.Header)
+		ctx.Req.Header.Del(d.config.Header)
+	}
+	if !ctx.Deadline.IsZero() {
+		return
+	}
+	timeout, source := d.config.Timeout, DeadlineSourceDefault
+	for _, rule := range d.config.Rules {
+		if matchAnyHost(rule.Hosts, ctx.Req.URL.Host) {
+			timeout, source = rule.Timeout, DeadlineSourceRule
+			break
+		}
+	}
+	if header != "" && containsIP(d.trusted, net.ParseIP(ctx.ClientIP)) {
+		if t := parseDeadlineTimeout(header); t > 0 {
+			if d.config.MaxTimeout > 0 && t > d.config.MaxTimeout {
+				t = d.config.MaxTimeout
+			}
+			timeout, source = t, DeadlineSourceHeader
+		}
+	}
+	if timeout <= 0 {
+		return
+	}
+	ctx.Deadline = ctx.Start.Add(timeout)
+	ctx.DeadlineSource = source
+}
+
+// parseDeadlineTimeout 解析秒数(可以有小数)或time.ParseDuration格式, 无效时返回0
+func parseDeadlineTimeout(s string) time.Duration {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second))
+	}
+	t, _ := time.ParseDuration(s)
+
+	return t
+}
+
+// deadlineContext 设置了截止时间时返回带截止时间的context
+func (c *Context) deadlineContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if c.Deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+
+	return context.WithDeadline(parent, c.Deadline)
+}
+
+// deadlinePassed 是否已超过截止时间
+func (c *Context) deadlinePassed() bool {
+	return !c.Deadline.IsZero() && !time.Now().Before(c.Deadline)
+}
+
+// deadlineExceeded 记录超过截止时间
+func (p *Proxy) deadlineExceeded(ctx *Context) error {
+	if !ctx.DeadlineExceeded {
+		ctx.DeadlineExceeded = true
+		atomic.AddInt64(&p.stats.deadlineExceeded, 1)
+	}
+
+	return ErrDeadlineExceeded
+}
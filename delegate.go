@@ -15,16 +15,140 @@
 package goproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 // Context 代理上下文
 type Context struct {
-	Req   *http.Request
-	Data  map[interface{}]interface{}
-	abort bool
+	Req  *http.Request
+	Data map[interface{}]interface{}
+	// ServerName 连接目标服务器时使用的TLS SNI, 为空时使用请求的域名, 可在BeforeRequest中设置
+	ServerName string
+	// ClientTLS 客户端到代理的TLS连接状态, HTTPS解密时为解密的连接, 否则为ListenerTLS, 非TLS连接为nil
+	ClientTLS *tls.ConnectionState
+	// ListenerTLS 代理监听TLS时客户端连接的状态
+	ListenerTLS *tls.ConnectionState
+	// ClientCert 代理监听TLS时验证通过的客户端证书, 可根据Subject、DNSNames、URIs等授权
+	ClientCert *x509.Certificate
+	// User 认证通过的用户名, 在Auth中设置, 用于按用户统计流量和配额
+	User string
+	// Bytes 本次请求或隧道的字节数, 在Finish中读取
+	Bytes ByteCounters
+	// ClientIP 客户端IP, 由RemoteAddr解析
+	ClientIP string
+	// RequestID 本次请求或隧道的ID, 在Connect之前生成, HTTPS解密和HTTP/2的每个请求重新生成
+	RequestID string
+	// Start 开始处理的时间, HTTPS解密时为当前请求的开始时间
+	Start time.Time
+	// Timing 连接目标服务器和等待响应的耗时, 在BeforeResponse、Finish中读取
+	Timing Timing
+	// CacheStatus 开启WithCache时GET、HEAD请求的缓存状态, CacheHit、CacheRevalidated或CacheMiss
+	CacheStatus string
+	// Attempts 向目标服务器发送请求的次数, 包括重试和跟随的重定向
+	Attempts int
+	// SNI 隧道转发时客户端ClientHello中的SNI, 开启WithSNIRouting时设置
+	SNI string
+	// ALPN 隧道转发时客户端ClientHello中的ALPN协议列表, 如h2、http/1.1, 开启WithSNIRouting时设置
+	ALPN []string
+	// Timeouts 本次请求或隧道的超时设置, 可在BeforeRequest、BeforeTunnelForward中修改
+	Timeouts Timeouts
+	// Categories URL分类, 配置WithCategorization时在BeforeRequest之前设置, CONNECT隧道在Auth之后设置
+	Categories []string
+	// Sampled 是否被WithTrafficSampling选中完整记录, 在BeforeRequest之前设置
+	Sampled bool
+	// Bandwidth 本次请求或隧道的带宽限制, 字节/秒, 上传和下载分别计算
+	// 需要开启WithBandwidthLimit, 可在Auth、BeforeRequest、BeforeTunnelForward中设置, 与全局限制同时生效
+	Bandwidth int64
+	// Dialer 连接目标服务器和上级代理使用的拨号器, 如*DialPolicy, 为nil时使用WithDialContext、WithDialPolicy或默认拨号器
+	// 可在Connect、Auth、BeforeRequest、BeforeTunnelForward中设置, SSH上级代理的连接共用, 不使用Dialer
+	Dialer Dialer
+	// OriginalDst 透明代理(ServeTransparent)连接的原始目标地址, 显式代理时为空
+	OriginalDst string
+	// ClientGeo 客户端的地理位置, 开启WithGeoIP时在Connect之前设置, 没有记录时为nil
+	ClientGeo *GeoInfo
+	// TargetGeo 请求目标的地理位置, 开启WithGeoIP时在检查WithACL之前设置, 没有记录时为nil
+	TargetGeo *GeoInfo
+	// ParentSession 粘性会话key, 开启WithUpstreamPool时相同key的请求和隧道使用同一个上级代理
+	// 可在Connect、Auth、BeforeRequest、BeforeTunnelForward中设置, 也可在ParentProxyCredentials中用于生成带会话的用户名
+	ParentSession string
+	// TunnelTarget 隧道转发连接的目标地址host:port, 调用BeforeTunnelForward前设置为CONNECT请求的地址
+	// 在BeforeTunnelForward中修改后直连新地址, 不经过SNI路由和上级代理, 可配合Dialer将指定域名的HTTPS转到内部服务
+	TunnelTarget string
+	// TunnelSocket 本次隧道连接的TCP参数, 为nil时使用WithTunnelSocketOptions, 可在Connect、Auth、BeforeTunnelForward中设置
+	TunnelSocket *SocketOptions
+	// SkipDecrypt 开启HTTPS解密时不解密本次CONNECT, 按隧道转发, 可在Connect、Auth中设置
+	SkipDecrypt bool
+	// Deadline 端到端截止时间, 开启WithRequestDeadline时在Connect之前设置, 可在Connect、Auth中设置或修改
+	// HTTPS解密后的请求在BeforeRequest之前重新设置
+	Deadline time.Time
+	// DeadlineSource 截止时间的来源, DeadlineSourceDefault、DeadlineSourceRule或DeadlineSourceHeader, 在Delegate中设置时为空
+	DeadlineSource string
+	// DeadlineExceeded 是否因超过截止时间取消, 在Finish中读取
+	DeadlineExceeded bool
+	// Listener 接收请求的Server监听名称, 不通过Server监听时为空
+	Listener string
+	// 接收请求的Server监听的策略
+	listener *listenerPolicy
+	abort    bool
+	// Respond设置的响应
+	response *http.Response
+	quota    *quotaUsage
+	throttle *throttle
+	// 劫持的客户端连接
+	clientConn net.Conn
+	// 访问日志使用的状态码、上级代理和错误
+	status      int
+	parentProxy *url.URL
+	errorClass  ErrorClass
+	err         error
+
+	blockPageRenderer BlockPageRenderer
+	// tunnelHeader WithHeaderRules添加的header, 隧道经过HTTP上级代理时随CONNECT发送
+	tunnelHeader http.Header
+	policyEvents *policyEvents
+	// interim 向客户端发送1xx响应
+	interim interimWriter
+	// WithTracing的当前span和包含span的context
+	span     Span
+	traceCtx context.Context
+	// 是否已生成策略事件
+	policyReported bool
+}
+
+// ByteCounters 字节数统计, HTTP请求只统计body, 隧道和HTTPS解密统计连接收发的全部字节
+// HTTPS解密时为整个连接上所有请求的累计值
+type ByteCounters struct {
+	// ClientRead 从客户端读取
+	ClientRead int64
+	// ClientWritten 写入客户端
+	ClientWritten int64
+	// UpstreamRead 从目标服务器或上级代理读取
+	UpstreamRead int64
+	// UpstreamWritten 写入目标服务器或上级代理
+	UpstreamWritten int64
+}
+
+// Outcome 一个HTTP请求、隧道或HTTPS解密后的请求的结果, 与访问日志记录一一对应
+type Outcome struct {
+	// Type http、https(HTTPS解密后的请求)、tunnel(CONNECT, 包括HTTPS解密的连接)
+	Type string
+	// StatusCode 返回给客户端的状态码, 未返回时为0
+	StatusCode int
+	// Err 处理过程中的错误, 成功时为nil
+	Err        error
+	ErrorClass ErrorClass
+	// Duration 耗时
+	Duration time.Duration
+	// Bytes 本次请求或隧道的字节数, HTTPS解密后的请求为该请求期间连接收发的字节数
+	Bytes ByteCounters
 }
 
 // Abort 中断执行
@@ -42,12 +166,53 @@ type Delegate interface {
 	Connect(ctx *Context, rw http.ResponseWriter)
 	// Auth 代理身份认证
 	Auth(ctx *Context, rw http.ResponseWriter)
-	// BeforeRequest HTTP请求前 设置X-Forwarded-For, 修改Header、Body
+	// BeforeRequest HTTP请求前 设置X-Forwarded-For, 修改Header、Body, 调用ctx.Respond时直接返回响应
 	BeforeRequest(ctx *Context)
 	// BeforeResponse 响应发送到客户端前, 修改Header、Body、Status Code
 	BeforeResponse(ctx *Context, resp *http.Response, err error)
-	// ParentProxy 上级代理
+	// OnError 请求目标服务器失败时在BeforeResponse之后调用, 包括HTTPS解密后的请求, 可写入自定义的错误响应
+	// 未写入时返回WithBlockPageRenderer生成的错误页面, Fields["error"]为UpstreamErrorKindOf(err)
+	OnError(ctx *Context, rw http.ResponseWriter, err error)
+	// ModifyRequestBody 在请求body转换之后、发送前调用, 返回新的body替换req.Body, 返回nil时不修改
+	// 替换后proxy删除Content-Length, 以分块传输发送, 新body需负责关闭原body
+	ModifyRequestBody(ctx *Context, req *http.Request) io.ReadCloser
+	// ModifyResponseBody 在响应body转换之后、压缩前调用, 返回新的body替换resp.Body, 返回nil时不修改
+	// 替换后proxy删除Content-Length, 新body需负责关闭原body, 不用于协议升级的响应
+	ModifyResponseBody(ctx *Context, resp *http.Response) io.ReadCloser
+	// BeforeTunnelForward 隧道转发(未解密的CONNECT)连接目标服务器前, 可设置Timeouts、TunnelTarget、TunnelSocket、Dialer, 调用Abort时返回403
+	BeforeTunnelForward(ctx *Context)
+	// TunnelEstablished 隧道转发(未解密的CONNECT)连接目标服务器并通知客户端后调用, targetConn为到目标服务器或上级代理的连接
+	// 调用Abort时关闭隧道
+	TunnelEstablished(ctx *Context, targetConn net.Conn)
+	// TunnelClosed 隧道转发结束时调用, bytesUp为从客户端读取的字节数, bytesDown为写入客户端的字节数, 正常关闭时err为nil
+	TunnelClosed(ctx *Context, bytesUp, bytesDown int64, err error)
+	// CircuitStateChanged WithCircuitBreaker的目标服务器熔断状态变化时调用, host为主机:端口
+	CircuitStateChanged(host string, state CircuitState)
+	// ParentProxy 上级代理, 支持http://、ssh://、socks5://和socks5h://
 	ParentProxy(*http.Request) (*url.URL, error)
+	// ParentProxyCredentials 经过HTTP或SOCKS5上级代理时调用, 返回本次请求或隧道的用户名密码, 返回nil时使用URL中的用户名密码
+	// attempt为开启WithParentProxyRotation时上级代理拒绝后重试的次数, 第一次为0, 可据此更换凭据
+	ParentProxyCredentials(ctx *Context, parent *url.URL, attempt int) *ParentCredentials
+	// ResolveHost 连接目标服务器或上级代理前解析域名, 返回nil时使用WithResolver或系统DNS, 用于按域名固定IP、内外网不同解析等
+	// HTTP连接池按域名复用连接, 同一域名应返回相同的结果, 返回0.0.0.0或::表示屏蔽
+	ResolveHost(ctx *Context, host string) ([]net.IP, error)
+	// RouteSNI 开启WithSNIRouting时读取客户端ClientHello后调用, 可根据ctx.SNI、ctx.ALPN选择上级代理、直连或拦截
+	// 返回nil时按WithSNIRouting的规则处理, 返回规则的Match不使用, 客户端发送的不是TLS时不调用
+	RouteSNI(ctx *Context) *SNIRule
+	// LimitExceeded 超出WithRateLimit或WithMaxRequestsPerClient的限制时调用, 可修改返回的页面
+	// err为ErrRateLimited或ErrPerClientRequestLimit, WithMaxClientConns、WithMaxConnsPerClientIP在Accept时拒绝连接, 没有请求, 不调用
+	LimitExceeded(ctx *Context, err error, page *BlockPage)
+	// BodyLimitExceeded 请求或响应body超过WithMaxRequestBodySize、WithMaxResponseBodySize时调用, err为ErrRequestBodyTooLarge或ErrResponseBodyTooLarge
+	// 转发中超过限制时在读取body的goroutine中调用, 错误响应通过OnError自定义
+	BodyLimitExceeded(ctx *Context, err error, limit int64)
+	// Blocked WithACL拦截请求时调用, 可修改拦截页面, rule为nil时表示没有匹配的规则并且默认拒绝
+	Blocked(ctx *Context, rule *ACLRule, page *BlockPage)
+	// ConnectPortAllowed 开启WithConnectPortPolicy时检查CONNECT的目标端口, allowed为按策略检查的结果, 返回false时拒绝
+	ConnectPortAllowed(ctx *Context, port int, allowed bool) bool
+	// ContentBlocked WithContentFilter拦截或删除响应body时调用, contentType为匹配的类型, 可修改拦截页面, ContentStrip时page为nil
+	ContentBlocked(ctx *Context, rule *ContentRule, contentType string, page *BlockPage)
+	// Complete 每个HTTP请求、隧道和HTTPS解密后的请求结束时调用, 隧道在Finish之前调用
+	Complete(ctx *Context, outcome *Outcome)
 	// Finish 本次请求结束
 	Finish(ctx *Context)
 	// 记录错误信息
@@ -69,10 +234,55 @@ func (h *DefaultDelegate) BeforeRequest(ctx *Context) {}
 
 func (h *DefaultDelegate) BeforeResponse(ctx *Context, resp *http.Response, err error) {}
 
+func (h *DefaultDelegate) OnError(ctx *Context, rw http.ResponseWriter, err error) {}
+
+func (h *DefaultDelegate) ModifyRequestBody(ctx *Context, req *http.Request) io.ReadCloser {
+	return nil
+}
+
+func (h *DefaultDelegate) ModifyResponseBody(ctx *Context, resp *http.Response) io.ReadCloser {
+	return nil
+}
+
+func (h *DefaultDelegate) BeforeTunnelForward(ctx *Context) {}
+
+func (h *DefaultDelegate) TunnelEstablished(ctx *Context, targetConn net.Conn) {}
+
+func (h *DefaultDelegate) TunnelClosed(ctx *Context, bytesUp, bytesDown int64, err error) {}
+
+func (h *DefaultDelegate) CircuitStateChanged(host string, state CircuitState) {}
+
+func (h *DefaultDelegate) ResolveHost(ctx *Context, host string) ([]net.IP, error) {
+	return nil, nil
+}
+
+func (h *DefaultDelegate) RouteSNI(ctx *Context) *SNIRule {
+	return nil
+}
+
+func (h *DefaultDelegate) LimitExceeded(ctx *Context, err error, page *BlockPage) {}
+
+func (h *DefaultDelegate) BodyLimitExceeded(ctx *Context, err error, limit int64) {}
+
+func (h *DefaultDelegate) Blocked(ctx *Context, rule *ACLRule, page *BlockPage) {}
+
+func (h *DefaultDelegate) ConnectPortAllowed(ctx *Context, port int, allowed bool) bool {
+	return allowed
+}
+
+func (h *DefaultDelegate) ContentBlocked(ctx *Context, rule *ContentRule, contentType string, page *BlockPage) {
+}
+
 func (h *DefaultDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
 	return http.ProxyFromEnvironment(req)
 }
 
+func (h *DefaultDelegate) ParentProxyCredentials(ctx *Context, parent *url.URL, attempt int) *ParentCredentials {
+	return nil
+}
+
+func (h *DefaultDelegate) Complete(ctx *Context, outcome *Outcome) {}
+
 func (h *DefaultDelegate) Finish(ctx *Context) {}
 
 func (h *DefaultDelegate) ErrorLog(err error) {
@@ -0,0 +1,209 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DelegateMux 按目标域名将请求分发到不同的Delegate, 如内部域名HTTPS解密并记录, 其他域名直接隧道转发
+// 匹配顺序为精确域名、通配符(最长的优先)、正则表达式(按注册顺序), 都不匹配时使用默认Delegate
+// 在第一次调用时按ctx.Req.URL.Host选择, 同一Context(包括HTTPS解密后的请求)之后使用同一个Delegate
+// ParentProxy、CircuitStateChanged按参数中的域名选择, ErrorLog使用默认Delegate
+// 应在New之前注册完成, 注册不能与请求处理并发
+type DelegateMux struct {
+	def       Delegate
+	exact     map[string]Delegate
+	wildcards []muxWildcard
+	regexps   []muxRegexp
+}
+
+type muxWildcard struct {
+	pattern string
+	d       Delegate
+}
+
+type muxRegexp struct {
+	re *regexp.Regexp
+	d  Delegate
+}
+
+type delegateMuxKey struct {
+	m *DelegateMux
+}
+
+var _ Delegate = &DelegateMux{}
+
+// NewDelegateMux 创建DelegateMux, def为没有匹配时使用的Delegate, 为nil时使用DefaultDelegate
+func NewDelegateMux(def Delegate) *DelegateMux {
+	if def == nil {
+		def = &DefaultDelegate{}
+	}
+
+	return &DelegateMux{def: def, exact: make(map[string]Delegate)}
+}
+
+// Handle 注册域名规则, 支持精确域名和"*.example.com"形式的通配符(匹配所有子域名), 规则同MatchHost
+func (m *DelegateMux) Handle(pattern string, d Delegate) {
+	pattern = strings.ToLower(pattern)
+	if !strings.HasPrefix(pattern, "*") {
+		m.exact[strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")] = d
+		return
+	}
+	m.wildcards = append(m.wildcards, muxWildcard{pattern: pattern, d: d})
+	sort.SliceStable(m.wildcards, func(i, j int) bool {
+		return len(m.wildcards[i].pattern) > len(m.wildcards[j].pattern)
+	})
+}
+
+// HandleRegexp 注册正则表达式规则, 匹配不带端口的小写域名
+func (m *DelegateMux) HandleRegexp(re *regexp.Regexp, d Delegate) {
+	m.regexps = append(m.regexps, muxRegexp{re: re, d: d})
+}
+
+// match 按域名选择Delegate
+func (m *DelegateMux) match(host string) Delegate {
+	host = strings.TrimSuffix(strings.ToLower(hostname(host)), ".")
+	if d, ok := m.exact[host]; ok {
+		return d
+	}
+	for _, w := range m.wildcards {
+		if matchHost(w.pattern, host) {
+			return w.d
+		}
+	}
+	for _, r := range m.regexps {
+		if r.re.MatchString(host) {
+			return r.d
+		}
+	}
+
+	return m.def
+}
+
+// delegate 本次请求使用的Delegate, 选择结果保存在ctx.Data
+func (m *DelegateMux) delegate(ctx *Context) Delegate {
+	key := delegateMuxKey{m: m}
+	if ctx.Data != nil {
+		if d, ok := ctx.Data[key].(Delegate); ok {
+			return d
+		}
+	}
+	d := m.match(ctx.Req.URL.Host)
+	if ctx.Data == nil {
+		ctx.Data = make(map[interface{}]interface{})
+	}
+	ctx.Data[key] = d
+
+	return d
+}
+
+func (m *DelegateMux) Connect(ctx *Context, rw http.ResponseWriter) {
+	m.delegate(ctx).Connect(ctx, rw)
+}
+
+func (m *DelegateMux) Auth(ctx *Context, rw http.ResponseWriter) {
+	m.delegate(ctx).Auth(ctx, rw)
+}
+
+func (m *DelegateMux) BeforeRequest(ctx *Context) {
+	m.delegate(ctx).BeforeRequest(ctx)
+}
+
+func (m *DelegateMux) BeforeResponse(ctx *Context, resp *http.Response, err error) {
+	m.delegate(ctx).BeforeResponse(ctx, resp, err)
+}
+
+func (m *DelegateMux) OnError(ctx *Context, rw http.ResponseWriter, err error) {
+	m.delegate(ctx).OnError(ctx, rw, err)
+}
+
+func (m *DelegateMux) ModifyRequestBody(ctx *Context, req *http.Request) io.ReadCloser {
+	return m.delegate(ctx).ModifyRequestBody(ctx, req)
+}
+
+func (m *DelegateMux) ModifyResponseBody(ctx *Context, resp *http.Response) io.ReadCloser {
+	return m.delegate(ctx).ModifyResponseBody(ctx, resp)
+}
+
+func (m *DelegateMux) BeforeTunnelForward(ctx *Context) {
+	m.delegate(ctx).BeforeTunnelForward(ctx)
+}
+
+func (m *DelegateMux) TunnelEstablished(ctx *Context, targetConn net.Conn) {
+	m.delegate(ctx).TunnelEstablished(ctx, targetConn)
+}
+
+func (m *DelegateMux) TunnelClosed(ctx *Context, bytesUp, bytesDown int64, err error) {
+	m.delegate(ctx).TunnelClosed(ctx, bytesUp, bytesDown, err)
+}
+
+func (m *DelegateMux) CircuitStateChanged(host string, state CircuitState) {
+	m.match(host).CircuitStateChanged(host, state)
+}
+
+func (m *DelegateMux) ParentProxy(req *http.Request) (*url.URL, error) {
+	return m.match(req.URL.Host).ParentProxy(req)
+}
+
+func (m *DelegateMux) ParentProxyCredentials(ctx *Context, parent *url.URL, attempt int) *ParentCredentials {
+	return m.delegate(ctx).ParentProxyCredentials(ctx, parent, attempt)
+}
+
+func (m *DelegateMux) ResolveHost(ctx *Context, host string) ([]net.IP, error) {
+	return m.delegate(ctx).ResolveHost(ctx, host)
+}
+
+func (m *DelegateMux) RouteSNI(ctx *Context) *SNIRule {
+	return m.delegate(ctx).RouteSNI(ctx)
+}
+
+func (m *DelegateMux) LimitExceeded(ctx *Context, err error, page *BlockPage) {
+	m.delegate(ctx).LimitExceeded(ctx, err, page)
+}
+
+func (m *DelegateMux) BodyLimitExceeded(ctx *Context, err error, limit int64) {
+	m.delegate(ctx).BodyLimitExceeded(ctx, err, limit)
+}
+
+func (m *DelegateMux) Blocked(ctx *Context, rule *ACLRule, page *BlockPage) {
+	m.delegate(ctx).Blocked(ctx, rule, page)
+}
+
+func (m *DelegateMux) ConnectPortAllowed(ctx *Context, port int, allowed bool) bool {
+	return m.delegate(ctx).ConnectPortAllowed(ctx, port, allowed)
+}
+
+func (m *DelegateMux) ContentBlocked(ctx *Context, rule *ContentRule, contentType string, page *BlockPage) {
+	m.delegate(ctx).ContentBlocked(ctx, rule, contentType, page)
+}
+
+func (m *DelegateMux) Complete(ctx *Context, outcome *Outcome) {
+	m.delegate(ctx).Complete(ctx, outcome)
+}
+
+func (m *DelegateMux) Finish(ctx *Context) {
+	m.delegate(ctx).Finish(ctx)
+}
+
+func (m *DelegateMux) ErrorLog(err error) {
+	m.def.ErrorLog(err)
+}
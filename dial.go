@@ -0,0 +1,203 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DialContextFunc 建立网络连接
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialContext 自定义连接目标服务器和上级代理的方式, HTTP transport与隧道转发共用
+func WithDialContext(dial DialContextFunc) Option {
+	return func(opt *options) {
+		opt.dialContext = dial
+	}
+}
+
+// Dialer 单个请求或隧道使用的拨号器, 如*DialPolicy, 或设置了LocalAddr、Control(绑定出口网卡)的*net.Dialer
+// 同时作为连接池的key, 需要是可比较的类型, 通常使用指针
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type dialerKey struct{}
+
+// withDialer 保存Context.Dialer到拨号的context, 由dialContext使用
+func withDialer(ctx context.Context, d Dialer) context.Context {
+	if d == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, dialerKey{}, d)
+}
+
+type proxyContextKey struct{}
+
+// withProxyContext 保存代理上下文到拨号的context, 由ResolveHost使用
+func withProxyContext(c context.Context, ctx *Context) context.Context {
+	return context.WithValue(c, proxyContextKey{}, ctx)
+}
+
+// requestDialer 处理Context.Dialer和ResolveHost, 没有Context.Dialer时使用dial连接
+// 用于未配置WithResolver、WithDialContext等时的transport
+func (p *Proxy) requestDialer(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if d, ok := ctx.Value(dialerKey{}).(Dialer); ok {
+			policy, _ := d.(*DialPolicy)
+			return p.dialWith(ctx, d.DialContext, policy, network, addr)
+		}
+		return p.dialWith(ctx, dial, nil, network, addr)
+	}
+}
+
+type dialerTransportKey struct {
+	base   *http.Transport
+	dialer Dialer
+}
+
+// dialerTransport 使用Context.Dialer的transport, 连接池与其他Dialer隔离
+func (p *Proxy) dialerTransport(base *http.Transport, d Dialer) *http.Transport {
+	key := dialerTransportKey{base: base, dialer: d}
+	if t, ok := p.dialerTransports.Load(key); ok {
+		return t.(*http.Transport)
+	}
+	t := base.Clone()
+	dial := base.DialContext
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(withDialer(ctx, d), network, addr)
+	}
+	actual, _ := p.dialerTransports.LoadOrStore(key, t)
+
+	return actual.(*http.Transport)
+}
+
+// dialContext 连接目标服务器, HTTP transport与隧道转发共用
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial, policy := p.dial, p.dialPolicy
+	if d, ok := ctx.Value(dialerKey{}).(Dialer); ok {
+		dial = d.DialContext
+		policy, _ = d.(*DialPolicy)
+	}
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   p.connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	return p.dialWith(ctx, dial, policy, network, addr)
+}
+
+// dialWith 处理unix socket路由和域名解析后使用dial连接, 依次尝试解析得到的IP
+// policy不为nil时由DialPolicy按地址族选择解析得到的IP
+func (p *Proxy) dialWith(ctx context.Context, dial DialContextFunc, policy *DialPolicy, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if path := p.unixSocketPath(host); path != "" {
+		return dial(ctx, "unix", path)
+	}
+	if net.ParseIP(host) != nil {
+		return dial(ctx, network, addr)
+	}
+	ips, err := p.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if ips == nil {
+		return dial(ctx, network, addr)
+	}
+	var lastErr error
+	if policy != nil {
+		var allowed []net.IP
+		for _, ip := range ips {
+			if !ip.IP.IsUnspecified() {
+				allowed = append(allowed, ip.IP)
+			}
+		}
+		if len(allowed) == 0 {
+			return nil, fmt.Errorf("%s 已被屏蔽", host)
+		}
+		return policy.dialIPs(ctx, network, allowed, port)
+	}
+	for _, ip := range ips {
+		// hosts映射到0.0.0.0或::表示屏蔽
+		if ip.IP.IsUnspecified() {
+			lastErr = fmt.Errorf("%s 已被屏蔽", host)
+			continue
+		}
+		conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// lookupHost 优先使用ResolveHost, 其次WithResolver, 都没有结果时返回nil, 由dial解析
+func (p *Proxy) lookupHost(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if c, ok := ctx.Value(proxyContextKey{}).(*Context); ok {
+		ips, err := p.callResolveHost(c, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) > 0 {
+			addrs := make([]net.IPAddr, len(ips))
+			for i, ip := range ips {
+				addrs[i] = net.IPAddr{IP: ip}
+			}
+			return addrs, nil
+		}
+	}
+	if p.resolver == nil {
+		return nil, nil
+	}
+
+	return p.resolver.LookupIPAddr(ctx, host)
+}
+
+// UnixSocketRoute 将目标域名映射到本地unix socket, Host header保持不变
+type UnixSocketRoute struct {
+	// Host 目标域名, 支持*.example.com
+	Host string
+	// Path unix socket路径
+	Path string
+}
+
+// WithUnixSocketRoutes 匹配的目标连接到unix socket, 按顺序匹配
+func WithUnixSocketRoutes(routes ...UnixSocketRoute) Option {
+	return func(opt *options) {
+		opt.unixSocketRoutes = append(opt.unixSocketRoutes, routes...)
+	}
+}
+
+func (p *Proxy) unixSocketPath(host string) string {
+	for _, route := range p.unixSocketRoutes {
+		if matchHost(route.Host, host) {
+			return route.Path
+		}
+	}
+
+	return ""
+}
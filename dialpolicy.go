@@ -0,0 +1,263 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultFallbackDelay = 300 * time.Millisecond
+	defaultDialTimeout   = 30 * time.Second
+)
+
+// AddressFamily 连接目标服务器和上级代理时的地址族
+type AddressFamily int
+
+const (
+	// AnyFamily 按解析结果的顺序, 第一个地址的地址族优先
+	AnyFamily AddressFamily = iota
+	// PreferIPv4 IPv4优先, 失败或超过FallbackDelay后尝试IPv6
+	PreferIPv4
+	// PreferIPv6 IPv6优先, 失败或超过FallbackDelay后尝试IPv4
+	PreferIPv6
+	// IPv4Only 只使用IPv4
+	IPv4Only
+	// IPv6Only 只使用IPv6
+	IPv6Only
+)
+
+// DialPolicy 拨号策略, 控制地址族、Happy Eyeballs(RFC 8305)和本地地址
+// 实现了Dialer, 可设置为Context.Dialer覆盖WithDialPolicy, 作为连接池的key, 相同设置应使用同一个指针
+type DialPolicy struct {
+	// Family 地址族偏好
+	Family AddressFamily
+	// FallbackDelay 优先的地址族未连接成功时, 等待该时间后同时连接另一个地址族, 默认300毫秒, 小于0时按顺序连接
+	FallbackDelay time.Duration
+	// LocalAddr 本地地址, 只连接相同地址族的目标地址
+	LocalAddr net.IP
+	// Interface 出口网卡名, 使用网卡上与目标相同地址族的第一个地址作为本地地址, 设置LocalAddr时不使用
+	Interface string
+	// Timeout 连接单个地址的超时时间, WithDialPolicy默认使用WithConnectTimeout, 作为Context.Dialer时默认30秒
+	Timeout time.Duration
+}
+
+// WithDialPolicy 连接目标服务器和上级代理的拨号策略, 可通过Context.Dialer为单个请求或隧道设置其他策略
+// 同时设置WithDialContext时不生效
+func WithDialPolicy(policy DialPolicy) Option {
+	return func(opt *options) {
+		opt.dialPolicy = &policy
+	}
+}
+
+// DialContext 解析域名后按策略连接
+func (d *DialPolicy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return d.dialIPs(ctx, network, []net.IP{ip}, port)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+
+	return d.dialIPs(ctx, network, ips, port)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialIPs 按地址族分为优先和备用两组, 备用组在FallbackDelay后或优先组全部失败时开始连接
+func (d *DialPolicy) dialIPs(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	local4, local6, err := d.localAddrs()
+	if err != nil {
+		return nil, err
+	}
+	// 设置本地地址时只连接有本地地址的地址族
+	bound := local4 != nil || local6 != nil
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if network != "tcp6" && (!bound || local4 != nil) {
+				v4 = append(v4, ip)
+			}
+		} else if network != "tcp4" && (!bound || local6 != nil) {
+			v6 = append(v6, ip)
+		}
+	}
+	var primary, fallback []net.IP
+	switch d.Family {
+	case IPv4Only:
+		primary = v4
+	case IPv6Only:
+		primary = v6
+	case PreferIPv6:
+		primary, fallback = v6, v4
+	case PreferIPv4:
+		primary, fallback = v4, v6
+	default:
+		primary, fallback = v4, v6
+		if len(ips) > 0 && ips[0].To4() == nil {
+			primary, fallback = v6, v4
+		}
+	}
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+	if len(primary) == 0 {
+		return nil, fmt.Errorf("没有符合地址族的地址: %v", ips)
+	}
+	local := func(ip net.IP) net.IP {
+		if ip.To4() != nil {
+			return local4
+		}
+		return local6
+	}
+	if len(fallback) == 0 || d.FallbackDelay < 0 {
+		return d.dialSerial(ctx, network, append(primary, fallback...), port, local)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	start := func(ips []net.IP) {
+		go func() {
+			conn, err := d.dialSerial(ctx, network, ips, port, local)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+	start(primary)
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending, fallbackStarted := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallback)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 另一组连接被取消或成功后关闭
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallback)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial 依次连接, 返回第一个错误
+func (d *DialPolicy) dialSerial(ctx context.Context, network string, ips []net.IP, port string, local func(net.IP) net.IP) (net.Conn, error) {
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	var firstErr error
+	for _, ip := range ips {
+		dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+		if l := local(ip); l != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: l}
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, firstErr
+}
+
+// localAddrs 本地地址, 设置时只连接对应地址族, 两个都为nil时不限制
+func (d *DialPolicy) localAddrs() (net.IP, net.IP, error) {
+	if d.LocalAddr != nil {
+		if d.LocalAddr.To4() != nil {
+			return d.LocalAddr, nil, nil
+		}
+		return nil, d.LocalAddr, nil
+	}
+	if d.Interface == "" {
+		return nil, nil, nil
+	}
+	iface, err := net.InterfaceByName(d.Interface)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var v4, v6 net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if n.IP.To4() != nil {
+			if v4 == nil {
+				v4 = n.IP
+			}
+		} else if v6 == nil {
+			v6 = n.IP
+		}
+	}
+	if v4 == nil && v6 == nil {
+		return nil, nil, errors.New("网卡" + d.Interface + "没有可用的地址")
+	}
+
+	return v4, v6, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package dlp 外发请求body的数据防泄漏检查, 内置银行卡号、密钥等正则规则, 支持自定义分类器
+package dlp
+
+import (
+	"regexp"
+)
+
+// Match 检测到的敏感数据在body中的位置
+type Match struct {
+	Start int
+	End   int
+}
+
+// Detector 敏感数据检测器, 正则规则或自定义分类器
+type Detector interface {
+	// Name 名称, 用于日志和策略事件
+	Name() string
+	// Detect 返回所有匹配的位置, 分类器无法定位时可返回Match{0, 0}表示命中但不可脱敏
+	Detect(body []byte) []Match
+}
+
+// DetectorFunc 函数形式的Detector
+type DetectorFunc struct {
+	DetectorName string
+	Func         func(body []byte) []Match
+}
+
+func (d DetectorFunc) Name() string {
+	return d.DetectorName
+}
+
+func (d DetectorFunc) Detect(body []byte) []Match {
+	return d.Func(body)
+}
+
+// RegexDetector 正则检测器
+type RegexDetector struct {
+	DetectorName string
+	Pattern      *regexp.Regexp
+	// Validate 进一步校验匹配的内容, 如银行卡号的Luhn校验, 为nil时不校验
+	Validate func(value []byte) bool
+}
+
+func (d *RegexDetector) Name() string {
+	return d.DetectorName
+}
+
+func (d *RegexDetector) Detect(body []byte) []Match {
+	var matches []Match
+	for _, loc := range d.Pattern.FindAllIndex(body, -1) {
+		if d.Validate != nil && !d.Validate(body[loc[0]:loc[1]]) {
+			continue
+		}
+		matches = append(matches, Match{Start: loc[0], End: loc[1]})
+	}
+
+	return matches
+}
+
+// CardNumbers 银行卡号, 13-19位数字, 允许空格或-分隔, 使用Luhn校验
+func CardNumbers() []Detector {
+	return []Detector{
+		&RegexDetector{
+			DetectorName: "card_number",
+			Pattern:      regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+			Validate:     luhn,
+		},
+	}
+}
+
+// SecretKeys 常见的云服务密钥、令牌和私钥
+func SecretKeys() []Detector {
+	return []Detector{
+		&RegexDetector{DetectorName: "aws_access_key", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+		&RegexDetector{DetectorName: "github_token", Pattern: regexp.MustCompile(`\b(?:gh[pousr]_[0-9A-Za-z]{36}|github_pat_[0-9A-Za-z_]{82})\b`)},
+		&RegexDetector{DetectorName: "slack_token", Pattern: regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z-]{10,}\b`)},
+		&RegexDetector{DetectorName: "google_api_key", Pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+		&RegexDetector{DetectorName: "private_key", Pattern: regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED )?PRIVATE KEY-----`)},
+	}
+}
+
+// luhn 银行卡号校验, 忽略空格和-
+func luhn(value []byte) bool {
+	sum := 0
+	digits := 0
+	double := false
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		n := int(c - '0')
+		if double {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+		digits++
+		double = !double
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dlp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ouqiang/goproxy"
+)
+
+const (
+	defaultMaxBodySize = 10 << 20
+	defaultRedaction   = "[REDACTED]"
+)
+
+// Action 检测到敏感数据后的处理方式
+type Action int
+
+const (
+	// ActionLog 只记录, 请求正常转发
+	ActionLog Action = iota
+	// ActionRedact 替换敏感数据后转发, 无法定位的命中按ActionBlock处理
+	ActionRedact
+	// ActionBlock 拦截请求
+	ActionBlock
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionRedact:
+		return "redact"
+	case ActionBlock:
+		return "block"
+	}
+
+	return "log"
+}
+
+// Policy 目标地址对应的检查策略
+type Policy struct {
+	// Hosts 目标域名, 支持*.example.com, 为空时匹配所有域名
+	Hosts []string
+	// Detectors 检测器, 如CardNumbers()、SecretKeys()
+	Detectors []Detector
+	// Action 处理方式
+	Action Action
+}
+
+// Finding 一次检查的结果
+type Finding struct {
+	// Action 实际的处理方式
+	Action Action
+	// Detectors 命中的检测器名称及次数
+	Detectors map[string]int
+}
+
+// Config Adapter配置
+type Config struct {
+	// Policies 按顺序匹配第一条策略, 没有匹配的策略时不检查
+	Policies []Policy
+	// MaxBodySize 最多检查的body大小, 超过时不检查直接放行, 默认10MB
+	MaxBodySize int64
+	// Redaction 脱敏替换的内容, 默认[REDACTED]
+	Redaction string
+	// BlockPage 拦截页面, 为nil时返回403
+	BlockPage func(ctx *goproxy.Context, finding *Finding) *goproxy.BlockPage
+	// Log 每次命中时调用, 可为nil
+	Log func(ctx *goproxy.Context, finding *Finding)
+}
+
+// Adapter 检查外发请求的body, 实现goproxy.ContentAdapter
+// 命中时上报data_leak策略事件
+type Adapter struct {
+	config Config
+}
+
+// NewAdapter 创建Adapter, 用于goproxy.WithContentAdapters
+func NewAdapter(config Config) *Adapter {
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+	if config.Redaction == "" {
+		config.Redaction = defaultRedaction
+	}
+
+	return &Adapter{config: config}
+}
+
+// AdaptRequest 检查请求body
+func (a *Adapter) AdaptRequest(ctx *goproxy.Context, req *http.Request) (*http.Request, *http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 || req.ContentLength > a.config.MaxBodySize {
+		return nil, nil, nil
+	}
+	if enc := req.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return nil, nil, nil
+	}
+	policy := a.policy(hostname(req.URL.Host))
+	if policy == nil {
+		return nil, nil, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, a.config.MaxBodySize+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, nil, err
+	}
+	if int64(len(buf)) > a.config.MaxBodySize {
+		req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(buf), req.Body), Closer: req.Body}
+		return req, nil, nil
+	}
+	req.Body.Close()
+
+	finding := &Finding{Action: policy.Action, Detectors: make(map[string]int)}
+	var matches []Match
+	for _, d := range policy.Detectors {
+		found := d.Detect(buf)
+		if len(found) == 0 {
+			continue
+		}
+		finding.Detectors[d.Name()] += len(found)
+		for _, m := range found {
+			if m.End <= m.Start && finding.Action == ActionRedact {
+				// 无法脱敏
+				finding.Action = ActionBlock
+			}
+		}
+		matches = append(matches, found...)
+	}
+	if len(finding.Detectors) == 0 {
+		setBody(req, buf)
+		return req, nil, nil
+	}
+	if a.config.Log != nil {
+		a.config.Log(ctx, finding)
+	}
+	switch finding.Action {
+	case ActionBlock:
+		return req, ctx.BlockPageResponse(a.blockPage(ctx, finding)), nil
+	case ActionRedact:
+		buf = redact(buf, matches, []byte(a.config.Redaction))
+	}
+	ctx.ReportPolicyEvent(&goproxy.PolicyEvent{
+		Type:     goproxy.PolicyEventDataLeak,
+		Reason:   "检测到敏感数据",
+		Category: "dlp",
+		Fields:   finding.fields(),
+	})
+	setBody(req, buf)
+
+	return req, nil, nil
+}
+
+// AdaptResponse 不处理响应
+func (a *Adapter) AdaptResponse(ctx *goproxy.Context, resp *http.Response) (*http.Response, error) {
+	return nil, nil
+}
+
+func (a *Adapter) policy(host string) *Policy {
+	for i := range a.config.Policies {
+		p := &a.config.Policies[i]
+		if len(p.Hosts) == 0 {
+			return p
+		}
+		for _, h := range p.Hosts {
+			if goproxy.MatchHost(h, host) {
+				return p
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *Adapter) blockPage(ctx *goproxy.Context, finding *Finding) *goproxy.BlockPage {
+	var page *goproxy.BlockPage
+	if a.config.BlockPage != nil {
+		page = a.config.BlockPage(ctx, finding)
+	}
+	if page == nil {
+		page = &goproxy.BlockPage{
+			StatusCode: http.StatusForbidden,
+			Message:    "请求包含敏感数据",
+			Category:   "dlp",
+		}
+	}
+	if page.EventType == "" {
+		page.EventType = goproxy.PolicyEventDataLeak
+	}
+	if page.Fields == nil {
+		page.Fields = finding.fields()
+	}
+
+	return page
+}
+
+// fields 策略事件和拦截页面的字段, 不包含敏感数据本身
+func (f *Finding) fields() map[string]string {
+	names := make([]string, 0, len(f.Detectors))
+	for name, n := range f.Detectors {
+		names = append(names, name+"="+strconv.Itoa(n))
+	}
+	sort.Strings(names)
+
+	return map[string]string{
+		"action":    f.Action.String(),
+		"detectors": strings.Join(names, ","),
+	}
+}
+
+// redact 替换所有匹配的位置, 重叠的位置合并
+func redact(body []byte, matches []Match, replacement []byte) []byte {
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+	var out bytes.Buffer
+	pos := 0
+	for _, m := range matches {
+		if m.End <= m.Start || m.End <= pos {
+			continue
+		}
+		if m.Start >= pos {
+			out.Write(body[pos:m.Start])
+			out.Write(replacement)
+		}
+		pos = m.End
+	}
+	out.Write(body[pos:])
+
+	return out.Bytes()
+}
+
+func setBody(req *http.Request, body []byte) {
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+func hostname(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+
+	return strings.Trim(addr, "[]")
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
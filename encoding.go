@@ -0,0 +1,177 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// WithIdentityEncoding 强制端到端不压缩: 请求上游时要求identity编码,
+// 仍然压缩的响应由代理解压后再交给delegate和客户端, 便于检查和记录body
+func WithIdentityEncoding() Option {
+	return func(opt *options) {
+		opt.identityEncoding = true
+	}
+}
+
+// WithDecodeResponseBody 解压gzip、deflate、br编码的响应body, BeforeResponse、响应body转换和ModifyResponseBody读取到解压后的内容
+// recompress为true时发送到客户端前按原编码重新压缩(多重编码时不压缩), 否则删除Content-Encoding以未压缩发送
+// 与WithIdentityEncoding不同, 不修改请求的Accept-Encoding, 其他编码的响应不解压, ETag改为弱校验
+func WithDecodeResponseBody(recompress bool) Option {
+	return func(opt *options) {
+		opt.decodeResponseBody = true
+		opt.recompressResponse = recompress
+	}
+}
+
+// decodeResponse 开启WithDecodeResponseBody时解压响应body, 返回重新压缩使用的编码, 不需要重新压缩时返回空
+func (p *Proxy) decodeResponse(req *http.Request, resp *http.Response) (string, error) {
+	if !p.decodeResponseBody || !hasResponseBody(req, resp) {
+		return "", nil
+	}
+	encodings := contentEncodings(resp.Header)
+	if len(encodings) == 0 {
+		return "", nil
+	}
+	for _, e := range encodings {
+		if !decodable(e) {
+			return "", nil
+		}
+	}
+	if err := decompressResponse(resp); err != nil {
+		return "", err
+	}
+	weakenETag(resp.Header)
+	if !p.recompressResponse || len(encodings) != 1 {
+		return "", nil
+	}
+
+	return encodings[0], nil
+}
+
+// hasResponseBody 响应是否有需要解压的body
+func hasResponseBody(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody || resp.ContentLength == 0 {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusSwitchingProtocols:
+		return false
+	}
+
+	return true
+}
+
+func decodable(encoding string) bool {
+	switch encoding {
+	case "gzip", "x-gzip", "deflate", "br":
+		return true
+	}
+
+	return false
+}
+
+// encodeResponse 按encoding重新压缩解压后的响应body
+func encodeResponse(resp *http.Response, encoding string) {
+	resp.Body = compressBody(resp.Body, func(w io.Writer) io.WriteCloser {
+		switch encoding {
+		case "br":
+			return brotli.NewWriter(w)
+		case "deflate":
+			return zlib.NewWriter(w)
+		}
+		return gzip.NewWriter(w)
+	})
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// decompressResponse 按Content-Encoding解压响应body, 并删除相关header
+func decompressResponse(resp *http.Response) error {
+	encodings := contentEncodings(resp.Header)
+	if len(encodings) == 0 {
+		return nil
+	}
+	body := resp.Body
+	var r io.Reader = body
+	// 多重编码按应用顺序的逆序解码
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		r, err = newDecoder(encodings[i], r)
+		if err != nil {
+			return err
+		}
+	}
+	resp.Body = &readCloser{Reader: r, Closer: body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return nil
+}
+
+// contentEncodings 解析Content-Encoding, 忽略identity
+func contentEncodings(h http.Header) []string {
+	var encodings []string
+	for _, v := range h["Content-Encoding"] {
+		for _, e := range strings.Split(v, ",") {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e != "" && e != "identity" {
+				encodings = append(encodings, e)
+			}
+		}
+	}
+
+	return encodings
+}
+
+func newDecoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// 部分服务器发送不带zlib头的原始deflate数据
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err == nil && isZlibHeader(header) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("不支持的Content-Encoding: %s", encoding)
+	}
+}
+
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UpstreamErrorKind 请求目标服务器失败的原因, 默认错误页面的Fields["error"]
+type UpstreamErrorKind string
+
+const (
+	// UpstreamErrorDNS 域名解析失败
+	UpstreamErrorDNS UpstreamErrorKind = "dns"
+	// UpstreamErrorDial 连接目标服务器失败, 如连接被拒绝、网络不可达
+	UpstreamErrorDial UpstreamErrorKind = "dial"
+	// UpstreamErrorTimeout 连接或等待响应超时, 返回504
+	UpstreamErrorTimeout UpstreamErrorKind = "timeout"
+	// UpstreamErrorTLS 与目标服务器TLS握手或证书校验失败
+	UpstreamErrorTLS UpstreamErrorKind = "tls"
+	// UpstreamErrorParent 上级代理拒绝请求
+	UpstreamErrorParent UpstreamErrorKind = "parent"
+	// UpstreamErrorUnavailable 超出并发连接数限制或熔断, 返回503, 单个客户端超出限制时返回429
+	UpstreamErrorUnavailable UpstreamErrorKind = "unavailable"
+	// UpstreamErrorBodyTooLarge 请求或响应body超过大小限制, 请求body超过限制时返回413
+	UpstreamErrorBodyTooLarge UpstreamErrorKind = "body_too_large"
+	// UpstreamErrorOther 其他错误, 如目标服务器关闭连接、响应格式错误
+	UpstreamErrorOther UpstreamErrorKind = "upstream"
+)
+
+// UpstreamErrorKindOf 区分请求目标服务器失败的原因
+func UpstreamErrorKindOf(err error) UpstreamErrorKind {
+	switch err {
+	case ErrHostConnLimit, ErrClientConnLimit, ErrPerClientRequestLimit, ErrPerClientConnLimit, ErrCircuitOpen:
+		return UpstreamErrorUnavailable
+	}
+	var dnsErr *net.DNSError
+	var parentErr *ParentProxyError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.Is(err, ErrRequestBodyTooLarge), errors.Is(err, ErrResponseBodyTooLarge):
+		return UpstreamErrorBodyTooLarge
+	case errors.As(err, &dnsErr):
+		return UpstreamErrorDNS
+	case errors.As(err, &parentErr):
+		return UpstreamErrorParent
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrDeadlineExceeded), isTimeout(err):
+		return UpstreamErrorTimeout
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr):
+		return UpstreamErrorTLS
+	case isDialError(err):
+		return UpstreamErrorDial
+	}
+
+	return UpstreamErrorOther
+}
+
+// writeError 请求目标服务器失败时调用Delegate.OnError, 未写入响应时返回默认的错误页面, 返回状态码
+// 页面通过WithBlockPageRenderer生成, 不生成策略事件
+func (p *Proxy) writeError(ctx *Context, rw http.ResponseWriter, err error) int {
+	w := &errorResponseWriter{ResponseWriter: rw}
+	p.callOnError(ctx, w, err)
+	if w.code != 0 {
+		return w.code
+	}
+	page := &BlockPage{
+		StatusCode: errorStatusCode(err),
+		Fields:     map[string]string{"error": string(UpstreamErrorKindOf(err))},
+	}
+	switch page.StatusCode {
+	case http.StatusServiceUnavailable:
+		page.Header = http.Header{"Retry-After": []string{strconv.Itoa(int(p.retryAfter / time.Second))}}
+	case http.StatusTooManyRequests:
+		// 与acquireClient相同
+		page.Header = http.Header{"Retry-After": []string{"1"}}
+	}
+	code, header, body := ctx.renderPage(page)
+	CopyHeader(rw.Header(), header)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(code)
+	rw.Write(body)
+
+	return code
+}
+
+// errorResponse HTTPS解密后的请求失败时生成错误响应
+func (p *Proxy) errorResponse(ctx *Context, err error) *http.Response {
+	w := &bufferedResponseWriter{header: make(http.Header)}
+	code := p.writeError(ctx, w, err)
+	resp := &http.Response{
+		StatusCode:    code,
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       ctx.Req,
+	}
+	resp.Header.Del("Content-Length")
+
+	return resp
+}
+
+// errorResponseWriter 记录OnError是否写入了响应
+type errorResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *errorResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap 用于http.ResponseController
+func (w *errorResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bufferedResponseWriter 缓存响应, 用于没有http.ResponseWriter的HTTPS解密连接
+type bufferedResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
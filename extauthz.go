@@ -0,0 +1,324 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExtAuthzTimeout   = 2 * time.Second
+	defaultExtAuthzCacheSize = 10000
+)
+
+// AuthzRequest 发送给外部授权服务的请求信息
+type AuthzRequest struct {
+	Method string `json:"method"`
+	// URL 完整URL, CONNECT隧道为host:port
+	URL  string `json:"url"`
+	Host string `json:"host"`
+	Path string `json:"path,omitempty"`
+	// ClientIP 客户端IP
+	ClientIP string `json:"client_ip"`
+	// User 认证通过的用户名
+	User string `json:"user,omitempty"`
+	// Listener 接收请求的Server监听名称
+	Listener string `json:"listener,omitempty"`
+	// Categories 开启WithCategorization时的URL分类
+	Categories []string `json:"categories,omitempty"`
+	// Header 请求header, 不包括Proxy-Authorization
+	Header http.Header `json:"header,omitempty"`
+}
+
+// AuthzDecision 外部授权服务的结果
+type AuthzDecision struct {
+	Allow bool `json:"allow"`
+	// StatusCode 拒绝时返回客户端的状态码, 默认403
+	StatusCode int `json:"status,omitempty"`
+	// Message 拒绝时拦截页面的说明
+	Message string `json:"message,omitempty"`
+	// Header 允许时添加到发往目标服务器的请求(隧道为随CONNECT发送给HTTP上级代理), 拒绝时添加到响应
+	Header http.Header `json:"headers,omitempty"`
+	// TTL 结果的缓存时间, 为0时使用ExtAuthzConfig.CacheTTL
+	TTL time.Duration `json:"-"`
+}
+
+// Authorizer 外部授权, 如HTTP或gRPC的策略服务(类似Envoy ext_authz), 与Delegate无关
+type Authorizer interface {
+	Authorize(ctx context.Context, req *AuthzRequest) (*AuthzDecision, error)
+}
+
+// AuthorizerFunc 函数形式的Authorizer, 可包装gRPC客户端
+type AuthorizerFunc func(ctx context.Context, req *AuthzRequest) (*AuthzDecision, error)
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, req *AuthzRequest) (*AuthzDecision, error) {
+	return f(ctx, req)
+}
+
+// ExtAuthzConfig 外部授权配置
+type ExtAuthzConfig struct {
+	Authorizer Authorizer
+	// Timeout 单次授权的超时时间, 默认2秒
+	Timeout time.Duration
+	// FailOpen 授权服务出错或超时时放行, 默认拒绝并返回403
+	FailOpen bool
+	// CacheTTL 授权结果的缓存时间, 为0时不缓存
+	CacheTTL time.Duration
+	// CacheSize 最多缓存的结果数, 默认10000
+	CacheSize int
+	// CacheKey 缓存的key, 默认为用户、客户端IP、监听名称、方法、域名和路径, 结果依赖header时需要自定义
+	CacheKey func(req *AuthzRequest) string
+}
+
+// WithExtAuthz 外部授权, CONNECT在WithACL、WithCategorization之后检查, HTTP请求和HTTPS解密后的请求在BeforeRequest之前检查
+// 授权服务出错时记录错误, 按FailOpen放行或拒绝
+func WithExtAuthz(config ExtAuthzConfig) Option {
+	return func(opt *options) {
+		opt.extAuthz = &config
+	}
+}
+
+type extAuthz struct {
+	config ExtAuthzConfig
+	cache  *authzCache
+}
+
+func newExtAuthz(config ExtAuthzConfig) *extAuthz {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultExtAuthzTimeout
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultExtAuthzCacheSize
+	}
+	if config.CacheKey == nil {
+		config.CacheKey = defaultAuthzCacheKey
+	}
+	a := &extAuthz{config: config}
+	if config.CacheTTL > 0 {
+		a.cache = newAuthzCache(config.CacheSize)
+	}
+
+	return a
+}
+
+func defaultAuthzCacheKey(req *AuthzRequest) string {
+	return req.User + "\x00" + req.ClientIP + "\x00" + req.Listener + "\x00" + req.Method + "\x00" + req.Host + req.Path
+}
+
+// authorize 调用外部授权, 拒绝时返回拦截页面
+func (p *Proxy) authorize(ctx *Context) *BlockPage {
+	a := p.extAuthz
+	req := newAuthzRequest(ctx)
+	key := a.config.CacheKey(req)
+	decision, ok := a.cache.get(key)
+	if !ok {
+		c, cancel := context.WithTimeout(ctx.Req.Context(), a.config.Timeout)
+		var err error
+		decision, err = a.config.Authorizer.Authorize(c, req)
+		cancel()
+		if err == nil && decision == nil {
+			err = fmt.Errorf("授权服务没有返回结果")
+		}
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("%s - 外部授权错误: %s", ctx.Req.URL.Host, err))
+			if a.config.FailOpen {
+				return nil
+			}
+			return &BlockPage{StatusCode: http.StatusForbidden, Message: "授权服务不可用"}
+		}
+		ttl := decision.TTL
+		if ttl == 0 {
+			ttl = a.config.CacheTTL
+		}
+		a.cache.set(key, decision, ttl)
+	}
+	if !decision.Allow {
+		page := &BlockPage{StatusCode: decision.StatusCode, Message: decision.Message}
+		if page.StatusCode == 0 {
+			page.StatusCode = http.StatusForbidden
+		}
+		if len(decision.Header) > 0 {
+			page.Header = CloneHeader(decision.Header)
+		}
+		return page
+	}
+	if len(decision.Header) == 0 {
+		return nil
+	}
+	header := ctx.Req.Header
+	if ctx.Req.Method == http.MethodConnect {
+		if ctx.tunnelHeader == nil {
+			ctx.tunnelHeader = make(http.Header)
+		}
+		header = ctx.tunnelHeader
+	}
+	for k, v := range decision.Header {
+		header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+
+	return nil
+}
+
+func newAuthzRequest(ctx *Context) *AuthzRequest {
+	r := ctx.Req
+	req := &AuthzRequest{
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Host:       r.URL.Host,
+		Path:       r.URL.Path,
+		ClientIP:   ctx.ClientIP,
+		User:       ctx.User,
+		Listener:   ctx.Listener,
+		Categories: ctx.Categories,
+		Header:     CloneHeader(r.Header),
+	}
+	if r.Method == http.MethodConnect {
+		req.URL = r.URL.Host
+	}
+	req.Header.Del("Proxy-Authorization")
+
+	return req
+}
+
+type authzCacheItem struct {
+	key      string
+	decision *AuthzDecision
+	expires  time.Time
+}
+
+// authzCache 授权结果的LRU缓存, 已满时淘汰最久未使用的结果
+type authzCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newAuthzCache(size int) *authzCache {
+	return &authzCache{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *authzCache) get(key string) (*AuthzDecision, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*authzCacheItem)
+	if time.Now().After(item.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+
+	return item.decision, true
+}
+
+func (c *authzCache) set(key string, decision *AuthzDecision, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	c.items[key] = c.ll.PushFront(&authzCacheItem{key: key, decision: decision, expires: now.Add(ttl)})
+	if c.ll.Len() <= c.size {
+		return
+	}
+	// 已满时优先淘汰已过期的结果, 仍超出时淘汰最久未使用的
+	for e := c.ll.Back(); e != nil; {
+		prev := e.Prev()
+		if now.After(e.Value.(*authzCacheItem).expires) {
+			c.remove(e)
+		}
+		e = prev
+	}
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove 调用方需持有mu
+func (c *authzCache) remove(e *list.Element) {
+	item := c.ll.Remove(e).(*authzCacheItem)
+	delete(c.items, item.key)
+}
+
+// AuthzAPI 通过HTTP接口授权
+// 请求POST endpoint, body为AuthzRequest的JSON, 响应200和AuthzDecision的JSON,
+// 如{"allow": false, "status": 403, "message": "...", "headers": {"X-User-Group": ["staff"]}, "ttl": 60}, ttl单位为秒
+type AuthzAPI struct {
+	endpoint string
+	client   *http.Client
+	header   http.Header
+}
+
+// NewAuthzAPI 创建授权API客户端, client为nil时使用默认client(超时由ExtAuthzConfig.Timeout控制), header为每个请求附加的头(如API Key)
+func NewAuthzAPI(endpoint string, client *http.Client, header http.Header) *AuthzAPI {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &AuthzAPI{endpoint: endpoint, client: client, header: header}
+}
+
+func (a *AuthzAPI) Authorize(ctx context.Context, r *AuthzRequest) (*AuthzDecision, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range a.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("授权API返回%s", resp.Status)
+	}
+	var result struct {
+		AuthzDecision
+		TTL float64 `json:"ttl"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("解析授权API响应错误: %s", err)
+	}
+	decision := result.AuthzDecision
+	decision.TTL = time.Duration(result.TTL * float64(time.Second))
+
+	return &decision, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDefaultAuthzCacheKey(t *testing.T) {
+	a := &AuthzRequest{User: "u", ClientIP: "10.0.0.1", Listener: "internal", Method: "GET", Host: "example.com", Path: "/"}
+	b := *a
+	b.Listener = "public"
+	if defaultAuthzCacheKey(a) == defaultAuthzCacheKey(&b) {
+		t.Error("不同监听的请求使用了相同的缓存key")
+	}
+}
+
+func TestAuthzCacheEviction(t *testing.T) {
+	c := newAuthzCache(3)
+	for i := 0; i < 3; i++ {
+		c.set(strconv.Itoa(i), &AuthzDecision{Allow: true}, time.Minute)
+	}
+	// 访问0后1为最久未使用
+	c.get("0")
+	c.set("3", &AuthzDecision{Allow: true}, time.Minute)
+	for key, want := range map[string]bool{"0": true, "1": false, "2": true, "3": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("get(%q) = %v, 期望 %v", key, ok, want)
+		}
+	}
+
+	// 已过期的结果优先淘汰
+	c = newAuthzCache(3)
+	c.set("a", &AuthzDecision{}, time.Minute)
+	c.set("expired", &AuthzDecision{}, time.Nanosecond)
+	c.set("b", &AuthzDecision{}, time.Minute)
+	time.Sleep(time.Millisecond)
+	c.set("c", &AuthzDecision{}, time.Minute)
+	if _, ok := c.items["expired"]; ok {
+		t.Error("已过期的结果没有淘汰")
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("get(%q) 未命中", key)
+		}
+	}
+	if c.ll.Len() != len(c.items) {
+		t.Errorf("list长度%d与map长度%d不一致", c.ll.Len(), len(c.items))
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithFlushInterval HTTP响应写入客户端的刷新间隔, 用于长轮询和分块传输的流式响应
+// 默认0不按时间刷新, 小于0时每次写入后立即刷新
+// text/event-stream和长度未知(Content-Length为-1)的响应总是每次写入后立即刷新
+func WithFlushInterval(d time.Duration) Option {
+	return func(opt *options) {
+		opt.flushInterval = d
+	}
+}
+
+// flushIntervalFor 响应的刷新间隔
+func (p *Proxy) flushIntervalFor(resp *http.Response) time.Duration {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+	if resp.ContentLength == -1 {
+		return -1
+	}
+
+	return p.flushInterval
+}
+
+// copyResponse 写入响应body, 按刷新间隔调用http.Flusher
+func (p *Proxy) copyResponse(rw http.ResponseWriter, resp *http.Response) error {
+	interval := p.flushIntervalFor(resp)
+	flusher, ok := rw.(http.Flusher)
+	if interval == 0 || !ok {
+		_, err := p.buffers.copy(rw, resp.Body)
+		return err
+	}
+	// 先发送响应头, 客户端可以尽早开始处理流
+	flusher.Flush()
+	w := &flushWriter{w: rw, f: flusher, interval: interval}
+	defer w.stop()
+	_, err := p.buffers.copy(w, resp.Body)
+
+	return err
+}
+
+// flushWriter 写入后立即刷新, 或在interval内最多刷新一次
+type flushWriter struct {
+	w        io.Writer
+	f        http.Flusher
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+	stopped bool
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.w.Write(b)
+	if w.interval < 0 {
+		w.f.Flush()
+		return n, err
+	}
+	if w.pending {
+		return n, err
+	}
+	w.pending = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.interval, w.delayedFlush)
+	} else {
+		w.timer.Reset(w.interval)
+	}
+
+	return n, err
+}
+
+func (w *flushWriter) delayedFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.pending || w.stopped {
+		return
+	}
+	w.f.Flush()
+	w.pending = false
+}
+
+// stop 停止定时刷新, 结束后由http.Server写入剩余数据
+func (w *flushWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
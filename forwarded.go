@@ -0,0 +1,165 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedMode 客户端发送的X-Forwarded-For、Forwarded和Via的处理方式
+type ForwardedMode int
+
+const (
+	// ForwardedAppend 保留客户端发送的值, 追加本次的客户端IP
+	ForwardedAppend ForwardedMode = iota
+	// ForwardedStrip 删除客户端发送的值, 只保留本代理添加的, 防止客户端伪造
+	ForwardedStrip
+	// ForwardedTrusted 客户端IP属于TrustedProxies时保留, 否则删除
+	ForwardedTrusted
+)
+
+// ForwardedConfig 转发请求时添加客户端信息的请求头
+type ForwardedConfig struct {
+	Mode ForwardedMode
+	// TrustedProxies 可信的下游代理, IP或CIDR, Mode为ForwardedTrusted时使用
+	TrustedProxies []string
+	// XForwardedFor 追加客户端IP到X-Forwarded-For
+	XForwardedFor bool
+	// Forwarded 追加RFC 7239的Forwarded: for=客户端IP;proto=http或https;host=Host
+	Forwarded bool
+	// Via 追加Via使用的代理名称, 如goproxy, 为空时不添加
+	Via string
+}
+
+// WithForwardedHeaders 转发请求时添加X-Forwarded-For、Forwarded和Via
+// 在Host、URL重写之后、BeforeRequest之前处理, BeforeRequest中仍可修改, CONNECT隧道不处理
+func WithForwardedHeaders(config ForwardedConfig) Option {
+	return func(opt *options) {
+		opt.forwarded = &config
+	}
+}
+
+type forwarded struct {
+	config  ForwardedConfig
+	trusted []*net.IPNet
+}
+
+func newForwarded(config ForwardedConfig) *forwarded {
+	return &forwarded{config: config, trusted: parseIPNets(config.TrustedProxies)}
+}
+
+// parseIPNets 解析IP或CIDR列表, 忽略无效的值
+func parseIPNets(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keep 是否保留客户端发送的值
+func (f *forwarded) keep(ip net.IP) bool {
+	switch f.config.Mode {
+	case ForwardedStrip:
+		return false
+	case ForwardedTrusted:
+		return ip != nil && containsIP(f.trusted, ip)
+	}
+
+	return true
+}
+
+func (f *forwarded) apply(req *http.Request) {
+	client := hostname(req.RemoteAddr)
+	ip := net.ParseIP(client)
+	if !f.keep(ip) {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("Forwarded")
+		req.Header.Del("Via")
+	}
+	if f.config.XForwardedFor && client != "" {
+		appendHeader(req.Header, "X-Forwarded-For", client)
+	}
+	if f.config.Forwarded {
+		node := client
+		if ip == nil {
+			node = "unknown"
+		}
+		proto := req.URL.Scheme
+		if proto == "" {
+			proto = "http"
+		}
+		appendHeader(req.Header, "Forwarded", fmt.Sprintf("for=%s;proto=%s;host=%s",
+			forwardedValue(node, ip != nil && ip.To4() == nil), proto, forwardedValue(req.Host, false)))
+	}
+	if f.config.Via != "" {
+		appendHeader(req.Header, "Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, f.config.Via))
+	}
+}
+
+// appendHeader 追加到已有值的末尾, 多个请求头合并为一个
+func appendHeader(h http.Header, key, value string) {
+	if prior := h.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(key, value)
+}
+
+// forwardedValue RFC 7239的值, IPv6地址加方括号, 不是token时加引号
+func forwardedValue(v string, ipv6 bool) string {
+	if ipv6 {
+		return `"[` + v + `]"`
+	}
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,501 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	ftpAnonymousPassword = "anonymous@"
+	// 目录列表的最大长度
+	ftpMaxListing = 8 << 20
+)
+
+// WithFTPGateway 处理浏览器通过代理发送的GET ftp://请求, 使用被动模式连接FTP服务器
+// 目录返回HTML列表, 文件以流式body返回, 用户名密码来自URL或Authorization, 都没有时匿名登录
+// FTP服务器总是直接连接, 不经过上级代理
+func WithFTPGateway() Option {
+	return func(opt *options) {
+		opt.ftpGateway = true
+	}
+}
+
+// ftpError FTP服务器返回的错误响应
+type ftpError struct {
+	Code int
+	Msg  string
+}
+
+func (e *ftpError) Error() string {
+	return fmt.Sprintf("FTP服务器响应: %d %s", e.Code, e.Msg)
+}
+
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// cmd 发送命令并读取响应, 支持多行响应
+func (c *ftpConn) cmd(format string, args ...interface{}) (int, string, error) {
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+
+	return c.text.ReadResponse(0)
+}
+
+// expect 发送命令, 响应码不是2xx或3xx时返回ftpError
+func (c *ftpConn) expect(format string, args ...interface{}) (int, error) {
+	code, msg, err := c.cmd(format, args...)
+	if err != nil {
+		return 0, err
+	}
+	if code >= 400 {
+		return code, &ftpError{Code: code, Msg: msg}
+	}
+
+	return code, nil
+}
+
+func (c *ftpConn) close() {
+	c.text.Cmd("QUIT")
+	c.conn.Close()
+}
+
+// passive 进入被动模式并建立数据连接, 优先使用EPSV, 数据连接使用控制连接的服务器地址
+func (c *ftpConn) passive(ctx context.Context, dial DialContextFunc) (net.Conn, error) {
+	host := hostname(c.conn.RemoteAddr().String())
+	var port int
+	code, msg, err := c.cmd("EPSV")
+	if err != nil {
+		return nil, err
+	}
+	if code == 229 {
+		// 229 Entering Extended Passive Mode (|||6446|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			port, _ = strconv.Atoi(msg[start+4 : end])
+		}
+	} else {
+		code, msg, err = c.cmd("PASV")
+		if err != nil {
+			return nil, err
+		}
+		if code != 227 {
+			return nil, &ftpError{Code: code, Msg: msg}
+		}
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start >= 0 && end > start {
+			fields := strings.Split(msg[start+1:end], ",")
+			if len(fields) == 6 {
+				p1, _ := strconv.Atoi(strings.TrimSpace(fields[4]))
+				p2, _ := strconv.Atoi(strings.TrimSpace(fields[5]))
+				port = p1<<8 | p2
+			}
+		}
+	}
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("无效的被动模式响应: %s", msg)
+	}
+
+	return dial(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// roundTripFTP 登录FTP服务器, 返回文件或目录列表
+func (p *Proxy) roundTripFTP(ctx *Context, req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := ftpResponse(req, http.StatusMethodNotAllowed, "text/plain; charset=utf-8", "FTP只支持GET和HEAD")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp, nil
+	}
+	// 路径和用户名密码作为FTP命令的参数发送, 包含换行时可注入其他命令
+	user, password := ftpCredentials(req)
+	if ftpUnsafe(req.URL.Path) || ftpUnsafe(user) || ftpUnsafe(password) {
+		return ftpResponse(req, http.StatusBadRequest, "text/plain; charset=utf-8", "FTP路径或用户名密码包含非法字符"), nil
+	}
+	dialCtx := withProxyContext(withDialer(req.Context(), ctx.Dialer), ctx)
+	dial := func(c context.Context, network, addr string) (net.Conn, error) {
+		c, cancel := context.WithTimeout(c, p.connectTimeout)
+		defer cancel()
+		conn, err := p.dialContext(c, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return withIdleTimeout(conn, p.targetRWTimeout), nil
+	}
+	conn, err := dial(dialCtx, "tcp", ensurePort(req.URL.Host, "21"))
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	// 客户端取消请求时中断控制连接, 正在读取的数据连接由body关闭
+	stop := context.AfterFunc(req.Context(), func() {
+		conn.Close()
+	})
+	resp, err := p.ftpRequest(dialCtx, c, req, dial)
+	if err == nil {
+		if body, ok := resp.Body.(*ftpBody); ok {
+			body.stop = stop
+			return resp, nil
+		}
+	}
+	stop()
+	c.close()
+	if err != nil {
+		var fe *ftpError
+		if errors.As(err, &fe) {
+			return ftpErrorResponse(req, fe), nil
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (p *Proxy) ftpRequest(ctx context.Context, c *ftpConn, req *http.Request, dial DialContextFunc) (*http.Response, error) {
+	if code, msg, err := c.text.ReadResponse(0); err != nil {
+		return nil, err
+	} else if code != 220 {
+		return nil, &ftpError{Code: code, Msg: msg}
+	}
+	user, password := ftpCredentials(req)
+	code, err := c.expect("USER %s", user)
+	if err == nil && code == 331 {
+		code, err = c.expect("PASS %s", password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code != 230 && code != 202 {
+		return nil, &ftpError{Code: 530, Msg: "登录失败"}
+	}
+	if _, err = c.expect("TYPE I"); err != nil {
+		return nil, err
+	}
+	name := req.URL.Path
+	if name == "" {
+		name = "/"
+	}
+	if strings.HasSuffix(name, "/") {
+		return p.ftpList(ctx, c, req, name, dial)
+	}
+
+	size := int64(-1)
+	if code, msg, err := c.cmd("SIZE %s", name); err != nil {
+		return nil, err
+	} else if code == 213 {
+		size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if req.Method == http.MethodHead && size >= 0 {
+		resp := ftpResponse(req, http.StatusOK, contentType, "")
+		resp.ContentLength = size
+		return resp, nil
+	}
+	var data net.Conn
+	code, msg := 550, "不是文件"
+	if req.Method == http.MethodGet {
+		if data, err = c.passive(ctx, dial); err != nil {
+			return nil, err
+		}
+		if code, msg, err = c.cmd("RETR %s", name); err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+	if code != 125 && code != 150 {
+		if data != nil {
+			data.Close()
+		}
+		// 不是文件时重定向到目录
+		if code == 550 {
+			if _, err := c.expect("CWD %s", name); err == nil {
+				resp := ftpResponse(req, http.StatusMovedPermanently, "text/plain; charset=utf-8", "")
+				resp.Header.Set("Location", ftpDirURL(req))
+				return resp, nil
+			}
+		}
+		return nil, &ftpError{Code: code, Msg: msg}
+	}
+	resp := ftpResponse(req, http.StatusOK, contentType, "")
+	resp.ContentLength = size
+	resp.Body = &ftpBody{data: data, ctrl: c}
+
+	return resp, nil
+}
+
+// ftpCredentials 用户名密码来自URL或Authorization, 都没有时匿名登录
+func ftpCredentials(req *http.Request) (user, password string) {
+	if req.URL.User != nil {
+		password, _ = req.URL.User.Password()
+		return req.URL.User.Username(), password
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		return user, password
+	}
+
+	return "anonymous", ftpAnonymousPassword
+}
+
+// ftpUnsafe 是否包含CR、LF或NUL, 不能作为FTP命令的参数
+func ftpUnsafe(s string) bool {
+	return strings.ContainsAny(s, "\r\n\x00")
+}
+
+// ftpDirURL 目录地址加上/, 去掉用户名密码
+func ftpDirURL(req *http.Request) string {
+	u := *req.URL
+	u.User = nil
+	u.Path += "/"
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// ftpBody 文件内容, 读完后读取传输完成的响应, 关闭时退出登录
+type ftpBody struct {
+	data net.Conn
+	ctrl *ftpConn
+	eof  bool
+	stop func() bool
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	n, err := b.data.Read(p)
+	if err == io.EOF {
+		b.eof = true
+		b.data.Close()
+		if code, msg, e := b.ctrl.text.ReadResponse(0); e != nil {
+			err = e
+		} else if code >= 400 {
+			err = &ftpError{Code: code, Msg: msg}
+		}
+	}
+
+	return n, err
+}
+
+func (b *ftpBody) Close() error {
+	b.stop()
+	b.data.Close()
+	if b.eof {
+		b.ctrl.close()
+	} else {
+		b.ctrl.conn.Close()
+	}
+
+	return nil
+}
+
+// ftpEntry 目录列表项
+type ftpEntry struct {
+	Name     string
+	Href     string
+	Dir      bool
+	Size     string
+	Modified string
+	Raw      string
+}
+
+var ftpListTemplate = template.Must(template.New("ftp").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{if .Parent}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{.Size}}</td><td>{{.Modified}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ftpList 返回HTML目录列表, 优先使用MLSD, 服务器不支持时使用LIST
+func (p *Proxy) ftpList(ctx context.Context, c *ftpConn, req *http.Request, dir string, dial DialContextFunc) (*http.Response, error) {
+	if _, err := c.expect("CWD %s", dir); err != nil {
+		return nil, err
+	}
+	if req.Method == http.MethodHead {
+		return ftpResponse(req, http.StatusOK, "text/html; charset=utf-8", ""), nil
+	}
+	var entries []ftpEntry
+	for _, command := range []string{"MLSD", "LIST"} {
+		listing, code, err := c.listing(ctx, command, dial)
+		if err != nil {
+			return nil, err
+		}
+		// 500、502表示不支持MLSD
+		if command == "MLSD" && (code == 500 || code == 502) {
+			continue
+		}
+		if code >= 400 {
+			return nil, &ftpError{Code: code, Msg: "读取目录失败"}
+		}
+		entries = parseFTPListing(listing, command == "MLSD")
+		break
+	}
+	var buf bytes.Buffer
+	err := ftpListTemplate.Execute(&buf, struct {
+		Title   string
+		Parent  bool
+		Entries []ftpEntry
+	}{Title: "ftp://" + req.URL.Host + dir, Parent: dir != "/", Entries: entries})
+	if err != nil {
+		return nil, err
+	}
+
+	return ftpResponse(req, http.StatusOK, "text/html; charset=utf-8", buf.String()), nil
+}
+
+// listing 通过数据连接读取列表命令的输出, 返回命令的响应码
+func (c *ftpConn) listing(ctx context.Context, command string, dial DialContextFunc) ([]byte, int, error) {
+	data, err := c.passive(ctx, dial)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer data.Close()
+	code, _, err := c.cmd("%s", command)
+	if err != nil || code != 125 && code != 150 {
+		return nil, code, err
+	}
+	listing, err := io.ReadAll(io.LimitReader(data, ftpMaxListing))
+	if err != nil {
+		return nil, 0, err
+	}
+	data.Close()
+	code, _, err = c.text.ReadResponse(0)
+
+	return listing, code, err
+}
+
+// parseFTPListing 解析MLSD的事实列表或LIST的Unix格式输出
+func parseFTPListing(listing []byte, mlsd bool) []ftpEntry {
+	var entries []ftpEntry
+	for _, line := range strings.Split(string(listing), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		var e ftpEntry
+		if mlsd {
+			facts, name, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			e.Name = name
+			for _, fact := range strings.Split(facts, ";") {
+				k, v, _ := strings.Cut(fact, "=")
+				switch strings.ToLower(k) {
+				case "type":
+					v = strings.ToLower(v)
+					if v == "cdir" || v == "pdir" {
+						e.Name = ""
+					}
+					e.Dir = v == "dir"
+				case "size":
+					e.Size = v
+				case "modify":
+					if len(v) >= 14 {
+						e.Modified = v[:4] + "-" + v[4:6] + "-" + v[6:8] + " " + v[8:10] + ":" + v[10:12] + ":" + v[12:14]
+					}
+				}
+			}
+		} else {
+			// -rw-r--r-- 1 owner group 1234 Jan 01 12:00 name
+			fields := strings.Fields(line)
+			if len(fields) < 9 || strings.HasPrefix(line, "total ") {
+				continue
+			}
+			e.Dir = strings.HasPrefix(fields[0], "d")
+			e.Size = fields[4]
+			e.Modified = strings.Join(fields[5:8], " ")
+			// 名称可能包含空格, 取第8个字段之后的内容
+			rest := line
+			for i := 0; i < 8; i++ {
+				rest = strings.TrimLeft(rest, " ")
+				rest = rest[strings.IndexByte(rest, ' ')+1:]
+			}
+			e.Name = strings.TrimLeft(rest, " ")
+			if strings.HasPrefix(fields[0], "l") {
+				e.Name, _, _ = strings.Cut(e.Name, " -> ")
+			}
+		}
+		if e.Name == "" || e.Name == "." || e.Name == ".." {
+			continue
+		}
+		e.Href = "./" + (&url.URL{Path: e.Name}).EscapedPath()
+		if e.Dir {
+			e.Href += "/"
+			e.Size = ""
+		}
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+func ftpResponse(req *http.Request, statusCode int, contentType, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if body == "" {
+		resp.Body = http.NoBody
+	}
+
+	return resp
+}
+
+// ftpErrorResponse FTP错误转换为HTTP状态码, 登录失败返回401, 浏览器可以提示输入用户名密码
+func ftpErrorResponse(req *http.Request, e *ftpError) *http.Response {
+	statusCode := http.StatusBadGateway
+	switch e.Code {
+	case 530:
+		statusCode = http.StatusUnauthorized
+	case 550:
+		statusCode = http.StatusNotFound
+	}
+	resp := ftpResponse(req, statusCode, "text/plain; charset=utf-8", e.Error())
+	if statusCode == http.StatusUnauthorized {
+		resp.Header.Set("WWW-Authenticate", `Basic realm="FTP `+hostname(req.URL.Host)+`"`)
+	}
+
+	return resp
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// GeoInfo IP地址的地理位置和自治系统信息
+type GeoInfo struct {
+	// Country ISO 3166-1国家代码, 如CN、US
+	Country string
+	// ASN 自治系统号
+	ASN uint
+	// Organization 自治系统所属组织
+	Organization string
+}
+
+// GeoIPReader 查询IP的地理位置, 可封装MaxMind GeoLite2等数据库, 没有记录时返回nil
+type GeoIPReader interface {
+	Lookup(ip net.IP) (*GeoInfo, error)
+}
+
+// WithGeoIP 查询客户端和目标的地理位置, 保存到Context.ClientGeo、Context.TargetGeo, 用于ACLRule.Geo和Upstream.Geo
+// 目标为域名时先解析域名, 使用第一个IP查询
+func WithGeoIP(reader GeoIPReader) Option {
+	return func(opt *options) {
+		opt.geoIP = reader
+	}
+}
+
+// GeoMatch 按地理位置匹配, 为空的条件不检查, 国家代码不区分大小写
+type GeoMatch struct {
+	// Countries 目标所在国家
+	Countries []string `json:"countries"`
+	// ASNs 目标所在自治系统
+	ASNs []uint `json:"asns"`
+	// ClientCountries 客户端所在国家
+	ClientCountries []string `json:"client_countries"`
+}
+
+// match 条件都满足时返回true, 有条件但没有查到地理位置时不匹配
+func (m *GeoMatch) match(ctx *Context) bool {
+	if len(m.Countries) > 0 && (ctx.TargetGeo == nil || !containsFold(m.Countries, ctx.TargetGeo.Country)) {
+		return false
+	}
+	if len(m.ASNs) > 0 && (ctx.TargetGeo == nil || !containsASN(m.ASNs, ctx.TargetGeo.ASN)) {
+		return false
+	}
+	if len(m.ClientCountries) > 0 && (ctx.ClientGeo == nil || !containsFold(m.ClientCountries, ctx.ClientGeo.Country)) {
+		return false
+	}
+
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsASN(list []uint, asn uint) bool {
+	for _, v := range list {
+		if v == asn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupGeo 查询IP的地理位置, 失败时返回nil
+func (p *Proxy) lookupGeo(ip net.IP) *GeoInfo {
+	if ip == nil {
+		return nil
+	}
+	info, err := p.geoIP.Lookup(ip)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("查询%s的地理位置错误: %s", ip, err))
+		return nil
+	}
+
+	return info
+}
+
+// lookupTargetGeo 查询请求目标的地理位置, 目标改变后重新查询
+func (p *Proxy) lookupTargetGeo(ctx *Context) {
+	if p.geoIP == nil {
+		return
+	}
+	host, _ := aclTarget(ctx.Req)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		c := withProxyContext(ctx.Req.Context(), ctx)
+		addrs, err := p.lookupHost(c, host)
+		if err == nil && addrs == nil {
+			addrs, err = net.DefaultResolver.LookupIPAddr(c, host)
+		}
+		if err == nil && len(addrs) > 0 {
+			ip = addrs[0].IP
+		}
+	}
+	ctx.TargetGeo = p.lookupGeo(ip)
+}
+
+// lookupClientGeo 查询客户端的地理位置
+func (p *Proxy) lookupClientGeo(ctx *Context) {
+	if p.geoIP != nil {
+		ctx.ClientGeo = p.lookupGeo(net.ParseIP(ctx.ClientIP))
+	}
+}
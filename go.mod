@@ -1,3 +1,15 @@
 module github.com/ouqiang/goproxy
 
-go 1.13
+// 库本身需要go 1.23, 当前版本由golang.org/x/crypto、x/sys和x/text的要求决定, 见README
+go 1.26.0
+
+require (
+	github.com/andybalholm/brotli v1.2.1
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.58.0
+)
+
+require (
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+)
@@ -0,0 +1,387 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const defaultHARMaxEntries = 1000
+
+// HAR HTTP Archive 1.2格式, 可导入浏览器开发者工具、Charles、Fiddler等查看
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog HAR的log对象
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+// HARCreator 生成HAR的工具
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry 一次请求和响应
+type HAREntry struct {
+	StartedDateTime string `json:"startedDateTime"`
+	// Time 总耗时, 毫秒
+	Time     float64     `json:"time"`
+	Request  HARRequest  `json:"request"`
+	Response HARResponse `json:"response"`
+	Cache    struct{}    `json:"cache"`
+	Timings  HARTimings  `json:"timings"`
+	Comment  string      `json:"comment,omitempty"`
+}
+
+// HARRequest HAR的request对象
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARResponse HAR的response对象, 请求失败时Status为0
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	// Error 请求失败的原因, HAR扩展字段
+	Error string `json:"_error,omitempty"`
+}
+
+// HARNameValue header和查询参数
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARCookie HAR的cookie对象
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// HARPostData 请求body, 不是UTF-8文本时以base64编码
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+// HARContent 响应body, 不是UTF-8文本时以base64编码
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings 各阶段耗时, 毫秒, 未知或不适用时为-1
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	// Connect 建立连接的耗时, 包括SSL
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// NewHAREntry 将采样记录转换为HAR entry
+func NewHAREntry(c *Capture) *HAREntry {
+	e := &HAREntry{
+		StartedDateTime: c.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            harMillis(c.Duration),
+		Request: HARRequest{
+			Method:      c.Method,
+			URL:         c.URL,
+			HTTPVersion: harVersion(c.Proto),
+			Cookies:     harCookies((&http.Request{Header: c.RequestHeader}).Cookies()),
+			Headers:     harHeaders(c.RequestHeader),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    int64(len(c.RequestBody)),
+		},
+		Response: HARResponse{
+			Status:      c.Status,
+			StatusText:  http.StatusText(c.Status),
+			HTTPVersion: harVersion(c.ResponseProto),
+			Cookies:     harCookies((&http.Response{Header: c.ResponseHeader}).Cookies()),
+			Headers:     harHeaders(c.ResponseHeader),
+			RedirectURL: c.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    int64(len(c.ResponseBody)),
+			Error:       c.Error,
+		},
+		Comment: c.RequestID,
+	}
+	if u, err := url.Parse(c.URL); err == nil {
+		e.Request.QueryString = harQuery(u.Query())
+	}
+	if len(c.RequestBody) > 0 {
+		text, encoding := harText(c.RequestBody)
+		e.Request.PostData = &HARPostData{
+			MimeType: c.RequestHeader.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		}
+	}
+	content := &e.Response.Content
+	content.Size = int64(len(c.ResponseBody))
+	content.MimeType = c.ResponseHeader.Get("Content-Type")
+	if len(c.ResponseBody) > 0 {
+		content.Text, content.Encoding = harText(c.ResponseBody)
+	}
+	if c.ResponseTruncated {
+		content.Comment = "truncated"
+	}
+	e.Timings = harTimings(c)
+
+	return e
+}
+
+// harTimings Capture只记录连接、TLS握手和首字节耗时, 其余时间计入receive
+func harTimings(c *Capture) HARTimings {
+	t := HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	var used time.Duration
+	if c.Timing.Dial > 0 || c.Timing.TLSHandshake > 0 {
+		t.Connect = harMillis(c.Timing.Dial + c.Timing.TLSHandshake)
+		used += c.Timing.Dial + c.Timing.TLSHandshake
+	}
+	if c.Timing.TLSHandshake > 0 {
+		t.SSL = harMillis(c.Timing.TLSHandshake)
+	}
+	t.Wait = harMillis(c.Timing.TTFB)
+	used += c.Timing.TTFB
+	if receive := c.Duration - used; receive > 0 {
+		t.Receive = harMillis(receive)
+	}
+
+	return t
+}
+
+func harMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func harVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+
+	return proto
+}
+
+// harHeaders 按名称排序, 同名的多个值分别输出
+func harHeaders(h http.Header) []HARNameValue {
+	list := []HARNameValue{}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			list = append(list, HARNameValue{Name: k, Value: v})
+		}
+	}
+
+	return list
+}
+
+func harQuery(q url.Values) []HARNameValue {
+	list := []HARNameValue{}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range q[k] {
+			list = append(list, HARNameValue{Name: k, Value: v})
+		}
+	}
+
+	return list
+}
+
+func harCookies(cookies []*http.Cookie) []HARCookie {
+	list := []HARCookie{}
+	for _, c := range cookies {
+		hc := HARCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			hc.Expires = c.Expires.Format(time.RFC3339)
+		}
+		list = append(list, hc)
+	}
+
+	return list
+}
+
+// harText UTF-8文本原样输出, 否则以base64编码
+func harText(b []byte) (text, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+// HARRecorder 保存记录并导出为HAR, 作为SamplingConfig.Sink使用, 全部记录时SamplingConfig.Rate设为1
+// 配合WithDecryptHTTPS可记录HTTPS解密后的请求
+type HARRecorder struct {
+	max int
+
+	mu      sync.Mutex
+	entries []*HAREntry
+}
+
+var _ CaptureSink = &HARRecorder{}
+
+// NewHARRecorder 最多保存maxEntries条记录, 超出时丢弃最早的, 默认1000
+func NewHARRecorder(maxEntries int) *HARRecorder {
+	if maxEntries <= 0 {
+		maxEntries = defaultHARMaxEntries
+	}
+
+	return &HARRecorder{max: maxEntries}
+}
+
+// Capture 实现CaptureSink接口
+func (r *HARRecorder) Capture(c *Capture) {
+	e := NewHAREntry(c)
+	r.mu.Lock()
+	if len(r.entries) >= r.max {
+		n := copy(r.entries, r.entries[len(r.entries)-r.max+1:])
+		r.entries = r.entries[:n]
+	}
+	r.entries = append(r.entries, e)
+	r.mu.Unlock()
+}
+
+// HAR 返回当前记录的副本, 按请求开始时间排序
+func (r *HARRecorder) HAR() *HAR {
+	r.mu.Lock()
+	entries := make([]*HAREntry, len(r.entries))
+	copy(entries, r.entries)
+	r.mu.Unlock()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime < entries[j].StartedDateTime
+	})
+
+	return newHAR(entries)
+}
+
+// WriteTo 将当前记录以HAR格式写入w
+func (r *HARRecorder) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.Marshal(r.HAR())
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+
+	return int64(n), err
+}
+
+// Len 当前的记录数
+func (r *HARRecorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.entries)
+}
+
+// Reset 清空记录, 开始新的会话
+func (r *HARRecorder) Reset() {
+	r.mu.Lock()
+	r.entries = nil
+	r.mu.Unlock()
+}
+
+// ServeHTTP 下载当前记录的HAR文件
+func (r *HARRecorder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "goproxy.har"}))
+	r.WriteTo(rw)
+}
+
+func newHAR(entries []*HAREntry) *HAR {
+	return &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "goproxy", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+// NewHARCaptureSink 每条记录一行HAR entry JSON写入w, 用于持续写入文件或发送到其他进程
+func NewHARCaptureSink(w io.Writer) CaptureSink {
+	return &harCaptureSink{w: w}
+}
+
+type harCaptureSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *harCaptureSink) Capture(c *Capture) {
+	line, err := json.Marshal(NewHAREntry(c))
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	s.w.Write(line)
+	s.mu.Unlock()
+}
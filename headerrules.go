@@ -0,0 +1,201 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// HeaderAction header操作类型
+type HeaderAction int
+
+const (
+	// HeaderSet 设置header, 替换已有的值
+	HeaderSet HeaderAction = iota
+	// HeaderAdd 追加一个值
+	HeaderAdd
+	// HeaderRemove 删除header, 忽略Value
+	HeaderRemove
+)
+
+// HeaderOp 一个header操作
+// Value支持变量: {client_ip}、{request_id}、{user}、{host}、{method}、{path}、{scheme}, 未知的变量原样保留
+type HeaderOp struct {
+	Action HeaderAction
+	Name   string
+	Value  string
+}
+
+// HeaderRule header重写规则, 所有条件都满足时应用, 条件为空时不限制
+type HeaderRule struct {
+	// Host 匹配请求的域名, 支持*.example.com
+	Host string
+	// Path 匹配请求的path, CONNECT隧道没有path, 设置Path的规则不匹配隧道
+	Path *regexp.Regexp
+	// Methods 匹配请求方法, 如GET、CONNECT
+	Methods []string
+	// Request 转发前对请求header的操作, 设置Host时修改请求的Host
+	Request []HeaderOp
+	// Response 收到响应后对响应header的操作, CONNECT隧道不使用
+	Response []HeaderOp
+}
+
+// WithHeaderRules 按规则修改请求和响应header, 按顺序应用所有匹配的规则
+// HTTP请求(包括HTTPS解密后的请求)在BeforeRequest之前修改请求header, 在BeforeResponse之前修改响应header
+// CONNECT隧道在BeforeTunnelForward之前修改CONNECT请求的header, Set和Add的header发送给HTTP上级代理
+func WithHeaderRules(rules ...HeaderRule) Option {
+	return func(opt *options) {
+		opt.headerRules = append(opt.headerRules, rules...)
+	}
+}
+
+func (r *HeaderRule) match(req *http.Request) bool {
+	if r.Host != "" && !matchHost(r.Host, req.URL.Host) {
+		return false
+	}
+	if r.Path != nil && (req.Method == http.MethodConnect || !r.Path.MatchString(req.URL.Path)) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, req.Method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyRequestHeaderRules 修改请求header, 返回Set和Add的header名称
+func (p *Proxy) applyRequestHeaderRules(ctx *Context) []string {
+	var names []string
+	for i := range p.headerRules {
+		rule := &p.headerRules[i]
+		if !rule.match(ctx.Req) {
+			continue
+		}
+		for _, op := range rule.Request {
+			value := expandHeaderValue(ctx, op.Value)
+			if http.CanonicalHeaderKey(op.Name) == "Host" {
+				if op.Action != HeaderRemove && value != "" {
+					ctx.Req.Host = value
+				}
+				continue
+			}
+			applyHeaderOp(ctx.Req.Header, op, value)
+			if op.Action != HeaderRemove {
+				names = append(names, op.Name)
+			}
+		}
+	}
+
+	return names
+}
+
+// applyResponseHeaderRules 修改响应header
+func (p *Proxy) applyResponseHeaderRules(ctx *Context, resp *http.Response) {
+	for i := range p.headerRules {
+		rule := &p.headerRules[i]
+		if len(rule.Response) == 0 || !rule.match(ctx.Req) {
+			continue
+		}
+		for _, op := range rule.Response {
+			applyHeaderOp(resp.Header, op, expandHeaderValue(ctx, op.Value))
+		}
+	}
+}
+
+// applyTunnelHeaderRules 修改CONNECT请求的header, 记录需要发送给上级代理的header
+func (p *Proxy) applyTunnelHeaderRules(ctx *Context) {
+	names := p.applyRequestHeaderRules(ctx)
+	if len(names) == 0 {
+		return
+	}
+	ctx.tunnelHeader = make(http.Header)
+	for _, name := range names {
+		if values := ctx.Req.Header.Values(name); len(values) > 0 {
+			ctx.tunnelHeader[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+}
+
+func applyHeaderOp(h http.Header, op HeaderOp, value string) {
+	switch op.Action {
+	case HeaderSet:
+		h.Set(op.Name, value)
+	case HeaderAdd:
+		h.Add(op.Name, value)
+	case HeaderRemove:
+		h.Del(op.Name)
+	}
+}
+
+// expandHeaderValue 替换{name}形式的变量
+func expandHeaderValue(ctx *Context, value string) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(value, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+		b.WriteString(value[:start])
+		if v, ok := headerVariable(ctx, value[start+1:end]); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(value[start : end+1])
+		}
+		value = value[end+1:]
+	}
+	b.WriteString(value)
+
+	return b.String()
+}
+
+func headerVariable(ctx *Context, name string) (string, bool) {
+	req := ctx.Req
+	switch name {
+	case "client_ip":
+		return ctx.ClientIP, true
+	case "request_id":
+		return ctx.RequestID, true
+	case "user":
+		return ctx.User, true
+	case "host":
+		return hostname(req.URL.Host), true
+	case "method":
+		return req.Method, true
+	case "path":
+		return req.URL.Path, true
+	case "scheme":
+		if req.URL.Scheme == "" {
+			return "http", true
+		}
+		return req.URL.Scheme, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,333 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HookStats 扩展点的执行耗时
+type HookStats struct {
+	// Calls 调用次数
+	Calls int64
+	// Total 累计耗时
+	Total time.Duration
+	// Max 单次最长耗时
+	Max time.Duration
+}
+
+type hookStat struct {
+	calls int64
+	total int64
+	max   int64
+}
+
+func (s *hookStat) observe(d time.Duration) {
+	atomic.AddInt64(&s.calls, 1)
+	atomic.AddInt64(&s.total, int64(d))
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&s.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (s *hookStat) since(start time.Time) {
+	s.observe(time.Since(start))
+}
+
+func (s *hookStat) snapshot() HookStats {
+	return HookStats{
+		Calls: atomic.LoadInt64(&s.calls),
+		Total: time.Duration(atomic.LoadInt64(&s.total)),
+		Max:   time.Duration(atomic.LoadInt64(&s.max)),
+	}
+}
+
+// hookStats 按名称统计Delegate方法、body转换和内容适配的耗时
+// 名称为Delegate方法名, 或"RequestBodyTransformer[序号] 类型"等, 用于定位增加延迟的扩展
+type hookStats struct {
+	connect        hookStat
+	auth           hookStat
+	beforeRequest  hookStat
+	beforeResponse hookStat
+	onError        hookStat
+	modifyRequest  hookStat
+	modifyResponse hookStat
+	beforeTunnel   hookStat
+	tunnelOpen     hookStat
+	tunnelClosed   hookStat
+	resolveHost    hookStat
+	routeSNI       hookStat
+	circuit        hookStat
+	limitExceeded  hookStat
+	bodyLimit      hookStat
+	blocked        hookStat
+	connectPort    hookStat
+	contentBlocked hookStat
+	parentProxy    hookStat
+	parentCreds    hookStat
+	complete       hookStat
+	finish         hookStat
+
+	mu    sync.Mutex
+	named []namedHookStat
+}
+
+type namedHookStat struct {
+	name string
+	stat *hookStat
+}
+
+// register 注册按名称统计的扩展点, 在New中调用
+func (h *hookStats) register(kind string, i int, v interface{}) *hookStat {
+	s := &hookStat{}
+	h.mu.Lock()
+	h.named = append(h.named, namedHookStat{name: fmt.Sprintf("%s[%d] %T", kind, i, v), stat: s})
+	h.mu.Unlock()
+
+	return s
+}
+
+func (h *hookStats) snapshot() map[string]HookStats {
+	m := map[string]HookStats{
+		"Connect":                h.connect.snapshot(),
+		"Auth":                   h.auth.snapshot(),
+		"BeforeRequest":          h.beforeRequest.snapshot(),
+		"BeforeResponse":         h.beforeResponse.snapshot(),
+		"OnError":                h.onError.snapshot(),
+		"ModifyRequestBody":      h.modifyRequest.snapshot(),
+		"ModifyResponseBody":     h.modifyResponse.snapshot(),
+		"BeforeTunnelForward":    h.beforeTunnel.snapshot(),
+		"TunnelEstablished":      h.tunnelOpen.snapshot(),
+		"TunnelClosed":           h.tunnelClosed.snapshot(),
+		"ResolveHost":            h.resolveHost.snapshot(),
+		"RouteSNI":               h.routeSNI.snapshot(),
+		"CircuitStateChanged":    h.circuit.snapshot(),
+		"LimitExceeded":          h.limitExceeded.snapshot(),
+		"BodyLimitExceeded":      h.bodyLimit.snapshot(),
+		"Blocked":                h.blocked.snapshot(),
+		"ConnectPortAllowed":     h.connectPort.snapshot(),
+		"ContentBlocked":         h.contentBlocked.snapshot(),
+		"ParentProxy":            h.parentProxy.snapshot(),
+		"ParentProxyCredentials": h.parentCreds.snapshot(),
+		"Complete":               h.complete.snapshot(),
+		"Finish":                 h.finish.snapshot(),
+	}
+	h.mu.Lock()
+	for _, n := range h.named {
+		m[n.name] = n.stat.snapshot()
+	}
+	h.mu.Unlock()
+
+	return m
+}
+
+// HookNames 按累计耗时从高到低排列的扩展点名称
+func (s Stats) HookNames() []string {
+	names := make([]string, 0, len(s.Hooks))
+	for name := range s.Hooks {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := s.Hooks[names[i]], s.Hooks[names[j]]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+// 带耗时统计的Delegate调用
+
+func (p *Proxy) callConnect(ctx *Context, rw http.ResponseWriter) {
+	defer p.hooks.connect.since(time.Now())
+	p.delegateOf(ctx).Connect(ctx, rw)
+}
+
+func (p *Proxy) callAuth(ctx *Context, rw http.ResponseWriter) {
+	defer p.hooks.auth.since(time.Now())
+	p.delegateOf(ctx).Auth(ctx, rw)
+}
+
+func (p *Proxy) callBeforeRequest(ctx *Context) {
+	defer p.hooks.beforeRequest.since(time.Now())
+	p.delegateOf(ctx).BeforeRequest(ctx)
+}
+
+func (p *Proxy) callBeforeResponse(ctx *Context, resp *http.Response, err error) {
+	defer p.hooks.beforeResponse.since(time.Now())
+	p.delegateOf(ctx).BeforeResponse(ctx, resp, err)
+}
+
+func (p *Proxy) callOnError(ctx *Context, rw http.ResponseWriter, err error) {
+	defer p.hooks.onError.since(time.Now())
+	p.delegateOf(ctx).OnError(ctx, rw, err)
+}
+
+// callModifyRequestBody 替换请求body时删除长度
+func (p *Proxy) callModifyRequestBody(ctx *Context, req *http.Request) {
+	defer p.hooks.modifyRequest.since(time.Now())
+	body := p.delegateOf(ctx).ModifyRequestBody(ctx, req)
+	if body == nil || body == req.Body {
+		return
+	}
+	req.Body = body
+	req.ContentLength = -1
+	req.TransferEncoding = nil
+	req.Header.Del("Content-Length")
+}
+
+// callModifyResponseBody 替换响应body时删除长度
+func (p *Proxy) callModifyResponseBody(ctx *Context, resp *http.Response) {
+	defer p.hooks.modifyResponse.since(time.Now())
+	body := p.delegateOf(ctx).ModifyResponseBody(ctx, resp)
+	if body == nil || body == resp.Body {
+		return
+	}
+	resp.Body = body
+	resp.ContentLength = -1
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Length")
+}
+
+func (p *Proxy) callBeforeTunnelForward(ctx *Context) {
+	defer p.hooks.beforeTunnel.since(time.Now())
+	p.delegateOf(ctx).BeforeTunnelForward(ctx)
+}
+
+func (p *Proxy) callTunnelEstablished(ctx *Context, targetConn net.Conn) {
+	defer p.hooks.tunnelOpen.since(time.Now())
+	p.delegateOf(ctx).TunnelEstablished(ctx, targetConn)
+}
+
+func (p *Proxy) callTunnelClosed(ctx *Context, bytesUp, bytesDown int64, err error) {
+	defer p.hooks.tunnelClosed.since(time.Now())
+	p.delegateOf(ctx).TunnelClosed(ctx, bytesUp, bytesDown, err)
+}
+
+func (p *Proxy) callCircuitStateChanged(host string, state CircuitState) {
+	defer p.hooks.circuit.since(time.Now())
+	p.delegate.CircuitStateChanged(host, state)
+}
+
+func (p *Proxy) callResolveHost(ctx *Context, host string) ([]net.IP, error) {
+	defer p.hooks.resolveHost.since(time.Now())
+	return p.delegateOf(ctx).ResolveHost(ctx, host)
+}
+
+func (p *Proxy) callRouteSNI(ctx *Context) *SNIRule {
+	defer p.hooks.routeSNI.since(time.Now())
+	return p.delegateOf(ctx).RouteSNI(ctx)
+}
+
+func (p *Proxy) callLimitExceeded(ctx *Context, err error, page *BlockPage) {
+	defer p.hooks.limitExceeded.since(time.Now())
+	p.delegateOf(ctx).LimitExceeded(ctx, err, page)
+}
+
+func (p *Proxy) callBodyLimitExceeded(ctx *Context, err error, limit int64) {
+	defer p.hooks.bodyLimit.since(time.Now())
+	p.delegateOf(ctx).BodyLimitExceeded(ctx, err, limit)
+}
+
+func (p *Proxy) callBlocked(ctx *Context, rule *ACLRule, page *BlockPage) {
+	defer p.hooks.blocked.since(time.Now())
+	p.delegateOf(ctx).Blocked(ctx, rule, page)
+}
+
+func (p *Proxy) callConnectPortAllowed(ctx *Context, port int, allowed bool) bool {
+	defer p.hooks.connectPort.since(time.Now())
+	return p.delegateOf(ctx).ConnectPortAllowed(ctx, port, allowed)
+}
+
+func (p *Proxy) callContentBlocked(ctx *Context, rule *ContentRule, contentType string, page *BlockPage) {
+	defer p.hooks.contentBlocked.since(time.Now())
+	p.delegateOf(ctx).ContentBlocked(ctx, rule, contentType, page)
+}
+
+func (p *Proxy) callParentProxy(req *http.Request) (*url.URL, error) {
+	defer p.hooks.parentProxy.since(time.Now())
+	if l := listenerOf(req.Context()); l != nil && l.delegate != nil {
+		return l.delegate.ParentProxy(req)
+	}
+	return p.delegate.ParentProxy(req)
+}
+
+func (p *Proxy) callParentProxyCredentials(ctx *Context, parent *url.URL, attempt int) *ParentCredentials {
+	defer p.hooks.parentCreds.since(time.Now())
+	return p.delegateOf(ctx).ParentProxyCredentials(ctx, parent, attempt)
+}
+
+func (p *Proxy) callComplete(ctx *Context, outcome *Outcome) {
+	defer p.hooks.complete.since(time.Now())
+	p.delegateOf(ctx).Complete(ctx, outcome)
+}
+
+func (p *Proxy) callFinish(ctx *Context) {
+	defer p.hooks.finish.since(time.Now())
+	p.delegateOf(ctx).Finish(ctx)
+}
+
+// timedReader 累计Read耗时
+type timedReader struct {
+	rc io.ReadCloser
+	d  time.Duration
+}
+
+func (r *timedReader) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := r.rc.Read(b)
+	r.d += time.Since(start)
+
+	return n, err
+}
+
+func (r *timedReader) Close() error {
+	return r.rc.Close()
+}
+
+// transformTimer 统计body转换自身的耗时, 即输出的Read耗时减去读取输入的耗时, 关闭时记录
+type transformTimer struct {
+	timedReader
+	input *timedReader
+	setup time.Duration
+	stat  *hookStat
+	once  sync.Once
+}
+
+func (t *transformTimer) Close() error {
+	err := t.timedReader.Close()
+	t.once.Do(func() {
+		d := t.setup + t.d - t.input.d
+		if d < 0 {
+			d = 0
+		}
+		t.stat.observe(d)
+	})
+
+	return err
+}
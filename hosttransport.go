@@ -0,0 +1,211 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultHostTransportIdleTimeout = 5 * time.Minute
+
+// HostTransport 匹配的目标主机使用独立的transport和连接池, 为0的设置使用默认transport的值
+type HostTransport struct {
+	// Hosts 目标主机, 支持精确匹配、*.example.com和*
+	Hosts []string
+	// PerHost 每个匹配的主机使用独立的transport, 默认匹配该规则的主机共用一个transport
+	PerHost bool
+	// MaxIdleConnsPerHost 每个主机的最大空闲连接数
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost 每个主机的最大连接数
+	MaxConnsPerHost int
+	// IdleConnTimeout 空闲连接的超时时间
+	IdleConnTimeout time.Duration
+	// TLSHandshakeTimeout TLS握手超时时间
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout 等待响应头的超时时间
+	ResponseHeaderTimeout time.Duration
+	// DisableKeepAlives 不复用连接
+	DisableKeepAlives bool
+	// TLSConfig 与目标服务器的TLS设置, 替换WithUpstreamTLS等的设置
+	TLSConfig *tls.Config
+}
+
+// HostTransportConfig 按目标主机的transport设置
+type HostTransportConfig struct {
+	// Rules 按顺序匹配第一条规则, 没有匹配的规则时使用默认transport
+	Rules []HostTransport
+	// IdleTimeout 超过该时间没有使用的transport关闭空闲连接后移除, 默认5分钟
+	IdleTimeout time.Duration
+}
+
+// WithHostTransports 按目标主机使用独立的transport, transport在第一次使用时创建
+// 直连和经过HTTP上级代理的请求使用, 经过SSH、SOCKS5上级代理和WithParentProxyAuth认证的上级代理时不使用
+func WithHostTransports(config HostTransportConfig) Option {
+	return func(opt *options) {
+		opt.hostTransports = &config
+	}
+}
+
+type hostTransportKey struct {
+	rule int
+	host string
+}
+
+type hostTransportEntry struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+type hostTransports struct {
+	rules       []HostTransport
+	idleTimeout time.Duration
+	// 移除transport时同时移除由它派生的transport
+	forget func(*http.Transport)
+
+	mu        sync.Mutex
+	entries   map[hostTransportKey]*hostTransportEntry
+	lastSweep time.Time
+}
+
+func newHostTransports(config HostTransportConfig, forget func(*http.Transport)) *hostTransports {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultHostTransportIdleTimeout
+	}
+
+	return &hostTransports{
+		rules:       config.Rules,
+		idleTimeout: config.IdleTimeout,
+		forget:      forget,
+		entries:     make(map[hostTransportKey]*hostTransportEntry),
+		lastSweep:   time.Now(),
+	}
+}
+
+// get 返回目标主机的transport, 没有匹配的规则时返回base
+func (h *hostTransports) get(base *http.Transport, host string) *http.Transport {
+	host = hostname(host)
+	rule := -1
+	for i := range h.rules {
+		if matchAnyHost(h.rules[i].Hosts, host) {
+			rule = i
+			break
+		}
+	}
+	if rule < 0 {
+		return base
+	}
+	key := hostTransportKey{rule: rule}
+	if h.rules[rule].PerHost {
+		key.host = host
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.lastSweep) >= h.idleTimeout/2 {
+		h.sweep(now)
+	}
+	e, ok := h.entries[key]
+	if !ok {
+		e = &hostTransportEntry{transport: h.rules[rule].transport(base)}
+		h.entries[key] = e
+	}
+	e.lastUsed = now
+
+	return e.transport
+}
+
+// sweep 移除长时间未使用的transport, 正在进行的请求不受影响, 调用方需持有mu
+func (h *hostTransports) sweep(now time.Time) {
+	h.lastSweep = now
+	for key, e := range h.entries {
+		if now.Sub(e.lastUsed) < h.idleTimeout {
+			continue
+		}
+		delete(h.entries, key)
+		e.transport.CloseIdleConnections()
+		h.forget(e.transport)
+	}
+}
+
+// closeIdleConnections 关闭所有transport的空闲连接
+func (h *hostTransports) closeIdleConnections() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.entries {
+		e.transport.CloseIdleConnections()
+	}
+}
+
+func (r *HostTransport) transport(base *http.Transport) *http.Transport {
+	t := base.Clone()
+	if r.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = r.MaxIdleConnsPerHost
+	}
+	if r.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = r.MaxConnsPerHost
+	}
+	if r.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = r.IdleConnTimeout
+	}
+	if r.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = r.TLSHandshakeTimeout
+	}
+	if r.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = r.ResponseHeaderTimeout
+	}
+	if r.DisableKeepAlives {
+		t.DisableKeepAlives = true
+	}
+	if r.TLSConfig != nil {
+		t.TLSClientConfig = r.TLSConfig.Clone()
+	}
+
+	return t
+}
+
+func matchAnyHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forgetTransport 移除由base派生的transport, 关闭它们的空闲连接
+func (p *Proxy) forgetTransport(base *http.Transport) {
+	derived := p.serverNameTransports.removeBase(base)
+	p.dialerTransports.Range(func(k, v interface{}) bool {
+		if k.(dialerTransportKey).base == base {
+			p.dialerTransports.Delete(k)
+			derived = append(derived, v.(*http.Transport))
+		}
+		return true
+	})
+	if v, ok := p.insecureTransports.LoadAndDelete(base); ok {
+		derived = append(derived, v.(*http.Transport))
+	}
+	if v, ok := p.handshakeTransports.LoadAndDelete(base); ok {
+		derived = append(derived, v.(*http.Transport))
+	}
+	for _, t := range derived {
+		t.CloseIdleConnections()
+		p.forgetTransport(t)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HSTSEntry 域名的HSTS策略
+type HSTSEntry struct {
+	Host              string
+	Expires           time.Time
+	IncludeSubDomains bool
+}
+
+// HSTSStore 保存HSTS策略, 可实现持久化或多实例共享
+type HSTSStore interface {
+	Get(host string) (*HSTSEntry, bool)
+	Set(entry *HSTSEntry)
+	Delete(host string)
+}
+
+// HSTSConfig HSTS设置
+type HSTSConfig struct {
+	// Preload 预加载的域名, 包括所有子域名, 永不过期
+	Preload []string
+	// Store 保存从响应中学习到的策略, 默认保存在内存中
+	Store HSTSStore
+}
+
+// WithHSTS 记录HTTPS响应中的Strict-Transport-Security, 匹配的HTTP请求在转发前升级为HTTPS,
+// 用于保护不处理HSTS的客户端. 显式使用80端口时改为443, 其他端口不变
+func WithHSTS(config HSTSConfig) Option {
+	return func(opt *options) {
+		opt.hsts = &config
+	}
+}
+
+type hsts struct {
+	preload map[string]bool
+	store   HSTSStore
+}
+
+func newHSTS(config HSTSConfig) *hsts {
+	h := &hsts{preload: make(map[string]bool), store: config.Store}
+	for _, host := range config.Preload {
+		h.preload[strings.ToLower(strings.TrimSuffix(host, "."))] = true
+	}
+	if h.store == nil {
+		h.store = NewMemoryHSTSStore()
+	}
+
+	return h
+}
+
+// upgrade 匹配HSTS策略的HTTP请求改为HTTPS
+func (h *hsts) upgrade(req *http.Request) {
+	u := req.URL
+	if u.Scheme != "http" {
+		return
+	}
+	host := strings.TrimSuffix(strings.ToLower(hostname(u.Host)), ".")
+	if net.ParseIP(host) != nil || !h.match(host) {
+		return
+	}
+	u.Scheme = "https"
+	if u.Port() == "80" {
+		u.Host = u.Hostname()
+		if _, port, err := net.SplitHostPort(req.Host); err == nil && port == "80" {
+			req.Host = hostname(req.Host)
+		}
+	}
+}
+
+// match 先匹配完整域名, 再匹配includeSubDomains的上级域名
+func (h *hsts) match(host string) bool {
+	now := time.Now()
+	for d, exact := host, true; d != ""; exact = false {
+		if h.preload[d] {
+			return true
+		}
+		if entry, ok := h.store.Get(d); ok {
+			if now.After(entry.Expires) {
+				h.store.Delete(d)
+			} else if exact || entry.IncludeSubDomains {
+				return true
+			}
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+
+	return false
+}
+
+// observe 记录HTTPS响应中的Strict-Transport-Security, HTTP响应中的忽略
+func (h *hsts) observe(resp *http.Response) {
+	if resp.Request == nil || resp.Request.URL.Scheme != "https" {
+		return
+	}
+	value := resp.Header.Get("Strict-Transport-Security")
+	if value == "" {
+		return
+	}
+	host := strings.TrimSuffix(strings.ToLower(hostname(resp.Request.URL.Host)), ".")
+	if net.ParseIP(host) != nil {
+		return
+	}
+	maxAge := int64(-1)
+	includeSubDomains := false
+	for _, directive := range strings.Split(value, ";") {
+		name, v, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "max-age":
+			n, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(v), `"`), 10, 64)
+			if err != nil || n < 0 {
+				return
+			}
+			maxAge = n
+		case "includesubdomains":
+			includeSubDomains = true
+		}
+	}
+	switch {
+	case maxAge < 0:
+		return
+	case maxAge == 0:
+		h.store.Delete(host)
+	default:
+		h.store.Set(&HSTSEntry{
+			Host:              host,
+			Expires:           time.Now().Add(time.Duration(maxAge) * time.Second),
+			IncludeSubDomains: includeSubDomains,
+		})
+	}
+}
+
+// MemoryHSTSStore 内存中的HSTSStore
+type MemoryHSTSStore struct {
+	mu      sync.RWMutex
+	entries map[string]*HSTSEntry
+}
+
+// NewMemoryHSTSStore 创建内存HSTSStore
+func NewMemoryHSTSStore() *MemoryHSTSStore {
+	return &MemoryHSTSStore{entries: make(map[string]*HSTSEntry)}
+}
+
+func (s *MemoryHSTSStore) Get(host string) (*HSTSEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.entries[host]
+
+	return entry, ok
+}
+
+func (s *MemoryHSTSStore) Set(entry *HSTSEntry) {
+	s.mu.Lock()
+	s.entries[entry.Host] = entry
+	s.mu.Unlock()
+}
+
+func (s *MemoryHSTSStore) Delete(host string) {
+	s.mu.Lock()
+	delete(s.entries, host)
+	s.mu.Unlock()
+}
+
+// Entries 所有未过期的策略
+func (s *MemoryHSTSStore) Entries() []*HSTSEntry {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]*HSTSEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		if now.Before(entry.Expires) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
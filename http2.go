@@ -0,0 +1,139 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// WithHTTP2 开启HTTP/2, 与目标服务器通过ALPN协商h2, HTTPS解密时也与客户端协商h2
+// WebSocket等协议升级请求仍使用HTTP/1.1
+func WithHTTP2() Option {
+	return func(opt *options) {
+		opt.http2 = true
+	}
+}
+
+// serveHTTP2 HTTPS解密后与客户端协商了h2, 每个stream作为独立的请求处理
+func (p *Proxy) serveHTTP2(ctx *Context, conn *tls.Conn) {
+	// 由http2.Server管理空闲超时
+	conn.SetDeadline(time.Time{})
+	server := &http2.Server{IdleTimeout: p.clientIdleTimeout}
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			p.serveHTTP2Stream(ctx, rw, req)
+		}),
+	})
+}
+
+func (p *Proxy) serveHTTP2Stream(conn *Context, rw http.ResponseWriter, req *http.Request) {
+	if p.Paused() {
+		p.writeMaintenance(rw)
+		return
+	}
+	req.RemoteAddr = conn.Req.RemoteAddr
+	req.TLS = conn.ClientTLS
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Host
+	atomic.AddInt64(&p.stats.totalRequests, 1)
+	ctx := conn.stream(req)
+	req.Body = newCountBody(req.Body, &ctx.Bytes.ClientRead)
+	start := time.Now()
+	ctx.interim = responseInterim(rw)
+	p.DoRequest(ctx, func(resp *http.Response, err error) {
+		if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+			resp.Body.Close()
+			err = fmt.Errorf("HTTP/2不支持协议升级")
+		}
+		if err != nil {
+			p.recordError(ctx, upstreamErrorClass(err), err)
+			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, HTTP/2请求错误: %s", ctx.Req.URL, err))
+			ctx.status = p.writeError(ctx, rw, err)
+			return
+		}
+		defer resp.Body.Close()
+		ctx.status = resp.StatusCode
+		resp.Body = newCountBody(resp.Body, &ctx.Bytes.ClientWritten)
+		CopyHeader(rw.Header(), resp.Header)
+		announceTrailers(rw.Header(), resp)
+		rw.WriteHeader(resp.StatusCode)
+		if err := p.copyResponse(rw, resp); err != nil && !isClientGone(req) {
+			// 中断stream, 客户端可以发现响应不完整
+			panic(http.ErrAbortHandler)
+		}
+		copyTrailers(rw.Header(), resp)
+	})
+	p.metrics.request(AccessLogTypeHTTPS, req.Method, ctx.status)
+	p.complete(ctx, req, AccessLogTypeHTTPS, start, ctx.status, ctx.Bytes)
+}
+
+// isClientGone 客户端已取消请求
+func isClientGone(req *http.Request) bool {
+	return req.Context().Err() != nil
+}
+
+// stream HTTP/2连接上每个stream使用独立的Context, 连接级的认证用户、配额和限速与连接共享
+func (c *Context) stream(req *http.Request) *Context {
+	data := make(map[interface{}]interface{}, len(c.Data))
+	for k, v := range c.Data {
+		data[k] = v
+	}
+
+	return &Context{
+		Req:               req,
+		Data:              data,
+		ServerName:        c.ServerName,
+		ClientTLS:         c.ClientTLS,
+		ListenerTLS:       c.ListenerTLS,
+		ClientCert:        c.ClientCert,
+		User:              c.User,
+		SNI:               c.SNI,
+		ALPN:              c.ALPN,
+		Timeouts:          c.Timeouts,
+		Bandwidth:         c.Bandwidth,
+		Dialer:            c.Dialer,
+		OriginalDst:       c.OriginalDst,
+		ClientIP:          c.ClientIP,
+		ClientGeo:         c.ClientGeo,
+		RequestID:         newRequestID(),
+		Start:             time.Now(),
+		quota:             c.quota,
+		throttle:          c.throttle,
+		clientConn:        c.clientConn,
+		blockPageRenderer: c.blockPageRenderer,
+		policyEvents:      c.policyEvents,
+		Listener:          c.Listener,
+		listener:          c.listener,
+	}
+}
+
+// http1Response 写入HTTP/1.1客户端前调整响应, 上游为HTTP/2时版本号和长度未知的body需要转换
+// 有trailer时必须使用chunked, resp.Write声明Trailer头并在body之后写入
+func http1Response(resp *http.Response) {
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if len(resp.Trailer) > 0 && resp.Body != nil && resp.Body != http.NoBody {
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	}
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && resp.Body != nil && resp.Body != http.NoBody {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+}
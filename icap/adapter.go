@@ -0,0 +1,174 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package icap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/ouqiang/goproxy"
+)
+
+const defaultMaxBodySize = 10 << 20
+
+// Config Adapter配置
+type Config struct {
+	// ReqModService REQMOD服务名, 如reqmod, 为空时不检查请求
+	ReqModService string
+	// RespModService RESPMOD服务名, 如respmod, 为空时不检查响应
+	RespModService string
+	// Bypass ICAP服务器出错时放行, 否则响应502
+	Bypass bool
+	// MaxBodySize 最多缓存的body大小, 超过时不检查直接放行, 默认10MB
+	MaxBodySize int64
+	// ErrorLog 记录放行的错误
+	ErrorLog func(error)
+}
+
+// Adapter 把请求和响应交给ICAP服务器处理, 实现goproxy.ContentAdapter
+type Adapter struct {
+	client *Client
+	config Config
+}
+
+// NewAdapter 创建Adapter, 用于goproxy.WithContentAdapters
+func NewAdapter(c *Client, config Config) *Adapter {
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+
+	return &Adapter{client: c, config: config}
+}
+
+// AdaptRequest 发送REQMOD
+func (a *Adapter) AdaptRequest(ctx *goproxy.Context, req *http.Request) (*http.Request, *http.Response, error) {
+	if a.config.ReqModService == "" || req.Header.Get("Upgrade") != "" {
+		return nil, nil, nil
+	}
+	body, ok, err := a.readBody(&req.Body, hasBody(req.Body, req.ContentLength))
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	newReq, resp, err := a.client.ReqMod(a.config.ReqModService, a.header(ctx), req, body)
+	if err != nil {
+		if err = a.bypass(req, a.config.ReqModService, err); err != nil {
+			return nil, nil, err
+		}
+		if body != nil {
+			setRequestBody(req, body, true)
+		}
+		return req, nil, nil
+	}
+	if newReq == req && body != nil {
+		setRequestBody(req, body, true)
+	}
+
+	return newReq, resp, nil
+}
+
+// AdaptResponse 发送RESPMOD
+func (a *Adapter) AdaptResponse(ctx *goproxy.Context, resp *http.Response) (*http.Response, error) {
+	if a.config.RespModService == "" || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil, nil
+	}
+	body, ok, err := a.readBody(&resp.Body, hasBody(resp.Body, resp.ContentLength))
+	if err != nil || !ok {
+		return nil, err
+	}
+	newResp, err := a.client.RespMod(a.config.RespModService, a.header(ctx), resp.Request, resp, body)
+	if err != nil {
+		if err = a.bypass(resp.Request, a.config.RespModService, err); err != nil {
+			return nil, err
+		}
+		newResp = resp
+	}
+	if newResp == resp && body != nil {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Del("Content-Length")
+		resp.TransferEncoding = nil
+	}
+
+	return newResp, nil
+}
+
+// header X-Client-IP和X-Authenticated-User
+func (a *Adapter) header(ctx *goproxy.Context) http.Header {
+	h := make(http.Header)
+	if ctx.Req != nil {
+		if ip := clientIP(ctx.Req.RemoteAddr); ip != "" {
+			h.Set("X-Client-IP", ip)
+		}
+	}
+	if ctx.User != "" {
+		h.Set("X-Authenticated-User", base64.StdEncoding.EncodeToString([]byte("Local://"+ctx.User)))
+	}
+
+	return h
+}
+
+// readBody 缓存body, 超过MaxBodySize时恢复body并返回ok为false
+func (a *Adapter) readBody(body *io.ReadCloser, has bool) ([]byte, bool, error) {
+	if !has {
+		return nil, true, nil
+	}
+	rc := *body
+	buf, err := ioutil.ReadAll(io.LimitReader(rc, a.config.MaxBodySize+1))
+	if err != nil {
+		rc.Close()
+		return nil, false, err
+	}
+	if int64(len(buf)) > a.config.MaxBodySize {
+		*body = &readCloser{Reader: io.MultiReader(bytes.NewReader(buf), rc), Closer: rc}
+		return nil, false, nil
+	}
+	rc.Close()
+
+	return buf, true, nil
+}
+
+func (a *Adapter) bypass(req *http.Request, service string, err error) error {
+	err = fmt.Errorf("ICAP %s错误: %s", service, err)
+	if !a.config.Bypass {
+		return err
+	}
+	if a.config.ErrorLog != nil {
+		url := ""
+		if req != nil {
+			url = req.URL.String()
+		}
+		a.config.ErrorLog(fmt.Errorf("%s - 放行, %s", url, err))
+	}
+
+	return nil
+}
+
+func clientIP(remoteAddr string) string {
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return ip
+	}
+
+	return remoteAddr
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
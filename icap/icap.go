@@ -0,0 +1,617 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package icap ICAP客户端(RFC 3507), 支持REQMOD、RESPMOD和Preview, 用于把请求和响应交给DLP、病毒扫描等内容适配服务器
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolSize   = 10
+	defaultTimeout    = 30 * time.Second
+	defaultOptionsTTL = time.Hour
+)
+
+// StatusError ICAP服务器返回的错误状态码
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "icap: " + e.Status
+}
+
+type options struct {
+	poolSize   int
+	timeout    time.Duration
+	preview    int
+	hasPreview bool
+}
+
+type Option func(*options)
+
+// WithPoolSize 最多保留的空闲连接数, 默认10
+func WithPoolSize(n int) Option {
+	return func(opt *options) {
+		opt.poolSize = n
+	}
+}
+
+// WithTimeout 连接和单次请求的超时时间, 默认30秒
+func WithTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.timeout = d
+	}
+}
+
+// WithPreview 指定Preview字节数, 不使用OPTIONS返回的值, 小于0时不使用Preview
+func WithPreview(n int) Option {
+	return func(opt *options) {
+		opt.preview = n
+		opt.hasPreview = true
+	}
+}
+
+// ServiceOptions OPTIONS请求返回的服务配置
+type ServiceOptions struct {
+	Methods []string
+	ISTag   string
+	// Preview 服务器期望的Preview字节数, 小于0时不支持Preview
+	Preview int
+	// Allow204 是否支持204(不修改)
+	Allow204 bool
+	// TTL 配置的有效期
+	TTL time.Duration
+}
+
+type cachedOptions struct {
+	opts    *ServiceOptions
+	expires time.Time
+}
+
+// Client ICAP客户端, 并发安全, 连接按需建立
+type Client struct {
+	addr string
+	host string
+	opts *options
+	idle chan *conn
+
+	mu       sync.Mutex
+	services map[string]*cachedOptions
+}
+
+// New 创建客户端, addr为host:port, 不立即连接
+func New(addr string, opt ...Option) *Client {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+	if opts.poolSize <= 0 {
+		opts.poolSize = defaultPoolSize
+	}
+	if opts.timeout <= 0 {
+		opts.timeout = defaultTimeout
+	}
+	host := addr
+	if h, port, err := net.SplitHostPort(addr); err == nil && port == "1344" {
+		host = h
+	}
+
+	return &Client{
+		addr:     addr,
+		host:     host,
+		opts:     opts,
+		idle:     make(chan *conn, opts.poolSize),
+		services: make(map[string]*cachedOptions),
+	}
+}
+
+// Close 关闭空闲连接
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Options 获取服务配置, 按Options-TTL缓存
+func (c *Client) Options(service string) (*ServiceOptions, error) {
+	c.mu.Lock()
+	cached := c.services[service]
+	c.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.opts, nil
+	}
+	resp, err := c.do(&request{method: "OPTIONS", service: service})
+	if err != nil {
+		return nil, err
+	}
+	so := &ServiceOptions{
+		ISTag:   resp.header.Get("ISTag"),
+		Preview: -1,
+		TTL:     defaultOptionsTTL,
+	}
+	for _, m := range strings.Split(resp.header.Get("Methods"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			so.Methods = append(so.Methods, m)
+		}
+	}
+	if v := resp.header.Get("Preview"); v != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n >= 0 {
+			so.Preview = n
+		}
+	}
+	for _, v := range strings.Split(resp.header.Get("Allow"), ",") {
+		if strings.TrimSpace(v) == "204" {
+			so.Allow204 = true
+		}
+	}
+	if v := resp.header.Get("Options-TTL"); v != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n > 0 {
+			so.TTL = time.Duration(n) * time.Second
+		}
+	}
+	c.mu.Lock()
+	c.services[service] = &cachedOptions{opts: so, expires: time.Now().Add(so.TTL)}
+	c.mu.Unlock()
+
+	return so, nil
+}
+
+// ReqMod 请求修改, body为完整的请求body, header为额外的ICAP请求头(如X-Client-IP)
+// 服务器未修改时返回原请求; 服务器直接返回响应(如拦截页面)时返回的响应不为nil
+func (c *Client) ReqMod(service string, header http.Header, req *http.Request, body []byte) (*http.Request, *http.Response, error) {
+	preview, err := c.preview(service)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.do(&request{
+		method:  "REQMOD",
+		service: service,
+		header:  header,
+		reqHdr:  requestHeader(req, body),
+		body:    body,
+		hasBody: hasBody(req.Body, req.ContentLength) || len(body) > 0,
+		preview: preview,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.code == http.StatusNoContent {
+		return req, nil, nil
+	}
+	if resp.resHdr != nil {
+		httpResp, err := parseResponse(resp, req)
+		return req, httpResp, err
+	}
+	if resp.reqHdr == nil {
+		return nil, nil, errors.New("icap: REQMOD响应缺少req-hdr或res-hdr")
+	}
+	newReq, err := parseRequest(resp, req)
+
+	return newReq, nil, err
+}
+
+// RespMod 响应修改, body为完整的响应body, 服务器未修改时返回原响应
+func (c *Client) RespMod(service string, header http.Header, req *http.Request, resp *http.Response, body []byte) (*http.Response, error) {
+	preview, err := c.preview(service)
+	if err != nil {
+		return nil, err
+	}
+	r := &request{
+		method:  "RESPMOD",
+		service: service,
+		header:  header,
+		resHdr:  responseHeader(resp, body),
+		body:    body,
+		hasBody: hasBody(resp.Body, resp.ContentLength) || len(body) > 0,
+		preview: preview,
+	}
+	if req != nil {
+		r.reqHdr = requestHeader(req, nil)
+	}
+	icapResp, err := c.do(r)
+	if err != nil {
+		return nil, err
+	}
+	if icapResp.code == http.StatusNoContent {
+		return resp, nil
+	}
+	if icapResp.resHdr == nil {
+		return nil, errors.New("icap: RESPMOD响应缺少res-hdr")
+	}
+
+	return parseResponse(icapResp, req)
+}
+
+// preview 返回本次请求的Preview字节数, 小于0时不使用Preview
+func (c *Client) preview(service string) (int, error) {
+	if c.opts.hasPreview {
+		return c.opts.preview, nil
+	}
+	so, err := c.Options(service)
+	if err != nil {
+		return -1, err
+	}
+	if !so.Allow204 {
+		return -1, nil
+	}
+
+	return so.Preview, nil
+}
+
+func hasBody(body io.ReadCloser, contentLength int64) bool {
+	return body != nil && body != http.NoBody && contentLength != 0
+}
+
+type request struct {
+	method  string
+	service string
+	header  http.Header
+	reqHdr  []byte
+	resHdr  []byte
+	body    []byte
+	hasBody bool
+	preview int
+}
+
+type response struct {
+	code    int
+	status  string
+	header  textproto.MIMEHeader
+	reqHdr  []byte
+	resHdr  []byte
+	body    []byte
+	hasBody bool
+}
+
+// do 发送请求并读取响应, Preview时先发送部分body, 收到100 Continue后再发送剩余部分
+func (c *Client) do(r *request) (*response, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.exchange(cn, r)
+	if err != nil || strings.EqualFold(resp.header.Get("Connection"), "close") {
+		cn.Close()
+	} else {
+		c.put(cn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.code >= 300 {
+		return nil, &StatusError{Code: resp.code, Status: resp.status}
+	}
+
+	return resp, nil
+}
+
+func (c *Client) exchange(cn *conn, r *request) (*response, error) {
+	cn.SetDeadline(time.Now().Add(c.opts.timeout))
+	w := cn.w
+	fmt.Fprintf(w, "%s icap://%s/%s ICAP/1.0\r\n", r.method, c.host, strings.TrimPrefix(r.service, "/"))
+	fmt.Fprintf(w, "Host: %s\r\n", c.host)
+	if r.method != "OPTIONS" {
+		w.WriteString("Allow: 204\r\n")
+	}
+	for k, vs := range r.header {
+		for _, v := range vs {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	preview := r.preview
+	if !r.hasBody {
+		preview = -1
+	}
+	if preview >= 0 {
+		if preview > len(r.body) {
+			preview = len(r.body)
+		}
+		fmt.Fprintf(w, "Preview: %d\r\n", preview)
+	}
+	fmt.Fprintf(w, "Encapsulated: %s\r\n\r\n", encapsulated(r))
+	w.Write(r.reqHdr)
+	w.Write(r.resHdr)
+	if !r.hasBody {
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		return readResponse(cn.r)
+	}
+	if preview < 0 {
+		writeChunk(w, r.body)
+		w.WriteString("0\r\n\r\n")
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		return readResponse(cn.r)
+	}
+	writeChunk(w, r.body[:preview])
+	if preview == len(r.body) {
+		w.WriteString("0; ieof\r\n\r\n")
+	} else {
+		w.WriteString("0\r\n\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	resp, err := readResponse(cn.r)
+	if err != nil || resp.code != http.StatusContinue {
+		return resp, err
+	}
+	writeChunk(w, r.body[preview:])
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readResponse(cn.r)
+}
+
+// encapsulated 生成Encapsulated头, 值为各部分的偏移量
+func encapsulated(r *request) string {
+	var parts []string
+	offset := 0
+	if r.reqHdr != nil {
+		parts = append(parts, "req-hdr="+strconv.Itoa(offset))
+		offset += len(r.reqHdr)
+	}
+	if r.resHdr != nil {
+		parts = append(parts, "res-hdr="+strconv.Itoa(offset))
+		offset += len(r.resHdr)
+	}
+	switch {
+	case !r.hasBody:
+		parts = append(parts, "null-body="+strconv.Itoa(offset))
+	case r.method == "RESPMOD":
+		parts = append(parts, "res-body="+strconv.Itoa(offset))
+	default:
+		parts = append(parts, "req-body="+strconv.Itoa(offset))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func writeChunk(w *bufio.Writer, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%x\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func readResponse(br *bufio.Reader) (*response, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, status, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "ICAP/") {
+		return nil, fmt.Errorf("icap: 无效的状态行: %q", line)
+	}
+	codeStr, _, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return nil, fmt.Errorf("icap: 无效的状态码: %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	resp := &response{code: code, status: status, header: header}
+	if code != http.StatusOK {
+		return resp, nil
+	}
+	type section struct {
+		name   string
+		offset int
+	}
+	var sections []section
+	for _, item := range strings.Split(header.Get("Encapsulated"), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		offset, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("icap: 无效的Encapsulated: %q", header.Get("Encapsulated"))
+		}
+		sections = append(sections, section{name: name, offset: offset})
+	}
+	for i, s := range sections {
+		switch s.name {
+		case "req-hdr", "res-hdr":
+			if i+1 >= len(sections) || sections[i+1].offset < s.offset {
+				return nil, fmt.Errorf("icap: 无效的Encapsulated: %q", header.Get("Encapsulated"))
+			}
+			buf := make([]byte, sections[i+1].offset-s.offset)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return nil, err
+			}
+			if s.name == "req-hdr" {
+				resp.reqHdr = buf
+			} else {
+				resp.resHdr = buf
+			}
+		case "req-body", "res-body":
+			body, err := ioutil.ReadAll(httputil.NewChunkedReader(br))
+			if err != nil {
+				return nil, err
+			}
+			// 最后一个chunk之后的trailer
+			for {
+				line, err := tp.ReadLine()
+				if err != nil {
+					return nil, err
+				}
+				if line == "" {
+					break
+				}
+			}
+			resp.body = body
+			resp.hasBody = true
+		}
+	}
+
+	return resp, nil
+}
+
+// requestHeader 序列化HTTP请求头, 请求行使用完整URL
+func requestHeader(req *http.Request, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.Method, req.URL.String())
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	h := req.Header.Clone()
+	h.Del("Host")
+	h.Del("Transfer-Encoding")
+	if body != nil {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	h.Write(&b)
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+// responseHeader 序列化HTTP响应头
+func responseHeader(resp *http.Response, body []byte) []byte {
+	var b bytes.Buffer
+	status := resp.Status
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+	fmt.Fprintf(&b, "HTTP/1.1 %s\r\n", status)
+	h := resp.Header.Clone()
+	h.Del("Transfer-Encoding")
+	if body != nil {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	h.Write(&b)
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+// parseRequest 解析修改后的请求, 保留原请求的context, URL不完整时使用原请求的scheme和host
+func parseRequest(resp *response, orig *http.Request) (*http.Request, error) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(resp.reqHdr)))
+	if err != nil {
+		return nil, fmt.Errorf("icap: 解析修改后的请求错误: %s", err)
+	}
+	u := r.URL
+	if u.Host == "" {
+		u.Scheme = orig.URL.Scheme
+		u.Host = orig.URL.Host
+	}
+	newReq := new(http.Request)
+	*newReq = *orig
+	newReq.Method = r.Method
+	newReq.URL = u
+	newReq.Host = r.Host
+	newReq.Header = r.Header
+	newReq.Header.Del("Content-Length")
+	newReq.TransferEncoding = nil
+	setRequestBody(newReq, resp.body, resp.hasBody)
+
+	return newReq, nil
+}
+
+func setRequestBody(req *http.Request, body []byte, has bool) {
+	if !has {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+		req.GetBody = nil
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// parseResponse 解析ICAP服务器返回的HTTP响应
+func parseResponse(resp *response, req *http.Request) (*http.Response, error) {
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp.resHdr)), req)
+	if err != nil {
+		return nil, fmt.Errorf("icap: 解析修改后的响应错误: %s", err)
+	}
+	r.Body.Close()
+	r.Header.Del("Content-Length")
+	r.Header.Del("Transfer-Encoding")
+	r.TransferEncoding = nil
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	if resp.hasBody {
+		r.Body = ioutil.NopCloser(bytes.NewReader(resp.body))
+		r.ContentLength = int64(len(resp.body))
+	}
+
+	return r, nil
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", c.addr, c.opts.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}, nil
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
@@ -0,0 +1,299 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ErrIntegrity 响应body与摘要不一致
+var ErrIntegrity = errors.New("响应完整性校验失败")
+
+// 默认缓存校验的响应body上限
+const defaultIntegrityMaxBuffer = 10 << 20
+
+// IntegrityMode 校验失败的处理方式
+type IntegrityMode int
+
+const (
+	// IntegrityLog 只记录错误, 响应正常返回
+	IntegrityLog IntegrityMode = iota
+	// IntegrityAbort 边转发边校验, 失败时中断连接, 响应使用chunked编码以便客户端发现响应不完整
+	IntegrityAbort
+	// IntegrityBlock 读取完整body校验后再返回, 失败时返回502, 超过MaxBufferSize时按IntegrityAbort处理
+	IntegrityBlock
+)
+
+// IntegrityConfig 响应完整性校验设置
+type IntegrityConfig struct {
+	Mode IntegrityMode
+	// Pins URL对应的固定摘要, 格式与Subresource Integrity相同, 如sha256-base64, 多个用空格分隔, 匹配任一即可
+	Pins map[string]string
+	// DisableHeaders 不校验响应头中的Content-MD5、Digest、Content-Digest, 只校验Pins
+	DisableHeaders bool
+	// MaxBufferSize IntegrityBlock最多缓存的body大小, 默认10MB
+	MaxBufferSize int64
+}
+
+// WithIntegrityCheck 校验目标服务器或上级代理返回的body, 防止下载的文件损坏或被篡改
+// 摘要针对Content-Encoding编码后的body, 206响应不校验响应头中的摘要
+func WithIntegrityCheck(config IntegrityConfig) Option {
+	return func(opt *options) {
+		if config.MaxBufferSize <= 0 {
+			config.MaxBufferSize = defaultIntegrityMaxBuffer
+		}
+		opt.integrity = &config
+	}
+}
+
+// digestCheck 一个摘要
+type digestCheck struct {
+	name     string
+	h        hash.Hash
+	expected [][]byte
+}
+
+func newDigestHash(alg string) hash.Hash {
+	switch strings.ToLower(alg) {
+	case "md5":
+		return md5.New()
+	case "sha", "sha1", "sha-1":
+		return sha1.New()
+	case "sha256", "sha-256":
+		return sha256.New()
+	case "sha384", "sha-384":
+		return sha512.New384()
+	case "sha512", "sha-512":
+		return sha512.New()
+	}
+
+	return nil
+}
+
+// parseResponseDigests 解析Content-MD5、Digest(RFC 3230)和Content-Digest(RFC 9530)
+func parseResponseDigests(header http.Header) ([]*digestCheck, error) {
+	var checks []*digestCheck
+	add := func(alg, value string) error {
+		h := newDigestHash(alg)
+		if h == nil {
+			// 不支持的算法忽略
+			return nil
+		}
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("摘要%s格式错误: %s", alg, value)
+		}
+		checks = append(checks, &digestCheck{name: alg, h: h, expected: [][]byte{sum}})
+		return nil
+	}
+	if v := header.Get("Content-MD5"); v != "" {
+		if err := add("md5", strings.TrimSpace(v)); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range header.Values("Digest") {
+		for _, item := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if err := add(kv[0], kv[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, v := range header.Values("Content-Digest") {
+		for _, item := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if err := add(kv[0], strings.Trim(kv[1], ":")); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return checks, nil
+}
+
+// parseIntegrity 解析Subresource Integrity格式, 同一算法的多个摘要匹配任一即可
+func parseIntegrity(integrity string) ([]*digestCheck, error) {
+	byAlg := make(map[string]*digestCheck)
+	var checks []*digestCheck
+	for _, item := range strings.Fields(integrity) {
+		// 去掉?后的选项
+		item = strings.SplitN(item, "?", 2)[0]
+		kv := strings.SplitN(item, "-", 2)
+		if len(kv) != 2 || newDigestHash(kv[0]) == nil {
+			return nil, fmt.Errorf("无效的integrity: %s", item)
+		}
+		sum, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("无效的integrity: %s", item)
+		}
+		c, ok := byAlg[kv[0]]
+		if !ok {
+			c = &digestCheck{name: kv[0], h: newDigestHash(kv[0])}
+			byAlg[kv[0]] = c
+			checks = append(checks, c)
+		}
+		c.expected = append(c.expected, sum)
+	}
+
+	return checks, nil
+}
+
+// verifyIntegrity 包装响应body, 读取结束时校验摘要
+func (p *Proxy) verifyIntegrity(ctx *Context, resp *http.Response) (*http.Response, error) {
+	config := p.integrity
+	u := ctx.Req.URL.String()
+	if resp.Request != nil {
+		u = resp.Request.URL.String()
+	}
+	var checks []*digestCheck
+	if pin, ok := config.Pins[u]; ok && resp.StatusCode == http.StatusOK {
+		pinChecks, err := parseIntegrity(pin)
+		if err != nil {
+			return resp, nil
+		}
+		checks = append(checks, pinChecks...)
+	}
+	if !config.DisableHeaders && resp.StatusCode != http.StatusPartialContent {
+		headerChecks, err := parseResponseDigests(resp.Header)
+		if err != nil {
+			p.recordError(ctx, ErrorClassUpstream, err)
+			p.delegate.ErrorLog(fmt.Errorf("%s - %s", u, err))
+		}
+		checks = append(checks, headerChecks...)
+	}
+	if len(checks) == 0 || resp.Body == nil || resp.Body == http.NoBody {
+		return resp, nil
+	}
+	v := &integrityReader{rc: resp.Body, checks: checks, onFail: func(err error) {
+		p.recordError(ctx, ErrorClassUpstream, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - %s", u, err))
+	}}
+	resp.Body = v
+	switch config.Mode {
+	case IntegrityAbort:
+		v.abort = true
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	case IntegrityBlock:
+		v.abort = true
+		if resp.ContentLength > config.MaxBufferSize {
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+			break
+		}
+		// 缓存时校验失败的错误由调用方记录
+		v.quiet = true
+		body, err := ioutil.ReadAll(io.LimitReader(v, config.MaxBufferSize+1))
+		v.quiet = false
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if int64(len(body)) > config.MaxBufferSize {
+			// 超过缓存上限, 剩余部分边转发边校验
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+			resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), v), Closer: v}
+			break
+		}
+		// 读取到EOF时已完成校验
+		v.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return resp, nil
+}
+
+// integrityReader 读取时计算摘要, EOF时比较
+type integrityReader struct {
+	rc     io.ReadCloser
+	checks []*digestCheck
+	abort  bool
+	quiet  bool
+	onFail func(error)
+	done   bool
+	err    error
+}
+
+func (r *integrityReader) Read(b []byte) (int, error) {
+	if r.done {
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+	n, err := r.rc.Read(b)
+	for _, c := range r.checks {
+		c.h.Write(b[:n])
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	r.done = true
+	if failed := r.verify(); failed != "" {
+		err := fmt.Errorf("%w: %s摘要不一致", ErrIntegrity, failed)
+		if !r.quiet {
+			r.onFail(err)
+		}
+		if r.abort {
+			r.err = err
+			return n, err
+		}
+	}
+
+	return n, io.EOF
+}
+
+// verify 返回不一致的算法名称
+func (r *integrityReader) verify() string {
+	for _, c := range r.checks {
+		sum := c.h.Sum(nil)
+		matched := false
+		for _, expected := range c.expected {
+			if subtle.ConstantTimeCompare(sum, expected) == 1 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return c.name
+		}
+	}
+
+	return ""
+}
+
+func (r *integrityReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/ouqiang/goproxy"
+	"github.com/ouqiang/goproxy/proxytest"
+)
+
+// ipv6Origin 返回请求的Host
+func ipv6Origin() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%s%s", req.Host, req.URL.Path)
+	})
+}
+
+func TestIPv6HTTP(t *testing.T) {
+	env := proxytest.New(ipv6Origin())
+	defer env.Close()
+	resp, err := env.Client.Get("http://[::1]/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "[::1]/path" {
+		t.Errorf("响应不符: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestIPv6Connect(t *testing.T) {
+	env := proxytest.New(ipv6Origin())
+	defer env.Close()
+	for _, target := range []string{"[::1]:80", "[2001:db8::1]:80"} {
+		conn, resp, err := env.Connect(target)
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+		if conn == nil {
+			t.Fatalf("%s: CONNECT失败: %s", target, resp.Status)
+		}
+		fmt.Fprintf(conn, "GET /tunnel HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+		resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		if string(body) != target+"/tunnel" {
+			t.Errorf("%s: 响应不符: %q", target, body)
+		}
+	}
+}
+
+func TestIPv6MITM(t *testing.T) {
+	env := proxytest.New(ipv6Origin(), goproxy.WithDecryptHTTPS(nil))
+	defer env.Close()
+	resp, err := env.Client.Get("https://[::1]/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "[::1]/secure" {
+		t.Errorf("响应不符: %d %q", resp.StatusCode, body)
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		t.Fatal("没有TLS连接信息")
+	}
+	leaf := resp.TLS.PeerCertificates[0]
+	if len(leaf.IPAddresses) != 1 || leaf.IPAddresses[0].String() != "::1" {
+		t.Errorf("中间人证书的IP SAN不符: %v", leaf.IPAddresses)
+	}
+}
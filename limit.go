@@ -0,0 +1,354 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHostConnLimit 目标主机并发连接数已达上限
+var ErrHostConnLimit = errors.New("目标主机并发连接数已达上限")
+
+// ErrPerClientRequestLimit 单个客户端的并发请求数已达上限
+var ErrPerClientRequestLimit = errors.New("单个客户端并发请求数已达上限")
+
+// WithMaxRequestsPerClient 在Auth之后限制单个客户端同时处理的请求和隧道数, 超出时返回429, 避免共享代理被少数客户端占满
+// key为nil时与WithRateLimit相同, 按Context.User区分, 未认证的请求按客户端IP区分
+// HTTPS解密后的请求与所在的CONNECT隧道一起计为一个, 空闲的keep-alive连接不计, 限制连接数使用WithMaxClientConns、WithMaxConnsPerClientIP
+func WithMaxRequestsPerClient(max int, key RateLimitKeyFunc) Option {
+	return func(opt *options) {
+		opt.maxClientRequests = max
+		opt.perClientKey = key
+	}
+}
+
+// keyLimiter 按key限制并发数, 如单个目标主机、单个客户端
+type keyLimiter struct {
+	max  int
+	wait time.Duration
+	err  error
+
+	mu   sync.Mutex
+	sems map[string]*hostSem
+}
+
+type hostSem struct {
+	ch   chan struct{}
+	refs int
+}
+
+// newHostLimiter 限制到单个目标主机的并发连接数
+func newHostLimiter(max int, wait time.Duration) *keyLimiter {
+	return &keyLimiter{
+		max:  max,
+		wait: wait,
+		err:  ErrHostConnLimit,
+		sems: make(map[string]*hostSem),
+	}
+}
+
+// newIPConnLimiter 限制单个客户端IP的并发连接数, 不排队
+func newIPConnLimiter(max int) *keyLimiter {
+	return &keyLimiter{
+		max:  max,
+		err:  ErrPerClientConnLimit,
+		sems: make(map[string]*hostSem),
+	}
+}
+
+// newClientLimiter 限制单个客户端的并发请求数, 不排队
+func newClientLimiter(max int) *keyLimiter {
+	return &keyLimiter{
+		max:  max,
+		err:  ErrPerClientRequestLimit,
+		sems: make(map[string]*hostSem),
+	}
+}
+
+// acquireHost 获取目标主机的连接名额, 主机名不区分大小写, 忽略端口
+func (l *keyLimiter) acquireHost(ctx context.Context, addr string) (release func(), err error) {
+	return l.acquire(ctx, strings.ToLower(hostname(addr)))
+}
+
+// acquire 获取名额, wait为0时不排队立即失败
+func (l *keyLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	l.mu.Lock()
+	sem, ok := l.sems[host]
+	if !ok {
+		sem = &hostSem{ch: make(chan struct{}, l.max)}
+		l.sems[host] = sem
+	}
+	sem.refs++
+	l.mu.Unlock()
+
+	release = func() {
+		<-sem.ch
+		l.unref(host, sem)
+	}
+	select {
+	case sem.ch <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.wait > 0 {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case sem.ch <- struct{}{}:
+			return release, nil
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	l.unref(host, sem)
+
+	return nil, l.err
+}
+
+// unref 没有使用者时删除, 避免map无限增长
+func (l *keyLimiter) unref(host string, sem *hostSem) {
+	l.mu.Lock()
+	sem.refs--
+	if sem.refs == 0 {
+		delete(l.sems, host)
+	}
+	l.mu.Unlock()
+}
+
+// ErrClientConnLimit 客户端并发连接数已达上限
+var ErrClientConnLimit = errors.New("客户端并发连接数已达上限")
+
+// ErrPerClientConnLimit 单个客户端IP的并发连接数已达上限
+var ErrPerClientConnLimit = errors.New("单个客户端IP并发连接数已达上限")
+
+const (
+	// rejectConnTimeout 拒绝连接时写入503的超时时间
+	rejectConnTimeout = time.Second
+	// maxRejectingConns 同时写入503的连接数, 超出时直接关闭
+	maxRejectingConns = 64
+	// rejectLogInterval 记录拒绝连接日志的最小间隔
+	rejectLogInterval = time.Second
+)
+
+// connLimiter 限制全局客户端并发连接数, 所有监听共享
+type connLimiter struct {
+	sem  chan struct{}
+	wait time.Duration
+}
+
+func newConnLimiter(max int, wait time.Duration) *connLimiter {
+	return &connLimiter{
+		sem:  make(chan struct{}, max),
+		wait: wait,
+	}
+}
+
+// acquire 获取连接名额, wait为0时不排队立即返回false
+func (l *connLimiter) acquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *connLimiter) release() {
+	<-l.sem
+}
+
+// connRejecter 拒绝超出WithMaxClientConns、WithMaxConnsPerClientIP限制的连接, 所有监听共享
+type connRejecter struct {
+	// rejecting 正在写入503或429的连接
+	rejecting chan struct{}
+
+	// rejected 上次记录日志后拒绝的连接数, loggedAt 上次记录日志的时间
+	rejected int64
+	loggedAt int64
+}
+
+func newConnRejecter() *connRejecter {
+	return &connRejecter{rejecting: make(chan struct{}, maxRejectingConns)}
+}
+
+// logReject 合并记录被拒绝的连接, 每rejectLogInterval最多记录一次, 避免大量连接时日志刷屏
+func (r *connRejecter) logReject(errorLog func(error), addr net.Addr, err error) {
+	atomic.AddInt64(&r.rejected, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&r.loggedAt)
+	if now-last < int64(rejectLogInterval) || !atomic.CompareAndSwapInt64(&r.loggedAt, last, now) {
+		return
+	}
+	n := atomic.SwapInt64(&r.rejected, 0)
+	errorLog(fmt.Errorf("%s - %s, 共拒绝%d个连接", addr, err, n))
+}
+
+// LimitListener 在Accept时限制客户端总并发连接数和单个客户端IP的并发连接数, 见WithMaxClientConns、WithMaxConnsPerClientIP, 都未设置时返回ln
+// 连接关闭后释放名额, 空闲的keep-alive连接和隧道同样占用名额
+// ListenAndServeTLS、ServeTLS、ServeSOCKS5和Server已使用, 自行创建http.Server时使用server.Serve(p.LimitListener(ln))
+func (p *Proxy) LimitListener(ln net.Listener) net.Listener {
+	return p.limitListener(ln, true)
+}
+
+// limitListener reply为true时以HTTP 503或429拒绝超出限制的连接, 否则直接关闭, 用于TLS和SOCKS5监听
+func (p *Proxy) limitListener(ln net.Listener, reply bool) net.Listener {
+	if p.connRejecter == nil {
+		return ln
+	}
+
+	return &limitListener{Listener: ln, proxy: p, reply: reply}
+}
+
+type limitListener struct {
+	net.Listener
+	proxy *Proxy
+	reply bool
+}
+
+// Accept 排队时阻塞Accept, 之后的连接在内核的backlog中等待
+func (l *limitListener) Accept() (net.Conn, error) {
+	rejecter := l.proxy.connRejecter
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, err := l.acquire(conn)
+		if err == nil {
+			return &limitConn{Conn: conn, release: release}, nil
+		}
+		l.proxy.stats.error(ErrorClassLimit)
+		rejecter.logReject(l.proxy.delegate.ErrorLog, conn.RemoteAddr(), err)
+		if !l.reply {
+			conn.Close()
+			continue
+		}
+		select {
+		case rejecter.rejecting <- struct{}{}:
+			go l.reject(conn, err)
+		default:
+			// 正在写入响应的连接过多时直接关闭, 避免每个连接占用goroutine和fd
+			conn.Close()
+		}
+	}
+}
+
+// acquire 先获取客户端IP的名额, 不排队, 再获取总名额
+func (l *limitListener) acquire(conn net.Conn) (release func(), err error) {
+	p := l.proxy
+	release = func() {}
+	if p.ipConnLimiter != nil {
+		release, err = p.ipConnLimiter.acquire(context.Background(), hostname(conn.RemoteAddr().String()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.connLimiter != nil {
+		if !p.connLimiter.acquire() {
+			release()
+			return nil, ErrClientConnLimit
+		}
+		releaseIP := release
+		release = func() {
+			p.connLimiter.release()
+			releaseIP()
+		}
+	}
+
+	return release, nil
+}
+
+// reject 写入响应和Retry-After后关闭连接, 超出总数限制时为503, 超出单个客户端IP的限制时为429
+func (l *limitListener) reject(conn net.Conn, err error) {
+	defer func() {
+		conn.Close()
+		<-l.proxy.connRejecter.rejecting
+	}()
+	conn.SetDeadline(time.Now().Add(rejectConnTimeout))
+	code := errorStatusCode(err)
+	retryAfter := 1
+	if code == http.StatusServiceUnavailable {
+		retryAfter = int(l.proxy.retryAfter / time.Second)
+	}
+	body := err.Error()
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nRetry-After: %d\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), retryAfter, len(body), body)
+	// 读取客户端已发送的请求, 避免直接关闭时返回RST导致客户端收不到响应
+	io.Copy(ioutil.Discard, conn)
+}
+
+// limitConn 关闭时释放名额
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+
+	return err
+}
+
+// acquireClient 获取客户端的请求名额, 超出限制时写入响应并返回false
+func (p *Proxy) acquireClient(ctx *Context, rw http.ResponseWriter) (release func(), ok bool) {
+	keyFunc := p.perClientKey
+	if keyFunc == nil {
+		keyFunc = defaultRateLimitKey
+	}
+	key := keyFunc(ctx)
+	if key == "" {
+		return func() {}, true
+	}
+	release, err := p.clientLimiter.acquire(ctx.Req.Context(), key)
+	if err != nil {
+		p.writeLimitExceeded(ctx, rw, err, &BlockPage{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    err.Error(),
+			Header:     http.Header{"Retry-After": []string{"1"}},
+		})
+		return nil, false
+	}
+
+	return release, true
+}
+
+// writeLimitExceeded 统计错误并调用LimitExceeded后返回页面
+func (p *Proxy) writeLimitExceeded(ctx *Context, rw http.ResponseWriter, err error, page *BlockPage) {
+	p.recordError(ctx, ErrorClassLimit, err)
+	p.callLimitExceeded(ctx, err, page)
+	ctx.WriteBlockPage(rw, page)
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnRejecterLogReject(t *testing.T) {
+	r := newConnRejecter()
+	var logs []string
+	errorLog := func(err error) { logs = append(logs, err.Error()) }
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	for i := 0; i < 100; i++ {
+		r.logReject(errorLog, addr, ErrClientConnLimit)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("记录了%d条日志, 期望1条", len(logs))
+	}
+	r.loggedAt -= int64(rejectLogInterval)
+	r.logReject(errorLog, addr, ErrClientConnLimit)
+	if len(logs) != 2 || !strings.Contains(logs[1], "共拒绝100个连接") {
+		t.Errorf("日志 = %q, 期望合并记录100个连接", logs)
+	}
+}
+
+func TestLimitListenerRejectingFull(t *testing.T) {
+	p := New(WithMaxClientConns(1, 0))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	limited := p.LimitListener(ln)
+	go func() {
+		conn, err := limited.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 名额已满, 之后的连接在Accept内被拒绝
+		limited.Accept()
+	}()
+
+	hold, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hold.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if resp := readRejected(t, &net.Dialer{}, ln.Addr().String()); !strings.HasPrefix(resp, "HTTP/1.1 503") {
+		t.Errorf("响应 = %q, 期望503", resp)
+	}
+
+	for i := 0; i < maxRejectingConns; i++ {
+		p.connRejecter.rejecting <- struct{}{}
+	}
+	if resp := readRejected(t, &net.Dialer{}, ln.Addr().String()); resp != "" {
+		t.Errorf("正在拒绝的连接已满时响应 = %q, 期望直接关闭", resp)
+	}
+}
+
+func TestLimitListenerPerClientIP(t *testing.T) {
+	p := New(WithMaxConnsPerClientIP(1))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	limited := p.LimitListener(ln)
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	addr := ln.Addr().String()
+	other := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+
+	hold, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hold.Close()
+	first := <-accepted
+	if resp := readRejected(t, &net.Dialer{}, addr); !strings.HasPrefix(resp, "HTTP/1.1 429") || !strings.Contains(resp, "Retry-After: 1") {
+		t.Errorf("响应 = %q, 期望429", resp)
+	}
+
+	// 其他IP不受影响
+	conn, err := other.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("其他IP的连接没有被接受")
+	}
+
+	// 关闭后释放名额
+	first.Close()
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("释放名额后连接没有被接受")
+	}
+}
+
+// readRejected 连接后读取被拒绝时的响应, 直接关闭时返回空字符串
+func readRejected(t *testing.T, dialer *net.Dialer, addr string) string {
+	t.Helper()
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("连接没有被关闭")
+	}
+
+	return string(b)
+}
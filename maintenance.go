@@ -0,0 +1,234 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 默认维护页面
+var defaultMaintenancePage = []byte("代理服务维护中, 请稍后重试\n")
+
+// WithMaintenancePage 维护模式下返回的503页面
+func WithMaintenancePage(contentType string, body []byte) Option {
+	return func(opt *options) {
+		opt.maintenanceContentType = contentType
+		opt.maintenancePage = body
+	}
+}
+
+// maintenance 维护模式状态
+type maintenance struct {
+	paused      int32
+	contentType string
+	page        []byte
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// Pause 进入维护模式, 新请求返回503, 已建立的隧道和HTTPS解密连接继续转发
+// drainAfter大于0时, 超过该时间后关闭仍未结束的连接, 为0时不关闭
+func (p *Proxy) Pause(drainAfter time.Duration) {
+	m := &p.maintenance
+	atomic.StoreInt32(&m.paused, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if drainAfter > 0 {
+		m.timer = time.AfterFunc(drainAfter, p.conns.closeAll)
+	}
+}
+
+// Resume 退出维护模式, 取消未执行的关闭连接
+func (p *Proxy) Resume() {
+	m := &p.maintenance
+	m.mu.Lock()
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.mu.Unlock()
+	atomic.StoreInt32(&m.paused, 0)
+}
+
+// Paused 是否处于维护模式
+func (p *Proxy) Paused() bool {
+	return atomic.LoadInt32(&p.maintenance.paused) == 1
+}
+
+// Shutdown 停止接收新请求(返回503), 等待正在处理的请求、隧道和HTTPS解密连接结束
+// ctx结束时关闭剩余的连接并返回ctx.Err(), 应在http.Server.Shutdown之前或同时调用
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.Pause(0)
+	p.closeIdleConnections()
+	interval := time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		if p.ClientConnNum() == 0 && p.conns.len() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			p.conns.closeAll()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		// 与http.Server.Shutdown相同, 轮询间隔逐渐增加到500毫秒
+		if interval < 500*time.Millisecond {
+			interval *= 2
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Close 停止接收新请求并立即关闭所有隧道和HTTPS解密连接
+func (p *Proxy) Close() error {
+	p.Pause(0)
+	p.conns.closeAll()
+	p.closeIdleConnections()
+	if pool := p.runtime().upstreams; pool != nil {
+		pool.stop()
+	}
+
+	return nil
+}
+
+// closeIdleConnections 关闭默认transport、WithHostTransports创建的transport和WithParentConnPool的空闲连接
+func (p *Proxy) closeIdleConnections() {
+	p.transport.CloseIdleConnections()
+	p.serverNameTransports.closeIdleConnections()
+	if p.hostTransports != nil {
+		p.hostTransports.closeIdleConnections()
+	}
+	if p.parentConns != nil {
+		p.parentConns.closeIdle()
+	}
+}
+
+func (m *maintenance) header() http.Header {
+	h := make(http.Header)
+	contentType := m.contentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	h.Set("Content-Type", contentType)
+
+	return h
+}
+
+func (m *maintenance) body() []byte {
+	if m.page == nil {
+		return defaultMaintenancePage
+	}
+
+	return m.page
+}
+
+// writeMaintenance 返回维护页面
+func (p *Proxy) writeMaintenance(rw http.ResponseWriter) {
+	CopyHeader(rw.Header(), p.maintenance.header())
+	rw.Header().Set("Retry-After", strconv.Itoa(int(p.retryAfter/time.Second)))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	rw.Write(p.maintenance.body())
+}
+
+// maintenanceResponse 已劫持的连接上返回的维护页面
+func (p *Proxy) maintenanceResponse(req *http.Request) *http.Response {
+	body := p.maintenance.body()
+	header := p.maintenance.header()
+	header.Set("Retry-After", strconv.Itoa(int(p.retryAfter/time.Second)))
+
+	return &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+}
+
+// connTracker 记录已劫持的客户端连接(隧道、HTTPS解密、WebSocket)
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*trackedConn
+}
+
+// trackedConn 连接建立时的信息, HTTPS解密后的请求会修改Context, 不直接引用
+type trackedConn struct {
+	id       string
+	typ      string
+	clientIP string
+	user     string
+	target   string
+	start    time.Time
+	bytes    *ByteCounters
+}
+
+func (t *connTracker) add(conn net.Conn, ctx *Context, typ string) {
+	tc := &trackedConn{
+		id:       ctx.RequestID,
+		typ:      typ,
+		clientIP: ctx.ClientIP,
+		user:     ctx.User,
+		target:   ctx.Req.URL.Host,
+		start:    time.Now(),
+		bytes:    &ctx.Bytes,
+	}
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]*trackedConn)
+	}
+	t.conns[conn] = tc
+	t.mu.Unlock()
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
+
+// len 当前连接数
+func (t *connTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.conns)
+}
+
+// closeAll 关闭所有连接
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net"
+	"strings"
+)
+
+// matchHost 域名匹配, pattern支持精确匹配、*.example.com匹配所有子域名、*匹配所有
+// IP地址按IP比较, IPv6可带方括号, 如[2001:db8::1]与2001:DB8:0::1匹配
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]"))
+	host = strings.TrimSuffix(strings.ToLower(hostname(host)), ".")
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	if ip := net.ParseIP(pattern); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+
+	return pattern == host
+}
+
+// MatchHost 域名匹配, 规则与WithHostRewriteRules等相同
+func MatchHost(pattern, host string) bool {
+	return matchHost(pattern, host)
+}
+
+// hostname 去掉端口, 返回不带方括号的主机名
+func hostname(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// ensurePort 地址没有端口时添加默认端口, 支持不带方括号的IPv6地址
+func ensurePort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	return net.JoinHostPort(hostname(addr), port)
+}
+
+// defaultPort URL协议的默认端口
+func defaultPort(scheme string) string {
+	if scheme == "https" || scheme == "wss" {
+		return "443"
+	}
+	if scheme == "ftp" {
+		return "21"
+	}
+
+	return "80"
+}
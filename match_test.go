@@ -0,0 +1,90 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import "testing"
+
+func TestHostname(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"192.0.2.1:443", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"::1", "::1"},
+		{"[::1]:80", "::1"},
+		{"[fe80::1%eth0]:443", "fe80::1%eth0"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+	}
+	for _, tt := range tests {
+		if got := hostname(tt.addr); got != tt.want {
+			t.Errorf("hostname(%q) = %q, 期望 %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestEnsurePort(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"example.com", "example.com:443"},
+		{"example.com:8443", "example.com:8443"},
+		{"192.0.2.1", "192.0.2.1:443"},
+		{"[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"2001:db8::1", "[2001:db8::1]:443"},
+		{"::1", "[::1]:443"},
+		{"[fe80::1%eth0]:8443", "[fe80::1%eth0]:8443"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:443"},
+	}
+	for _, tt := range tests {
+		if got := ensurePort(tt.addr, "443"); got != tt.want {
+			t.Errorf("ensurePort(%q) = %q, 期望 %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"*", "[2001:db8::1]:443", true},
+		{"example.com", "EXAMPLE.com:443", true},
+		{"example.com", "example.com.", true},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"2001:db8::1", "[2001:db8::1]:443", true},
+		{"[2001:db8::1]", "2001:db8::1", true},
+		{"2001:db8::1", "[2001:DB8:0::1]:443", true},
+		{"2001:db8::1", "[2001:db8::2]:443", false},
+		{"::1", "[::1]:8080", true},
+		{"::1", "127.0.0.1", false},
+		{"127.0.0.1", "[::ffff:127.0.0.1]:80", true},
+		{"fe80::1%eth0", "[fe80::1%eth0]:443", true},
+		{"fe80::1%eth0", "[fe80::1%eth1]:443", false},
+	}
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, 期望 %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 上游响应耗时直方图的区间(秒), 与Prometheus客户端的默认值相同
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 记录的请求方法, 其他方法计为OTHER, 避免标签基数过大
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true,
+	http.MethodTrace: true,
+}
+
+type metricRequestKey struct {
+	typ    string
+	method string
+	status int
+}
+
+// metrics Prometheus指标, 请求结束时更新
+type metrics struct {
+	mu       sync.Mutex
+	requests map[metricRequestKey]int64
+
+	// 按类型(http、tunnel)统计的字节数
+	httpBytes   ByteCounters
+	tunnelBytes ByteCounters
+
+	latencyMu     sync.Mutex
+	latencyCounts []uint64
+	latencySum    float64
+	latencyCount  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:      make(map[metricRequestKey]int64),
+		latencyCounts: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+// request 记录一次请求, typ为访问日志类型
+func (m *metrics) request(typ, method string, status int) {
+	if !metricMethods[method] {
+		method = "OTHER"
+	}
+	key := metricRequestKey{typ: typ, method: method, status: status}
+	m.mu.Lock()
+	m.requests[key]++
+	m.mu.Unlock()
+}
+
+// bytes 记录客户端连接的字节数, HTTPS解密的连接计入tunnel
+func (m *metrics) bytes(tunnel bool, b ByteCounters) {
+	dst := &m.httpBytes
+	if tunnel {
+		dst = &m.tunnelBytes
+	}
+	atomic.AddInt64(&dst.ClientRead, atomic.LoadInt64(&b.ClientRead))
+	atomic.AddInt64(&dst.ClientWritten, atomic.LoadInt64(&b.ClientWritten))
+	atomic.AddInt64(&dst.UpstreamRead, atomic.LoadInt64(&b.UpstreamRead))
+	atomic.AddInt64(&dst.UpstreamWritten, atomic.LoadInt64(&b.UpstreamWritten))
+}
+
+// latency 记录从发送请求到收到响应头的耗时
+func (m *metrics) latency(d time.Duration) {
+	seconds := d.Seconds()
+	m.latencyMu.Lock()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			m.latencyCounts[i]++
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+	m.latencyMu.Unlock()
+}
+
+// MetricsHandler Prometheus文本格式的指标, 可挂载到管理端口, 如mux.Handle("/metrics", proxy.MetricsHandler())
+//
+//	goproxy_requests_total{type,method,status}  请求数, type为http、https(HTTPS解密后的请求)、tunnel
+//	goproxy_upstream_latency_seconds            发送请求到收到目标服务器响应头的耗时
+//	goproxy_bytes_total{type,direction}         字节数, direction为client_in、client_out、upstream_in、upstream_out
+//	goproxy_active_requests、goproxy_active_tunnels
+//	goproxy_deadline_exceeded_total             超过端到端截止时间(WithRequestDeadline、Context.Deadline)的请求和隧道数
+//	goproxy_admission_active、goproxy_admission_queue_depth、goproxy_admission_rejected_total  开启WithAdmissionControl时输出
+//	goproxy_parent_conns_idle、goproxy_parent_conns_reused_total、goproxy_parent_conns_streams_total  开启WithParentConnPool时输出
+//	goproxy_errors_total{class}                 按分类统计的错误数, 如connect(拨号)、tls(握手)
+func (p *Proxy) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := bufio.NewWriter(rw)
+		p.writeMetrics(w)
+		w.Flush()
+	})
+}
+
+func (p *Proxy) writeMetrics(w *bufio.Writer) {
+	m := p.metrics
+	stats := p.Snapshot()
+
+	writeMetricHeader(w, "goproxy_requests_total", "counter", "客户端请求数")
+	m.mu.Lock()
+	keys := make([]metricRequestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "goproxy_requests_total{type=%q,method=%q,status=\"%d\"} %d\n", k.typ, k.method, k.status, m.requests[k])
+	}
+	m.mu.Unlock()
+
+	writeMetricHeader(w, "goproxy_upstream_latency_seconds", "histogram", "发送请求到收到目标服务器响应头的耗时")
+	m.latencyMu.Lock()
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(w, "goproxy_upstream_latency_seconds_bucket{le=%q} %d\n", formatFloat(le), m.latencyCounts[i])
+	}
+	fmt.Fprintf(w, "goproxy_upstream_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+	fmt.Fprintf(w, "goproxy_upstream_latency_seconds_sum %s\n", formatFloat(m.latencySum))
+	fmt.Fprintf(w, "goproxy_upstream_latency_seconds_count %d\n", m.latencyCount)
+	m.latencyMu.Unlock()
+
+	writeMetricHeader(w, "goproxy_bytes_total", "counter", "传输的字节数")
+	for _, item := range []struct {
+		typ string
+		b   *ByteCounters
+	}{{"http", &m.httpBytes}, {"tunnel", &m.tunnelBytes}} {
+		fmt.Fprintf(w, "goproxy_bytes_total{type=%q,direction=\"client_in\"} %d\n", item.typ, atomic.LoadInt64(&item.b.ClientRead))
+		fmt.Fprintf(w, "goproxy_bytes_total{type=%q,direction=\"client_out\"} %d\n", item.typ, atomic.LoadInt64(&item.b.ClientWritten))
+		fmt.Fprintf(w, "goproxy_bytes_total{type=%q,direction=\"upstream_in\"} %d\n", item.typ, atomic.LoadInt64(&item.b.UpstreamRead))
+		fmt.Fprintf(w, "goproxy_bytes_total{type=%q,direction=\"upstream_out\"} %d\n", item.typ, atomic.LoadInt64(&item.b.UpstreamWritten))
+	}
+
+	writeMetricHeader(w, "goproxy_active_requests", "gauge", "正在处理的客户端请求数")
+	fmt.Fprintf(w, "goproxy_active_requests %d\n", stats.ActiveRequests)
+	writeMetricHeader(w, "goproxy_active_tunnels", "gauge", "正在转发的隧道和HTTPS解密连接数")
+	fmt.Fprintf(w, "goproxy_active_tunnels %d\n", stats.ActiveTunnels)
+	writeMetricHeader(w, "goproxy_deadline_exceeded_total", "counter", "超过端到端截止时间的请求和隧道数")
+	fmt.Fprintf(w, "goproxy_deadline_exceeded_total %d\n", stats.DeadlineExceeded)
+
+	if p.admission != nil {
+		writeMetricHeader(w, "goproxy_admission_active", "gauge", "准入控制正在处理的上游请求数")
+		fmt.Fprintf(w, "goproxy_admission_active %d\n", stats.Admission.Active)
+		writeMetricHeader(w, "goproxy_admission_queue_depth", "gauge", "准入控制正在排队的请求数")
+		fmt.Fprintf(w, "goproxy_admission_queue_depth %d\n", stats.Admission.Queued)
+		writeMetricHeader(w, "goproxy_admission_rejected_total", "counter", "队列已满或排队超时拒绝的请求数")
+		fmt.Fprintf(w, "goproxy_admission_rejected_total %d\n", stats.Admission.Rejected)
+	}
+	if p.parentConns != nil {
+		writeMetricHeader(w, "goproxy_parent_conns_idle", "gauge", "预先建立的上级代理空闲连接数")
+		fmt.Fprintf(w, "goproxy_parent_conns_idle %d\n", stats.ParentConns.Idle)
+		writeMetricHeader(w, "goproxy_parent_conns_reused_total", "counter", "使用预先建立的上级代理连接的隧道数")
+		fmt.Fprintf(w, "goproxy_parent_conns_reused_total %d\n", stats.ParentConns.Reused)
+		writeMetricHeader(w, "goproxy_parent_conns_streams_total", "counter", "通过上级代理HTTP/2 CONNECT stream转发的隧道数")
+		fmt.Fprintf(w, "goproxy_parent_conns_streams_total %d\n", stats.ParentConns.Streams)
+	}
+
+	writeMetricHeader(w, "goproxy_buffer_pool_gets_total", "counter", "从缓冲区池取出缓冲区的次数")
+	fmt.Fprintf(w, "goproxy_buffer_pool_gets_total %d\n", stats.BufferPool.Gets)
+	writeMetricHeader(w, "goproxy_buffer_pool_allocs_total", "counter", "缓冲区池新分配的缓冲区数")
+	fmt.Fprintf(w, "goproxy_buffer_pool_allocs_total %d\n", stats.BufferPool.Allocs)
+	writeMetricHeader(w, "goproxy_buffer_pool_in_use", "gauge", "正在使用的缓冲区数")
+	fmt.Fprintf(w, "goproxy_buffer_pool_in_use %d\n", stats.BufferPool.InUse)
+
+	writeMetricHeader(w, "goproxy_errors_total", "counter", "按分类统计的错误数")
+	for i := ErrorClass(0); i < errorClassNum; i++ {
+		fmt.Fprintf(w, "goproxy_errors_total{class=%q} %d\n", i.String(), stats.Errors[i])
+	}
+
+	writeMetricHeader(w, "goproxy_uptime_seconds", "gauge", "运行时长")
+	fmt.Fprintf(w, "goproxy_uptime_seconds %s\n", formatFloat(stats.Uptime.Seconds()))
+}
+
+func writeMetricHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
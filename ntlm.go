@@ -0,0 +1,197 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	ntlmNegotiateUnicode         = 0x00000001
+	ntlmRequestTarget            = 0x00000004
+	ntlmNegotiateNTLM            = 0x00000200
+	ntlmNegotiateAlwaysSign      = 0x00008000
+	ntlmNegotiateExtendedSession = 0x00080000
+	ntlmNegotiateTargetInfo      = 0x00800000
+	ntlmNegotiate128             = 0x20000000
+	ntlmNegotiate56              = 0x80000000
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+const ntlmFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+	ntlmNegotiateExtendedSession | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// NTLMParentAuth NTLMv2认证, 协商、质询、认证三条消息在同一连接上完成
+func NTLMParentAuth(domain, user, password string) ParentAuthProvider {
+	return parentAuthFunc(func(*url.URL, string) ParentAuthSession {
+		round := 0
+		return sessionFunc(func(challenges []string) (string, error) {
+			round++
+			switch round {
+			case 1:
+				return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+			case 2:
+				raw, ok := authChallenge(challenges, "NTLM")
+				if !ok || raw == "" {
+					return "", errors.New("上级代理未返回NTLM质询")
+				}
+				challenge, err := base64.StdEncoding.DecodeString(raw)
+				if err != nil {
+					return "", errors.New("无效的NTLM质询")
+				}
+				msg, err := ntlmAuthenticateMessage(challenge, domain, user, password)
+				if err != nil {
+					return "", err
+				}
+				return "NTLM " + base64.StdEncoding.EncodeToString(msg), nil
+			default:
+				return "", errors.New("用户名或密码错误")
+			}
+		})
+	})
+}
+
+// ntlmNegotiateMessage 第一条消息, 不携带域和工作站
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmFlags)
+
+	return msg
+}
+
+// ntlmAuthenticateMessage 根据上级代理的质询生成第三条消息
+func ntlmAuthenticateMessage(challenge []byte, domain, user, password string) ([]byte, error) {
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+
+	return ntlmAuthenticate(challenge, domain, user, password, clientChallenge, ntlmFiletime(time.Now()))
+}
+
+// ntlmAuthenticate 使用指定的客户端质询生成第三条消息, now为质询中没有MsvAvTimestamp时使用的时间
+func ntlmAuthenticate(challenge []byte, domain, user, password string, clientChallenge []byte, now uint64) ([]byte, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("无效的NTLM质询")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:]) & ntlmFlags
+	serverChallenge := challenge[24:32]
+	var targetInfo []byte
+	if len(challenge) >= 48 {
+		n := int(binary.LittleEndian.Uint16(challenge[40:]))
+		offset := int(binary.LittleEndian.Uint32(challenge[44:]))
+		if offset+n > len(challenge) {
+			return nil, errors.New("无效的NTLM质询")
+		}
+		targetInfo = challenge[offset : offset+n]
+	}
+
+	key := ntlmV2Hash(domain, user, password)
+	// NTLMv2_CLIENT_CHALLENGE
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, ntlmTimestamp(targetInfo, now)...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+	ntResponse := append(hmacMD5(key, serverChallenge, temp), temp...)
+	lmResponse := append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+
+	fields := [][]byte{lmResponse, ntResponse, utf16LE(domain), utf16LE(user), nil, nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, f := range fields {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[pos:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(msg[pos+2:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(msg[pos+4:], uint32(len(msg)))
+		msg = append(msg, f...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+
+	return msg, nil
+}
+
+// ntlmTimestamp 优先使用质询中的MsvAvTimestamp, 否则使用now
+func ntlmTimestamp(targetInfo []byte, now uint64) []byte {
+	for b := targetInfo; len(b) >= 4; {
+		id := binary.LittleEndian.Uint16(b)
+		n := int(binary.LittleEndian.Uint16(b[2:]))
+		if id == ntlmAvEOL || len(b) < 4+n {
+			break
+		}
+		if id == ntlmAvTimestamp && n == 8 {
+			return b[4:12]
+		}
+		b = b[4+n:]
+	}
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, now)
+
+	return ts
+}
+
+// ntlmFiletime 1601-01-01起的100纳秒数
+func ntlmFiletime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100 + 116444736000000000)
+}
+
+func ntlmV2Hash(domain, user, password string) []byte {
+	return hmacMD5(ntHash(password), utf16LE(strings.ToUpper(user)+domain))
+}
+
+// ntHash NT hash, 即密码UTF-16LE编码的MD4摘要
+func ntHash(password string) []byte {
+	h := md4.New()
+	h.Write(utf16LE(password))
+
+	return h.Sum(nil)
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+func utf16LE(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, v := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], v)
+	}
+
+	return b
+}
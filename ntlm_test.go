@@ -0,0 +1,134 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// MS-NLMP 4.2.4 NTLMv2认证示例
+const (
+	nlmpTargetInfo = "02000c0044006f006d00610069006e00" + "01000c00530065007200760065007200" + "00000000"
+	nlmpChallenge  = "4e544c4d53535000" + "02000000" + "0c000c0038000000" + "33828ae2" + "0123456789abcdef" +
+		"0000000000000000" + "2400240044000000" + "060070170000000f" + "530065007200760065007200" + nlmpTargetInfo
+	nlmpClientChallenge = "aaaaaaaaaaaaaaaa"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestNTHash(t *testing.T) {
+	// MS-NLMP 4.2.2.1.2 NTOWFv1
+	if got := hex.EncodeToString(ntHash("Password")); got != "a4f49c406510bdcab6824ee7c30fd852" {
+		t.Errorf("ntHash(Password) = %s", got)
+	}
+	// MS-NLMP 4.2.4.1.1 NTOWFv2
+	if got := hex.EncodeToString(ntlmV2Hash("Domain", "User", "Password")); got != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("ntlmV2Hash = %s", got)
+	}
+}
+
+// ntlmField 读取AUTHENTICATE_MESSAGE中第i个字段
+func ntlmField(t *testing.T, msg []byte, i int) []byte {
+	t.Helper()
+	pos := 12 + i*8
+	n := int(binary.LittleEndian.Uint16(msg[pos:]))
+	offset := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+	if offset+n > len(msg) {
+		t.Fatalf("字段%d超出消息长度", i)
+	}
+
+	return msg[offset : offset+n]
+}
+
+func TestNTLMAuthenticate(t *testing.T) {
+	challenge := mustHex(t, nlmpChallenge)
+	clientChallenge := mustHex(t, nlmpClientChallenge)
+	msg, err := ntlmAuthenticate(challenge, "Domain", "User", "Password", clientChallenge, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Fatalf("消息头 = %x", msg[:12])
+	}
+
+	// MS-NLMP 4.2.4.2.1 LMv2
+	if got, want := ntlmField(t, msg, 0), mustHex(t, "86c35097ac9cec102554764a57cccc19"+nlmpClientChallenge); !bytes.Equal(got, want) {
+		t.Errorf("LmChallengeResponse = %x, 期望 %x", got, want)
+	}
+	// MS-NLMP 4.2.4.2.2 NTProofStr, 之后为NTLMv2_CLIENT_CHALLENGE, 示例中时间为0
+	nt := ntlmField(t, msg, 1)
+	temp := mustHex(t, "0101000000000000"+"0000000000000000"+nlmpClientChallenge+"00000000"+nlmpTargetInfo+"00000000")
+	if want := mustHex(t, "68cd0ab851e51c96aabc927bebef6a1c"); len(nt) < 16 || !bytes.Equal(nt[:16], want) {
+		t.Errorf("NTProofStr = %x, 期望 %x", nt, want)
+	} else if !bytes.Equal(nt[16:], temp) {
+		t.Errorf("NTLMv2_CLIENT_CHALLENGE = %x, 期望 %x", nt[16:], temp)
+	}
+	if got := ntlmField(t, msg, 2); !bytes.Equal(got, utf16LE("Domain")) {
+		t.Errorf("DomainName = %x", got)
+	}
+	if got := ntlmField(t, msg, 3); !bytes.Equal(got, utf16LE("User")) {
+		t.Errorf("UserName = %x", got)
+	}
+	if got, want := binary.LittleEndian.Uint32(msg[60:]), uint32(0xe28a8233&ntlmFlags); got != want {
+		t.Errorf("NegotiateFlags = %#x, 期望 %#x", got, want)
+	}
+}
+
+func TestNTLMTimestamp(t *testing.T) {
+	// 质询中包含MsvAvTimestamp时使用质询的时间
+	ts := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	targetInfo := append([]byte{ntlmAvTimestamp, 0, 8, 0}, ts...)
+	targetInfo = append(targetInfo, 0, 0, 0, 0)
+	if got := ntlmTimestamp(targetInfo, 42); !bytes.Equal(got, ts) {
+		t.Errorf("ntlmTimestamp = %x, 期望 %x", got, ts)
+	}
+	if got := binary.LittleEndian.Uint64(ntlmTimestamp(mustHex(t, nlmpTargetInfo), 42)); got != 42 {
+		t.Errorf("ntlmTimestamp = %d, 期望 42", got)
+	}
+}
+
+func TestNTLMAuthenticateMessageInvalid(t *testing.T) {
+	valid := mustHex(t, nlmpChallenge)
+	truncated := append([]byte(nil), valid...)
+	// TargetInfo超出消息长度
+	binary.LittleEndian.PutUint16(truncated[40:], 0xff)
+	negotiate := ntlmNegotiateMessage()
+	tests := map[string][]byte{
+		"过短":           valid[:20],
+		"签名错误":         append([]byte("NTLMSSP\x01"), valid[8:]...),
+		"消息类型错误":       append(append([]byte(nil), negotiate...), valid[32:]...),
+		"TargetInfo越界": truncated,
+	}
+	for name, challenge := range tests {
+		if _, err := ntlmAuthenticateMessage(challenge, "Domain", "User", "Password"); err == nil {
+			t.Errorf("%s: 期望错误", name)
+		}
+	}
+	if _, err := ntlmAuthenticateMessage(valid, "Domain", "User", "Password"); err != nil {
+		t.Errorf("ntlmAuthenticateMessage 错误: %s", err)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pac
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ouqiang/goproxy/resolver"
+)
+
+// runtime PAC标准函数的运行环境
+type runtime struct {
+	ctx      context.Context
+	resolver resolver.Resolver
+	myIP     func() string
+	now      time.Time
+	errorLog func(error)
+}
+
+// globals 创建全局作用域并定义PAC标准函数
+func (rt *runtime) globals() *scope {
+	g := newScope(nil, true)
+	define := func(name string, f builtin) {
+		g.vars[name] = f
+	}
+	str := func(args []value, i int) string {
+		return toString(arg(args, i))
+	}
+	define("isPlainHostName", func(args []value) (value, error) {
+		return !strings.Contains(str(args, 0), "."), nil
+	})
+	define("dnsDomainIs", func(args []value) (value, error) {
+		return strings.HasSuffix(strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))), nil
+	})
+	define("localHostOrDomainIs", func(args []value) (value, error) {
+		host, hostdom := strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))
+		if host == hostdom {
+			return true, nil
+		}
+		return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+	})
+	define("dnsDomainLevels", func(args []value) (value, error) {
+		return float64(strings.Count(str(args, 0), ".")), nil
+	})
+	define("shExpMatch", func(args []value) (value, error) {
+		return shExpMatch(str(args, 0), str(args, 1)), nil
+	})
+	define("isResolvable", func(args []value) (value, error) {
+		return rt.resolve(str(args, 0)) != nil, nil
+	})
+	define("dnsResolve", func(args []value) (value, error) {
+		if ip := rt.resolve(str(args, 0)); ip != nil {
+			return ip.String(), nil
+		}
+		return null, nil
+	})
+	define("isInNet", func(args []value) (value, error) {
+		ip := rt.resolve(str(args, 0))
+		pattern, mask := net.ParseIP(str(args, 1)).To4(), net.ParseIP(str(args, 2)).To4()
+		if ip == nil || pattern == nil || mask == nil {
+			return false, nil
+		}
+		m := net.IPMask(mask)
+		return ip.Mask(m).Equal(pattern.Mask(m)), nil
+	})
+	define("convert_addr", func(args []value) (value, error) {
+		ip := net.ParseIP(str(args, 0)).To4()
+		if ip == nil {
+			return float64(0), nil
+		}
+		return float64(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+	})
+	define("myIpAddress", func(args []value) (value, error) {
+		return rt.myIP(), nil
+	})
+	define("weekdayRange", func(args []value) (value, error) {
+		return rt.weekdayRange(args), nil
+	})
+	define("dateRange", func(args []value) (value, error) {
+		return rt.dateRange(args), nil
+	})
+	define("timeRange", func(args []value) (value, error) {
+		return rt.timeRange(args), nil
+	})
+	define("alert", func(args []value) (value, error) {
+		if rt.errorLog != nil {
+			rt.errorLog(errors.New("PAC alert: " + str(args, 0)))
+		}
+		return undefined, nil
+	})
+	define("parseInt", func(args []value) (value, error) {
+		s := strings.TrimSpace(str(args, 0))
+		sign := 1.0
+		if strings.HasPrefix(s, "-") {
+			sign, s = -1, s[1:]
+		}
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if i == 0 {
+			return toNumber("NaN"), nil
+		}
+		return sign * toNumber(s[:i]), nil
+	})
+
+	return g
+}
+
+// resolve 域名解析为IPv4地址, 失败时返回nil
+func (rt *runtime) resolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	addrs, err := rt.resolver.LookupIPAddr(rt.ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// shExpMatch shell通配符匹配, *匹配任意字符串(包括/), ?匹配单个字符
+func shExpMatch(s, pattern string) bool {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+
+	return err == nil && re.MatchString(s)
+}
+
+// clock 参数最后为"GMT"时使用UTC时间
+func (rt *runtime) clock(args []value) ([]value, time.Time) {
+	if n := len(args); n > 0 && toString(args[n-1]) == "GMT" {
+		return args[:n-1], rt.now.UTC()
+	}
+
+	return args, rt.now
+}
+
+var weekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+var months = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == strings.ToUpper(s) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// inRange start到end之间(包含), start大于end时跨越边界, 如FRI到MON
+func inRange(v, start, end int) bool {
+	if start <= end {
+		return start <= v && v <= end
+	}
+
+	return v >= start || v <= end
+}
+
+func (rt *runtime) weekdayRange(args []value) bool {
+	args, now := rt.clock(args)
+	if len(args) == 0 {
+		return false
+	}
+	start := indexOf(weekdays, toString(args[0]))
+	end := start
+	if len(args) > 1 {
+		end = indexOf(weekdays, toString(args[1]))
+	}
+	if start < 0 || end < 0 {
+		return false
+	}
+
+	return inRange(int(now.Weekday()), start, end)
+}
+
+// dateRange 支持(日)、(月)、(年)及其范围, 如dateRange(1, "JAN", 15, "MAR")、dateRange("JAN", 2024, "JUN", 2024)
+func (rt *runtime) dateRange(args []value) bool {
+	args, now := rt.clock(args)
+	fields := make([]dateField, 0, len(args))
+	for _, a := range args {
+		if m := indexOf(months, toString(a)); m >= 0 {
+			fields = append(fields, dateField{'m', m})
+			continue
+		}
+		n := int(toNumber(a))
+		if n > 31 {
+			fields = append(fields, dateField{'y', n})
+		} else {
+			fields = append(fields, dateField{'d', n})
+		}
+	}
+	current := map[byte]int{'d': now.Day(), 'm': int(now.Month()) - 1, 'y': now.Year()}
+	// key 按年、月、日的顺序组合为可比较的数值
+	key := func(list []dateField, get func(f dateField) int) int {
+		k := 0
+		for _, kind := range []byte{'y', 'm', 'd'} {
+			for _, f := range list {
+				if f.kind == kind {
+					k = k*10000 + get(f)
+				}
+			}
+		}
+		return k
+	}
+	switch len(fields) {
+	case 1:
+		return current[fields[0].kind] == fields[0].v
+	case 2, 4, 6:
+		half := len(fields) / 2
+		start, end := fields[:half], fields[half:]
+		for i := range start {
+			if start[i].kind != end[i].kind {
+				return false
+			}
+		}
+		v := key(start, func(f dateField) int { return current[f.kind] })
+		s := key(start, func(f dateField) int { return f.v })
+		e := key(end, func(f dateField) int { return f.v })
+		for _, f := range start {
+			if f.kind == 'y' {
+				// 包含年份时不跨越边界
+				return s <= v && v <= e
+			}
+		}
+		return inRange(v, s, e)
+	}
+
+	return false
+}
+
+// dateField dateRange的参数, kind为d(日)、m(月, 从0开始)或y(年)
+type dateField struct {
+	kind byte
+	v    int
+}
+
+// timeRange 支持(时)、(时, 时)、(时, 分, 时, 分)、(时, 分, 秒, 时, 分, 秒), 结束时间不包含
+func (rt *runtime) timeRange(args []value) bool {
+	args, now := rt.clock(args)
+	n := make([]int, len(args))
+	for i, a := range args {
+		n[i] = int(toNumber(a))
+	}
+	v := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	var start, end int
+	switch len(n) {
+	case 1:
+		start, end = n[0]*3600, (n[0]+1)*3600
+	case 2:
+		start, end = n[0]*3600, n[1]*3600
+	case 4:
+		start, end = n[0]*3600+n[1]*60, n[2]*3600+n[3]*60
+	case 6:
+		start, end = n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5]
+	default:
+		return false
+	}
+	if start <= end {
+		return start <= v && v < end
+	}
+
+	return v >= start || v < end
+}
@@ -0,0 +1,1292 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 单次执行最多执行的语句数, 避免死循环
+	maxSteps = 1000000
+	// 最大调用深度
+	maxCallDepth = 200
+)
+
+var (
+	errStepLimit = errors.New("PAC执行超过最大步数")
+	errCallDepth = errors.New("PAC调用层级过深")
+)
+
+// thrownError throw语句抛出的值
+type thrownError struct {
+	v value
+}
+
+func (e *thrownError) Error() string {
+	return "未捕获的异常: " + toString(e.v)
+}
+
+type value = interface{}
+
+type undefinedType struct{}
+
+type nullType struct{}
+
+var (
+	undefined value = undefinedType{}
+	null      value = nullType{}
+)
+
+type array struct {
+	elems []value
+}
+
+type object struct {
+	keys  []string
+	props map[string]value
+}
+
+func newObject() *object {
+	return &object{props: make(map[string]value)}
+}
+
+func (o *object) set(key string, v value) {
+	if _, ok := o.props[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.props[key] = v
+}
+
+// function 脚本中定义的函数
+type function struct {
+	lit *funcLit
+	env *scope
+}
+
+// builtin Go实现的函数
+type builtin func(args []value) (value, error)
+
+type jsRegexp struct {
+	re     *regexp.Regexp
+	source string
+	flags  string
+}
+
+type jsDate struct {
+	t time.Time
+}
+
+type scope struct {
+	vars   map[string]value
+	parent *scope
+	// 函数作用域, var声明在最近的函数作用域
+	fn bool
+}
+
+func newScope(parent *scope, fn bool) *scope {
+	return &scope{vars: make(map[string]value), parent: parent, fn: fn}
+}
+
+func (s *scope) lookup(name string) (value, bool) {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+// assign 赋值给已声明的变量, 未声明时赋值给全局变量
+func (s *scope) assign(name string, v value) {
+	cur := s
+	for ; cur != nil; cur = cur.parent {
+		if _, ok := cur.vars[name]; ok {
+			cur.vars[name] = v
+			return
+		}
+		if cur.parent == nil {
+			cur.vars[name] = v
+			return
+		}
+	}
+}
+
+func (s *scope) funcScope() *scope {
+	for cur := s; cur != nil; cur = cur.parent {
+		if cur.fn || cur.parent == nil {
+			return cur
+		}
+	}
+
+	return s
+}
+
+type completion int
+
+const (
+	normal completion = iota
+	returned
+	broke
+	continued
+)
+
+type interp struct {
+	steps int
+	depth int
+	now   func() time.Time
+}
+
+func (in *interp) step() error {
+	in.steps++
+	if in.steps > maxSteps {
+		return errStepLimit
+	}
+
+	return nil
+}
+
+// hoist 函数声明在执行前定义
+func hoist(body []node, env *scope) {
+	for _, s := range body {
+		if d, ok := s.(*funcDecl); ok {
+			env.vars[d.fn.name] = &function{lit: d.fn, env: env}
+		}
+	}
+}
+
+func (in *interp) run(body []node, env *scope) (completion, value, error) {
+	for _, s := range body {
+		c, v, err := in.exec(s, env)
+		if err != nil || c != normal {
+			return c, v, err
+		}
+	}
+
+	return normal, nil, nil
+}
+
+func (in *interp) exec(s node, env *scope) (completion, value, error) {
+	if err := in.step(); err != nil {
+		return normal, nil, err
+	}
+	switch s := s.(type) {
+	case *emptyStmt, *funcDecl:
+		return normal, nil, nil
+	case *exprStmt:
+		_, err := in.eval(s.x, env)
+		return normal, nil, err
+	case *varDecl:
+		return normal, nil, in.declare(s, env)
+	case *blockStmt:
+		return in.block(s.body, env)
+	case *ifStmt:
+		cond, err := in.eval(s.cond, env)
+		if err != nil {
+			return normal, nil, err
+		}
+		if toBool(cond) {
+			return in.exec(s.then, env)
+		}
+		if s.els != nil {
+			return in.exec(s.els, env)
+		}
+		return normal, nil, nil
+	case *forStmt:
+		return in.execFor(s, env)
+	case *forInStmt:
+		return in.execForIn(s, env)
+	case *switchStmt:
+		return in.execSwitch(s, env)
+	case *tryStmt:
+		return in.execTry(s, env)
+	case *throwStmt:
+		v, err := in.eval(s.x, env)
+		if err != nil {
+			return normal, nil, err
+		}
+		return normal, nil, &thrownError{v: v}
+	case *whileStmt:
+		for first := true; ; first = false {
+			if !(s.do && first) {
+				cond, err := in.eval(s.cond, env)
+				if err != nil {
+					return normal, nil, err
+				}
+				if !toBool(cond) {
+					return normal, nil, nil
+				}
+			}
+			c, v, err := in.exec(s.body, env)
+			if err != nil || c == returned {
+				return c, v, err
+			}
+			if c == broke {
+				return normal, nil, nil
+			}
+			if err := in.step(); err != nil {
+				return normal, nil, err
+			}
+		}
+	case *returnStmt:
+		if s.x == nil {
+			return returned, undefined, nil
+		}
+		v, err := in.eval(s.x, env)
+		return returned, v, err
+	case *breakStmt:
+		return broke, nil, nil
+	case *continueStmt:
+		return continued, nil, nil
+	}
+
+	return normal, nil, fmt.Errorf("不支持的语句%T", s)
+}
+
+// block 在新的块作用域中执行
+func (in *interp) block(body []node, env *scope) (completion, value, error) {
+	inner := newScope(env, false)
+	hoist(body, inner)
+
+	return in.run(body, inner)
+}
+
+func (in *interp) declare(d *varDecl, env *scope) error {
+	target := env
+	if d.kind == "var" {
+		target = env.funcScope()
+	}
+	for i, name := range d.names {
+		if d.inits[i] == nil {
+			if _, ok := target.vars[name]; !ok {
+				target.vars[name] = undefined
+			}
+			continue
+		}
+		v, err := in.eval(d.inits[i], env)
+		if err != nil {
+			return err
+		}
+		target.vars[name] = v
+	}
+
+	return nil
+}
+
+func (in *interp) execFor(s *forStmt, env *scope) (completion, value, error) {
+	loop := newScope(env, false)
+	if s.init != nil {
+		if d, ok := s.init.(*varDecl); ok {
+			if err := in.declare(d, loop); err != nil {
+				return normal, nil, err
+			}
+		} else if _, err := in.eval(s.init, loop); err != nil {
+			return normal, nil, err
+		}
+	}
+	for {
+		if s.cond != nil {
+			cond, err := in.eval(s.cond, loop)
+			if err != nil {
+				return normal, nil, err
+			}
+			if !toBool(cond) {
+				return normal, nil, nil
+			}
+		}
+		c, v, err := in.exec(s.body, loop)
+		if err != nil || c == returned {
+			return c, v, err
+		}
+		if c == broke {
+			return normal, nil, nil
+		}
+		if s.update != nil {
+			if _, err := in.eval(s.update, loop); err != nil {
+				return normal, nil, err
+			}
+		}
+		if err := in.step(); err != nil {
+			return normal, nil, err
+		}
+	}
+}
+
+func (in *interp) execForIn(s *forInStmt, env *scope) (completion, value, error) {
+	obj, err := in.eval(s.obj, env)
+	if err != nil {
+		return normal, nil, err
+	}
+	var keys []string
+	switch o := obj.(type) {
+	case *object:
+		keys = append(keys, o.keys...)
+	case *array:
+		for i := range o.elems {
+			keys = append(keys, strconv.Itoa(i))
+		}
+	case string:
+		for i := range []rune(o) {
+			keys = append(keys, strconv.Itoa(i))
+		}
+	}
+	loop := newScope(env, false)
+	for _, key := range keys {
+		if s.decl {
+			loop.vars[s.name] = key
+		} else {
+			loop.assign(s.name, key)
+		}
+		c, v, err := in.exec(s.body, loop)
+		if err != nil || c == returned {
+			return c, v, err
+		}
+		if c == broke {
+			break
+		}
+	}
+
+	return normal, nil, nil
+}
+
+// execSwitch 使用===比较, 从匹配的case开始顺序执行直到break
+func (in *interp) execSwitch(s *switchStmt, env *scope) (completion, value, error) {
+	disc, err := in.eval(s.disc, env)
+	if err != nil {
+		return normal, nil, err
+	}
+	start := -1
+	for i, c := range s.cases {
+		if c.test == nil {
+			continue
+		}
+		v, err := in.eval(c.test, env)
+		if err != nil {
+			return normal, nil, err
+		}
+		if strictEquals(disc, v) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		for i, c := range s.cases {
+			if c.test == nil {
+				start = i
+			}
+		}
+		if start < 0 {
+			return normal, nil, nil
+		}
+	}
+	inner := newScope(env, false)
+	for _, c := range s.cases {
+		hoist(c.body, inner)
+	}
+	for _, c := range s.cases[start:] {
+		ct, v, err := in.run(c.body, inner)
+		if err != nil || ct == returned || ct == continued {
+			return ct, v, err
+		}
+		if ct == broke {
+			return normal, nil, nil
+		}
+	}
+
+	return normal, nil, nil
+}
+
+// execTry catch捕获throw和执行错误, 超过最大步数和调用层级不能捕获, 避免脚本绕过限制
+func (in *interp) execTry(s *tryStmt, env *scope) (completion, value, error) {
+	c, v, err := in.block(s.body, env)
+	if err != nil && s.hasCatch && err != errStepLimit && err != errCallDepth {
+		inner := newScope(env, false)
+		if s.param != "" {
+			inner.vars[s.param] = errorValue(err)
+		}
+		hoist(s.catch, inner)
+		c, v, err = in.run(s.catch, inner)
+	}
+	if s.hasFinally {
+		// finally中的return、break和错误覆盖之前的结果
+		fc, fv, ferr := in.block(s.finally, env)
+		if ferr != nil || fc != normal {
+			return fc, fv, ferr
+		}
+	}
+
+	return c, v, err
+}
+
+// errorValue catch参数的值, 执行错误转为带name和message的对象
+func errorValue(err error) value {
+	if e, ok := err.(*thrownError); ok {
+		return e.v
+	}
+	o := newObject()
+	o.set("name", "Error")
+	o.set("message", err.Error())
+
+	return o
+}
+
+func (in *interp) eval(x node, env *scope) (value, error) {
+	switch x := x.(type) {
+	case *numberLit:
+		return x.v, nil
+	case *stringLit:
+		return x.v, nil
+	case *regexpLit:
+		return newRegexp(x.pattern, x.flags)
+	case *ident:
+		return in.lookup(x.name, env)
+	case *arrayLit:
+		a := &array{}
+		for _, e := range x.elems {
+			v, err := in.eval(e, env)
+			if err != nil {
+				return nil, err
+			}
+			a.elems = append(a.elems, v)
+		}
+		return a, nil
+	case *objectLit:
+		o := newObject()
+		for i, k := range x.keys {
+			v, err := in.eval(x.values[i], env)
+			if err != nil {
+				return nil, err
+			}
+			o.set(k, v)
+		}
+		return o, nil
+	case *funcLit:
+		return &function{lit: x, env: env}, nil
+	case *unaryExpr:
+		if id, ok := x.x.(*ident); ok && x.op == "typeof" {
+			if _, found := env.lookup(id.name); !found {
+				return "undefined", nil
+			}
+		}
+		v, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "!":
+			return !toBool(v), nil
+		case "-":
+			return -toNumber(v), nil
+		case "+":
+			return toNumber(v), nil
+		}
+		return typeOf(v), nil
+	case *updateExpr:
+		old, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		n := toNumber(old)
+		updated := n + 1
+		if x.op == "--" {
+			updated = n - 1
+		}
+		if err := in.store(x.x, updated, env); err != nil {
+			return nil, err
+		}
+		if x.prefix {
+			return updated, nil
+		}
+		return n, nil
+	case *binaryExpr:
+		a, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		b, err := in.eval(x.y, env)
+		if err != nil {
+			return nil, err
+		}
+		return binaryOp(x.op, a, b)
+	case *logicalExpr:
+		a, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		if toBool(a) == (x.op == "||") {
+			return a, nil
+		}
+		return in.eval(x.y, env)
+	case *condExpr:
+		cond, err := in.eval(x.cond, env)
+		if err != nil {
+			return nil, err
+		}
+		if toBool(cond) {
+			return in.eval(x.x, env)
+		}
+		return in.eval(x.y, env)
+	case *assignExpr:
+		v, err := in.eval(x.value, env)
+		if err != nil {
+			return nil, err
+		}
+		if x.op != "=" {
+			old, err := in.eval(x.target, env)
+			if err != nil {
+				return nil, err
+			}
+			if v, err = binaryOp(x.op[:1], old, v); err != nil {
+				return nil, err
+			}
+		}
+		return v, in.store(x.target, v, env)
+	case *memberExpr:
+		obj, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		key, err := in.memberKey(x, env)
+		if err != nil {
+			return nil, err
+		}
+		return getMember(obj, key)
+	case *callExpr:
+		fn, err := in.eval(x.fn, env)
+		if err != nil {
+			return nil, err
+		}
+		args, err := in.evalArgs(x.args, env)
+		if err != nil {
+			return nil, err
+		}
+		return in.call(fn, args)
+	case *newExpr:
+		id, ok := x.fn.(*ident)
+		if !ok {
+			return nil, errors.New("不支持的new表达式")
+		}
+		args, err := in.evalArgs(x.args, env)
+		if err != nil {
+			return nil, err
+		}
+		switch id.name {
+		case "Date":
+			return &jsDate{t: in.now()}, nil
+		case "RegExp":
+			pattern, flags := "", ""
+			if len(args) > 0 {
+				pattern = toString(args[0])
+			}
+			if len(args) > 1 {
+				flags = toString(args[1])
+			}
+			return newRegexp(pattern, flags)
+		case "Array":
+			return &array{elems: args}, nil
+		case "Object":
+			return newObject(), nil
+		}
+		return nil, fmt.Errorf("不支持new %s", id.name)
+	}
+
+	return nil, fmt.Errorf("不支持的表达式%T", x)
+}
+
+func (in *interp) lookup(name string, env *scope) (value, error) {
+	if v, ok := env.lookup(name); ok {
+		return v, nil
+	}
+	switch name {
+	case "undefined":
+		return undefined, nil
+	case "null":
+		return null, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	}
+
+	return nil, fmt.Errorf("%s未定义", name)
+}
+
+func (in *interp) memberKey(x *memberExpr, env *scope) (string, error) {
+	if !x.computed {
+		return x.name, nil
+	}
+	k, err := in.eval(x.index, env)
+	if err != nil {
+		return "", err
+	}
+
+	return toString(k), nil
+}
+
+func (in *interp) evalArgs(list []node, env *scope) ([]value, error) {
+	args := make([]value, 0, len(list))
+	for _, a := range list {
+		v, err := in.eval(a, env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	return args, nil
+}
+
+// store 赋值给变量或属性
+func (in *interp) store(target node, v value, env *scope) error {
+	switch t := target.(type) {
+	case *ident:
+		env.assign(t.name, v)
+		return nil
+	case *memberExpr:
+		obj, err := in.eval(t.x, env)
+		if err != nil {
+			return err
+		}
+		key, err := in.memberKey(t, env)
+		if err != nil {
+			return err
+		}
+		switch o := obj.(type) {
+		case *object:
+			o.set(key, v)
+		case *array:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i > 1<<20 {
+				return nil
+			}
+			for len(o.elems) <= i {
+				o.elems = append(o.elems, undefined)
+			}
+			o.elems[i] = v
+		case undefinedType, nullType:
+			return fmt.Errorf("无法设置%s的属性%s", toString(obj), key)
+		}
+		return nil
+	}
+
+	return errors.New("无效的赋值")
+}
+
+func (in *interp) call(fn value, args []value) (value, error) {
+	switch f := fn.(type) {
+	case builtin:
+		return f(args)
+	case *function:
+		if in.depth >= maxCallDepth {
+			return nil, errCallDepth
+		}
+		in.depth++
+		defer func() { in.depth-- }()
+		env := newScope(f.env, true)
+		for i, name := range f.lit.params {
+			if i < len(args) {
+				env.vars[name] = args[i]
+			} else {
+				env.vars[name] = undefined
+			}
+		}
+		hoist(f.lit.body, env)
+		c, v, err := in.run(f.lit.body, env)
+		if err != nil {
+			return nil, err
+		}
+		if c == returned {
+			return v, nil
+		}
+		return undefined, nil
+	}
+
+	return nil, fmt.Errorf("%s不是函数", toString(fn))
+}
+
+func newRegexp(pattern, flags string) (value, error) {
+	prefix := ""
+	if strings.Contains(flags, "i") {
+		prefix = "(?i)"
+	}
+	re, err := regexp.Compile(prefix + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("无效的正则表达式/%s/: %s", pattern, err)
+	}
+
+	return &jsRegexp{re: re, source: pattern, flags: flags}, nil
+}
+
+func typeOf(v value) string {
+	switch v.(type) {
+	case undefinedType:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *function, builtin:
+		return "function"
+	}
+
+	return "object"
+}
+
+func toBool(v value) bool {
+	switch v := v.(type) {
+	case undefinedType, nullType:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+
+	return true
+}
+
+func toNumber(v value) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case nullType:
+		return 0
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			if n, err := strconv.ParseUint(s[2:], 16, 64); err == nil {
+				return float64(n)
+			}
+			return math.NaN()
+		}
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	case *array:
+		return toNumber(toString(v))
+	}
+
+	return math.NaN()
+}
+
+func formatNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.Abs(f) < 1e21:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func toString(v value) string {
+	switch v := v.(type) {
+	case undefinedType:
+		return "undefined"
+	case nullType:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	case *array:
+		parts := make([]string, len(v.elems))
+		for i, e := range v.elems {
+			if e != undefined && e != null {
+				parts[i] = toString(e)
+			}
+		}
+		return strings.Join(parts, ",")
+	case *jsRegexp:
+		return "/" + v.source + "/" + v.flags
+	case *jsDate:
+		return v.t.Format("Mon Jan 02 2006 15:04:05 GMT-0700")
+	case *function, builtin:
+		return "function"
+	}
+
+	return "[object Object]"
+}
+
+// toPrimitive 数组和对象转为字符串, 用于+和比较
+func toPrimitive(v value) value {
+	switch v.(type) {
+	case *array, *object, *jsRegexp, *jsDate, *function, builtin:
+		return toString(v)
+	}
+
+	return v
+}
+
+func strictEquals(a, b value) bool {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		return ok && a == b
+	case *array, *object, *jsRegexp, *jsDate, *function:
+		return a == b
+	case builtin:
+		return false
+	}
+
+	return a == b
+}
+
+func looseEquals(a, b value) bool {
+	if typeOf(a) == typeOf(b) && (a == null) == (b == null) {
+		return strictEquals(a, b)
+	}
+	isNil := func(v value) bool { return v == null || v == undefined }
+	if isNil(a) || isNil(b) {
+		return isNil(a) && isNil(b)
+	}
+	a, b = toPrimitive(a), toPrimitive(b)
+	if _, ok := a.(string); ok {
+		if _, ok := b.(string); ok {
+			return a == b
+		}
+	}
+
+	return toNumber(a) == toNumber(b)
+}
+
+func binaryOp(op string, a, b value) (value, error) {
+	switch op {
+	case ",":
+		return b, nil
+	case "==":
+		return looseEquals(a, b), nil
+	case "!=":
+		return !looseEquals(a, b), nil
+	case "===":
+		return strictEquals(a, b), nil
+	case "!==":
+		return !strictEquals(a, b), nil
+	case "in":
+		key := toString(a)
+		switch o := b.(type) {
+		case *object:
+			_, ok := o.props[key]
+			return ok, nil
+		case *array:
+			i, err := strconv.Atoi(key)
+			return err == nil && i >= 0 && i < len(o.elems), nil
+		}
+		return nil, errors.New("in的右侧不是对象")
+	case "+":
+		a, b = toPrimitive(a), toPrimitive(b)
+		as, aok := a.(string)
+		bs, bok := b.(string)
+		if aok || bok {
+			if !aok {
+				as = toString(a)
+			}
+			if !bok {
+				bs = toString(b)
+			}
+			return as + bs, nil
+		}
+		return toNumber(a) + toNumber(b), nil
+	case "-":
+		return toNumber(a) - toNumber(b), nil
+	case "*":
+		return toNumber(a) * toNumber(b), nil
+	case "/":
+		return toNumber(a) / toNumber(b), nil
+	case "%":
+		return math.Mod(toNumber(a), toNumber(b)), nil
+	case "<", ">", "<=", ">=":
+		a, b = toPrimitive(a), toPrimitive(b)
+		as, aok := a.(string)
+		bs, bok := b.(string)
+		if aok && bok {
+			switch op {
+			case "<":
+				return as < bs, nil
+			case ">":
+				return as > bs, nil
+			case "<=":
+				return as <= bs, nil
+			}
+			return as >= bs, nil
+		}
+		x, y := toNumber(a), toNumber(b)
+		switch op {
+		case "<":
+			return x < y, nil
+		case ">":
+			return x > y, nil
+		case "<=":
+			return x <= y, nil
+		}
+		return x >= y, nil
+	}
+
+	return nil, fmt.Errorf("不支持的运算符%s", op)
+}
+
+// getMember 读取属性, 字符串、数组、正则表达式和日期的方法返回绑定了接收者的builtin
+func getMember(obj value, key string) (value, error) {
+	switch o := obj.(type) {
+	case undefinedType, nullType:
+		return nil, fmt.Errorf("无法读取%s的属性%s", toString(obj), key)
+	case string:
+		return stringMember(o, key), nil
+	case *array:
+		return arrayMember(o, key), nil
+	case *object:
+		if v, ok := o.props[key]; ok {
+			return v, nil
+		}
+	case *jsRegexp:
+		switch key {
+		case "source":
+			return o.source, nil
+		case "test":
+			return builtin(func(args []value) (value, error) {
+				return o.re.MatchString(toString(arg(args, 0))), nil
+			}), nil
+		case "exec":
+			return builtin(func(args []value) (value, error) {
+				return matchResult(o.re.FindStringSubmatch(toString(arg(args, 0)))), nil
+			}), nil
+		}
+	case *jsDate:
+		if f, ok := dateMethods[key]; ok {
+			return builtin(func(args []value) (value, error) {
+				return float64(f(o.t)), nil
+			}), nil
+		}
+	}
+
+	return undefined, nil
+}
+
+func arg(args []value, i int) value {
+	if i < len(args) {
+		return args[i]
+	}
+
+	return undefined
+}
+
+// intArg 整数参数, 未提供时返回def
+func intArg(args []value, i int, def int) int {
+	if i >= len(args) || args[i] == undefined {
+		return def
+	}
+	n := toNumber(args[i])
+	if math.IsNaN(n) {
+		return 0
+	}
+	if math.IsInf(n, 0) {
+		if n > 0 {
+			return math.MaxInt32
+		}
+		return math.MinInt32
+	}
+
+	return int(n)
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+
+	return n
+}
+
+func matchResult(m []string) value {
+	if m == nil {
+		return null
+	}
+	a := &array{}
+	for _, s := range m {
+		a.elems = append(a.elems, s)
+	}
+
+	return a
+}
+
+func stringMember(s string, key string) value {
+	r := []rune(s)
+	method := func(f func(args []value) value) value {
+		return builtin(func(args []value) (value, error) { return f(args), nil })
+	}
+	switch key {
+	case "length":
+		return float64(len(r))
+	case "toLowerCase":
+		return method(func([]value) value { return strings.ToLower(s) })
+	case "toUpperCase":
+		return method(func([]value) value { return strings.ToUpper(s) })
+	case "trim":
+		return method(func([]value) value { return strings.TrimSpace(s) })
+	case "indexOf":
+		return method(func(args []value) value {
+			from := clamp(intArg(args, 1, 0), 0, len(r))
+			i := strings.Index(string(r[from:]), toString(arg(args, 0)))
+			if i < 0 {
+				return float64(-1)
+			}
+			return float64(from + len([]rune(string(r[from:])[:i])))
+		})
+	case "lastIndexOf":
+		return method(func(args []value) value {
+			i := strings.LastIndex(s, toString(arg(args, 0)))
+			if i < 0 {
+				return float64(-1)
+			}
+			return float64(len([]rune(s[:i])))
+		})
+	case "includes":
+		return method(func(args []value) value { return strings.Contains(s, toString(arg(args, 0))) })
+	case "startsWith":
+		return method(func(args []value) value { return strings.HasPrefix(s, toString(arg(args, 0))) })
+	case "endsWith":
+		return method(func(args []value) value { return strings.HasSuffix(s, toString(arg(args, 0))) })
+	case "charAt":
+		return method(func(args []value) value {
+			i := intArg(args, 0, 0)
+			if i < 0 || i >= len(r) {
+				return ""
+			}
+			return string(r[i])
+		})
+	case "charCodeAt":
+		return method(func(args []value) value {
+			i := intArg(args, 0, 0)
+			if i < 0 || i >= len(r) {
+				return math.NaN()
+			}
+			return float64(r[i])
+		})
+	case "substring":
+		return method(func(args []value) value {
+			start := clamp(intArg(args, 0, 0), 0, len(r))
+			end := clamp(intArg(args, 1, len(r)), 0, len(r))
+			if start > end {
+				start, end = end, start
+			}
+			return string(r[start:end])
+		})
+	case "substr":
+		return method(func(args []value) value {
+			start := intArg(args, 0, 0)
+			if start < 0 {
+				start += len(r)
+			}
+			start = clamp(start, 0, len(r))
+			end := clamp(start+intArg(args, 1, len(r)), start, len(r))
+			return string(r[start:end])
+		})
+	case "slice":
+		return method(func(args []value) value {
+			start, end := sliceRange(intArg(args, 0, 0), intArg(args, 1, len(r)), len(r))
+			return string(r[start:end])
+		})
+	case "concat":
+		return method(func(args []value) value {
+			var b strings.Builder
+			b.WriteString(s)
+			for _, a := range args {
+				b.WriteString(toString(a))
+			}
+			return b.String()
+		})
+	case "split":
+		return method(func(args []value) value {
+			var parts []string
+			switch sep := arg(args, 0).(type) {
+			case undefinedType:
+				parts = []string{s}
+			case *jsRegexp:
+				parts = sep.re.Split(s, -1)
+			default:
+				parts = strings.Split(s, toString(sep))
+			}
+			if limit := intArg(args, 1, -1); limit >= 0 && limit < len(parts) {
+				parts = parts[:limit]
+			}
+			a := &array{}
+			for _, p := range parts {
+				a.elems = append(a.elems, p)
+			}
+			return a
+		})
+	case "match":
+		return method(func(args []value) value {
+			re, ok := arg(args, 0).(*jsRegexp)
+			if !ok {
+				re = &jsRegexp{re: regexp.MustCompile(regexp.QuoteMeta(toString(arg(args, 0))))}
+			}
+			if strings.Contains(re.flags, "g") {
+				return matchResult(re.re.FindAllString(s, -1))
+			}
+			return matchResult(re.re.FindStringSubmatch(s))
+		})
+	case "replace":
+		return method(func(args []value) value {
+			repl := toString(arg(args, 1))
+			if re, ok := arg(args, 0).(*jsRegexp); ok {
+				repl = strings.NewReplacer("$&", "${0}", "$$", "$").Replace(repl)
+				if strings.Contains(re.flags, "g") {
+					return re.re.ReplaceAllString(s, repl)
+				}
+				loc := re.re.FindStringSubmatchIndex(s)
+				if loc == nil {
+					return s
+				}
+				return s[:loc[0]] + string(re.re.ExpandString(nil, repl, s, loc)) + s[loc[1]:]
+			}
+			return strings.Replace(s, toString(arg(args, 0)), repl, 1)
+		})
+	}
+	if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(r) {
+		return string(r[i])
+	}
+
+	return undefined
+}
+
+func sliceRange(start, end, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	start, end = clamp(start, 0, n), clamp(end, 0, n)
+	if start > end {
+		start = end
+	}
+
+	return start, end
+}
+
+func arrayMember(a *array, key string) value {
+	switch key {
+	case "length":
+		return float64(len(a.elems))
+	case "push":
+		return builtin(func(args []value) (value, error) {
+			a.elems = append(a.elems, args...)
+			return float64(len(a.elems)), nil
+		})
+	case "join":
+		return builtin(func(args []value) (value, error) {
+			sep := ","
+			if v := arg(args, 0); v != undefined {
+				sep = toString(v)
+			}
+			parts := make([]string, len(a.elems))
+			for i, e := range a.elems {
+				if e != undefined && e != null {
+					parts[i] = toString(e)
+				}
+			}
+			return strings.Join(parts, sep), nil
+		})
+	case "indexOf":
+		return builtin(func(args []value) (value, error) {
+			for i, e := range a.elems {
+				if strictEquals(e, arg(args, 0)) {
+					return float64(i), nil
+				}
+			}
+			return float64(-1), nil
+		})
+	case "slice":
+		return builtin(func(args []value) (value, error) {
+			start, end := sliceRange(intArg(args, 0, 0), intArg(args, 1, len(a.elems)), len(a.elems))
+			return &array{elems: append([]value(nil), a.elems[start:end]...)}, nil
+		})
+	case "concat":
+		return builtin(func(args []value) (value, error) {
+			elems := append([]value(nil), a.elems...)
+			for _, v := range args {
+				if other, ok := v.(*array); ok {
+					elems = append(elems, other.elems...)
+				} else {
+					elems = append(elems, v)
+				}
+			}
+			return &array{elems: elems}, nil
+		})
+	case "sort":
+		return builtin(func(args []value) (value, error) {
+			sort.SliceStable(a.elems, func(i, j int) bool { return toString(a.elems[i]) < toString(a.elems[j]) })
+			return a, nil
+		})
+	}
+	if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(a.elems) {
+		return a.elems[i]
+	}
+
+	return undefined
+}
+
+var dateMethods = map[string]func(t time.Time) int{
+	"getFullYear":    func(t time.Time) int { return t.Year() },
+	"getMonth":       func(t time.Time) int { return int(t.Month()) - 1 },
+	"getDate":        func(t time.Time) int { return t.Day() },
+	"getDay":         func(t time.Time) int { return int(t.Weekday()) },
+	"getHours":       func(t time.Time) int { return t.Hour() },
+	"getMinutes":     func(t time.Time) int { return t.Minute() },
+	"getSeconds":     func(t time.Time) int { return t.Second() },
+	"getTime":        func(t time.Time) int { return int(t.UnixNano() / int64(time.Millisecond)) },
+	"getUTCFullYear": func(t time.Time) int { return t.UTC().Year() },
+	"getUTCMonth":    func(t time.Time) int { return int(t.UTC().Month()) - 1 },
+	"getUTCDate":     func(t time.Time) int { return t.UTC().Day() },
+	"getUTCDay":      func(t time.Time) int { return int(t.UTC().Weekday()) },
+	"getUTCHours":    func(t time.Time) int { return t.UTC().Hour() },
+	"getUTCMinutes":  func(t time.Time) int { return t.UTC().Minute() },
+	"getUTCSeconds":  func(t time.Time) int { return t.UTC().Second() },
+}
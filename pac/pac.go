@@ -0,0 +1,360 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package pac 加载代理自动配置(PAC)文件, 按FindProxyForURL的结果选择上级代理
+//
+//	p, err := pac.Load("http://wpad.example.com/wpad.dat", pac.WithRefreshInterval(10*time.Minute))
+//	proxy := goproxy.New(goproxy.WithDelegate(p.Delegate(&goproxy.DefaultDelegate{})))
+//
+// 内置精简的JavaScript解释器, 支持PAC文件常用的语法和全部PAC标准函数
+package pac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ouqiang/goproxy"
+	"github.com/ouqiang/goproxy/resolver"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	// PAC文件最大长度
+	maxScriptSize = 4 << 20
+)
+
+type options struct {
+	refreshInterval time.Duration
+	client          *http.Client
+	resolver        resolver.Resolver
+	timeout         time.Duration
+	errorLog        func(error)
+}
+
+type Option func(*options)
+
+// WithRefreshInterval 定期重新加载PAC文件, 加载失败时继续使用之前的内容, 为0不刷新
+func WithRefreshInterval(d time.Duration) Option {
+	return func(opt *options) {
+		opt.refreshInterval = d
+	}
+}
+
+// WithHTTPClient 下载PAC文件使用的client, 默认10秒超时
+func WithHTTPClient(c *http.Client) Option {
+	return func(opt *options) {
+		opt.client = c
+	}
+}
+
+// WithResolver dnsResolve、isInNet等函数使用的解析器, 默认net.DefaultResolver
+func WithResolver(r resolver.Resolver) Option {
+	return func(opt *options) {
+		opt.resolver = r
+	}
+}
+
+// WithTimeout 单次执行FindProxyForURL的DNS解析超时时间, 默认5秒
+func WithTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.timeout = d
+	}
+}
+
+// WithErrorLog 记录刷新失败和alert输出
+func WithErrorLog(f func(error)) Option {
+	return func(opt *options) {
+		opt.errorLog = f
+	}
+}
+
+// PAC 已加载的PAC文件, 并发安全
+type PAC struct {
+	src  string
+	opts *options
+
+	mu     sync.RWMutex
+	script []node
+
+	myIPOnce sync.Once
+	myIP     string
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// Load 从文件路径或http(s)地址加载PAC文件
+func Load(src string, opt ...Option) (*PAC, error) {
+	p := newPAC(src, opt)
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	if p.opts.refreshInterval > 0 {
+		go p.refresh()
+	}
+
+	return p, nil
+}
+
+// Parse 使用PAC文件的内容创建, 不刷新
+func Parse(script string, opt ...Option) (*PAC, error) {
+	p := newPAC("", opt)
+	if err := p.compile(script); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func newPAC(src string, opt []Option) *PAC {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+	if opts.client == nil {
+		opts.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.resolver == nil {
+		opts.resolver = net.DefaultResolver
+	}
+	if opts.timeout <= 0 {
+		opts.timeout = defaultTimeout
+	}
+
+	return &PAC{src: src, opts: opts, stop: make(chan struct{})}
+}
+
+// Reload 重新加载PAC文件, 失败时继续使用之前的内容
+func (p *PAC) Reload() error {
+	if p.src == "" {
+		return nil
+	}
+	script, err := p.fetch()
+	if err != nil {
+		return fmt.Errorf("加载PAC文件%s错误: %s", p.src, err)
+	}
+
+	return p.compile(script)
+}
+
+func (p *PAC) fetch() (string, error) {
+	if !strings.HasPrefix(p.src, "http://") && !strings.HasPrefix(p.src, "https://") {
+		data, err := ioutil.ReadFile(p.src)
+		return string(data), err
+	}
+	resp, err := p.opts.client.Get(p.src)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("服务器返回%s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxScriptSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxScriptSize {
+		return "", errors.New("PAC文件过大")
+	}
+
+	return string(data), nil
+}
+
+// compile 解析脚本并检查是否定义了FindProxyForURL
+func (p *PAC) compile(script string) error {
+	body, err := parse(script)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, s := range body {
+		if d, ok := s.(*funcDecl); ok && d.fn.name == "FindProxyForURL" {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("PAC文件没有定义FindProxyForURL")
+	}
+	p.mu.Lock()
+	p.script = body
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *PAC) refresh() {
+	ticker := time.NewTicker(p.opts.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.Reload(); err != nil && p.opts.errorLog != nil {
+				p.opts.errorLog(err)
+			}
+		}
+	}
+}
+
+// Close 停止定期刷新
+func (p *PAC) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+
+	return nil
+}
+
+// FindProxyForURL 执行PAC文件的FindProxyForURL, 返回原始结果, 如"PROXY a:8080; DIRECT"
+// 每次调用使用独立的全局作用域, 脚本修改全局变量不影响其他请求
+func (p *PAC) FindProxyForURL(rawURL, host string) (string, error) {
+	p.mu.RLock()
+	script := p.script
+	p.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.timeout)
+	defer cancel()
+	rt := &runtime{
+		ctx:      ctx,
+		resolver: p.opts.resolver,
+		myIP:     p.myIPAddress,
+		now:      time.Now(),
+		errorLog: p.opts.errorLog,
+	}
+	in := &interp{now: time.Now}
+	g := rt.globals()
+	hoist(script, g)
+	if _, _, err := in.run(script, g); err != nil {
+		return "", fmt.Errorf("执行PAC文件错误: %s", err)
+	}
+	fn, ok := g.vars["FindProxyForURL"]
+	if !ok {
+		return "", errors.New("PAC文件没有定义FindProxyForURL")
+	}
+	result, err := in.call(fn, []value{rawURL, host})
+	if err != nil {
+		return "", fmt.Errorf("执行FindProxyForURL错误: %s", err)
+	}
+
+	return toString(result), nil
+}
+
+// myIPAddress 本机访问外网使用的IP, 只通过UDP确定路由, 不发送数据
+func (p *PAC) myIPAddress() string {
+	p.myIPOnce.Do(func() {
+		p.myIP = "127.0.0.1"
+		conn, err := net.Dial("udp", "198.18.0.1:53")
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+			p.myIP = addr.IP.String()
+		}
+	})
+
+	return p.myIP
+}
+
+// ParentProxy 实现Delegate.ParentProxy, 使用结果中第一个支持的代理
+// PROXY和HTTP使用http://, SOCKS和SOCKS5使用socks5://, DIRECT直连, 不支持HTTPS和SOCKS4
+// CONNECT请求按https://host/计算, 与浏览器相同不包含路径
+func (p *PAC) ParentProxy(req *http.Request) (*url.URL, error) {
+	rawURL, host := pacURL(req)
+	result, err := p.FindProxyForURL(rawURL, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseResult(result)
+}
+
+func pacURL(req *http.Request) (string, string) {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]")
+	if req.Method == http.MethodConnect {
+		if strings.HasSuffix(host, ":443") {
+			host = strings.TrimSuffix(host, ":443")
+		}
+		return "https://" + host + "/", hostname
+	}
+	u := *req.URL
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	u.Host = host
+
+	return u.String(), hostname
+}
+
+// ParseResult 解析FindProxyForURL的结果, 返回第一个支持的代理, DIRECT或结果为空时返回nil
+func ParseResult(result string) (*url.URL, error) {
+	for _, item := range strings.Split(result, ";") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		scheme := ""
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+	}
+	if strings.TrimSpace(result) == "" {
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("PAC结果中没有支持的代理: %s", result)
+}
+
+// Delegate 包装next, 使用PAC文件选择上级代理
+func (p *PAC) Delegate(next goproxy.Delegate) goproxy.Delegate {
+	return &delegate{Delegate: next, p: p}
+}
+
+type delegate struct {
+	goproxy.Delegate
+	p *PAC
+}
+
+func (d *delegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return d.p.ParentProxy(req)
+}
@@ -0,0 +1,315 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pac
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type staticResolver map[string]string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip, ok := r[host]; ok {
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+
+	return nil, errors.New("no such host")
+}
+
+var testResolver = staticResolver{"intranet.example": "10.2.3.4"}
+
+// testNow 2024年3月15日星期五14:30, UTC+8
+var testNow = time.Date(2024, time.March, 15, 14, 30, 0, 0, time.FixedZone("CST", 8*3600))
+
+// runScript 与FindProxyForURL相同执行脚本, 使用固定的时间和解析器
+func runScript(src string) (string, error) {
+	script, err := parse(src)
+	if err != nil {
+		return "", err
+	}
+	rt := &runtime{
+		ctx:      context.Background(),
+		resolver: testResolver,
+		myIP:     func() string { return "192.168.1.10" },
+		now:      testNow,
+	}
+	in := &interp{now: func() time.Time { return testNow }}
+	g := rt.globals()
+	hoist(script, g)
+	if _, _, err := in.run(script, g); err != nil {
+		return "", err
+	}
+	result, err := in.call(g.vars["FindProxyForURL"], []value{"http://www.example.com/a/b?c=1", "www.example.com"})
+	if err != nil {
+		return "", err
+	}
+
+	return toString(result), nil
+}
+
+type exprTest struct {
+	expr string
+	want string
+}
+
+func testExprs(t *testing.T, tests []exprTest) {
+	t.Helper()
+	for _, tt := range tests {
+		got, err := runScript("function FindProxyForURL(url, host) { return " + tt.expr + "; }")
+		if err != nil {
+			t.Errorf("%s 错误: %s", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %q, 期望 %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	testExprs(t, []exprTest{
+		{`isPlainHostName("www")`, "true"},
+		{`isPlainHostName(host)`, "false"},
+		{`dnsDomainIs(host, ".example.com")`, "true"},
+		{`dnsDomainIs("WWW.EXAMPLE.COM", ".example.com")`, "true"},
+		{`dnsDomainIs("www.example.org", ".example.com")`, "false"},
+		{`localHostOrDomainIs("www", "www.example.com")`, "true"},
+		{`localHostOrDomainIs("www.example.com", "www.example.com")`, "true"},
+		{`localHostOrDomainIs("home.example.com", "www.example.com")`, "false"},
+		{`dnsDomainLevels(host)`, "2"},
+		{`dnsDomainLevels("www")`, "0"},
+		{`shExpMatch(url, "*.example.com/*")`, "true"},
+		{`shExpMatch(url, "*/a/*")`, "true"},
+		{`shExpMatch("abc", "a?c")`, "true"},
+		{`shExpMatch("abbc", "a?c")`, "false"},
+		{`shExpMatch("axb", "a.b")`, "false"},
+		{`shExpMatch("a+b", "a+b")`, "true"},
+		{`isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0")`, "true"},
+		{`isInNet("192.168.1.1", "10.0.0.0", "255.0.0.0")`, "false"},
+		{`isInNet("intranet.example", "10.2.0.0", "255.255.0.0")`, "true"},
+		{`isInNet("missing.example", "0.0.0.0", "0.0.0.0")`, "false"},
+		{`dnsResolve("intranet.example")`, "10.2.3.4"},
+		{`dnsResolve("missing.example")`, "null"},
+		{`isResolvable("intranet.example")`, "true"},
+		{`isResolvable("missing.example")`, "false"},
+		{`myIpAddress()`, "192.168.1.10"},
+		{`convert_addr("104.16.0.1")`, "1745879041"},
+		{`parseInt("42px")`, "42"},
+		{`parseInt("-7")`, "-7"},
+		{`parseInt("px")`, "NaN"},
+		{`weekdayRange("MON", "FRI")`, "true"},
+		{`weekdayRange("SAT", "SUN")`, "false"},
+		{`weekdayRange("FRI", "MON")`, "true"},
+		{`weekdayRange("FRI", "GMT")`, "true"},
+		{`dateRange(15)`, "true"},
+		{`dateRange("MAR")`, "true"},
+		{`dateRange(1, "MAR", 20, "MAR")`, "true"},
+		{`dateRange("DEC", "MAR")`, "true"},
+		{`dateRange("NOV", "FEB")`, "false"},
+		{`dateRange("JAN", 2024, "FEB", 2024)`, "false"},
+		{`dateRange(2023, 2024)`, "true"},
+		{`timeRange(14)`, "true"},
+		{`timeRange(14, 30, 15, 0)`, "true"},
+		{`timeRange(15, 16)`, "false"},
+		{`timeRange(22, 15)`, "true"},
+		{`timeRange(6, "GMT")`, "true"},
+	})
+}
+
+func TestOperators(t *testing.T) {
+	testExprs(t, []exprTest{
+		{`1 + 2 * 3`, "7"},
+		{`(1 + 2) * 3`, "9"},
+		{`"a" + 1`, "a1"},
+		{`"3" * "4"`, "12"},
+		{`7 % 3`, "1"},
+		{`4 / 2 / 1`, "2"},
+		{`1 / 0`, "Infinity"},
+		{`-"x"`, "NaN"},
+		{`1 == "1"`, "true"},
+		{`1 === "1"`, "false"},
+		{`null == undefined`, "true"},
+		{`null === undefined`, "false"},
+		{`"b" > "a"`, "true"},
+		{`"10" < "9"`, "true"},
+		{`10 < 9`, "false"},
+		{`!0`, "true"},
+		{`!!"x"`, "true"},
+		{`0 || "d"`, "d"},
+		{`1 && 2`, "2"},
+		{`true ? "y" : "n"`, "y"},
+		{`(1, 2)`, "2"},
+		{`typeof notDefined`, "undefined"},
+		{`typeof host`, "string"},
+		{`typeof []`, "object"},
+		{`typeof dnsResolve`, "function"},
+		{`"k" in {k: 1}`, "true"},
+		{`[1, 2, 3].join("-")`, "1-2-3"},
+		{`[1, 2] + ""`, "1,2"},
+		{`"a,b,c".split(",").length`, "3"},
+		{`host.substring(0, 3).toUpperCase()`, "WWW"},
+		{`host.indexOf("example")`, "4"},
+	})
+}
+
+func TestRegexpLiterals(t *testing.T) {
+	testExprs(t, []exprTest{
+		{`/^www\./.test(host)`, "true"},
+		{`/EXAMPLE/.test(host)`, "false"},
+		{`/EXAMPLE/i.test(host)`, "true"},
+		{`"a1b2".replace(/[0-9]/g, "")`, "ab"},
+		{`"a1b2".replace(/[0-9]/, "")`, "ab2"},
+		{`/(\w+)\.com/.exec(host)[1]`, "example"},
+		{`"x/y/z".split(/\//).length`, "3"},
+		{`new RegExp("^www").test(host)`, "true"},
+		{`/a/g.source`, "a"},
+	})
+}
+
+func TestStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"switch", `switch (host) { case "a": return 1; case "www.example.com": return 2; default: return 3; }`, "2"},
+		{"switch default", `switch (1) { case 2: return "two"; default: return "default"; }`, "default"},
+		{"switch 严格比较", `switch ("1") { case 1: return "number"; case "1": return "string"; }`, "string"},
+		{"switch fallthrough", `var s = ""; switch (1) { case 1: s += "a"; case 2: s += "b"; break; case 3: s += "c"; } return s;`, "ab"},
+		{"switch default在中间", `var s = ""; switch (9) { case 1: s += "a"; default: s += "d"; case 2: s += "b"; } return s;`, "db"},
+		{"switch 无匹配", `switch (9) { case 1: return "a"; } return "none";`, "none"},
+		{"switch中continue", `var n = 0; for (var i = 0; i < 5; i++) { switch (i % 2) { case 0: continue; } n++; } return n;`, "2"},
+		{"throw字符串", `try { throw "boom"; } catch (e) { return "caught " + e; }`, "caught boom"},
+		{"捕获执行错误", `try { notDefined(); } catch (e) { return e.name + ": " + e.message; }`, "Error: notDefined未定义"},
+		{"catch省略参数", `try { throw 1; } catch { return "ok"; }`, "ok"},
+		{"finally", `var s = ""; try { s += "t"; } finally { s += "f"; } return s;`, "tf"},
+		{"finally在return后执行", `var s = {v: ""}; function f() { try { return "t"; } finally { s.v = "f"; } } return f() + s.v;`, "tf"},
+		{"finally覆盖return", `function f() { try { return "t"; } finally { return "f"; } } return f();`, "f"},
+		{"catch中throw", `try { try { throw "inner"; } catch (e) { throw "outer " + e; } } catch (e) { return e; }`, "outer inner"},
+		{"函数中throw", `function f() { throw "f"; } try { f(); } catch (e) { return e; }`, "f"},
+		{"for-in", `var o = {a: 1, b: 2}, s = ""; for (var k in o) { s += k + o[k]; } return s;`, "a1b2"},
+		{"do-while", `var i = 0; do { i++; } while (i < 3); return i;`, "3"},
+		{"全局变量", `return counter;`, "1"},
+	}
+	for _, tt := range tests {
+		got, err := runScript("var counter = 1;\nfunction FindProxyForURL(url, host) {\n" + tt.body + "\n}")
+		if err != nil {
+			t.Errorf("%s 错误: %s", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %q, 期望 %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"步数", `while (true) {}`, errStepLimit},
+		{"try不能捕获步数", `try { while (true) {} } catch (e) { return "caught"; }`, errStepLimit},
+		{"调用层级", `function f() { return f(); } return f();`, errCallDepth},
+		{"try不能捕获调用层级", `function f() { return f(); } try { return f(); } catch (e) { return "caught"; }`, errCallDepth},
+	}
+	for _, tt := range tests {
+		_, err := runScript("function FindProxyForURL(url, host) {\n" + tt.body + "\n}")
+		if err != tt.want {
+			t.Errorf("%s 错误 = %v, 期望 %v", tt.name, err, tt.want)
+		}
+	}
+
+	_, err := runScript(`function FindProxyForURL(url, host) { throw "boom"; }`)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("未捕获的throw错误 = %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse(`function FindProxyForURL(url, host) {
+		if (shExpMatch(host, "*.example.com")) {
+			return "PROXY proxy.example.com:8080; DIRECT";
+		}
+		return "DIRECT";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.FindProxyForURL("http://www.example.com/", "www.example.com")
+	if err != nil || result != "PROXY proxy.example.com:8080; DIRECT" {
+		t.Errorf("FindProxyForURL = %q, %v", result, err)
+	}
+
+	invalid := []string{
+		`function other() { return "DIRECT"; }`,
+		`function FindProxyForURL(url, host) { return 1 +; }`,
+		`function FindProxyForURL(url, host) { return "DIRECT"; `,
+		`function FindProxyForURL(url, host) { try { return 1; } }`,
+		`function FindProxyForURL(url, host) { switch (1) { default: break; default: break; } }`,
+		`function FindProxyForURL(url, host) { switch (1) { return 1; } }`,
+		`function FindProxyForURL(url, host) { throw
+			"x"; }`,
+		`class A {} function FindProxyForURL(url, host) {}`,
+		`function FindProxyForURL(url, host) { return "unterminated; }`,
+		`function FindProxyForURL(url, host) { return /[/.test(host); }`,
+	}
+	for _, script := range invalid {
+		if _, err := Parse(script); err == nil {
+			t.Errorf("Parse(%q) 期望错误", script)
+		}
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	tests := []struct {
+		result  string
+		want    string
+		wantErr bool
+	}{
+		{"PROXY a.example.com:8080; DIRECT", "http://a.example.com:8080", false},
+		{"proxy a:8080", "http://a:8080", false},
+		{"HTTP a:8080", "http://a:8080", false},
+		{"SOCKS b:1080", "socks5://b:1080", false},
+		{"SOCKS5 b:1080; PROXY a:8080", "socks5://b:1080", false},
+		{"HTTPS a:443; SOCKS4 c:1080; PROXY d:3128", "http://d:3128", false},
+		{"PROXY; DIRECT", "", false},
+		{"DIRECT; PROXY a:8080", "", false},
+		{"DIRECT", "", false},
+		{"", "", false},
+		{"HTTPS a:443", "", true},
+		{"SOCKS4 c:1080", "", true},
+	}
+	for _, tt := range tests {
+		u, err := ParseResult(tt.result)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseResult(%q) 错误 = %v", tt.result, err)
+			continue
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("ParseResult(%q) = %q, 期望 %q", tt.result, got, tt.want)
+		}
+	}
+}
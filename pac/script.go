@@ -0,0 +1,1091 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pac
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 精简的JavaScript解析器, 支持PAC文件常用的语法:
+// var/let/const、函数、if/else、for、for-in、while、do-while、switch、try/catch/finally、
+// throw、break、continue、return, 字符串、数字、数组、对象和正则表达式字面量, 不支持class和with
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokRegexp
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	line int
+}
+
+type lexer struct {
+	src    string
+	pos    int
+	line   int
+	tokens []token
+}
+
+var puncts = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "<", ">", "+", "-", "*", "/", "%", "!", "?", ":", "=",
+}
+
+func tokenize(src string) ([]token, error) {
+	l := &lexer{src: src, line: 1}
+	for {
+		if err := l.skipSpace(); err != nil {
+			return nil, err
+		}
+		if l.pos >= len(l.src) {
+			l.tokens = append(l.tokens, token{kind: tokEOF, line: l.line})
+			return l.tokens, nil
+		}
+		if err := l.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "//"):
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("注释未结束")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		case strings.HasPrefix(l.src[l.pos:], "\u00a0"), strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.pos += utf8.RuneLen([]rune(l.src[l.pos:])[0])
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("PAC第%d行: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) emit(kind tokenKind, text string) {
+	l.tokens = append(l.tokens, token{kind: kind, text: text, line: l.line})
+}
+
+// regexpAllowed 根据上一个token判断/是除号还是正则表达式
+func (l *lexer) regexpAllowed() bool {
+	if len(l.tokens) == 0 {
+		return true
+	}
+	prev := l.tokens[len(l.tokens)-1]
+	switch prev.kind {
+	case tokNumber, tokString, tokRegexp:
+		return false
+	case tokIdent:
+		return prev.text == "return" || prev.text == "typeof"
+	}
+
+	return prev.text != ")" && prev.text != "]" && prev.text != "}"
+}
+
+func (l *lexer) next() error {
+	c := l.src[l.pos]
+	switch {
+	case isIdentStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isIdentStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		l.emit(tokIdent, l.src[start:l.pos])
+	case isDigit(c) || c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+		return l.number()
+	case c == '"' || c == '\'':
+		return l.string(c)
+	case c == '/' && l.regexpAllowed():
+		return l.regexp()
+	default:
+		for _, p := range puncts {
+			if strings.HasPrefix(l.src[l.pos:], p) {
+				l.emit(tokPunct, p)
+				l.pos += len(p)
+				return nil
+			}
+		}
+		return l.errorf("无效的字符%q", c)
+	}
+
+	return nil
+}
+
+func (l *lexer) number() error {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && strings.IndexByte("0123456789abcdefABCDEF", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		n, err := strconv.ParseUint(l.src[start+2:l.pos], 16, 64)
+		if err != nil {
+			return l.errorf("无效的数字%s", l.src[start:l.pos])
+		}
+		l.tokens = append(l.tokens, token{kind: tokNumber, text: l.src[start:l.pos], num: float64(n), line: l.line})
+		return nil
+	}
+	for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	}
+	n, err := strconv.ParseFloat(l.src[start:l.pos], 64)
+	if err != nil {
+		return l.errorf("无效的数字%s", l.src[start:l.pos])
+	}
+	l.tokens = append(l.tokens, token{kind: tokNumber, text: l.src[start:l.pos], num: n, line: l.line})
+
+	return nil
+}
+
+func (l *lexer) string(quote byte) error {
+	l.pos++
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return l.errorf("字符串未结束")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		if c == quote {
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if l.pos >= len(l.src) {
+			return l.errorf("字符串未结束")
+		}
+		e := l.src[l.pos]
+		l.pos++
+		switch e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0':
+			b.WriteByte(0)
+		case '\n':
+			l.line++
+		case 'x', 'u':
+			size := 2
+			if e == 'u' {
+				size = 4
+			}
+			if l.pos+size > len(l.src) {
+				return l.errorf("无效的转义")
+			}
+			n, err := strconv.ParseUint(l.src[l.pos:l.pos+size], 16, 32)
+			if err != nil {
+				return l.errorf("无效的转义")
+			}
+			b.WriteRune(rune(n))
+			l.pos += size
+		default:
+			b.WriteByte(e)
+		}
+	}
+	l.emit(tokString, b.String())
+
+	return nil
+}
+
+func (l *lexer) regexp() error {
+	start := l.pos
+	l.pos++
+	inClass := false
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return l.errorf("正则表达式未结束")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		if c == '\\' {
+			l.pos++
+			continue
+		}
+		if c == '[' {
+			inClass = true
+		} else if c == ']' {
+			inClass = false
+		} else if c == '/' && !inClass {
+			break
+		}
+	}
+	for l.pos < len(l.src) && isIdentStart(l.src[l.pos]) {
+		l.pos++
+	}
+	l.emit(tokRegexp, l.src[start:l.pos])
+
+	return nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// 语法树
+
+type node interface{}
+
+type (
+	numberLit struct{ v float64 }
+	stringLit struct{ v string }
+	regexpLit struct{ pattern, flags string }
+	ident     struct{ name string }
+	arrayLit  struct{ elems []node }
+	objectLit struct {
+		keys   []string
+		values []node
+	}
+	funcLit struct {
+		name   string
+		params []string
+		body   []node
+	}
+	unaryExpr struct {
+		op string
+		x  node
+	}
+	updateExpr struct {
+		op     string
+		prefix bool
+		x      node
+	}
+	binaryExpr struct {
+		op   string
+		x, y node
+	}
+	logicalExpr struct {
+		op   string
+		x, y node
+	}
+	condExpr   struct{ cond, x, y node }
+	assignExpr struct {
+		op     string
+		target node
+		value  node
+	}
+	memberExpr struct {
+		x        node
+		name     string
+		index    node
+		computed bool
+	}
+	callExpr struct {
+		fn   node
+		args []node
+	}
+	newExpr struct {
+		fn   node
+		args []node
+	}
+)
+
+type (
+	varDecl struct {
+		kind  string
+		names []string
+		inits []node
+	}
+	funcDecl  struct{ fn *funcLit }
+	exprStmt  struct{ x node }
+	blockStmt struct{ body []node }
+	ifStmt    struct{ cond, then, els node }
+	forStmt   struct{ init, cond, update, body node }
+	forInStmt struct {
+		decl bool
+		name string
+		obj  node
+		body node
+	}
+	whileStmt struct {
+		cond node
+		body node
+		do   bool
+	}
+	switchStmt struct {
+		disc  node
+		cases []switchCase
+	}
+	tryStmt struct {
+		body []node
+		// param catch的参数名, 可省略
+		param      string
+		catch      []node
+		hasCatch   bool
+		finally    []node
+		hasFinally bool
+	}
+	throwStmt    struct{ x node }
+	returnStmt   struct{ x node }
+	breakStmt    struct{}
+	continueStmt struct{}
+	emptyStmt    struct{}
+)
+
+// switchCase test为nil时为default
+type switchCase struct {
+	test node
+	body []node
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parse(src string) ([]node, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	var body []node
+	for !p.at(tokEOF, "") {
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+
+	return body, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// at 当前token是否为指定的类型和文本, text为空时只比较类型
+func (p *parser) at(kind tokenKind, text string) bool {
+	t := p.tokens[p.pos]
+	return t.kind == kind && (text == "" || t.text == text)
+}
+
+func (p *parser) isPunct(text string) bool {
+	return p.at(tokPunct, text)
+}
+
+func (p *parser) isKeyword(text string) bool {
+	return p.at(tokIdent, text)
+}
+
+func (p *parser) advance() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("PAC第%d行: %s", p.peek().line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(text string) error {
+	if !p.isPunct(text) {
+		return p.errorf("缺少%s", text)
+	}
+	p.advance()
+
+	return nil
+}
+
+func (p *parser) identifier() (string, error) {
+	if !p.at(tokIdent, "") {
+		return "", p.errorf("缺少标识符")
+	}
+
+	return p.advance().text, nil
+}
+
+// semicolon 语句结束, 分号可省略
+func (p *parser) semicolon() {
+	if p.isPunct(";") {
+		p.advance()
+	}
+}
+
+func (p *parser) statement() (node, error) {
+	t := p.peek()
+	if t.kind == tokPunct {
+		switch t.text {
+		case "{":
+			body, err := p.block()
+			return &blockStmt{body: body}, err
+		case ";":
+			p.advance()
+			return &emptyStmt{}, nil
+		}
+	}
+	if t.kind == tokIdent {
+		switch t.text {
+		case "var", "let", "const":
+			d, err := p.varDecl()
+			p.semicolon()
+			return d, err
+		case "function":
+			p.advance()
+			fn, err := p.function(true)
+			if err != nil {
+				return nil, err
+			}
+			return &funcDecl{fn: fn}, nil
+		case "if":
+			return p.ifStatement()
+		case "for":
+			return p.forStatement()
+		case "while":
+			p.advance()
+			cond, err := p.parenExpr()
+			if err != nil {
+				return nil, err
+			}
+			body, err := p.statement()
+			return &whileStmt{cond: cond, body: body}, err
+		case "do":
+			p.advance()
+			body, err := p.statement()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isKeyword("while") {
+				return nil, p.errorf("缺少while")
+			}
+			p.advance()
+			cond, err := p.parenExpr()
+			p.semicolon()
+			return &whileStmt{cond: cond, body: body, do: true}, err
+		case "return":
+			line := p.advance().line
+			if p.isPunct(";") || p.isPunct("}") || p.at(tokEOF, "") || p.peek().line != line {
+				p.semicolon()
+				return &returnStmt{}, nil
+			}
+			x, err := p.expression()
+			p.semicolon()
+			return &returnStmt{x: x}, err
+		case "break":
+			p.advance()
+			p.semicolon()
+			return &breakStmt{}, nil
+		case "continue":
+			p.advance()
+			p.semicolon()
+			return &continueStmt{}, nil
+		case "switch":
+			return p.switchStatement()
+		case "try":
+			return p.tryStatement()
+		case "throw":
+			line := p.advance().line
+			if p.peek().line != line {
+				return nil, p.errorf("throw之后不能换行")
+			}
+			x, err := p.expression()
+			p.semicolon()
+			return &throwStmt{x: x}, err
+		case "class", "with":
+			return nil, p.errorf("不支持%s语句", t.text)
+		}
+	}
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.semicolon()
+
+	return &exprStmt{x: x}, nil
+}
+
+func (p *parser) block() ([]node, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var body []node
+	for !p.isPunct("}") {
+		if p.at(tokEOF, "") {
+			return nil, p.errorf("缺少}")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	p.advance()
+
+	return body, nil
+}
+
+func (p *parser) varDecl() (*varDecl, error) {
+	d := &varDecl{kind: p.advance().text}
+	for {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		var init node
+		if p.isPunct("=") {
+			p.advance()
+			if init, err = p.assignment(); err != nil {
+				return nil, err
+			}
+		}
+		d.names = append(d.names, name)
+		d.inits = append(d.inits, init)
+		if !p.isPunct(",") {
+			return d, nil
+		}
+		p.advance()
+	}
+}
+
+// function 解析函数的名称、参数和函数体, 当前token为function之后
+func (p *parser) function(needName bool) (*funcLit, error) {
+	fn := &funcLit{}
+	if p.at(tokIdent, "") {
+		fn.name = p.advance().text
+	} else if needName {
+		return nil, p.errorf("缺少函数名")
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.isPunct(")") {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, name)
+		if !p.isPunct(",") {
+			break
+		}
+		p.advance()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	fn.body = body
+
+	return fn, err
+}
+
+func (p *parser) parenExpr() (node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	return x, p.expect(")")
+}
+
+func (p *parser) ifStatement() (node, error) {
+	p.advance()
+	cond, err := p.parenExpr()
+	if err != nil {
+		return nil, err
+	}
+	then, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	s := &ifStmt{cond: cond, then: then}
+	if p.isKeyword("else") {
+		p.advance()
+		if s.els, err = p.statement(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (p *parser) forStatement() (node, error) {
+	p.advance()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	// for (var x in obj)
+	start := p.pos
+	decl := p.isKeyword("var") || p.isKeyword("let") || p.isKeyword("const")
+	if decl {
+		p.advance()
+	}
+	if p.at(tokIdent, "") && p.tokens[p.pos+1].kind == tokIdent && p.tokens[p.pos+1].text == "in" {
+		name := p.advance().text
+		p.advance()
+		obj, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		body, err := p.statement()
+		return &forInStmt{decl: decl, name: name, obj: obj, body: body}, err
+	}
+	p.pos = start
+	s := &forStmt{}
+	var err error
+	if !p.isPunct(";") {
+		if decl {
+			s.init, err = p.varDecl()
+		} else {
+			s.init, err = p.expression()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.isPunct(";") {
+		if s.cond, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.isPunct(")") {
+		if s.update, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	s.body, err = p.statement()
+
+	return s, err
+}
+
+func (p *parser) switchStatement() (node, error) {
+	p.advance()
+	disc, err := p.parenExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	s := &switchStmt{disc: disc}
+	hasDefault := false
+	for !p.isPunct("}") {
+		var c switchCase
+		switch {
+		case p.isKeyword("case"):
+			p.advance()
+			if c.test, err = p.expression(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword("default"):
+			if hasDefault {
+				return nil, p.errorf("重复的default")
+			}
+			hasDefault = true
+			p.advance()
+		default:
+			return nil, p.errorf("缺少case")
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		for !p.isKeyword("case") && !p.isKeyword("default") && !p.isPunct("}") {
+			if p.at(tokEOF, "") {
+				return nil, p.errorf("缺少}")
+			}
+			stmt, err := p.statement()
+			if err != nil {
+				return nil, err
+			}
+			c.body = append(c.body, stmt)
+		}
+		s.cases = append(s.cases, c)
+	}
+	p.advance()
+
+	return s, nil
+}
+
+func (p *parser) tryStatement() (node, error) {
+	p.advance()
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	s := &tryStmt{body: body}
+	if p.isKeyword("catch") {
+		p.advance()
+		s.hasCatch = true
+		if p.isPunct("(") {
+			p.advance()
+			if s.param, err = p.identifier(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		if s.catch, err = p.block(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isKeyword("finally") {
+		p.advance()
+		s.hasFinally = true
+		if s.finally, err = p.block(); err != nil {
+			return nil, err
+		}
+	}
+	if !s.hasCatch && !s.hasFinally {
+		return nil, p.errorf("try缺少catch或finally")
+	}
+
+	return s, nil
+}
+
+// expression 逗号表达式只保留最后一个值
+func (p *parser) expression() (node, error) {
+	x, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct(",") {
+		p.advance()
+		y, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: ",", x: x, y: y}
+	}
+
+	return x, nil
+}
+
+func (p *parser) assignment() (node, error) {
+	x, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-=", "*=", "/="} {
+		if p.isPunct(op) {
+			switch x.(type) {
+			case *ident, *memberExpr:
+			default:
+				return nil, p.errorf("无效的赋值")
+			}
+			p.advance()
+			value, err := p.assignment()
+			return &assignExpr{op: op, target: x, value: value}, err
+		}
+	}
+
+	return x, nil
+}
+
+func (p *parser) conditional() (node, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.isPunct("?") {
+		return cond, err
+	}
+	p.advance()
+	x, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	y, err := p.assignment()
+
+	return &condExpr{cond: cond, x: x, y: y}, err
+}
+
+// 二元运算符的优先级, 从低到高
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "===", "!=="},
+	{"<", ">", "<=", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(binaryLevels) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range binaryLevels[level] {
+			if p.isPunct(o) || o == "in" && p.isKeyword("in") {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return x, nil
+		}
+		p.advance()
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if op == "&&" || op == "||" {
+			x = &logicalExpr{op: op, x: x, y: y}
+		} else {
+			x = &binaryExpr{op: op, x: x, y: y}
+		}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	switch {
+	case p.isPunct("!"), p.isPunct("-"), p.isPunct("+"), p.isKeyword("typeof"):
+		op := p.advance().text
+		x, err := p.unary()
+		return &unaryExpr{op: op, x: x}, err
+	case p.isPunct("++"), p.isPunct("--"):
+		op := p.advance().text
+		x, err := p.unary()
+		return &updateExpr{op: op, prefix: true, x: x}, err
+	}
+	x, err := p.postfix()
+	if err != nil {
+		return nil, err
+	}
+	if p.isPunct("++") || p.isPunct("--") {
+		return &updateExpr{op: p.advance().text, x: x}, nil
+	}
+
+	return x, nil
+}
+
+func (p *parser) postfix() (node, error) {
+	var x node
+	var err error
+	if p.isKeyword("new") {
+		p.advance()
+		fn, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		var args []node
+		if p.isPunct("(") {
+			if args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		x = &newExpr{fn: fn, args: args}
+	} else if x, err = p.primary(); err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isPunct("."):
+			p.advance()
+			name, err := p.identifier()
+			if err != nil {
+				return nil, err
+			}
+			x = &memberExpr{x: x, name: name}
+		case p.isPunct("["):
+			p.advance()
+			index, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &memberExpr{x: x, index: index, computed: true}
+		case p.isPunct("("):
+			args, err := p.arguments()
+			if err != nil {
+				return nil, err
+			}
+			x = &callExpr{fn: x, args: args}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) arguments() ([]node, error) {
+	p.advance()
+	var args []node
+	for !p.isPunct(")") {
+		arg, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.isPunct(",") {
+			break
+		}
+		p.advance()
+	}
+
+	return args, p.expect(")")
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.advance()
+		return &numberLit{v: t.num}, nil
+	case tokString:
+		p.advance()
+		return &stringLit{v: t.text}, nil
+	case tokRegexp:
+		p.advance()
+		end := strings.LastIndexByte(t.text, '/')
+		return &regexpLit{pattern: t.text[1:end], flags: t.text[end+1:]}, nil
+	case tokIdent:
+		if t.text == "function" {
+			p.advance()
+			return p.function(false)
+		}
+		p.advance()
+		return &ident{name: t.text}, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			return p.parenExpr()
+		case "[":
+			return p.arrayLiteral()
+		case "{":
+			return p.objectLiteral()
+		}
+	case tokEOF:
+		return nil, p.errorf("意外的文件结尾")
+	}
+
+	return nil, p.errorf("意外的%s", t.text)
+}
+
+func (p *parser) arrayLiteral() (node, error) {
+	p.advance()
+	a := &arrayLit{}
+	for !p.isPunct("]") {
+		x, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		a.elems = append(a.elems, x)
+		if !p.isPunct(",") {
+			break
+		}
+		p.advance()
+	}
+
+	return a, p.expect("]")
+}
+
+func (p *parser) objectLiteral() (node, error) {
+	p.advance()
+	o := &objectLit{}
+	for !p.isPunct("}") {
+		t := p.advance()
+		switch t.kind {
+		case tokIdent, tokString:
+			o.keys = append(o.keys, t.text)
+		case tokNumber:
+			o.keys = append(o.keys, formatNumber(t.num))
+		default:
+			return nil, p.errorf("无效的属性名")
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		x, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		o.values = append(o.values, x)
+		if !p.isPunct(",") {
+			break
+		}
+		p.advance()
+	}
+
+	return o, p.expect("}")
+}
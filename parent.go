@@ -0,0 +1,295 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+type parentProxyKey struct{}
+
+// parentProxyValue 请求对应的上级代理, 由DoRequest确定后传递给transport
+type parentProxyValue struct {
+	url *url.URL
+}
+
+// withParentProxy 保存上级代理和代理上下文到请求context, 避免transport重复调用delegate
+func withParentProxy(req *http.Request, ctx *Context, u *url.URL) *http.Request {
+	c := context.WithValue(req.Context(), parentProxyKey{}, &parentProxyValue{url: u})
+
+	return req.WithContext(withProxyContext(c, ctx))
+}
+
+// transportProxy 作为http.Transport.Proxy, 优先使用DoRequest确定的上级代理
+func (p *Proxy) transportProxy(req *http.Request) (*url.URL, error) {
+	if v, ok := req.Context().Value(parentProxyKey{}).(*parentProxyValue); ok {
+		return v.url, nil
+	}
+
+	return p.callParentProxy(req)
+}
+
+// roundTrip 确定上级代理后发送请求, 开启WithRetry时连接失败后重试
+func (p *Proxy) roundTrip(ctx *Context, req *http.Request) (*http.Response, error) {
+	if p.retry != nil {
+		return p.retry.do(ctx, req, p.roundTripOnce, p.delegate.ErrorLog)
+	}
+
+	return p.roundTripOnce(ctx, req)
+}
+
+func (p *Proxy) roundTripOnce(ctx *Context, req *http.Request) (*http.Response, error) {
+	ctx.Attempts++
+	if req.URL.Scheme == "ftp" && p.ftpGateway {
+		return p.roundTripFTP(ctx, req)
+	}
+	if err := p.signRequest(req); err != nil {
+		return nil, err
+	}
+	if pool := p.runtime().upstreams; pool != nil {
+		return p.roundTripUpstream(ctx, req, pool)
+	}
+	parentProxyURL, err := p.callParentProxy(req)
+	if err != nil {
+		return nil, fmt.Errorf("解析代理地址错误: %s", err)
+	}
+
+	return p.roundTripParent(ctx, req, parentProxyURL)
+}
+
+// roundTripParent 经过指定的上级代理发送请求, parentProxyURL为nil时直连
+// 开启WithParentProxyRotation时上级代理拒绝后更换凭据重试
+func (p *Proxy) roundTripParent(ctx *Context, req *http.Request, parentProxyURL *url.URL) (*http.Response, error) {
+	ctx.parentProxy = parentProxyURL
+	for attempt := 0; ; attempt++ {
+		resp, err := p.roundTripParentOnce(ctx, req, parentProxyURL, attempt)
+		code := parentRefusal(resp, err)
+		if parentProxyURL == nil || !p.parentRotation.retry(code, attempt) || req.Context().Err() != nil ||
+			req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		p.delegate.ErrorLog(fmt.Errorf("%s - 上级代理%s返回%d, 更换凭据重试", req.URL.Host, parentProxyURL.Host, code))
+	}
+}
+
+func (p *Proxy) roundTripParentOnce(ctx *Context, req *http.Request, parentProxyURL *url.URL, attempt int) (*http.Response, error) {
+	upstream := p.withParentCredentials(ctx, parentProxyURL, attempt)
+	req = withParentProxy(req, ctx, upstream)
+	if parentProxyURL == nil {
+		if p.breaker == nil {
+			return p.roundTripper(ctx, req, nil).RoundTrip(req)
+		}
+		host := ensurePort(req.URL.Host, defaultPort(req.URL.Scheme))
+		if !p.breaker.allow(host) {
+			return nil, ErrCircuitOpen
+		}
+		resp, err := p.roundTripper(ctx, req, nil).RoundTrip(req)
+		p.breaker.observe(host, isDialError(err))
+		return resp, err
+	}
+	call := p.parentStats.start(parentProxyURL)
+	resp, err := p.roundTripper(ctx, req, upstream).RoundTrip(req)
+	call.observe(err)
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		call.done()
+		return resp, err
+	}
+	resp.Body = call.body(resp.Body)
+
+	return resp, nil
+}
+
+// roundTripper 根据上级代理类型和SNI选择transport
+func (p *Proxy) roundTripper(ctx *Context, req *http.Request, parent *url.URL) *http.Transport {
+	t := p.transport
+	switch {
+	case parent != nil && parent.Scheme == "ssh":
+		t = p.ssh.transport(parent, p.transport)
+	case isSOCKS(parent):
+		t = p.socksTransport(parent, p.transport)
+	case p.parentAuthProvider(parent) != nil:
+		t = p.parentAuthTransport(parent, p.transport)
+	case p.hostTransports != nil:
+		t = p.hostTransports.get(t, req.URL.Host)
+	}
+	if req.URL.Scheme == "https" && p.upstreamTLS.insecureHost(req.URL.Host) {
+		t = p.insecureTransport(t)
+	}
+	if ctx.ServerName != "" && req.URL.Scheme == "https" {
+		t = p.serverNameTransport(t, ctx.ServerName)
+	}
+	if ctx.Dialer != nil {
+		t = p.dialerTransport(t, ctx.Dialer)
+	}
+	if p.tlsHandshaker != nil && req.URL.Scheme == "https" && (parent == nil || parent.Scheme == "ssh" || isSOCKS(parent)) {
+		t = p.handshakeTransport(t)
+	}
+
+	return t
+}
+
+// maxServerNameTransports 指定SNI的transport最多保留的数量, Delegate可为每个请求选择不同的SNI
+const maxServerNameTransports = 256
+
+type serverNameKey struct {
+	base       *http.Transport
+	serverName string
+}
+
+// serverNameTransport 指定SNI的transport, 连接池与默认transport隔离
+func (p *Proxy) serverNameTransport(base *http.Transport, serverName string) *http.Transport {
+	return p.serverNameTransports.get(serverNameKey{base: base, serverName: serverName}, func() *http.Transport {
+		t := base.Clone()
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.ServerName = serverName
+		return t
+	})
+}
+
+// transportLRU 按最近使用淘汰的transport缓存
+type transportLRU struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	items map[serverNameKey]*list.Element
+	// evict 淘汰后调用, 在mu之外
+	evict func(t *http.Transport)
+}
+
+type transportLRUItem struct {
+	key serverNameKey
+	t   *http.Transport
+}
+
+func newTransportLRU(max int, evict func(t *http.Transport)) *transportLRU {
+	return &transportLRU{max: max, ll: list.New(), items: make(map[serverNameKey]*list.Element), evict: evict}
+}
+
+// get 返回key对应的transport, 不存在时使用create创建
+func (c *transportLRU) get(key serverNameKey, create func() *http.Transport) *http.Transport {
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*transportLRUItem).t
+	}
+	t := create()
+	c.items[key] = c.ll.PushFront(&transportLRUItem{key: key, t: t})
+	var evicted []*http.Transport
+	for c.ll.Len() > c.max {
+		evicted = append(evicted, c.remove(c.ll.Back()))
+	}
+	c.mu.Unlock()
+	for _, t := range evicted {
+		c.evict(t)
+	}
+
+	return t
+}
+
+// removeBase 移除由base派生的transport
+func (c *transportLRU) removeBase(base *http.Transport) []*http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var removed []*http.Transport
+	for key, e := range c.items {
+		if key.base == base {
+			removed = append(removed, c.remove(e))
+		}
+	}
+
+	return removed
+}
+
+// remove 调用方需持有mu
+func (c *transportLRU) remove(e *list.Element) *http.Transport {
+	item := c.ll.Remove(e).(*transportLRUItem)
+	delete(c.items, item.key)
+
+	return item.t
+}
+
+func (c *transportLRU) closeIdleConnections() {
+	c.mu.Lock()
+	transports := make([]*http.Transport, 0, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		transports = append(transports, e.Value.(*transportLRUItem).t)
+	}
+	c.mu.Unlock()
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// ParentProxyError 上级代理拒绝CONNECT请求, 如407认证失败、403禁止访问、5xx连接目标失败
+type ParentProxyError struct {
+	// Proxy 上级代理地址
+	Proxy string
+	// StatusCode 上级代理返回的状态码
+	StatusCode int
+	Status     string
+}
+
+func (e *ParentProxyError) Error() string {
+	return fmt.Sprintf("上级代理%s CONNECT响应: %s", e.Proxy, e.Status)
+}
+
+// clientStatusCode 返回给客户端的状态码
+// 上级代理认证失败是本代理的配置问题, 返回502, 避免客户端误以为需要向本代理认证
+func (e *ParentProxyError) clientStatusCode() int {
+	if e.StatusCode == http.StatusProxyAuthRequired || e.StatusCode < http.StatusBadRequest {
+		return http.StatusBadGateway
+	}
+
+	return e.StatusCode
+}
+
+// readTunnelResponse 读取上级代理对CONNECT的响应, 非200时返回ParentProxyError
+func readTunnelResponse(conn net.Conn, parent *url.URL) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("读取上级代理CONNECT响应错误: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &ParentProxyError{Proxy: parent.Host, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if br.Buffered() == 0 {
+		return conn, nil
+	}
+
+	return &replayConn{Conn: conn, r: br}, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestServerNameTransportEviction(t *testing.T) {
+	p := New()
+	first := p.serverNameTransport(p.transport, "h0.example")
+	p.handshakeTransport(first)
+	for i := 1; i <= maxServerNameTransports; i++ {
+		p.handshakeTransport(p.serverNameTransport(p.transport, fmt.Sprintf("h%d.example", i)))
+	}
+	if _, ok := p.handshakeTransports.Load(first); ok {
+		t.Error("淘汰的transport派生的handshake transport没有移除")
+	}
+	n := 0
+	p.handshakeTransports.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != maxServerNameTransports {
+		t.Errorf("handshake transport数量为%d, 期望%d", n, maxServerNameTransports)
+	}
+	if p.serverNameTransport(p.transport, "h0.example") == first {
+		t.Error("淘汰后应重新创建transport")
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 上级代理认证最多往返次数, NTLM需要2次
+const maxParentAuthRounds = 4
+
+// ParentAuthProvider 上级代理认证方式, 每次CONNECT握手创建一个会话
+// 内置BasicParentAuth、DigestParentAuth、NTLMParentAuth和NegotiateParentAuth
+type ParentAuthProvider interface {
+	NewSession(parent *url.URL, target string) ParentAuthSession
+}
+
+// ParentAuthSession 一次CONNECT握手的认证状态, NTLM、Negotiate等认证在同一连接上多次往返
+type ParentAuthSession interface {
+	// Authorization 返回Proxy-Authorization, challenges为上级代理407响应的Proxy-Authenticate, 首轮为nil
+	// 首轮返回空字符串时不带认证发送, 等待上级代理的质询, 无法继续认证时返回错误
+	Authorization(challenges []string) (string, error)
+}
+
+// WithParentProxyAuth 按上级代理选择认证方式, 返回nil时使用URL中的用户名密码进行Basic认证
+// 用于隧道转发的CONNECT, 以及经过上级代理的HTTP请求: 返回非nil时HTTP请求也通过CONNECT隧道发送, 要求上级代理允许CONNECT到目标端口
+func WithParentProxyAuth(f func(parent *url.URL) ParentAuthProvider) Option {
+	return func(opt *options) {
+		opt.parentAuth = f
+	}
+}
+
+// parentAuthProvider 上级代理的认证方式, 未设置或不需要时返回nil
+func (p *Proxy) parentAuthProvider(parent *url.URL) ParentAuthProvider {
+	if p.parentAuth == nil || parent == nil || parent.Scheme == "ssh" || isSOCKS(parent) {
+		return nil
+	}
+
+	return p.parentAuth(parent)
+}
+
+// parentHandshake 向上级代理发送CONNECT, 收到407时按ParentAuthProvider认证后在同一连接上重新发送
+func (p *Proxy) parentHandshake(conn net.Conn, parent *url.URL, targetAddr string, header http.Header) (net.Conn, error) {
+	targetAddr = ensurePort(targetAddr, "443")
+	provider := p.parentAuthProvider(parent)
+	if provider == nil {
+		if _, err := conn.Write([]byte(makeTunnelRequestLine(targetAddr, parent, header, ""))); err != nil {
+			return nil, err
+		}
+		return readTunnelResponse(conn, parent)
+	}
+	session := provider.NewSession(parent, targetAddr)
+	auth, err := session.Authorization(nil)
+	if err != nil {
+		return nil, fmt.Errorf("上级代理%s认证失败: %s", parent.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	for round := 0; ; round++ {
+		if _, err := conn.Write([]byte(makeTunnelRequestLine(targetAddr, parent, header, auth))); err != nil {
+			return nil, err
+		}
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return nil, fmt.Errorf("读取上级代理CONNECT响应错误: %s", err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			if br.Buffered() == 0 {
+				return conn, nil
+			}
+			return &replayConn{Conn: conn, r: br}, nil
+		}
+		// 读完407的body, 同一连接继续认证
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		refused := &ParentProxyError{Proxy: parent.Host, StatusCode: resp.StatusCode, Status: resp.Status}
+		if resp.StatusCode != http.StatusProxyAuthRequired || round+1 >= maxParentAuthRounds || resp.Close {
+			return nil, refused
+		}
+		// 认证失败时仍返回ParentProxyError, 与本代理未配置认证时的407一致
+		auth, err = session.Authorization(resp.Header.Values("Proxy-Authenticate"))
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("上级代理%s认证失败: %s", parent.Host, err))
+			return nil, refused
+		}
+		if auth == "" {
+			return nil, refused
+		}
+	}
+}
+
+// parentAuthTransport 需要认证的上级代理使用独立的transport, HTTP请求通过CONNECT隧道发送
+func (p *Proxy) parentAuthTransport(parent *url.URL, base *http.Transport) *http.Transport {
+	key := parent.String()
+	if t, ok := p.parentAuthTransports.Load(key); ok {
+		return t.(*http.Transport)
+	}
+	t := base.Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := p.dialContext(ctx, network, ensurePort(parent.Host, "80"))
+		if err != nil {
+			return nil, err
+		}
+		stop := context.AfterFunc(ctx, func() {
+			conn.SetDeadline(time.Unix(1, 0))
+		})
+		tunnel, err := p.parentHandshake(conn, parent, addr, nil)
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	}
+	actual, _ := p.parentAuthTransports.LoadOrStore(key, t)
+
+	return actual.(*http.Transport)
+}
+
+// authChallenge 查找指定认证方式的质询, 返回方式名之后的参数
+func authChallenge(challenges []string, scheme string) (string, bool) {
+	for _, c := range challenges {
+		name, params, _ := strings.Cut(strings.TrimSpace(c), " ")
+		if strings.EqualFold(name, scheme) {
+			return strings.TrimSpace(params), true
+		}
+	}
+
+	return "", false
+}
+
+// parseAuthParams 解析key=value或key="value"形式的认证参数
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+
+	return params
+}
+
+type parentAuthFunc func(parent *url.URL, target string) ParentAuthSession
+
+func (f parentAuthFunc) NewSession(parent *url.URL, target string) ParentAuthSession {
+	return f(parent, target)
+}
+
+type sessionFunc func(challenges []string) (string, error)
+
+func (f sessionFunc) Authorization(challenges []string) (string, error) {
+	return f(challenges)
+}
+
+// BasicParentAuth Basic认证, 首轮即发送用户名密码
+func BasicParentAuth(user, password string) ParentAuthProvider {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return parentAuthFunc(func(*url.URL, string) ParentAuthSession {
+		return sessionFunc(func(challenges []string) (string, error) {
+			if challenges != nil {
+				return "", errors.New("用户名或密码错误")
+			}
+			return auth, nil
+		})
+	})
+}
+
+// DigestParentAuth Digest认证(RFC 7616), 支持MD5、SHA-256及其-sess算法和qop=auth
+func DigestParentAuth(user, password string) ParentAuthProvider {
+	return parentAuthFunc(func(_ *url.URL, target string) ParentAuthSession {
+		s := &digestSession{user: user, password: password, uri: target}
+		return sessionFunc(s.authorization)
+	})
+}
+
+type digestSession struct {
+	user, password, uri string
+	nc                  int
+}
+
+func (s *digestSession) authorization(challenges []string) (string, error) {
+	if challenges == nil {
+		return "", nil
+	}
+	if s.nc > 0 {
+		return "", errors.New("用户名或密码错误")
+	}
+	raw, ok := authChallenge(challenges, "Digest")
+	if !ok {
+		return "", errors.New("上级代理不支持Digest认证")
+	}
+	c := parseAuthParams(raw)
+	s.nc++
+	nc := fmt.Sprintf("%08x", s.nc)
+	cnonce := randomHex(16)
+	response, qop, err := digestResponse(c, s.user, s.password, http.MethodConnect, s.uri, nc, cnonce)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q`, s.user, c["realm"], c["nonce"], s.uri, response)
+	if c["algorithm"] != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", c["algorithm"])
+	}
+	if qop != "" {
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce=%q`, qop, nc, cnonce)
+	}
+	if c["opaque"] != "" {
+		fmt.Fprintf(&b, `, opaque=%q`, c["opaque"])
+	}
+
+	return b.String(), nil
+}
+
+// digestResponse 按质询c计算response, 质询支持qop=auth时返回的qop为auth
+func digestResponse(c map[string]string, user, password, method, uri, nc, cnonce string) (response, qop string, err error) {
+	algorithm := strings.ToUpper(c["algorithm"])
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", "", fmt.Errorf("不支持的Digest算法%s", c["algorithm"])
+	}
+	h := func(s string) string {
+		d := newHash()
+		io.WriteString(d, s)
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	ha1 := h(user + ":" + c["realm"] + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + c["nonce"] + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	for _, q := range strings.Split(c["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if qop != "" {
+		return h(ha1 + ":" + c["nonce"] + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2), qop, nil
+	}
+
+	return h(ha1 + ":" + c["nonce"] + ":" + ha2), "", nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// GSSContext Negotiate认证的安全上下文, 如gokrb5的SPNEGO客户端
+type GSSContext interface {
+	// Step input为上级代理返回的令牌, 首轮为nil, 返回发送给上级代理的令牌
+	Step(input []byte) ([]byte, error)
+}
+
+// NegotiateParentAuth Negotiate(SPNEGO, Kerberos)认证, newContext每次握手调用一次, 服务主体名通常为HTTP/上级代理主机名
+func NegotiateParentAuth(newContext func(parent *url.URL) (GSSContext, error)) ParentAuthProvider {
+	return parentAuthFunc(func(parent *url.URL, _ string) ParentAuthSession {
+		var gss GSSContext
+		return sessionFunc(func(challenges []string) (string, error) {
+			var input []byte
+			if challenges == nil {
+				var err error
+				if gss, err = newContext(parent); err != nil {
+					return "", err
+				}
+			} else {
+				raw, ok := authChallenge(challenges, "Negotiate")
+				if !ok {
+					return "", errors.New("上级代理不支持Negotiate认证")
+				}
+				if raw == "" {
+					return "", errors.New("上级代理拒绝Negotiate令牌")
+				}
+				var err error
+				if input, err = base64.StdEncoding.DecodeString(raw); err != nil {
+					return "", fmt.Errorf("无效的Negotiate令牌: %s", err)
+				}
+			}
+			token, err := gss.Step(input)
+			if err != nil || len(token) == 0 {
+				return "", err
+			}
+			return "Negotiate " + base64.StdEncoding.EncodeToString(token), nil
+		})
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// RFC 7616 3.9.1示例的质询
+const rfc7616Challenge = `realm="http-auth@example.org", qop="auth, auth-int", nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", ` +
+	`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+
+func TestDigestResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		password  string
+		cnonce    string
+		want      string
+	}{
+		{
+			name:      "RFC 7616 MD5",
+			challenge: rfc7616Challenge + ", algorithm=MD5",
+			password:  "Circle of Life",
+			cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			want:      "8ca523f5e9506fed4657c9700eebdbec",
+		},
+		{
+			name:      "RFC 7616 SHA-256",
+			challenge: rfc7616Challenge + ", algorithm=SHA-256",
+			password:  "Circle of Life",
+			cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			want:      "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		},
+		{
+			name:      "RFC 2617",
+			challenge: `realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			password:  "Circle Of Life",
+			cnonce:    "0a4f113b",
+			want:      "6629fae49393a05397450978507c4ef1",
+		},
+	}
+	for _, tt := range tests {
+		response, qop, err := digestResponse(parseAuthParams(tt.challenge), "Mufasa", tt.password, http.MethodGet, "/dir/index.html", "00000001", tt.cnonce)
+		if err != nil {
+			t.Errorf("%s 错误: %s", tt.name, err)
+			continue
+		}
+		if response != tt.want || qop != "auth" {
+			t.Errorf("%s response = %s, qop = %s, 期望 %s, auth", tt.name, response, qop, tt.want)
+		}
+	}
+
+	if _, _, err := digestResponse(parseAuthParams(rfc7616Challenge+", algorithm=SHA-512-256"), "Mufasa", "Circle of Life", http.MethodGet, "/", "00000001", "x"); err == nil {
+		t.Error("不支持的算法期望错误")
+	}
+}
+
+func TestDigestParentAuth(t *testing.T) {
+	session := DigestParentAuth("Mufasa", "Circle of Life").NewSession(nil, "example.com:443")
+	if auth, err := session.Authorization(nil); err != nil || auth != "" {
+		t.Fatalf("首轮 = %q, %v, 期望不发送认证", auth, err)
+	}
+	challenges := []string{`Basic realm="x"`, "Digest " + rfc7616Challenge + ", algorithm=SHA-256"}
+	auth, err := session.Authorization(challenges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(auth, "Digest ") {
+		t.Fatalf("Authorization = %q", auth)
+	}
+	params := parseAuthParams(strings.TrimPrefix(auth, "Digest "))
+	want := map[string]string{
+		"username":  "Mufasa",
+		"realm":     "http-auth@example.org",
+		"uri":       "example.com:443",
+		"algorithm": "SHA-256",
+		"qop":       "auth",
+		"nc":        "00000001",
+		"opaque":    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %q, 期望 %q", k, params[k], v)
+		}
+	}
+	response, _, _ := digestResponse(parseAuthParams(strings.TrimPrefix(challenges[1], "Digest ")), "Mufasa", "Circle of Life",
+		http.MethodConnect, "example.com:443", "00000001", params["cnonce"])
+	if params["response"] != response {
+		t.Errorf("response = %s, 期望 %s", params["response"], response)
+	}
+	// 认证失败后上级代理再次质询
+	if _, err := session.Authorization(challenges); err == nil {
+		t.Error("再次质询期望错误")
+	}
+}
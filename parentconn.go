@@ -0,0 +1,533 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// ParentConnPoolConfig 隧道上级代理的连接池设置
+// 每个上级代理预先建立空闲的TCP(https上级代理为TLS)连接, CONNECT时直接使用, 省去建立连接的耗时
+// 每条连接只能承载一个隧道, 使用后在后台补充; 开启HTTP2时多个隧道复用同一连接
+// 本次隧道设置了Context.Dialer或上级代理使用WithParentProxyAuth的多轮认证时不使用预先建立的连接
+type ParentConnPoolConfig struct {
+	// Idle 每个上级代理保持的空闲连接数, 默认4
+	Idle int
+	// IdleTimeout 空闲连接的最长保留时间, 默认30秒, 应小于上级代理关闭空闲连接的时间
+	IdleTimeout time.Duration
+	// HTTP2 https上级代理协商HTTP/2时通过CONNECT stream转发隧道, 不支持HTTP/2时使用HTTP/1.1
+	HTTP2 bool
+	// TLSConfig 连接https上级代理的TLS设置, 为nil时按系统根证书验证, ServerName默认为上级代理的域名
+	TLSConfig *tls.Config
+}
+
+// ParentConnStats 隧道上级代理连接池的状态
+type ParentConnStats struct {
+	// Idle 当前空闲连接数
+	Idle int
+	// Reused 使用预先建立的连接的隧道数
+	Reused int64
+	// Dialed 没有空闲连接时新建连接的隧道数
+	Dialed int64
+	// Streams 通过HTTP/2 CONNECT stream转发的隧道数
+	Streams int64
+}
+
+// WithParentConnPool 隧道经过HTTP、HTTPS上级代理时使用连接池, 降低高并发隧道的连接耗时
+func WithParentConnPool(config ParentConnPoolConfig) Option {
+	return func(opt *options) {
+		opt.parentConns = &config
+	}
+}
+
+// errParentNoH2 https上级代理没有协商HTTP/2
+var errParentNoH2 = errors.New("上级代理不支持HTTP/2")
+
+type parentConns struct {
+	config ParentConnPoolConfig
+	dial   DialContextFunc
+
+	mu    sync.Mutex
+	pools map[string]*warmPool
+
+	h2      *http2.Transport
+	h2Mu    sync.Mutex
+	h2Conns map[string]*h2Parent
+	noH2    sync.Map
+
+	reused  int64
+	dialed  int64
+	streams int64
+}
+
+// warmPool 一个上级代理的空闲连接
+type warmPool struct {
+	idle    []*warmConn
+	dialing int
+}
+
+// warmConn 空闲连接, 后台读取用于发现上级代理关闭连接和空闲超时
+type warmConn struct {
+	net.Conn
+	taken bool
+	done  chan error
+}
+
+func newParentConns(config ParentConnPoolConfig, dial DialContextFunc) *parentConns {
+	if config.Idle <= 0 {
+		config.Idle = 4
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 30 * time.Second
+	}
+	c := &parentConns{
+		config: config,
+		dial:   dial,
+		pools:  make(map[string]*warmPool),
+	}
+	if config.HTTP2 {
+		c.h2 = &http2.Transport{}
+		c.h2Conns = make(map[string]*h2Parent)
+	}
+
+	return c
+}
+
+// useParentConns 本次隧道能否使用连接池
+func (p *Proxy) useParentConns(ctx *Context, parent *url.URL) bool {
+	return p.parentConns != nil && ctx.Dialer == nil && p.parentAuthProvider(parent) == nil &&
+		(parent.Scheme == "http" || parent.Scheme == "https")
+}
+
+// useH2 是否通过HTTP/2 CONNECT stream转发
+func (c *parentConns) useH2(parent *url.URL) bool {
+	if c.h2 == nil || parent.Scheme != "https" {
+		return false
+	}
+	_, no := c.noH2.Load(parent.Host)
+
+	return !no
+}
+
+func parentAddr(parent *url.URL) string {
+	return ensurePort(parent.Host, defaultPort(parent.Scheme))
+}
+
+// tlsConfig 连接上级代理的TLS设置
+func (c *parentConns) tlsConfig(parent *url.URL, protos ...string) *tls.Config {
+	cfg := &tls.Config{}
+	if c.config.TLSConfig != nil {
+		cfg = c.config.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = hostname(parent.Host)
+	}
+	cfg.NextProtos = protos
+
+	return cfg
+}
+
+// connect 建立到上级代理的连接, https上级代理完成TLS握手
+func (c *parentConns) connect(ctx context.Context, parent *url.URL) (net.Conn, error) {
+	conn, err := c.dial(ctx, "tcp", parentAddr(parent))
+	if err != nil || parent.Scheme != "https" {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, c.tlsConfig(parent, "http/1.1"))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// get 取出空闲连接, 没有时新建, 并在后台补充空闲连接
+func (c *parentConns) get(ctx context.Context, parent *url.URL) (net.Conn, error) {
+	key := parent.Scheme + "://" + parent.Host
+	defer c.fill(key, parent)
+	for {
+		c.mu.Lock()
+		pool := c.pool(key)
+		if len(pool.idle) == 0 {
+			c.mu.Unlock()
+			break
+		}
+		w := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		w.taken = true
+		c.mu.Unlock()
+		if conn := w.take(); conn != nil {
+			atomic.AddInt64(&c.reused, 1)
+			return conn, nil
+		}
+	}
+	atomic.AddInt64(&c.dialed, 1)
+
+	return c.connect(ctx, parent)
+}
+
+func (c *parentConns) pool(key string) *warmPool {
+	pool := c.pools[key]
+	if pool == nil {
+		pool = &warmPool{}
+		c.pools[key] = pool
+	}
+
+	return pool
+}
+
+// fill 在后台补充空闲连接到Idle个
+func (c *parentConns) fill(key string, parent *url.URL) {
+	c.mu.Lock()
+	pool := c.pool(key)
+	n := c.config.Idle - len(pool.idle) - pool.dialing
+	pool.dialing += max(n, 0)
+	c.mu.Unlock()
+	for i := 0; i < n; i++ {
+		go func() {
+			dialCtx, cancel := context.WithTimeout(context.Background(), c.config.IdleTimeout)
+			conn, err := c.connect(dialCtx, parent)
+			cancel()
+			c.mu.Lock()
+			pool.dialing--
+			if err == nil {
+				w := &warmConn{Conn: conn, done: make(chan error, 1)}
+				pool.idle = append(pool.idle, w)
+				go c.watch(key, w)
+			}
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// watch 等待上级代理关闭连接或空闲超时, 取出时中断读取
+func (c *parentConns) watch(key string, w *warmConn) {
+	w.SetReadDeadline(time.Now().Add(c.config.IdleTimeout))
+	var b [1]byte
+	n, err := w.Read(b[:])
+	if n > 0 {
+		// 上级代理不应在CONNECT之前发送数据
+		err = io.ErrUnexpectedEOF
+	}
+	c.mu.Lock()
+	taken := w.taken
+	if !taken {
+		pool := c.pools[key]
+		for i, v := range pool.idle {
+			if v == w {
+				pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+	if !taken {
+		w.Close()
+		return
+	}
+	w.done <- err
+}
+
+// take 中断后台读取, 连接仍然可用时返回
+func (w *warmConn) take() net.Conn {
+	w.SetReadDeadline(time.Unix(1, 0))
+	err := <-w.done
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		w.Close()
+		return nil
+	}
+	w.SetReadDeadline(time.Time{})
+
+	return w.Conn
+}
+
+// closeIdle 关闭空闲连接
+func (c *parentConns) closeIdle() {
+	c.mu.Lock()
+	var idle []*warmConn
+	for _, pool := range c.pools {
+		idle = append(idle, pool.idle...)
+		pool.idle = nil
+	}
+	c.mu.Unlock()
+	for _, w := range idle {
+		w.Close()
+	}
+	if c.h2 != nil {
+		c.h2Mu.Lock()
+		for _, hp := range c.h2Conns {
+			hp.closeIdle()
+		}
+		c.h2Mu.Unlock()
+	}
+}
+
+func (c *parentConns) stats() ParentConnStats {
+	c.mu.Lock()
+	idle := 0
+	for _, pool := range c.pools {
+		idle += len(pool.idle)
+	}
+	c.mu.Unlock()
+
+	return ParentConnStats{
+		Idle:    idle,
+		Reused:  atomic.LoadInt64(&c.reused),
+		Dialed:  atomic.LoadInt64(&c.dialed),
+		Streams: atomic.LoadInt64(&c.streams),
+	}
+}
+
+// h2Parent 一个上级代理的HTTP/2连接, 同时只建立一个连接, 并发stream达到上限时新建
+type h2Parent struct {
+	// sem 容量为1, 取得后才能查找和建立连接, 等待时可被取消
+	sem   chan struct{}
+	conns []*http2.ClientConn
+}
+
+func (hp *h2Parent) closeIdle() {
+	<-hp.sem
+	for _, cc := range hp.conns {
+		if cc.State().StreamsActive == 0 {
+			cc.Close()
+		}
+	}
+	hp.sem <- struct{}{}
+}
+
+// h2Conn 取得可以发起新stream的连接, 没有时新建
+func (c *parentConns) h2Conn(ctx context.Context, parent *url.URL) (*http2.ClientConn, error) {
+	key := parentAddr(parent)
+	c.h2Mu.Lock()
+	hp := c.h2Conns[key]
+	if hp == nil {
+		hp = &h2Parent{sem: make(chan struct{}, 1)}
+		hp.sem <- struct{}{}
+		c.h2Conns[key] = hp
+	}
+	c.h2Mu.Unlock()
+	select {
+	case <-hp.sem:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { hp.sem <- struct{}{} }()
+	conns := hp.conns[:0]
+	var found *http2.ClientConn
+	for _, cc := range hp.conns {
+		if s := cc.State(); s.Closed || s.Closing {
+			continue
+		}
+		conns = append(conns, cc)
+		if found == nil && cc.ReserveNewRequest() {
+			found = cc
+		}
+	}
+	hp.conns = conns
+	if found != nil {
+		return found, nil
+	}
+	cc, err := c.dialH2(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	if !cc.ReserveNewRequest() {
+		cc.Close()
+		return nil, errors.New("上级代理HTTP/2连接不能发起新的stream")
+	}
+	hp.conns = append(hp.conns, cc)
+
+	return cc, nil
+}
+
+// dialH2 建立到上级代理的HTTP/2连接, 没有协商HTTP/2时返回errParentNoH2
+func (c *parentConns) dialH2(ctx context.Context, parent *url.URL) (*http2.ClientConn, error) {
+	conn, err := c.dial(ctx, "tcp", parentAddr(parent))
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, c.tlsConfig(parent, http2.NextProtoTLS, "http/1.1"))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, errParentNoH2
+	}
+	cc, err := c.h2.NewClientConn(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	return cc, nil
+}
+
+// connectH2 通过HTTP/2 CONNECT stream建立隧道, 请求body为写入方向, 响应body为读取方向
+func (c *parentConns) connectH2(ctx context.Context, parent *url.URL, targetAddr string, header http.Header) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           &url.URL{Scheme: "https", Host: parentAddr(parent)},
+		Host:          ensurePort(targetAddr, "443"),
+		Header:        CloneHeader(header),
+		Body:          pr,
+		ContentLength: -1,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(parent.User.Username()+":"+password)))
+	}
+	cc, err := c.h2Conn(ctx, parent)
+	if err != nil {
+		pw.Close()
+		if errors.Is(err, errParentNoH2) {
+			c.noH2.Store(parent.Host, true)
+		}
+		return nil, err
+	}
+	// stream的生命周期与隧道相同, 不随拨号超时结束
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := cc.RoundTrip(req.WithContext(streamCtx))
+	if !stop() && err == nil {
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, &ParentProxyError{Proxy: parent.Host, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	atomic.AddInt64(&c.streams, 1)
+
+	return &h2TunnelConn{body: resp.Body, pw: pw, cancel: cancel, remote: stringAddr(parentAddr(parent))}, nil
+}
+
+// h2TunnelConn 上级代理的HTTP/2 CONNECT stream
+// 读写共用一个截止时间, 到达后结束stream, 不能再延长
+type h2TunnelConn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	remote net.Addr
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func (c *h2TunnelConn) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+
+	return n, err
+}
+
+func (c *h2TunnelConn) Write(b []byte) (int, error) {
+	n, err := c.pw.Write(b)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+
+	return n, err
+}
+
+func (c *h2TunnelConn) Close() error {
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+	c.pw.Close()
+	err := c.body.Close()
+	c.cancel()
+
+	return err
+}
+
+func (c *h2TunnelConn) expire() {
+	c.expired.Store(true)
+	c.pw.CloseWithError(os.ErrDeadlineExceeded)
+	c.cancel()
+}
+
+func (c *h2TunnelConn) LocalAddr() net.Addr {
+	return stringAddr("")
+}
+
+func (c *h2TunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *h2TunnelConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired.Load() {
+		return nil
+	}
+	if t.IsZero() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		return nil
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		c.expire()
+		return nil
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(d, c.expire)
+	} else {
+		c.timer.Reset(d)
+	}
+
+	return nil
+}
+
+func (c *h2TunnelConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *h2TunnelConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+)
+
+const defaultParentRotationAttempts = 3
+
+// ParentCredentials 单个请求或隧道使用的上级代理用户名密码
+type ParentCredentials struct {
+	Username string
+	Password string
+}
+
+// ParentRotationConfig 上级代理返回指定状态码时调用Delegate.ParentProxyCredentials更换凭据后重试
+type ParentRotationConfig struct {
+	// StatusCodes 触发重试的状态码, 默认407和429
+	// HTTP请求无法区分上级代理和目标服务器返回的状态码, CONNECT只检查上级代理的响应
+	StatusCodes []int
+	// MaxAttempts 最多尝试次数, 包括第一次, 默认3
+	MaxAttempts int
+}
+
+// WithParentProxyRotation 上级代理拒绝时更换凭据重试, HTTP请求只在body可以重新读取时重试
+func WithParentProxyRotation(config ParentRotationConfig) Option {
+	return func(opt *options) {
+		opt.parentRotation = &config
+	}
+}
+
+type parentRotation struct {
+	statusCodes []int
+	maxAttempts int
+}
+
+func newParentRotation(config ParentRotationConfig) *parentRotation {
+	r := &parentRotation{statusCodes: config.StatusCodes, maxAttempts: config.MaxAttempts}
+	if len(r.statusCodes) == 0 {
+		r.statusCodes = []int{http.StatusProxyAuthRequired, http.StatusTooManyRequests}
+	}
+	if r.maxAttempts <= 0 {
+		r.maxAttempts = defaultParentRotationAttempts
+	}
+
+	return r
+}
+
+// retry attempt次尝试返回statusCode后是否重试
+func (r *parentRotation) retry(statusCode, attempt int) bool {
+	if r == nil || attempt+1 >= r.maxAttempts {
+		return false
+	}
+	for _, code := range r.statusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withParentCredentials 返回带有Delegate.ParentProxyCredentials凭据的上级代理地址, 没有凭据时返回parent
+// SSH上级代理使用自己的认证, 不调用
+func (p *Proxy) withParentCredentials(ctx *Context, parent *url.URL, attempt int) *url.URL {
+	if parent == nil || parent.Scheme == "ssh" {
+		return parent
+	}
+	creds := p.callParentProxyCredentials(ctx, parent, attempt)
+	if creds == nil {
+		return parent
+	}
+	u := *parent
+	u.User = url.UserPassword(creds.Username, creds.Password)
+
+	return &u
+}
+
+// parentRefusal 上级代理拒绝的状态码, HTTP请求为响应的状态码
+func parentRefusal(resp *http.Response, err error) int {
+	var e *ParentProxyError
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	if err == nil && resp != nil {
+		return resp.StatusCode
+	}
+
+	return 0
+}
+
+// onProxyConnectResponse 经过HTTP上级代理的HTTPS请求, CONNECT失败时返回ParentProxyError, 用于判断是否重试
+func onProxyConnectResponse(_ context.Context, proxyURL *url.URL, _ *http.Request, resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	return &ParentProxyError{Proxy: proxyURL.Host, StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// stickyMember 相同会话key总是选择同一个成员, 成员不可用时只影响该成员的会话
+func stickyMember(session string, candidates []*upstreamMember) *upstreamMember {
+	var best *upstreamMember
+	var bestScore uint64
+	for _, m := range candidates {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s|%s", session, m.url)
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+
+	return best
+}
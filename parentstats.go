@@ -0,0 +1,208 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 连续失败达到该次数视为不健康
+	parentUnhealthyErrors = 3
+	// 延迟指数移动平均的权重
+	parentLatencyAlpha = 0.2
+)
+
+// ParentProxyStatus 上级代理状态, 根据经过该上级代理的请求和隧道被动统计
+type ParentProxyStatus struct {
+	// URL 上级代理地址, 不含密码
+	URL string
+	// Healthy 最近连续失败次数未达到阈值
+	Healthy bool
+	// Weight 当前权重, 未配置负载均衡时健康为1, 不健康为0, 上级代理池中为Upstream.Weight
+	Weight int
+	// Latency 最近的请求延迟(指数移动平均), 隧道为建立连接的耗时
+	Latency time.Duration
+	// Requests 请求和隧道总数
+	Requests int64
+	// Errors 失败总数
+	Errors int64
+	// ConsecutiveErrors 连续失败次数, 成功后清零
+	ConsecutiveErrors int64
+	// InFlight 正在进行的请求和隧道数
+	InFlight int64
+	// LastError 最近一次错误
+	LastError     string
+	LastErrorTime time.Time
+	LastUsed      time.Time
+}
+
+// ParentProxyStats 返回所有使用过的上级代理的状态, 按URL排序
+// 开启WithUpstreamPool时池中的上级代理按熔断状态判断是否健康
+func (p *Proxy) ParentProxyStats() []ParentProxyStatus {
+	list := p.parentStats.snapshot()
+	if pool := p.runtime().upstreams; pool != nil {
+		for i := range list {
+			if healthy, weight, ok := pool.healthy(list[i].URL); ok {
+				list[i].Healthy, list[i].Weight = healthy, weight
+			}
+		}
+	}
+
+	return list
+}
+
+// OnParentProxyHealthChange 上级代理因请求成功或失败改变健康状态时调用f, 用于告警或集群同步
+func (p *Proxy) OnParentProxyHealthChange(f func(st ParentProxyStatus, healthy bool)) {
+	p.parentStats.mu.Lock()
+	p.parentStats.watchers = append(p.parentStats.watchers, f)
+	p.parentStats.mu.Unlock()
+}
+
+// SetParentProxyHealth 设置上级代理的健康状态, 如从其他实例同步, 不触发OnParentProxyHealthChange
+// parentURL格式与ParentProxyStatus.URL相同, 之后的请求结果仍会更新状态
+func (p *Proxy) SetParentProxyHealth(parentURL string, healthy bool, lastError string) {
+	s := &p.parentStats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status(parentURL)
+	if healthy {
+		st.ConsecutiveErrors = 0
+		return
+	}
+	if st.ConsecutiveErrors < parentUnhealthyErrors {
+		st.ConsecutiveErrors = parentUnhealthyErrors
+	}
+	st.LastError = lastError
+	st.LastErrorTime = time.Now()
+}
+
+type parentStats struct {
+	mu sync.Mutex
+	m  map[string]*ParentProxyStatus
+	// 健康状态变化时调用, 不持有锁
+	watchers []func(st ParentProxyStatus, healthy bool)
+}
+
+func parentStatsKey(u *url.URL) string {
+	key := u.Scheme + "://"
+	if u.User != nil {
+		key += u.User.Username() + "@"
+	}
+
+	return key + u.Host
+}
+
+// start 开始一次请求或隧道, 返回的parentCall用于记录结果
+func (s *parentStats) start(u *url.URL) *parentCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status(parentStatsKey(u))
+	st.Requests++
+	st.InFlight++
+	st.LastUsed = time.Now()
+
+	return &parentCall{s: s, st: st, start: time.Now()}
+}
+
+// status 返回key对应的状态, 不存在时创建, 调用方需持有mu
+func (s *parentStats) status(key string) *ParentProxyStatus {
+	if s.m == nil {
+		s.m = make(map[string]*ParentProxyStatus)
+	}
+	st, ok := s.m[key]
+	if !ok {
+		st = &ParentProxyStatus{URL: key}
+		s.m[key] = st
+	}
+
+	return st
+}
+
+func (s *parentStats) snapshot() []ParentProxyStatus {
+	s.mu.Lock()
+	list := make([]ParentProxyStatus, 0, len(s.m))
+	for _, st := range s.m {
+		item := *st
+		item.Healthy = item.ConsecutiveErrors < parentUnhealthyErrors
+		if item.Healthy {
+			item.Weight = 1
+		}
+		list = append(list, item)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].URL < list[j].URL })
+
+	return list
+}
+
+// parentCall 一次经过上级代理的请求或隧道
+type parentCall struct {
+	s     *parentStats
+	st    *ParentProxyStatus
+	start time.Time
+	once  sync.Once
+}
+
+// observe 记录连接或请求结果
+func (c *parentCall) observe(err error) {
+	latency := time.Since(c.start)
+	c.s.mu.Lock()
+	st := c.st
+	wasHealthy := st.ConsecutiveErrors < parentUnhealthyErrors
+	if err != nil {
+		st.Errors++
+		st.ConsecutiveErrors++
+		st.LastError = err.Error()
+		st.LastErrorTime = time.Now()
+	} else {
+		st.ConsecutiveErrors = 0
+		if st.Latency == 0 {
+			st.Latency = latency
+		} else {
+			st.Latency = time.Duration(parentLatencyAlpha*float64(latency) + (1-parentLatencyAlpha)*float64(st.Latency))
+		}
+	}
+	healthy := st.ConsecutiveErrors < parentUnhealthyErrors
+	status := *st
+	watchers := c.s.watchers
+	c.s.mu.Unlock()
+	if healthy != wasHealthy {
+		for _, f := range watchers {
+			f(status, healthy)
+		}
+	}
+}
+
+// done 请求或隧道结束, 可重复调用
+func (c *parentCall) done() {
+	c.once.Do(func() {
+		c.s.mu.Lock()
+		c.st.InFlight--
+		c.s.mu.Unlock()
+	})
+}
+
+// body 响应body关闭时结束
+func (c *parentCall) body(rc io.ReadCloser) io.ReadCloser {
+	return &readCloser{Reader: rc, Closer: closerFunc(func() error {
+		c.done()
+		return rc.Close()
+	})}
+}
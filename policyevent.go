@@ -0,0 +1,339 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultPolicyEventBatchSize     = 100
+	defaultPolicyEventFlushInterval = 5 * time.Second
+	defaultPolicyEventQueueSize     = 10000
+	defaultPolicyEventRetries       = 3
+)
+
+// PolicyEventType 策略事件类型
+type PolicyEventType string
+
+const (
+	// PolicyEventBlocked 请求被拦截
+	PolicyEventBlocked PolicyEventType = "blocked"
+	// PolicyEventAuthFailure 代理身份认证失败
+	PolicyEventAuthFailure PolicyEventType = "auth_failure"
+	// PolicyEventMalware 检测到恶意内容
+	PolicyEventMalware PolicyEventType = "malware"
+	// PolicyEventDataLeak 检测到敏感数据外发
+	PolicyEventDataLeak PolicyEventType = "data_leak"
+)
+
+// PolicyEvent 策略事件, 用于对接SIEM等安全事件平台
+type PolicyEvent struct {
+	Type     PolicyEventType `json:"type"`
+	Time     time.Time       `json:"time"`
+	ClientIP string          `json:"client_ip"`
+	User     string          `json:"user,omitempty"`
+	Method   string          `json:"method,omitempty"`
+	URL      string          `json:"url,omitempty"`
+	Host     string          `json:"host,omitempty"`
+	// Status 返回给客户端的状态码
+	Status int `json:"status,omitempty"`
+	// Reason 原因, 如拦截说明、病毒名称
+	Reason string `json:"reason,omitempty"`
+	// Category 分类, 如广告、恶意网站
+	Category string `json:"category,omitempty"`
+	// Fields 其他字段
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// PolicyEventSink 接收批量策略事件, 由单个goroutine按顺序调用
+type PolicyEventSink interface {
+	Send(events []*PolicyEvent) error
+}
+
+// PolicyEventConfig 批量发送设置
+type PolicyEventConfig struct {
+	// BatchSize 累计到该数量时立即发送, 默认100
+	BatchSize int
+	// FlushInterval 未达到BatchSize时的最长等待时间, 默认5秒
+	FlushInterval time.Duration
+	// QueueSize 每个sink待发送事件的队列长度, 默认10000, 队列满时丢弃
+	QueueSize int
+}
+
+// WithPolicyEventSinks 发送拦截、认证失败、恶意内容等策略事件
+// 调用Context.WriteBlockPage、Context.BlockPageResponse或Connect、Auth中断并返回401/403/407/451时自动生成事件,
+// 其他事件(如恶意内容)使用Context.ReportPolicyEvent上报
+func WithPolicyEventSinks(config PolicyEventConfig, sinks ...PolicyEventSink) Option {
+	return func(opt *options) {
+		opt.policyEventConfig = config
+		opt.policyEventSinks = append(opt.policyEventSinks, sinks...)
+	}
+}
+
+// FlushPolicyEvents 立即发送所有缓存的策略事件, 等待发送完成, 用于退出前调用
+func (p *Proxy) FlushPolicyEvents() {
+	if p.policyEvents == nil {
+		return
+	}
+	p.policyEvents.flush()
+}
+
+// ReportPolicyEvent 上报策略事件, 未设置的客户端地址、用户、请求信息从Context中获取
+// 未配置WithPolicyEventSinks时忽略
+func (c *Context) ReportPolicyEvent(event *PolicyEvent) {
+	c.policyReported = true
+	if c.policyEvents == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.User == "" {
+		event.User = c.User
+	}
+	if c.Req != nil {
+		if event.ClientIP == "" {
+			event.ClientIP = hostname(c.Req.RemoteAddr)
+		}
+		if event.Method == "" {
+			event.Method = c.Req.Method
+		}
+		if event.URL == "" {
+			event.URL = c.Req.URL.String()
+			if c.Req.Method == http.MethodConnect {
+				event.URL = c.Req.URL.Host
+			}
+		}
+		if event.Host == "" {
+			event.Host = hostname(c.Req.URL.Host)
+		}
+	}
+	c.policyEvents.send(event)
+}
+
+// reportBlockPage 拦截页面对应的事件
+func (c *Context) reportBlockPage(page *BlockPage) {
+	typ := PolicyEventBlocked
+	switch {
+	case page.EventType != "":
+		typ = page.EventType
+	case page.StatusCode == http.StatusUnauthorized || page.StatusCode == http.StatusProxyAuthRequired:
+		typ = PolicyEventAuthFailure
+	}
+	c.ReportPolicyEvent(&PolicyEvent{
+		Type:     typ,
+		Status:   page.StatusCode,
+		Reason:   page.Message,
+		Category: page.Category,
+		Fields:   page.Fields,
+	})
+}
+
+// reportAbort Connect、Auth直接写入响应中断时, 根据状态码生成事件
+func (c *Context) reportAbort() {
+	if c.policyReported {
+		return
+	}
+	typ := PolicyEventBlocked
+	switch c.status {
+	case http.StatusUnauthorized, http.StatusProxyAuthRequired:
+		typ = PolicyEventAuthFailure
+	case http.StatusForbidden, http.StatusUnavailableForLegalReasons:
+	default:
+		return
+	}
+	c.ReportPolicyEvent(&PolicyEvent{Type: typ, Status: c.status})
+}
+
+// policyEvents 每个sink一个批量发送goroutine
+type policyEvents struct {
+	batchers []*eventBatcher
+}
+
+func newPolicyEvents(config PolicyEventConfig, sinks []PolicyEventSink, errLog func(error)) *policyEvents {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultPolicyEventBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultPolicyEventFlushInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultPolicyEventQueueSize
+	}
+	e := &policyEvents{}
+	for _, sink := range sinks {
+		b := &eventBatcher{
+			sink:     sink,
+			config:   config,
+			errLog:   errLog,
+			queue:    make(chan *PolicyEvent, config.QueueSize),
+			flushReq: make(chan chan struct{}),
+		}
+		go b.run()
+		e.batchers = append(e.batchers, b)
+	}
+
+	return e
+}
+
+func (e *policyEvents) send(event *PolicyEvent) {
+	for _, b := range e.batchers {
+		select {
+		case b.queue <- event:
+		default:
+			b.errLog(fmt.Errorf("策略事件队列已满, 丢弃事件: %s %s", event.Type, event.URL))
+		}
+	}
+}
+
+func (e *policyEvents) flush() {
+	for _, b := range e.batchers {
+		done := make(chan struct{})
+		b.flushReq <- done
+		<-done
+	}
+}
+
+type eventBatcher struct {
+	sink     PolicyEventSink
+	config   PolicyEventConfig
+	errLog   func(error)
+	queue    chan *PolicyEvent
+	flushReq chan chan struct{}
+}
+
+func (b *eventBatcher) run() {
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*PolicyEvent, 0, b.config.BatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.sink.Send(batch); err != nil {
+			b.errLog(fmt.Errorf("发送%d条策略事件失败: %s", len(batch), err))
+		}
+		batch = make([]*PolicyEvent, 0, b.config.BatchSize)
+	}
+	for {
+		select {
+		case event := <-b.queue:
+			batch = append(batch, event)
+			if len(batch) >= b.config.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-b.flushReq:
+			// 发送队列中已有的事件
+			for n := len(b.queue); n > 0; n-- {
+				batch = append(batch, <-b.queue)
+				if len(batch) >= b.config.BatchSize {
+					send()
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+type httpEventSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// NewHTTPEventSink 以JSON数组POST到url, 网络错误、429、5xx时重试3次
+// secret不为空时按SignWebhook签名, 请求头与告警webhook相同, X-Goproxy-Event为policy
+func NewHTTPEventSink(url, secret string, client *http.Client) PolicyEventSink {
+	if client == nil {
+		client = &http.Client{Timeout: defaultAlertTimeout}
+	}
+
+	return &httpEventSink{url: url, secret: secret, client: client}
+}
+
+func (s *httpEventSink) Send(events []*PolicyEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	return postWebhook(s.client, s.url, s.secret, nil, "policy", body, defaultPolicyEventRetries)
+}
+
+type writerEventSink struct {
+	w io.Writer
+}
+
+// NewWriterEventSink 每个事件一个JSON对象, 单独调用一次Write
+// 可配合syslog.Writer发送到syslog, 或写入文件
+func NewWriterEventSink(w io.Writer) PolicyEventSink {
+	return &writerEventSink{w: w}
+}
+
+func (s *writerEventSink) Send(events []*PolicyEvent) error {
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// KafkaMessage 写入Kafka的消息
+type KafkaMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+// KafkaProducer Kafka生产者, 由使用方基于Kafka客户端库实现
+type KafkaProducer interface {
+	Produce(topic string, messages []KafkaMessage) error
+}
+
+type kafkaEventSink struct {
+	producer KafkaProducer
+	topic    string
+}
+
+// NewKafkaEventSink 每个事件一条消息写入topic, key为客户端IP, 同一客户端的事件进入同一分区
+func NewKafkaEventSink(producer KafkaProducer, topic string) PolicyEventSink {
+	return &kafkaEventSink{producer: producer, topic: topic}
+}
+
+func (s *kafkaEventSink) Send(events []*PolicyEvent) error {
+	messages := make([]KafkaMessage, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, KafkaMessage{Key: []byte(event.ClientIP), Value: value})
+	}
+
+	return s.producer.Produce(s.topic, messages)
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PortRange 端口范围, 包含Min和Max
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// AnyPort 匹配所有端口
+var AnyPort = PortRange{Min: 1, Max: 65535}
+
+// ParsePortRange 解析端口, 支持"443"、"8000-8999"和匹配所有端口的"*"
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return AnyPort, nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	min, err1 := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	max, err2 := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err1 != nil || err2 != nil || min == 0 || min > max {
+		return PortRange{}, fmt.Errorf("无效的端口范围: %s", s)
+	}
+
+	return PortRange{Min: int(min), Max: int(max)}, nil
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// ConnectPortPolicy CONNECT允许连接的目标端口
+type ConnectPortPolicy struct {
+	// Allow 允许的端口, 为空时只允许443
+	Allow []PortRange
+	// StatusCode 拒绝时的状态码, 默认403
+	StatusCode int
+}
+
+// WithConnectPortPolicy 限制CONNECT的目标端口, 避免被用作SMTP等服务的开放中继
+// 在WithACL之后检查, 包括HTTPS解密、SOCKS5和透明代理的连接, 可通过Delegate.ConnectPortAllowed修改结果
+func WithConnectPortPolicy(policy ConnectPortPolicy) Option {
+	return func(opt *options) {
+		opt.connectPorts = &policy
+	}
+}
+
+// allowed 端口是否在允许范围内
+func (c *ConnectPortPolicy) allowed(port int) bool {
+	if len(c.Allow) == 0 {
+		return port == 443
+	}
+	for _, r := range c.Allow {
+		if r.contains(port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkConnectPort 检查CONNECT的目标端口, 返回nil时放行
+func (p *Proxy) checkConnectPort(ctx *Context) *BlockPage {
+	if p.connectPorts == nil {
+		return nil
+	}
+	_, port := aclTarget(ctx.Req)
+	if p.callConnectPortAllowed(ctx, port, p.connectPorts.allowed(port)) {
+		return nil
+	}
+	statusCode := p.connectPorts.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusForbidden
+	}
+
+	return &BlockPage{StatusCode: statusCode, Message: fmt.Sprintf("不允许连接端口%d", port)}
+}
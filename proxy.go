@@ -18,17 +18,24 @@ package goproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ouqiang/goproxy/cert"
+	"github.com/ouqiang/goproxy/resolver"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -38,24 +45,151 @@ const (
 	defaultTargetReadWriteTimeout = 30 * time.Second
 	// 客户端读写超时时间
 	defaultClientReadWriteTimeout = 30 * time.Second
+	// 过载时建议客户端重试的间隔
+	defaultRetryAfter = 5 * time.Second
 )
 
 // 隧道连接成功响应行
 var tunnelEstablishedResponseLine = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
 
-var badGateway = []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", http.StatusBadGateway, http.StatusText(http.StatusBadGateway)))
+// 生成只有状态行的响应
+func makeStatusResponse(code int) []byte {
+	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code)))
+}
+
+// 请求失败时返回给客户端的状态码
+func errorStatusCode(err error) int {
+	switch err {
+	case ErrHostConnLimit, ErrClientConnLimit, ErrCircuitOpen, ErrQueueFull, ErrQueueTimeout:
+		return http.StatusServiceUnavailable
+	case ErrPerClientRequestLimit, ErrPerClientConnLimit:
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrRequestBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if UpstreamErrorKindOf(err) == UpstreamErrorTimeout {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// 生成隧道建立请求, addr没有端口时使用443, IPv6地址带方括号
+// authorization为ParentAuthProvider生成的认证, 为空且上级代理URL包含用户名密码时发送Basic认证
+// header为WithHeaderRules添加的header
+func makeTunnelRequestLine(addr string, parent *url.URL, header http.Header, authorization string) string {
+	addr = ensurePort(addr, "443")
+	auth := ""
+	if authorization != "" {
+		auth = "Proxy-Authorization: " + authorization + "\r\n"
+	} else if parent.User != nil {
+		password, _ := parent.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(parent.User.Username() + ":" + password))
+		auth = "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	var extra strings.Builder
+	header.Write(&extra)
 
-// 生成隧道建立请求行
-func makeTunnelRequestLine(addr string) string {
-	return fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", addr)
+	return fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s%s\r\n", addr, addr, auth, extra.String())
 }
 
 type options struct {
-	disableKeepAlive bool
-	delegate         Delegate
-	decryptHTTPS     bool
-	certCache        cert.Cache
-	transport        *http.Transport
+	disableKeepAlive   bool
+	delegate           Delegate
+	decryptHTTPS       bool
+	certCache          cert.Cache
+	mitmCA             *tls.Certificate
+	transport          *http.Transport
+	resolver           resolver.Resolver
+	maxConnsPerHost    int
+	maxClientRequests  int
+	perClientKey       RateLimitKeyFunc
+	connQueueTimeout   time.Duration
+	maxClientConns     int
+	maxClientConnsIP   int
+	clientQueueTimeout time.Duration
+	retryAfter         time.Duration
+	clientIdleTimeout  time.Duration
+	tunnelIdleTimeout  time.Duration
+	connectTimeout     time.Duration
+	clientRWTimeout    time.Duration
+	targetRWTimeout    time.Duration
+	sshConfig          SSHConfigFunc
+	unixSocketRoutes   []UnixSocketRoute
+	hostRewriteRules   []HostRewriteRule
+	urlRewriteRules    []URLRewriteRule
+	redirectRules      []RedirectRule
+	identityEncoding   bool
+	dialContext        DialContextFunc
+
+	requestTransformers  []BodyTransformer
+	responseTransformers []BodyTransformer
+
+	userQuota         bool
+	quotaStore        QuotaStore
+	quotaLimit        QuotaLimitFunc
+	quotaAction       QuotaAction
+	quotaThrottleRate int64
+	bandwidth         *BandwidthConfig
+	flushInterval     time.Duration
+	http2             bool
+	bufferSize        int
+
+	maintenanceContentType string
+	maintenancePage        []byte
+	blockPageRenderer      BlockPageRenderer
+	webSocketCompression   WebSocketCompression
+	accessLogSinks         []AccessLogSink
+	coalesceMaxBody        int64
+	maxRequestBody         int64
+	maxResponseBody        int64
+	decodeResponseBody     bool
+	recompressResponse     bool
+	alertConfig            AlertConfig
+	alertWebhooks          []AlertWebhook
+	policyEventConfig      PolicyEventConfig
+	policyEventSinks       []PolicyEventSink
+	rateLimiter            RateLimiter
+	rateLimitKey           RateLimitKeyFunc
+	upstreamClientCert     func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	upstreamTLS            *UpstreamTLSConfig
+	parentAuth             func(*url.URL) ParentAuthProvider
+	connectPorts           *ConnectPortPolicy
+	geoIP                  GeoIPReader
+	hostTransports         *HostTransportConfig
+	dialPolicy             *DialPolicy
+	ftpGateway             bool
+	parentRotation         *ParentRotationConfig
+	tunnelSocket           *SocketOptions
+	signingRules           []SigningRule
+	integrity              *IntegrityConfig
+	contentAdapters        []ContentAdapter
+	categorization         *CategoryConfig
+	acl                    *ACLConfig
+	forwarded              *ForwardedConfig
+	headerRules            []HeaderRule
+	routes                 *RouteTable
+	tracing                *TracingConfig
+	cache                  *CacheConfig
+	cassette               *CassetteConfig
+	retry                  *RetryPolicy
+	circuitBreaker         *CircuitBreakerConfig
+	clientCert             *ClientCertConfig
+	upstreamPool           *UpstreamPoolConfig
+	sniRouting             bool
+	sniRules               []SNIRule
+	hsts                   *HSTSConfig
+	compression            *CompressionConfig
+	sampling               *SamplingConfig
+	tee                    *TeeConfig
+	contentFilter          *ContentFilterConfig
+	admission              *AdmissionConfig
+	extAuthz               *ExtAuthzConfig
+	tlsHandshaker          TLSHandshaker
+	parentConns            *ParentConnPoolConfig
+	deadline               *DeadlineConfig
+	basicAuth              *basicAuth
 }
 
 type Option func(*options)
@@ -81,6 +215,13 @@ func WithTransport(t *http.Transport) Option {
 	}
 }
 
+// WithUpstreamClientCertificate 目标服务器要求客户端证书时调用, 每次握手获取, 可配合cert.KeyPairReloader在运行时替换
+func WithUpstreamClientCertificate(f func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) Option {
+	return func(opt *options) {
+		opt.upstreamClientCert = f
+	}
+}
+
 // WithDecryptHTTPS 中间人代理, 解密HTTPS, 需实现证书缓存接口
 func WithDecryptHTTPS(c cert.Cache) Option {
 	return func(opt *options) {
@@ -89,6 +230,93 @@ func WithDecryptHTTPS(c cert.Cache) Option {
 	}
 }
 
+// WithMITMCA 开启HTTPS解密, 使用指定的根证书动态签发目标域名的证书, 私钥支持RSA、ECDSA和Ed25519
+// 证书缓存通过WithDecryptHTTPS设置, 根证书无效时记录错误, HTTPS解密的请求握手失败
+func WithMITMCA(ca *tls.Certificate) Option {
+	return func(opt *options) {
+		opt.decryptHTTPS = true
+		opt.mitmCA = ca
+	}
+}
+
+// WithResolver 自定义DNS解析, 如resolver.NewDoH
+func WithResolver(r resolver.Resolver) Option {
+	return func(opt *options) {
+		opt.resolver = r
+	}
+}
+
+// WithMaxConnsPerHost 限制到单个目标主机的并发连接数(包括隧道)
+// queueTimeout为排队等待时间, 为0时超出限制立即返回503
+func WithMaxConnsPerHost(max int, queueTimeout time.Duration) Option {
+	return func(opt *options) {
+		opt.maxConnsPerHost = max
+		opt.connQueueTimeout = queueTimeout
+	}
+}
+
+// WithMaxClientConns 限制客户端总并发连接数, 在Accept时检查, 连接关闭后释放, 见Proxy.LimitListener
+// queueTimeout为排队等待时间, 为0时超出限制立即返回503并带上Retry-After后关闭连接, TLS、SOCKS5和透明代理的连接直接关闭
+func WithMaxClientConns(max int, queueTimeout time.Duration) Option {
+	return func(opt *options) {
+		opt.maxClientConns = max
+		opt.clientQueueTimeout = queueTimeout
+	}
+}
+
+// WithMaxConnsPerClientIP 限制单个客户端IP的并发连接数, 在Accept时检查, 连接关闭后释放, 避免少数客户端占满WithMaxClientConns的名额
+// 超出限制时不排队, 立即返回429并带上Retry-After后关闭连接, TLS、SOCKS5和透明代理的连接直接关闭
+func WithMaxConnsPerClientIP(max int) Option {
+	return func(opt *options) {
+		opt.maxClientConnsIP = max
+	}
+}
+
+// WithRetryAfter 过载返回503时Retry-After的值, 默认5秒
+func WithRetryAfter(d time.Duration) Option {
+	return func(opt *options) {
+		opt.retryAfter = d
+	}
+}
+
+// WithClientIdleTimeout 客户端keep-alive连接等待下一个请求的空闲超时时间, 默认30秒
+// 作用于HTTPS解密后的客户端连接, 普通HTTP连接由http.Server.IdleTimeout控制
+func WithClientIdleTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.clientIdleTimeout = d
+	}
+}
+
+// WithTunnelIdleTimeout 隧道空闲超时时间, 同时作用于客户端和目标服务器连接, 任一方向有数据传输时延长
+// 未设置时分别使用WithClientReadWriteTimeout和WithTargetReadWriteTimeout作为空闲超时
+func WithTunnelIdleTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.tunnelIdleTimeout = d
+	}
+}
+
+// WithConnectTimeout 连接目标服务器和上级代理的超时时间, 默认5秒, 使用WithDialContext时由自定义拨号器决定
+func WithConnectTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.connectTimeout = d
+	}
+}
+
+// WithClientReadWriteTimeout 客户端连接的读写超时时间, 默认30秒, 小于0时不超时
+// 作用于HTTPS解密的握手和每个请求, 隧道和WebSocket中作为空闲超时
+func WithClientReadWriteTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.clientRWTimeout = d
+	}
+}
+
+// WithTargetReadWriteTimeout 隧道到目标服务器连接的空闲超时时间, 默认30秒, 小于0时不超时
+func WithTargetReadWriteTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.targetRWTimeout = d
+	}
+}
+
 // New 创建proxy实例
 func New(opt ...Option) *Proxy {
 	opts := &options{}
@@ -114,16 +342,225 @@ func New(opt ...Option) *Proxy {
 			ExpectContinueTimeout: 1 * time.Second,
 		}
 	}
+	if opts.http2 {
+		opts.transport.ForceAttemptHTTP2 = true
+	}
 
 	p := &Proxy{}
+	p.stats.start = time.Now()
+	p.metrics = newMetrics()
 	p.delegate = opts.delegate
+	p.resolver = opts.resolver
+	p.dial = opts.dialContext
+	p.unixSocketRoutes = opts.unixSocketRoutes
+	rc := &runtimeConfig{
+		hostRewriteRules: opts.hostRewriteRules,
+		urlRewriteRules:  opts.urlRewriteRules,
+		routes:           opts.routes,
+		rateLimiter:      opts.rateLimiter,
+	}
+	p.redirectRules = opts.redirectRules
+	p.identityEncoding = opts.identityEncoding
+	p.requestTransformers = opts.requestTransformers
+	p.responseTransformers = opts.responseTransformers
+	for i, t := range p.requestTransformers {
+		p.requestTransformerStats = append(p.requestTransformerStats, p.hooks.register("RequestBodyTransformer", i, t))
+	}
+	for i, t := range p.responseTransformers {
+		p.responseTransformerStats = append(p.responseTransformerStats, p.hooks.register("ResponseBodyTransformer", i, t))
+	}
+	p.maintenance.contentType = opts.maintenanceContentType
+	p.maintenance.page = opts.maintenancePage
+	p.blockPageRenderer = opts.blockPageRenderer
+	p.webSocketCompression = opts.webSocketCompression
+	p.accessLogSinks = opts.accessLogSinks
+	p.rateLimitKey = opts.rateLimitKey
+	p.signingRules = opts.signingRules
+	p.integrity = opts.integrity
+	p.contentAdapters = opts.contentAdapters
+	for i, a := range p.contentAdapters {
+		p.adapterRequestStats = append(p.adapterRequestStats, p.hooks.register("ContentAdapter.AdaptRequest", i, a))
+		p.adapterResponseStats = append(p.adapterResponseStats, p.hooks.register("ContentAdapter.AdaptResponse", i, a))
+	}
+	p.sniRouting = opts.sniRouting
+	if opts.hsts != nil {
+		p.hsts = newHSTS(*opts.hsts)
+	}
+	if opts.compression != nil {
+		p.compressor = newCompressor(*opts.compression)
+	}
+	p.basicAuth = opts.basicAuth
+	if opts.sampling != nil {
+		p.sampler = newSampler(*opts.sampling)
+	}
+	if opts.tee != nil {
+		p.tee = newTee(*opts.tee, p.delegate.ErrorLog)
+	}
+	if opts.contentFilter != nil {
+		p.contentFilter = newContentFilter(*opts.contentFilter)
+	}
+	if opts.admission != nil {
+		p.admission = newAdmission(*opts.admission)
+	}
+	if opts.parentConns != nil {
+		p.parentConns = newParentConns(*opts.parentConns, p.dialContext)
+	}
+	if opts.deadline != nil {
+		p.deadlines = newDeadlines(*opts.deadline)
+	}
+	if opts.extAuthz != nil {
+		p.extAuthz = newExtAuthz(*opts.extAuthz)
+	}
+	p.sniRules = opts.sniRules
+	if opts.acl != nil {
+		rc.acl = newACL(*opts.acl)
+	}
+	p.headerRules = opts.headerRules
+	p.tracing = opts.tracing
+	if opts.forwarded != nil {
+		p.forwarded = newForwarded(*opts.forwarded)
+	}
+	if opts.cassette != nil {
+		p.cassette = newCassette(*opts.cassette)
+	}
+	if opts.cache != nil {
+		p.cache = newHTTPCache(*opts.cache)
+	}
+	if opts.retry != nil && opts.retry.MaxAttempts > 1 {
+		p.retry = newRetrier(*opts.retry)
+	}
+	if opts.circuitBreaker != nil {
+		p.breaker = newCircuitBreaker(*opts.circuitBreaker, p.callCircuitStateChanged)
+	}
+	p.clientCert = opts.clientCert
+	if opts.upstreamPool != nil {
+		rc.upstreams = newUpstreamPool(*opts.upstreamPool, p.checkUpstream, p.delegate.ErrorLog)
+	}
+	p.config.Store(rc)
+	if opts.categorization != nil {
+		p.categorizer = newCategorizer(*opts.categorization)
+	}
+	p.maxRequestBody = opts.maxRequestBody
+	p.maxResponseBody = opts.maxResponseBody
+	p.decodeResponseBody = opts.decodeResponseBody
+	p.recompressResponse = opts.recompressResponse
+	if opts.coalesceMaxBody > 0 {
+		p.coalescer = newCoalescer(opts.coalesceMaxBody)
+	}
+	p.clientIdleTimeout = opts.clientIdleTimeout
+	if p.clientIdleTimeout <= 0 {
+		p.clientIdleTimeout = defaultClientReadWriteTimeout
+	}
+	p.tunnelIdleTimeout = opts.tunnelIdleTimeout
+	p.connectTimeout = opts.connectTimeout
+	if p.connectTimeout <= 0 {
+		p.connectTimeout = defaultTargetConnectTimeout
+	}
+	if opts.dialPolicy != nil && p.dial == nil {
+		p.dialPolicy = opts.dialPolicy
+		if p.dialPolicy.Timeout <= 0 {
+			p.dialPolicy.Timeout = p.connectTimeout
+		}
+		p.dial = p.dialPolicy.DialContext
+	}
+	p.clientRWTimeout = opts.clientRWTimeout
+	if p.clientRWTimeout == 0 {
+		p.clientRWTimeout = defaultClientReadWriteTimeout
+	}
+	p.targetRWTimeout = opts.targetRWTimeout
+	if p.targetRWTimeout == 0 {
+		p.targetRWTimeout = defaultTargetReadWriteTimeout
+	}
+	p.retryAfter = opts.retryAfter
+	if p.retryAfter <= 0 {
+		p.retryAfter = defaultRetryAfter
+	}
+	if opts.maxClientConns > 0 {
+		p.connLimiter = newConnLimiter(opts.maxClientConns, opts.clientQueueTimeout)
+	}
+	if opts.maxClientConnsIP > 0 {
+		p.ipConnLimiter = newIPConnLimiter(opts.maxClientConnsIP)
+	}
+	if p.connLimiter != nil || p.ipConnLimiter != nil {
+		p.connRejecter = newConnRejecter()
+	}
+	if opts.maxConnsPerHost > 0 {
+		p.hostLimiter = newHostLimiter(opts.maxConnsPerHost, opts.connQueueTimeout)
+	}
+	if opts.maxClientRequests > 0 {
+		p.clientLimiter = newClientLimiter(opts.maxClientRequests)
+		p.perClientKey = opts.perClientKey
+	}
 	p.decryptHTTPS = opts.decryptHTTPS
 	if p.decryptHTTPS {
 		p.cert = cert.NewCertificate(opts.certCache)
+		if opts.mitmCA != nil {
+			if err := p.cert.SetCAKeyPair(opts.mitmCA); err != nil {
+				p.delegate.ErrorLog(fmt.Errorf("HTTPS解密根证书无效: %s", err))
+				p.cert.SetCA(nil, nil)
+			}
+		}
 	}
 	p.transport = opts.transport
 	p.transport.DisableKeepAlives = opts.disableKeepAlive
-	p.transport.Proxy = p.delegate.ParentProxy
+	p.parentAuth = opts.parentAuth
+	p.connectPorts = opts.connectPorts
+	p.geoIP = opts.geoIP
+	p.ftpGateway = opts.ftpGateway
+	p.tunnelSocket = opts.tunnelSocket
+	p.tlsHandshaker = opts.tlsHandshaker
+	if opts.parentRotation != nil {
+		p.parentRotation = newParentRotation(*opts.parentRotation)
+		p.transport.OnProxyConnectResponse = onProxyConnectResponse
+	}
+	if opts.hostTransports != nil {
+		p.hostTransports = newHostTransports(*opts.hostTransports, p.forgetTransport)
+	}
+	if opts.upstreamTLS != nil {
+		p.upstreamTLS = opts.upstreamTLS
+		p.upstreamTLS.apply(p.transport)
+	}
+	if opts.upstreamClientCert != nil {
+		if p.transport.TLSClientConfig == nil {
+			p.transport.TLSClientConfig = &tls.Config{}
+		}
+		p.transport.TLSClientConfig.GetClientCertificate = opts.upstreamClientCert
+	}
+	p.transport.Proxy = p.transportProxy
+	if p.resolver != nil || len(p.unixSocketRoutes) > 0 || p.dial != nil {
+		p.transport.DialContext = p.dialContext
+	} else {
+		if p.transport.DialContext == nil {
+			p.transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+		}
+		p.transport.DialContext = p.requestDialer(p.transport.DialContext)
+	}
+	p.transport.DialContext = timeoutDialer(p.transport.DialContext)
+	p.ssh = newSSHManager(opts.sshConfig, p.dialContext)
+	// 淘汰时同时移除由它派生的transport, 如Dialer、WithUpstreamTLSHandshaker使用的transport
+	p.serverNameTransports = newTransportLRU(maxServerNameTransports, func(t *http.Transport) {
+		t.CloseIdleConnections()
+		p.forgetTransport(t)
+	})
+	if opts.userQuota {
+		p.quota = newQuotaManager(opts.quotaStore, opts.quotaLimit, opts.quotaAction, opts.quotaThrottleRate, p.delegate.ErrorLog)
+	}
+	p.flushInterval = opts.flushInterval
+	p.http2 = opts.http2
+	p.buffers = newBufferPool(opts.bufferSize)
+	if opts.bandwidth != nil {
+		p.throttler = newThrottler(*opts.bandwidth)
+	}
+	if len(opts.policyEventSinks) > 0 {
+		p.policyEvents = newPolicyEvents(opts.policyEventConfig, opts.policyEventSinks, p.delegate.ErrorLog)
+	}
+	if len(opts.alertWebhooks) > 0 {
+		p.alerter = newAlerter(opts.alertConfig, opts.alertWebhooks, p.delegate.ErrorLog)
+		p.OnParentProxyHealthChange(p.alerter.parent)
+		if p.quota != nil {
+			p.quota.alert = p.alerter.quota
+		}
+	}
 
 	return p
 }
@@ -132,9 +569,109 @@ func New(opt ...Option) *Proxy {
 type Proxy struct {
 	delegate      Delegate
 	clientConnNum int32
+	clients       clientTracker
+	hostStats     hostStatsRecorder
 	decryptHTTPS  bool
 	cert          *cert.Certificate
 	transport     *http.Transport
+	resolver      resolver.Resolver
+	dial          DialContextFunc
+	hostLimiter   *keyLimiter
+	clientLimiter *keyLimiter
+	perClientKey  RateLimitKeyFunc
+	connLimiter   *connLimiter
+	ipConnLimiter *keyLimiter
+	connRejecter  *connRejecter
+	retryAfter    time.Duration
+
+	clientIdleTimeout time.Duration
+	tunnelIdleTimeout time.Duration
+	connectTimeout    time.Duration
+	clientRWTimeout   time.Duration
+	targetRWTimeout   time.Duration
+
+	ssh *sshManager
+	// SOCKS5上级代理使用的transport
+	socksTransports sync.Map
+	// 需要ParentAuthProvider认证的上级代理使用的transport
+	parentAuthTransports sync.Map
+	parentAuth           func(*url.URL) ParentAuthProvider
+	connectPorts         *ConnectPortPolicy
+	geoIP                GeoIPReader
+	unixSocketRoutes     []UnixSocketRoute
+	redirectRules        []RedirectRule
+	identityEncoding     bool
+
+	requestTransformers  []BodyTransformer
+	responseTransformers []BodyTransformer
+	// 扩展点耗时统计
+	hooks                    hookStats
+	requestTransformerStats  []*hookStat
+	responseTransformerStats []*hookStat
+	adapterRequestStats      []*hookStat
+	adapterResponseStats     []*hookStat
+	// 指定SNI的transport
+	serverNameTransports *transportLRU
+	upstreamTLS          *UpstreamTLSConfig
+	insecureTransports   sync.Map
+	tlsHandshaker        TLSHandshaker
+	parentConns          *parentConns
+	deadlines            *deadlines
+	handshakeTransports  sync.Map
+	dialerTransports     sync.Map
+	hostTransports       *hostTransports
+	dialPolicy           *DialPolicy
+	ftpGateway           bool
+	parentRotation       *parentRotation
+	tunnelSocket         *SocketOptions
+	quota                *quotaManager
+	throttler            *throttler
+	flushInterval        time.Duration
+	http2                bool
+	buffers              *bufferPool
+	maintenance          maintenance
+	// 已劫持的客户端连接
+	conns       connTracker
+	parentStats parentStats
+	stats       stats
+
+	blockPageRenderer    BlockPageRenderer
+	webSocketCompression WebSocketCompression
+	accessLogSinks       []AccessLogSink
+	coalescer            *coalescer
+	maxRequestBody       int64
+	maxResponseBody      int64
+	decodeResponseBody   bool
+	recompressResponse   bool
+	alerter              *alerter
+	policyEvents         *policyEvents
+	rateLimitKey         RateLimitKeyFunc
+	signingRules         []SigningRule
+	integrity            *IntegrityConfig
+	contentAdapters      []ContentAdapter
+	categorizer          *categorizer
+	forwarded            *forwarded
+	headerRules          []HeaderRule
+	tracing              *TracingConfig
+	contentFilter        *contentFilter
+	admission            *admission
+	extAuthz             *extAuthz
+	// config 可由ApplyConfig替换的配置
+	config     atomic.Pointer[runtimeConfig]
+	configMu   sync.Mutex
+	cache      *httpCache
+	cassette   *cassette
+	retry      *retrier
+	breaker    *circuitBreaker
+	clientCert *ClientCertConfig
+	sniRouting bool
+	sniRules   []SNIRule
+	hsts       *hsts
+	compressor *compressor
+	sampler    *sampler
+	tee        *tee
+	metrics    *metrics
+	basicAuth  *basicAuth
 }
 
 var _ http.Handler = &Proxy{}
@@ -144,26 +681,140 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
+	atomic.AddInt64(&p.stats.totalRequests, 1)
+	if p.Paused() {
+		p.writeMaintenance(rw)
+		return
+	}
+	tlsState := listenerTLS(req)
+	ctx := &Context{
+		Req:               req,
+		Data:              make(map[interface{}]interface{}),
+		ClientTLS:         tlsState,
+		ListenerTLS:       tlsState,
+		blockPageRenderer: p.blockPageRenderer,
+		policyEvents:      p.policyEvents,
+		ClientIP:          hostname(req.RemoteAddr),
+		RequestID:         newRequestID(),
+		Start:             time.Now(),
+		listener:          listenerOf(req.Context()),
+	}
+	if ctx.listener != nil {
+		ctx.Listener = ctx.listener.name
+	}
+	if info := transparentOf(req); info != nil {
+		ctx.OriginalDst = info.dst
+		ctx.SNI = info.sni
+		ctx.ALPN = info.alpn
+	}
+	p.lookupClientGeo(ctx)
 	atomic.AddInt32(&p.clientConnNum, 1)
+	clientIP := ctx.ClientIP
+	p.clients.add(clientIP)
 	defer func() {
 		atomic.AddInt32(&p.clientConnNum, -1)
+		p.clients.remove(clientIP)
 	}()
-	ctx := &Context{
-		Req:  req,
-		Data: make(map[interface{}]interface{}),
+	if req.ProtoMajor == 2 {
+		if req.Method == http.MethodConnect {
+			rw = &h2ConnectWriter{ResponseWriter: rw, req: req}
+		} else if req.URL.Scheme == "" && req.TLS != nil {
+			// HTTP/2没有绝对地址形式, 代理的HTTP请求以:authority作为目标
+			req.URL.Scheme = "http"
+		}
+	}
+	if ctx.ClientCert = verifiedClientCert(ctx.ListenerTLS); ctx.ClientCert != nil {
+		ctx.User = p.clientCertUser(ctx.ClientCert)
+	}
+	rw = &responseRecorder{ResponseWriter: rw, ctx: ctx}
+	defer p.callFinish(ctx)
+	typ := AccessLogTypeHTTP
+	if req.Method == http.MethodConnect {
+		typ = AccessLogTypeTunnel
 	}
-	defer p.delegate.Finish(ctx)
-	p.delegate.Connect(ctx, rw)
+	defer func() {
+		p.metrics.request(typ, req.Method, ctx.status)
+		p.metrics.bytes(typ == AccessLogTypeTunnel, ctx.Bytes)
+	}()
+	start := ctx.Start
+	defer func() {
+		p.complete(ctx, req, typ, start, ctx.status, ctx.Bytes)
+	}()
+	if p.alerter != nil {
+		host := hostname(req.URL.Host)
+		defer func() {
+			p.alerter.bandwidth(host, atomic.LoadInt64(&ctx.Bytes.ClientRead)+atomic.LoadInt64(&ctx.Bytes.ClientWritten))
+		}()
+	}
+	p.deadlines.apply(ctx)
+	p.callConnect(ctx, rw)
 	if ctx.abort {
+		ctx.writeResponse(rw)
+		ctx.reportAbort()
 		return
 	}
-	p.delegate.Auth(ctx, rw)
+	if auth := p.basicAuthOf(ctx.listener); auth != nil && ctx.ClientCert == nil {
+		auth.authenticate(ctx, rw)
+		if ctx.abort {
+			return
+		}
+	}
+	p.callAuth(ctx, rw)
 	if ctx.abort {
+		ctx.writeResponse(rw)
+		ctx.reportAbort()
 		return
 	}
+	if req.Method == http.MethodConnect {
+		p.lookupTargetGeo(ctx)
+		if page := p.checkACL(ctx); page != nil {
+			ctx.WriteBlockPage(rw, page)
+			return
+		}
+		if page := p.checkConnectPort(ctx); page != nil {
+			ctx.WriteBlockPage(rw, page)
+			return
+		}
+	}
+	if p.categorizer != nil && req.Method == http.MethodConnect {
+		if page := p.categorize(ctx); page != nil {
+			ctx.WriteBlockPage(rw, page)
+			return
+		}
+	}
+	if p.extAuthz != nil && req.Method == http.MethodConnect {
+		if page := p.authorize(ctx); page != nil {
+			ctx.WriteBlockPage(rw, page)
+			return
+		}
+	}
+	if !p.checkRateLimit(ctx, rw) {
+		return
+	}
+	if p.clientLimiter != nil {
+		release, ok := p.acquireClient(ctx, rw)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+	if p.quota != nil && ctx.User != "" {
+		usage, err := p.quota.begin(ctx.User)
+		if err != nil {
+			p.recordError(ctx, ErrorClassQuota, err)
+			p.delegate.ErrorLog(fmt.Errorf("%s - %s: %s", req.URL.Host, ctx.User, err))
+			ctx.WriteBlockPage(rw, &BlockPage{StatusCode: p.quota.statusCode(), Message: err.Error()})
+			return
+		}
+		defer usage.flush()
+		ctx.quota = usage
+	}
+	if p.throttler != nil {
+		ctx.throttle = p.newThrottle(ctx)
+	}
 
 	switch {
-	case ctx.Req.Method == http.MethodConnect && p.decryptHTTPS:
+	case ctx.Req.Method == http.MethodConnect && p.decryptHTTPS && !ctx.SkipDecrypt && !isRawTransparent(req) && !isSOCKSRequest(req):
 		p.forwardHTTPS(ctx, rw)
 	case ctx.Req.Method == http.MethodConnect:
 		p.forwardTunnel(ctx, rw)
@@ -173,166 +824,855 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 }
 
 // ClientConnNum 获取客户端连接数
+//
+// Deprecated: 使用Snapshot().ActiveRequests
 func (p *Proxy) ClientConnNum() int32 {
 	return atomic.LoadInt32(&p.clientConnNum)
 }
 
+// MITMCertificate 返回HTTPS解密使用的证书管理, 可通过LoadCA、WatchCAFiles在运行时替换根证书
+// 未开启HTTPS解密时返回nil
+func (p *Proxy) MITMCertificate() *cert.Certificate {
+	return p.cert
+}
+
 // DoRequest 执行HTTP请求，并调用responseFunc处理response
 func (p *Proxy) DoRequest(ctx *Context, responseFunc func(*http.Response, error)) {
 	if ctx.Data == nil {
 		ctx.Data = make(map[interface{}]interface{})
 	}
-	p.delegate.BeforeRequest(ctx)
+	if p.tracing != nil {
+		finish := p.startSpan(ctx, "HTTP "+ctx.Req.Method,
+			Attribute{Key: "http.request.method", Value: ctx.Req.Method},
+			Attribute{Key: "url.full", Value: ctx.Req.URL.String()},
+		)
+		next := responseFunc
+		var status int
+		var respErr error
+		responseFunc = func(resp *http.Response, err error) {
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			respErr = err
+			next(resp, err)
+		}
+		defer func() {
+			finish(status, respErr)
+		}()
+	}
+	p.deadlines.apply(ctx)
+	if !ctx.Deadline.IsZero() {
+		reqCtx, cancel := ctx.deadlineContext(ctx.Req.Context())
+		defer cancel()
+		ctx.Req = ctx.Req.WithContext(reqCtx)
+		next := responseFunc
+		responseFunc = func(resp *http.Response, err error) {
+			if err != nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+				err = p.deadlineExceeded(ctx)
+			}
+			next(resp, err)
+		}
+	}
+	if resp := p.route(ctx); resp != nil {
+		responseFunc(resp, nil)
+		return
+	}
+	p.rewriteHost(ctx.Req)
+	p.rewriteURL(ctx.Req)
+	if p.hsts != nil {
+		p.hsts.upgrade(ctx.Req)
+	}
+	p.lookupTargetGeo(ctx)
+	if page := p.checkACL(ctx); page != nil {
+		responseFunc(ctx.BlockPageResponse(page), nil)
+		return
+	}
+	if p.categorizer != nil {
+		if page := p.categorize(ctx); page != nil {
+			responseFunc(ctx.BlockPageResponse(page), nil)
+			return
+		}
+	}
+	if p.extAuthz != nil {
+		if page := p.authorize(ctx); page != nil {
+			responseFunc(ctx.BlockPageResponse(page), nil)
+			return
+		}
+	}
+	if p.forwarded != nil {
+		p.forwarded.apply(ctx.Req)
+	}
+	if len(p.headerRules) > 0 {
+		p.applyRequestHeaderRules(ctx)
+	}
+	var capture *sampleCapture
+	if p.sampler != nil {
+		if capture = p.sampler.start(ctx); capture != nil {
+			defer capture.end()
+		}
+	}
+	p.callBeforeRequest(ctx)
 	if ctx.abort {
+		if resp := ctx.takeResponse(); resp != nil {
+			ctx.abort = false
+			responseFunc(resp, nil)
+		}
 		return
 	}
+	teeing := p.tee != nil && p.tee.match(ctx)
+	if p.hostLimiter != nil {
+		release, err := p.hostLimiter.acquireHost(ctx.Req.Context(), ctx.Req.URL.Host)
+		if err != nil {
+			responseFunc(nil, err)
+			return
+		}
+		defer release()
+	}
+	if p.admission != nil {
+		release, err := p.admission.acquire(ctx.Req.Context())
+		if err != nil {
+			responseFunc(nil, err)
+			return
+		}
+		defer release()
+	}
 	newReq := new(http.Request)
 	*newReq = *ctx.Req
 	newReq.Header = CloneHeader(newReq.Header)
+	webSocket := isWebSocketUpgrade(newReq.Header)
+	if webSocket {
+		negotiateWebSocketExtensions(newReq.Header, p.webSocketCompression)
+	}
 	removeConnectionHeaders(newReq.Header)
 	for _, item := range hopHeaders {
 		if newReq.Header.Get(item) != "" {
 			newReq.Header.Del(item)
 		}
 	}
-	resp, err := p.transport.RoundTrip(newReq)
-	p.delegate.BeforeResponse(ctx, resp, err)
+	keepTETrailers(newReq.Header, ctx.Req.Header)
+	if err := p.limitRequestBody(ctx, newReq); err != nil {
+		responseFunc(nil, err)
+		return
+	}
+	if expectsContinue(newReq) {
+		// 目标服务器不返回100直接返回最终响应时, 关闭连接而不是发送body, 避免客户端上传不需要的body
+		newReq.Close = true
+	}
+	if webSocket {
+		keepUpgradeHeaders(newReq.Header, ctx.Req.Header)
+	}
+	if p.identityEncoding {
+		newReq.Header.Set("Accept-Encoding", "identity")
+	}
+	body, transformed, err := transformBody(ctx, p.requestTransformers, p.requestTransformerStats, newReq.Header, newReq.Body)
+	if err != nil {
+		responseFunc(nil, err)
+		return
+	}
+	if transformed {
+		newReq.Body = body
+		newReq.ContentLength = -1
+	}
+	p.callModifyRequestBody(ctx, newReq)
+	if capture != nil {
+		capture.request(newReq)
+	}
+	if teeing {
+		p.tee.request(ctx, newReq)
+	}
+	var resp *http.Response
+	if len(p.contentAdapters) > 0 {
+		newReq, resp, err = p.adaptRequest(ctx, newReq)
+		if err != nil {
+			responseFunc(nil, err)
+			return
+		}
+	}
+	if resp == nil {
+		resp, err = p.fetch(ctx, newReq)
+	}
+	if err == nil {
+		if err = p.limitResponseBody(ctx, resp); err != nil {
+			resp = nil
+		}
+	}
+	var decoded string
+	if err == nil {
+		if decoded, err = p.decodeResponse(ctx.Req, resp); err != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+	}
+	if err == nil && p.contentFilter != nil {
+		resp = p.filterContent(ctx, resp)
+	}
+	if err == nil && len(p.headerRules) > 0 {
+		p.applyResponseHeaderRules(ctx, resp)
+	}
+	p.callBeforeResponse(ctx, resp, err)
 	if ctx.abort {
 		return
 	}
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		// 协议升级后body是双向连接, 不经过body转换和压缩
+		upgrade := CloneHeader(resp.Header)
+		removeConnectionHeaders(resp.Header)
+		for _, h := range hopHeaders {
+			resp.Header.Del(h)
+		}
+		keepUpgradeHeaders(resp.Header, upgrade)
+		responseFunc(resp, nil)
+		return
+	}
+	if err == nil {
+		body, transformed, err := transformBody(ctx, p.responseTransformers, p.responseTransformerStats, resp.Header, resp.Body)
+		if err != nil {
+			responseFunc(nil, err)
+			return
+		}
+		if transformed {
+			resp.Body = body
+			resp.ContentLength = -1
+		}
+		p.callModifyResponseBody(ctx, resp)
+	}
+	if capture != nil {
+		capture.response(ctx, resp, err)
+	}
+	if teeing && err == nil {
+		p.tee.response(ctx, resp)
+	}
 	if err == nil {
 		removeConnectionHeaders(resp.Header)
 		for _, h := range hopHeaders {
 			resp.Header.Del(h)
 		}
+		if p.compressor != nil {
+			p.compressor.compress(ctx.Req, resp)
+		}
+		if decoded != "" && resp.Header.Get("Content-Encoding") == "" {
+			encodeResponse(resp, decoded)
+		}
 	}
 	responseFunc(resp, err)
 }
 
+// fetch 请求目标服务器, 处理重定向、完整性校验、解压和响应内容适配
+func (p *Proxy) fetch(ctx *Context, req *http.Request) (*http.Response, error) {
+	req.Body = newCountBody(req.Body, &ctx.Bytes.UpstreamWritten)
+	req, deadline := requestDeadline(ctx, req)
+	var resp *http.Response
+	var err error
+	req, trace := traceRequest(req, ctx.relayInterim)
+	start := time.Now()
+	send := func(req *http.Request) (*http.Response, error) {
+		if p.coalescer != nil {
+			return p.coalescer.roundTrip(req, func() (*http.Response, error) {
+				return p.roundTrip(ctx, req)
+			})
+		}
+		return p.roundTrip(ctx, req)
+	}
+	if p.cassette != nil {
+		network := send
+		send = func(req *http.Request) (*http.Response, error) {
+			return p.cassette.roundTrip(req, network)
+		}
+	}
+	if p.cache != nil {
+		resp, err = p.cache.roundTrip(ctx, req, send)
+	} else {
+		resp, err = send(req)
+	}
+	ctx.Timing = trace.finish()
+	if p.tracing != nil {
+		p.connectionSpans(ctx, trace)
+	}
+	if err == nil && ctx.CacheStatus != CacheHit {
+		p.metrics.latency(time.Since(start))
+	}
+	if deadline != nil {
+		resp, err = deadline(resp, err)
+	}
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		// 协议升级后的字节数在spliceUpgrade中统计
+		return resp, nil
+	}
+	if err == nil {
+		resp, err = p.followRedirects(ctx, req, resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = newCountBody(resp.Body, &ctx.Bytes.UpstreamRead)
+	if p.integrity != nil {
+		if resp, err = p.verifyIntegrity(ctx, resp); err != nil {
+			return nil, err
+		}
+	}
+	if p.identityEncoding {
+		if err = decompressResponse(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	if p.hsts != nil {
+		p.hsts.observe(resp)
+	}
+	if len(p.contentAdapters) > 0 {
+		return p.adaptResponse(ctx, resp)
+	}
+
+	return resp, nil
+}
+
 // HTTP转发
 func (p *Proxy) forwardHTTP(ctx *Context, rw http.ResponseWriter) {
-	ctx.Req.URL.Scheme = "http"
+	if ctx.Req.URL.Scheme != "ftp" || !p.ftpGateway {
+		ctx.Req.URL.Scheme = "http"
+	}
+	ctx.Req.Body = newCountBody(ctx.Req.Body, &p.stats.bytesIn, &ctx.Bytes.ClientRead)
+	if ctx.quota != nil {
+		ctx.Req.Body = ctx.quota.body(ctx.Req.Body, throttleUp)
+	}
+	if ctx.throttle != nil {
+		ctx.Req.Body = ctx.throttle.body(ctx.Req.Body, throttleUp)
+	}
+	ctx.interim = responseInterim(rw)
 	p.DoRequest(ctx, func(resp *http.Response, err error) {
 		if err != nil {
+			p.recordError(ctx, upstreamErrorClass(err), err)
 			p.delegate.ErrorLog(fmt.Errorf("%s - HTTP请求错误: , 错误: %s", ctx.Req.URL, err))
-			rw.WriteHeader(http.StatusBadGateway)
+			p.writeError(ctx, rw, err)
+			return
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			p.forwardUpgrade(ctx, rw, resp)
 			return
 		}
 		defer resp.Body.Close()
+		resp.Body = newCountBody(resp.Body, &p.stats.bytesOut, &ctx.Bytes.ClientWritten)
+		if ctx.quota != nil {
+			resp.Body = ctx.quota.body(resp.Body, throttleDown)
+		}
+		if ctx.throttle != nil {
+			resp.Body = ctx.throttle.body(resp.Body, throttleDown)
+		}
 		CopyHeader(rw.Header(), resp.Header)
+		announceTrailers(rw.Header(), resp)
 		rw.WriteHeader(resp.StatusCode)
-		io.Copy(rw, resp.Body)
+		if err := p.copyResponse(rw, resp); errors.Is(err, ErrIntegrity) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrResponseBodyTooLarge) {
+			// 校验失败、超过Timeouts.Total或响应body大小限制时中断连接, 不写入chunked结束标记, 客户端可以发现响应不完整
+			if ctx.deadlinePassed() {
+				p.deadlineExceeded(ctx)
+			}
+			panic(http.ErrAbortHandler)
+		}
+		copyTrailers(rw.Header(), resp)
 	})
 }
 
 // HTTPS转发
 func (p *Proxy) forwardHTTPS(ctx *Context, rw http.ResponseWriter) {
+	if p.tracing != nil {
+		finish := p.startSpan(ctx, "CONNECT",
+			Attribute{Key: "server.address", Value: ctx.Req.URL.Host},
+			Attribute{Key: "goproxy.mitm", Value: true},
+		)
+		defer func() {
+			// ctx.status为最后一个解密后请求的状态码
+			finish(0, ctx.err)
+		}()
+	}
 	clientConn, err := hijacker(rw)
 	if err != nil {
+		p.recordError(ctx, ErrorClassClient, err)
 		p.delegate.ErrorLog(err)
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
 	defer clientConn.Close()
-	_, err = clientConn.Write(tunnelEstablishedResponseLine)
+	ctx.clientConn = clientConn
+	p.conns.add(clientConn, ctx, TunnelTypeMITM)
+	defer p.conns.remove(clientConn)
+	defer p.stats.tunnel()()
+	clientConn = newCountConn(clientConn,
+		[]*int64{&p.stats.bytesIn, &ctx.Bytes.ClientRead},
+		[]*int64{&p.stats.bytesOut, &ctx.Bytes.ClientWritten})
+	if ctx.quota != nil {
+		clientConn = ctx.quota.conn(clientConn)
+	}
+	if ctx.throttle != nil {
+		clientConn = ctx.throttle.conn(clientConn)
+	}
+	err = ctx.writeTunnelEstablished(clientConn)
 	if err != nil {
+		p.recordError(ctx, ErrorClassClient, err)
 		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 通知客户端隧道已连接失败, %s", ctx.Req.URL.Host, err))
 		return
 	}
+	ctx.status = http.StatusOK
 	tlsConfig, err := p.cert.GenerateTlsConfig(ctx.Req.URL.Host)
 	if err != nil {
+		p.recordError(ctx, ErrorClassTLS, err)
 		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 生成证书失败: %s", ctx.Req.URL.Host, err))
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
+	if p.http2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
 	tlsClientConn := tls.Server(clientConn, tlsConfig)
-	tlsClientConn.SetDeadline(time.Now().Add(defaultClientReadWriteTimeout))
+	setDeadline(tlsClientConn, p.clientRWTimeout)
 	defer tlsClientConn.Close()
 	if err := tlsClientConn.Handshake(); err != nil {
+		p.recordError(ctx, ErrorClassTLS, err)
 		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 握手失败: %s", ctx.Req.URL.Host, err))
 		return
 	}
-	buf := bufio.NewReader(tlsClientConn)
-	tlsReq, err := http.ReadRequest(buf)
-	if err != nil {
-		if err != io.EOF {
-			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 读取客户端请求失败: %s", ctx.Req.URL.Host, err))
-		}
+	tlsState := tlsClientConn.ConnectionState()
+	ctx.ClientTLS = &tlsState
+	if tlsState.NegotiatedProtocol == http2.NextProtoTLS {
+		p.serveHTTP2(ctx, tlsClientConn)
 		return
 	}
-	tlsReq.RemoteAddr = ctx.Req.RemoteAddr
-	tlsReq.URL.Scheme = "https"
-	tlsReq.URL.Host = tlsReq.Host
-
-	ctx.Req = tlsReq
-	p.DoRequest(ctx, func(resp *http.Response, err error) {
+	buf := bufio.NewReader(tlsClientConn)
+	// 解密后的请求都使用CONNECT请求的context, 不使用上一个请求带截止时间的context
+	connCtx := ctx.Req.Context()
+	for {
+		// 等待下一个请求, 空闲超时后关闭连接
+		tlsClientConn.SetDeadline(time.Now().Add(p.clientIdleTimeout))
+		reqBytes := ctx.Bytes
+		tlsReq, err := http.ReadRequest(buf)
 		if err != nil {
-			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 请求错误: %s", ctx.Req.URL, err))
-			tlsClientConn.Write(badGateway)
+			if err != io.EOF && !isTimeout(err) {
+				p.recordError(ctx, ErrorClassClient, err)
+				p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 读取客户端请求失败: %s", ctx.Req.URL.Host, err))
+			}
 			return
 		}
-		err = resp.Write(tlsClientConn)
-		if err != nil {
-			p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, response写入客户端失败, %s", ctx.Req.URL, err))
+		setDeadline(tlsClientConn, p.clientRWTimeout)
+		if p.Paused() {
+			p.maintenanceResponse(tlsReq).Write(tlsClientConn)
+			return
 		}
-		resp.Body.Close()
-	})
+		tlsReq.RemoteAddr = ctx.Req.RemoteAddr
+		tlsReq.TLS = &tlsState
+		tlsReq.URL.Scheme = "https"
+		if tlsReq.Host == "" {
+			tlsReq.Host = ctx.Req.URL.Host
+		}
+		tlsReq.URL.Host = tlsReq.Host
+		// 与CONNECT请求相同, 代理关闭或HTTP/2 stream取消时取消转发
+		tlsReq = tlsReq.WithContext(connCtx)
+		var expect *expectContinueBody
+		if expectsContinue(tlsReq) {
+			expect = &expectContinueBody{ReadCloser: tlsReq.Body, w: tlsClientConn}
+			tlsReq.Body = expect
+		}
+		atomic.AddInt64(&p.stats.totalRequests, 1)
+
+		ctx.Req = tlsReq
+		ctx.err = nil
+		ctx.RequestID = newRequestID()
+		ctx.Timing = Timing{}
+		ctx.CacheStatus = ""
+		ctx.Attempts = 0
+		keepAlive := !tlsReq.Close
+		reqStart, status := time.Now(), 0
+		ctx.Start = reqStart
+		// 每个解密后的请求重新计算截止时间
+		ctx.Deadline, ctx.DeadlineSource, ctx.DeadlineExceeded = time.Time{}, "", false
+		ctx.interim = connInterim(tlsClientConn)
+		p.DoRequest(ctx, func(resp *http.Response, err error) {
+			if expect != nil && !expect.finish() {
+				keepAlive = false
+			}
+			if err != nil {
+				p.recordError(ctx, upstreamErrorClass(err), err)
+				p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 请求错误: %s", ctx.Req.URL, err))
+				resp := p.errorResponse(ctx, err)
+				status = resp.StatusCode
+				if errors.Is(err, ErrRequestBodyTooLarge) {
+					// 请求body没有读完, 不能继续读取下一个请求
+					keepAlive = false
+					resp.Close = true
+				}
+				if err := resp.Write(tlsClientConn); err != nil {
+					keepAlive = false
+				}
+				return
+			}
+			status = resp.StatusCode
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				keepAlive = false
+				p.forwardHTTPSUpgrade(ctx, tlsClientConn, buf, resp)
+				return
+			}
+			if resp.Close {
+				keepAlive = false
+			}
+			http1Response(resp)
+			err = resp.Write(tlsClientConn)
+			if err != nil {
+				keepAlive = false
+				p.recordError(ctx, ErrorClassClient, err)
+				p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, response写入客户端失败, %s", ctx.Req.URL, err))
+			}
+			resp.Body.Close()
+		})
+		p.metrics.request(AccessLogTypeHTTPS, tlsReq.Method, status)
+		p.complete(ctx, tlsReq, AccessLogTypeHTTPS, reqStart, status, ctx.Bytes.sub(reqBytes))
+		ctx.err = nil
+		if ctx.abort || !keepAlive {
+			return
+		}
+	}
 }
 
 // 隧道转发
 func (p *Proxy) forwardTunnel(ctx *Context, rw http.ResponseWriter) {
+	if p.tracing != nil {
+		finish := p.startSpan(ctx, "CONNECT", Attribute{Key: "server.address", Value: ctx.Req.URL.Host})
+		defer func() {
+			finish(ctx.status, ctx.err)
+		}()
+	}
+	p.route(ctx)
+	if len(p.headerRules) > 0 {
+		p.applyTunnelHeaderRules(ctx)
+	}
+	targetAddr := ensurePort(ctx.Req.URL.Host, "443")
+	ctx.TunnelTarget = targetAddr
+	p.callBeforeTunnelForward(ctx)
+	if ctx.abort {
+		ctx.writeResponse(rw)
+		if ctx.status == 0 {
+			rw.WriteHeader(http.StatusForbidden)
+		}
+		ctx.reportAbort()
+		return
+	}
+	// BeforeTunnelForward修改了目标地址时直连, 不经过SNI路由和上级代理
+	redirected := ctx.TunnelTarget != "" && ensurePort(ctx.TunnelTarget, "443") != targetAddr
+	if redirected {
+		targetAddr = ensurePort(ctx.TunnelTarget, "443")
+	}
+	ctx.TunnelTarget = targetAddr
+	if p.hostLimiter != nil {
+		release, err := p.hostLimiter.acquireHost(ctx.Req.Context(), targetAddr)
+		if err != nil {
+			p.recordError(ctx, ErrorClassLimit, err)
+			p.delegate.ErrorLog(fmt.Errorf("%s - 隧道转发失败: %s", ctx.Req.URL.Host, err))
+			p.writeError(ctx, rw, err)
+			return
+		}
+		defer release()
+	}
 	clientConn, err := hijacker(rw)
 	if err != nil {
+		p.recordError(ctx, ErrorClassClient, err)
 		p.delegate.ErrorLog(err)
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
 	defer clientConn.Close()
-	parentProxyURL, err := p.delegate.ParentProxy(ctx.Req)
-	if err != nil {
-		p.delegate.ErrorLog(fmt.Errorf("%s - 解析代理地址错误: %s", ctx.Req.URL.Host, err))
-		rw.WriteHeader(http.StatusBadGateway)
-		return
+	ctx.clientConn = clientConn
+	p.applySocketOptions(ctx, clientConn)
+	p.conns.add(clientConn, ctx, TunnelTypeTunnel)
+	defer p.conns.remove(clientConn)
+	defer p.stats.tunnel()()
+	clientConn = newCountConn(clientConn,
+		[]*int64{&p.stats.bytesIn, &ctx.Bytes.ClientRead},
+		[]*int64{&p.stats.bytesOut, &ctx.Bytes.ClientWritten})
+	if ctx.quota != nil {
+		clientConn = ctx.quota.conn(clientConn)
 	}
-	targetAddr := ctx.Req.URL.Host
-	if parentProxyURL != nil {
-		targetAddr = parentProxyURL.Host
+	if ctx.throttle != nil {
+		clientConn = ctx.throttle.conn(clientConn)
+	}
+	// 开启SNI路由时已通知客户端隧道建立, 出错只能关闭连接
+	established := p.sniRouting && !redirected
+	var parentProxyURL *url.URL
+	resolved := redirected
+	if established {
+		var ok bool
+		clientConn, parentProxyURL, resolved, ok = p.routeBySNI(ctx, clientConn)
+		if !ok {
+			return
+		}
+	}
+	// 拨号期间客户端断开时取消拨号, HTTP/2的CONNECT由stream的context取消, 超过截止时间时取消拨号或关闭隧道
+	tunnelCtx, cancelTunnel := ctx.deadlineContext(ctx.Req.Context())
+	defer cancelTunnel()
+	ctx.Req = ctx.Req.WithContext(tunnelCtx)
+	stopWatch := func() net.Conn { return clientConn }
+	if _, ok := ctx.clientConn.(*h2StreamConn); !ok {
+		stopWatch = watchClose(clientConn, cancelTunnel)
+	}
+	upstreams := p.runtime().upstreams
+	if !resolved && upstreams == nil {
+		parentProxyURL, err = p.callParentProxy(ctx.Req)
+		if err != nil {
+			p.recordError(ctx, ErrorClassParent, err)
+			p.delegate.ErrorLog(fmt.Errorf("%s - 解析代理地址错误: %s", ctx.Req.URL.Host, err))
+			if !established {
+				ctx.status = http.StatusBadGateway
+				ctx.writeTunnelStatus(clientConn, http.StatusBadGateway)
+			}
+			return
+		}
+	}
+	var targetConn net.Conn
+	var class ErrorClass
+	if resolved || upstreams == nil {
+		ctx.parentProxy = parentProxyURL
+		var call *parentCall
+		targetConn, call, class, err = p.connectTunnel(ctx, parentProxyURL, targetAddr)
+		if call != nil {
+			defer call.done()
+		}
+	} else {
+		var release func()
+		targetConn, release, class, err = p.connectTunnelUpstream(ctx, upstreams, targetAddr)
+		defer release()
+	}
+	clientConn = stopWatch()
+	if tunnelCtx.Err() != nil {
+		if targetConn != nil {
+			targetConn.Close()
+		}
+		err, class = fmt.Errorf("客户端已断开: %w", context.Cause(tunnelCtx)), ErrorClassClient
+		if errors.Is(tunnelCtx.Err(), context.DeadlineExceeded) {
+			err, class = p.deadlineExceeded(ctx), ErrorClassConnect
+		}
 	}
-
-	targetConn, err := net.DialTimeout("tcp", targetAddr, defaultTargetConnectTimeout)
 	if err != nil {
-		p.delegate.ErrorLog(fmt.Errorf("%s - 隧道转发连接目标服务器失败: %s", ctx.Req.URL.Host, err))
-		rw.WriteHeader(http.StatusBadGateway)
+		p.recordError(ctx, class, err)
+		if class == ErrorClassConnect {
+			p.delegate.ErrorLog(fmt.Errorf("%s - 隧道转发连接目标服务器失败: %s", ctx.Req.URL.Host, err))
+		} else {
+			p.delegate.ErrorLog(fmt.Errorf("%s - %s", ctx.Req.URL.Host, err))
+		}
+		if !established {
+			code := errorStatusCode(err)
+			if e, ok := err.(*ParentProxyError); ok {
+				code = e.clientStatusCode()
+			}
+			ctx.status = code
+			ctx.writeTunnelStatus(clientConn, code)
+		}
 		return
 	}
 	defer targetConn.Close()
-	clientConn.SetDeadline(time.Now().Add(defaultClientReadWriteTimeout))
-	targetConn.SetDeadline(time.Now().Add(defaultTargetReadWriteTimeout))
-	if parentProxyURL == nil {
-		_, err = clientConn.Write(tunnelEstablishedResponseLine)
+	clientIdle, _ := p.tunnelIdleTimeouts(ctx.Timeouts)
+	clientConn = withIdleTimeout(clientConn, clientIdle)
+	if !established {
+		err = ctx.writeTunnelEstablished(clientConn)
 		if err != nil {
+			p.recordError(ctx, ErrorClassClient, err)
 			p.delegate.ErrorLog(fmt.Errorf("%s - 隧道连接成功,通知客户端错误: %s", ctx.Req.URL.Host, err))
 			return
 		}
-	} else {
-		tunnelRequestLine := makeTunnelRequestLine(ctx.Req.URL.Host)
-		targetConn.Write([]byte(tunnelRequestLine))
+	}
+	ctx.status = http.StatusOK
+	p.callTunnelEstablished(ctx, targetConn)
+	if ctx.abort {
+		ctx.reportAbort()
+		return
+	}
+	if ctx.Timeouts.Total > 0 {
+		timer := time.AfterFunc(ctx.Timeouts.Total, func() {
+			clientConn.Close()
+			targetConn.Close()
+		})
+		defer timer.Stop()
 	}
 
-	p.transfer(clientConn, targetConn)
+	stop := context.AfterFunc(tunnelCtx, func() {
+		clientConn.Close()
+		targetConn.Close()
+	})
+	defer stop()
+	err = p.transfer(clientConn, targetConn)
+	if errors.Is(tunnelCtx.Err(), context.DeadlineExceeded) {
+		err = p.deadlineExceeded(ctx)
+	}
+	p.callTunnelClosed(ctx, atomic.LoadInt64(&ctx.Bytes.ClientRead), atomic.LoadInt64(&ctx.Bytes.ClientWritten), err)
+}
+
+// connectTunnel 连接目标服务器, 经过HTTP上级代理时完成CONNECT, 返回的parentCall不为nil时需要在隧道结束后调用done
+// 开启WithParentProxyRotation时上级代理拒绝后更换凭据重试
+func (p *Proxy) connectTunnel(ctx *Context, parentProxyURL *url.URL, targetAddr string) (net.Conn, *parentCall, ErrorClass, error) {
+	for attempt := 0; ; attempt++ {
+		conn, call, class, err := p.connectTunnelOnce(ctx, parentProxyURL, targetAddr, attempt)
+		code := parentRefusal(nil, err)
+		if err == nil || code == 0 || !p.parentRotation.retry(code, attempt) || ctx.Req.Context().Err() != nil {
+			return conn, call, class, err
+		}
+		if call != nil {
+			call.done()
+		}
+		p.delegate.ErrorLog(fmt.Errorf("%s - 上级代理%s拒绝, 更换凭据重试: %s", ctx.Req.URL.Host, parentProxyURL.Host, err))
+	}
+}
+
+func (p *Proxy) connectTunnelOnce(ctx *Context, parentProxyURL *url.URL, targetAddr string, attempt int) (net.Conn, *parentCall, ErrorClass, error) {
+	upstream := p.withParentCredentials(ctx, parentProxyURL, attempt)
+	var call *parentCall
+	if parentProxyURL != nil {
+		call = p.parentStats.start(parentProxyURL)
+	}
+	dialCtx, cancel := dialTimeoutContext(ctx.Req.Context(), ctx.Timeouts)
+	defer cancel()
+	dialCtx = withProxyContext(withDialer(dialCtx, ctx.Dialer), ctx)
+	var targetConn net.Conn
+	var err error
+	var stream bool
+	dialStart := time.Now()
+	defer func() {
+		ctx.Timing.Dial = time.Since(dialStart)
+		if p.tracing != nil {
+			var attrs []Attribute
+			if parentProxyURL != nil {
+				attrs = append(attrs, Attribute{Key: "goproxy.parent_proxy", Value: parentProxyURL.Host})
+			}
+			p.childSpan(ctx, "dial", SpanKindClient, dialStart, time.Now(), err, attrs...)
+		}
+	}()
+	switch {
+	case parentProxyURL == nil && p.breaker != nil:
+		if !p.breaker.allow(targetAddr) {
+			err = ErrCircuitOpen
+			break
+		}
+		targetConn, err = p.dialContext(dialCtx, "tcp", targetAddr)
+		p.breaker.observe(targetAddr, err != nil)
+	case parentProxyURL == nil:
+		targetConn, err = p.dialContext(dialCtx, "tcp", targetAddr)
+	case parentProxyURL.Scheme == "ssh":
+		targetConn, err = p.ssh.DialContext(dialCtx, parentProxyURL, "tcp", targetAddr)
+		// SSH通道直达目标, 与直连相同
+		parentProxyURL = nil
+	case isSOCKS(parentProxyURL):
+		targetConn, err = p.dialSOCKS(dialCtx, upstream, "tcp", targetAddr)
+		parentProxyURL = nil
+	case p.useParentConns(ctx, parentProxyURL):
+		if p.parentConns.useH2(parentProxyURL) {
+			targetConn, err = p.parentConns.connectH2(dialCtx, upstream, targetAddr, ctx.tunnelHeader)
+			stream = err == nil
+			if !errors.Is(err, errParentNoH2) {
+				break
+			}
+		}
+		targetConn, err = p.parentConns.get(dialCtx, parentProxyURL)
+	default:
+		targetConn, err = p.dialContext(dialCtx, "tcp", parentProxyURL.Host)
+	}
+	_, refused := err.(*ParentProxyError)
+	if call != nil && !refused {
+		call.observe(err)
+	}
+	if refused {
+		return nil, call, ErrorClassParent, err
+	}
+	if err != nil {
+		return nil, call, ErrorClassConnect, err
+	}
+	p.applySocketOptions(ctx, targetConn)
+	targetConn = newCountConn(targetConn, []*int64{&ctx.Bytes.UpstreamRead}, []*int64{&ctx.Bytes.UpstreamWritten})
+	_, targetIdle := p.tunnelIdleTimeouts(ctx.Timeouts)
+	targetConn = withIdleTimeout(targetConn, targetIdle)
+	if parentProxyURL != nil && !stream {
+		conn := targetConn
+		// 拨号超时和客户端断开同样中断CONNECT握手
+		stop := context.AfterFunc(dialCtx, func() {
+			conn.SetDeadline(time.Unix(1, 0))
+		})
+		targetConn, err = p.parentHandshake(conn, upstream, targetAddr, ctx.tunnelHeader)
+		if !stop() && err == nil {
+			err = dialCtx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, call, ErrorClassParent, err
+		}
+	}
+
+	return targetConn, call, 0, nil
+}
+
+// connectTunnelUpstream 从上级代理池选择上级代理建立隧道, 连接失败或上级代理返回5xx时换用其他上级代理
+// 返回的release在隧道结束后调用
+func (p *Proxy) connectTunnelUpstream(ctx *Context, pool *upstreamPool, targetAddr string) (net.Conn, func(), ErrorClass, error) {
+	var tried []*upstreamMember
+	var lastErr error
+	var lastClass ErrorClass
+	for {
+		m, err := pool.pick(ctx, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, func() {}, lastClass, lastErr
+			}
+			return nil, func() {}, ErrorClassParent, err
+		}
+		tried = append(tried, m)
+		ctx.parentProxy = m.url
+		conn, call, class, err := p.connectTunnel(ctx, m.url, targetAddr)
+		e, refused := err.(*ParentProxyError)
+		if refused && e.StatusCode < http.StatusInternalServerError {
+			// 上级代理拒绝访问目标, 不是上级代理的故障
+			pool.observe(m, nil)
+		} else {
+			pool.observe(m, err)
+		}
+		release := func() {
+			if call != nil {
+				call.done()
+			}
+			pool.release(m)
+		}
+		if err == nil {
+			return conn, release, 0, nil
+		}
+		release()
+		if refused && e.StatusCode < http.StatusInternalServerError || ctx.Req.Context().Err() != nil {
+			return nil, func() {}, class, err
+		}
+		p.delegate.ErrorLog(fmt.Errorf("%s - 上级代理%s隧道建立失败, 尝试其他上级代理: %s", ctx.Req.URL.Host, m.url.Host, err))
+		lastErr, lastClass = err, class
+	}
 }
 
 // 双向转发
-func (p *Proxy) transfer(src net.Conn, dst net.Conn) {
+// 两个方向都结束后返回, 保证Finish中读取的字节数完整, 返回先结束的方向的错误, 正常关闭时为nil
+func (p *Proxy) transfer(src, dst io.ReadWriteCloser) error {
+	errc := make(chan error, 2)
 	go func() {
-		io.Copy(src, dst)
+		_, err := p.buffers.copy(src, dst)
 		src.Close()
 		dst.Close()
+		errc <- err
 	}()
 
-	io.Copy(dst, src)
+	_, err := p.buffers.copy(dst, src)
 	dst.Close()
 	src.Close()
+	errc <- err
+	err = <-errc
+	<-errc
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// 是否为超时错误
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
 }
 
 // 获取底层连接
@@ -0,0 +1,67 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMakeTunnelRequestLine(t *testing.T) {
+	parent := &url.URL{Scheme: "http", Host: "parent:3128"}
+	withUser := &url.URL{Scheme: "http", Host: "parent:3128", User: url.UserPassword("user", "pass")}
+	tests := []struct {
+		addr          string
+		parent        *url.URL
+		header        http.Header
+		authorization string
+		want          string
+	}{
+		{"example.com:443", parent, nil, "", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"},
+		{"example.com", parent, nil, "", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"},
+		{"[2001:db8::1]:8443", parent, nil, "", "CONNECT [2001:db8::1]:8443 HTTP/1.1\r\nHost: [2001:db8::1]:8443\r\n\r\n"},
+		{"[2001:db8::1]", parent, nil, "", "CONNECT [2001:db8::1]:443 HTTP/1.1\r\nHost: [2001:db8::1]:443\r\n\r\n"},
+		{"::1", parent, nil, "", "CONNECT [::1]:443 HTTP/1.1\r\nHost: [::1]:443\r\n\r\n"},
+		{"[::1]:443", withUser, nil, "", "CONNECT [::1]:443 HTTP/1.1\r\nHost: [::1]:443\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n"},
+		{"[::1]:443", withUser, nil, "Bearer token", "CONNECT [::1]:443 HTTP/1.1\r\nHost: [::1]:443\r\nProxy-Authorization: Bearer token\r\n\r\n"},
+		{"[::1]:443", parent, http.Header{"X-Trace": {"1"}}, "", "CONNECT [::1]:443 HTTP/1.1\r\nHost: [::1]:443\r\nX-Trace: 1\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		if got := makeTunnelRequestLine(tt.addr, tt.parent, tt.header, tt.authorization); got != tt.want {
+			t.Errorf("makeTunnelRequestLine(%q) = %q, 期望 %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestErrorStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrClientConnLimit, http.StatusServiceUnavailable},
+		{ErrHostConnLimit, http.StatusServiceUnavailable},
+		{ErrCircuitOpen, http.StatusServiceUnavailable},
+		{ErrPerClientRequestLimit, http.StatusTooManyRequests},
+		{ErrPerClientConnLimit, http.StatusTooManyRequests},
+		{ErrRequestBodyTooLarge, http.StatusRequestEntityTooLarge},
+		{ErrDeadlineExceeded, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		if got := errorStatusCode(tt.err); got != tt.want {
+			t.Errorf("errorStatusCode(%q) = %d, 期望 %d", tt.err, got, tt.want)
+		}
+	}
+}
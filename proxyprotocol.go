@@ -0,0 +1,233 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+// PROXY protocol v2的签名
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolConfig 接收HAProxy PROXY protocol(v1、v2)的配置
+type ProxyProtocolConfig struct {
+	// TrustedProxies 允许发送PROXY头的负载均衡地址, IP或CIDR, 为空时信任所有连接
+	// 其他地址的连接不解析PROXY头, 按普通连接处理
+	TrustedProxies []string
+	// Optional 可信连接没有PROXY头时按普通连接处理, 默认关闭连接
+	Optional bool
+	// HeaderTimeout 读取PROXY头的超时时间, 默认5秒
+	HeaderTimeout time.Duration
+}
+
+// NewProxyProtocolListener 解析连接开头的PROXY头, 连接的RemoteAddr为真实的客户端地址, LocalAddr为原始目标地址
+// 用于四层负载均衡之后, Context.ClientIP、访问日志、限流和X-Forwarded-For等均使用真实的客户端地址
+// PROXY头在连接的goroutine中首次调用Read、RemoteAddr或LocalAddr时读取, 不阻塞Accept
+func NewProxyProtocolListener(ln net.Listener, config ProxyProtocolConfig) net.Listener {
+	if config.HeaderTimeout <= 0 {
+		config.HeaderTimeout = defaultProxyProtocolTimeout
+	}
+
+	return &proxyProtocolListener{
+		Listener: ln,
+		config:   config,
+		trusted:  parseIPNets(config.TrustedProxies),
+	}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	config  ProxyProtocolConfig
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trusted) > 0 && !containsIP(l.trusted, net.ParseIP(hostname(conn.RemoteAddr().String()))) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{Conn: conn, config: &l.config}, nil
+}
+
+// proxyProtocolConn 读取PROXY头之后的连接
+type proxyProtocolConn struct {
+	net.Conn
+	config *ProxyProtocolConfig
+	once   sync.Once
+	r      io.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.remote, c.local = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+		br := bufio.NewReader(c.Conn)
+		c.r = br
+		c.Conn.SetReadDeadline(time.Now().Add(c.config.HeaderTimeout))
+		remote, local, err := readProxyProtocolHeader(br, c.config.Optional)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("%s - 读取PROXY protocol头错误: %s", c.remote, err)
+			c.Conn.Close()
+			return
+		}
+		if remote != nil {
+			c.remote, c.local = remote, local
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.init()
+	return c.local
+}
+
+// readProxyProtocolHeader 读取v1或v2的PROXY头, LOCAL命令和UNKNOWN协议返回nil地址
+func readProxyProtocolHeader(br *bufio.Reader, optional bool) (remote, local net.Addr, err error) {
+	prefix, err := br.Peek(len(proxyProtocolV2Sig))
+	switch {
+	case bytes.Equal(prefix, proxyProtocolV2Sig):
+		return readProxyProtocolV2(br)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readProxyProtocolV1(br)
+	case optional && (err == nil || len(prefix) > 0 || errors.Is(err, io.EOF)):
+		// 客户端发送的数据少于签名长度时仍按普通连接处理
+		return nil, nil, nil
+	case err != nil:
+		return nil, nil, err
+	}
+
+	return nil, nil, errors.New("缺少PROXY头")
+}
+
+// readProxyProtocolV1 文本格式: PROXY TCP4 源地址 目标地址 源端口 目标端口\r\n, 最长107字节
+func readProxyProtocolV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1头过长或缺少CRLF")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("无效的v1头: %q", line)
+	}
+	remote, err := parseProxyProtocolAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := parseProxyProtocolAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return remote, local, nil
+}
+
+func parseProxyProtocolAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("无效的地址: %s", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的端口: %s", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// readProxyProtocolV2 二进制格式: 签名(12) 版本和命令(1) 地址族和协议(1) 长度(2) 地址 TLV
+func readProxyProtocolV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("不支持的v2版本: %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0:
+		// LOCAL: 负载均衡自身的健康检查等, 使用连接的地址
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("不支持的v2命令: %d", hdr[12]&0x0f)
+	}
+	// 只处理TCP, UDP和Unix socket使用连接的地址
+	switch hdr[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, nil, errors.New("v2 IPv4地址长度不足")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, nil, errors.New("v2 IPv6地址长度不足")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	}
+
+	return nil, nil, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxytest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/ouqiang/goproxy"
+)
+
+var _ goproxy.Delegate = &FuncDelegate{}
+
+// FuncDelegate 由函数字段实现的Delegate, 未设置的回调什么也不做, 便于在测试中断言回调
+// 未设置OnParentProxy时不使用上级代理
+type FuncDelegate struct {
+	OnConnect        func(ctx *goproxy.Context, rw http.ResponseWriter)
+	OnAuth           func(ctx *goproxy.Context, rw http.ResponseWriter)
+	OnBeforeRequest  func(ctx *goproxy.Context)
+	OnBeforeResponse func(ctx *goproxy.Context, resp *http.Response, err error)
+	// OnErrorResponse 对应OnError方法
+	OnErrorResponse          func(ctx *goproxy.Context, rw http.ResponseWriter, err error)
+	OnModifyRequestBody      func(ctx *goproxy.Context, req *http.Request) io.ReadCloser
+	OnModifyResponseBody     func(ctx *goproxy.Context, resp *http.Response) io.ReadCloser
+	OnBeforeTunnelForward    func(ctx *goproxy.Context)
+	OnTunnelEstablished      func(ctx *goproxy.Context, targetConn net.Conn)
+	OnTunnelClosed           func(ctx *goproxy.Context, bytesUp, bytesDown int64, err error)
+	OnCircuitStateChanged    func(host string, state goproxy.CircuitState)
+	OnResolveHost            func(ctx *goproxy.Context, host string) ([]net.IP, error)
+	OnRouteSNI               func(ctx *goproxy.Context) *goproxy.SNIRule
+	OnLimitExceeded          func(ctx *goproxy.Context, err error, page *goproxy.BlockPage)
+	OnBodyLimitExceeded      func(ctx *goproxy.Context, err error, limit int64)
+	OnBlocked                func(ctx *goproxy.Context, rule *goproxy.ACLRule, page *goproxy.BlockPage)
+	OnConnectPortAllowed     func(ctx *goproxy.Context, port int, allowed bool) bool
+	OnContentBlocked         func(ctx *goproxy.Context, rule *goproxy.ContentRule, contentType string, page *goproxy.BlockPage)
+	OnParentProxy            func(req *http.Request) (*url.URL, error)
+	OnParentProxyCredentials func(ctx *goproxy.Context, parent *url.URL, attempt int) *goproxy.ParentCredentials
+	OnComplete               func(ctx *goproxy.Context, outcome *goproxy.Outcome)
+	OnFinish                 func(ctx *goproxy.Context)
+	OnErrorLog               func(err error)
+}
+
+func (d *FuncDelegate) Connect(ctx *goproxy.Context, rw http.ResponseWriter) {
+	if d.OnConnect != nil {
+		d.OnConnect(ctx, rw)
+	}
+}
+
+func (d *FuncDelegate) Auth(ctx *goproxy.Context, rw http.ResponseWriter) {
+	if d.OnAuth != nil {
+		d.OnAuth(ctx, rw)
+	}
+}
+
+func (d *FuncDelegate) BeforeRequest(ctx *goproxy.Context) {
+	if d.OnBeforeRequest != nil {
+		d.OnBeforeRequest(ctx)
+	}
+}
+
+func (d *FuncDelegate) BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error) {
+	if d.OnBeforeResponse != nil {
+		d.OnBeforeResponse(ctx, resp, err)
+	}
+}
+
+func (d *FuncDelegate) OnError(ctx *goproxy.Context, rw http.ResponseWriter, err error) {
+	if d.OnErrorResponse != nil {
+		d.OnErrorResponse(ctx, rw, err)
+	}
+}
+
+func (d *FuncDelegate) ModifyRequestBody(ctx *goproxy.Context, req *http.Request) io.ReadCloser {
+	if d.OnModifyRequestBody != nil {
+		return d.OnModifyRequestBody(ctx, req)
+	}
+
+	return nil
+}
+
+func (d *FuncDelegate) ModifyResponseBody(ctx *goproxy.Context, resp *http.Response) io.ReadCloser {
+	if d.OnModifyResponseBody != nil {
+		return d.OnModifyResponseBody(ctx, resp)
+	}
+
+	return nil
+}
+
+func (d *FuncDelegate) BeforeTunnelForward(ctx *goproxy.Context) {
+	if d.OnBeforeTunnelForward != nil {
+		d.OnBeforeTunnelForward(ctx)
+	}
+}
+
+func (d *FuncDelegate) TunnelEstablished(ctx *goproxy.Context, targetConn net.Conn) {
+	if d.OnTunnelEstablished != nil {
+		d.OnTunnelEstablished(ctx, targetConn)
+	}
+}
+
+func (d *FuncDelegate) TunnelClosed(ctx *goproxy.Context, bytesUp, bytesDown int64, err error) {
+	if d.OnTunnelClosed != nil {
+		d.OnTunnelClosed(ctx, bytesUp, bytesDown, err)
+	}
+}
+
+func (d *FuncDelegate) CircuitStateChanged(host string, state goproxy.CircuitState) {
+	if d.OnCircuitStateChanged != nil {
+		d.OnCircuitStateChanged(host, state)
+	}
+}
+
+func (d *FuncDelegate) ResolveHost(ctx *goproxy.Context, host string) ([]net.IP, error) {
+	if d.OnResolveHost != nil {
+		return d.OnResolveHost(ctx, host)
+	}
+
+	return nil, nil
+}
+
+func (d *FuncDelegate) RouteSNI(ctx *goproxy.Context) *goproxy.SNIRule {
+	if d.OnRouteSNI != nil {
+		return d.OnRouteSNI(ctx)
+	}
+
+	return nil
+}
+
+func (d *FuncDelegate) LimitExceeded(ctx *goproxy.Context, err error, page *goproxy.BlockPage) {
+	if d.OnLimitExceeded != nil {
+		d.OnLimitExceeded(ctx, err, page)
+	}
+}
+
+func (d *FuncDelegate) BodyLimitExceeded(ctx *goproxy.Context, err error, limit int64) {
+	if d.OnBodyLimitExceeded != nil {
+		d.OnBodyLimitExceeded(ctx, err, limit)
+	}
+}
+
+func (d *FuncDelegate) Blocked(ctx *goproxy.Context, rule *goproxy.ACLRule, page *goproxy.BlockPage) {
+	if d.OnBlocked != nil {
+		d.OnBlocked(ctx, rule, page)
+	}
+}
+
+func (d *FuncDelegate) ConnectPortAllowed(ctx *goproxy.Context, port int, allowed bool) bool {
+	if d.OnConnectPortAllowed != nil {
+		return d.OnConnectPortAllowed(ctx, port, allowed)
+	}
+
+	return allowed
+}
+
+func (d *FuncDelegate) ContentBlocked(ctx *goproxy.Context, rule *goproxy.ContentRule, contentType string, page *goproxy.BlockPage) {
+	if d.OnContentBlocked != nil {
+		d.OnContentBlocked(ctx, rule, contentType, page)
+	}
+}
+
+func (d *FuncDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	if d.OnParentProxy != nil {
+		return d.OnParentProxy(req)
+	}
+
+	return nil, nil
+}
+
+func (d *FuncDelegate) ParentProxyCredentials(ctx *goproxy.Context, parent *url.URL, attempt int) *goproxy.ParentCredentials {
+	if d.OnParentProxyCredentials != nil {
+		return d.OnParentProxyCredentials(ctx, parent, attempt)
+	}
+
+	return nil
+}
+
+func (d *FuncDelegate) Complete(ctx *goproxy.Context, outcome *goproxy.Outcome) {
+	if d.OnComplete != nil {
+		d.OnComplete(ctx, outcome)
+	}
+}
+
+func (d *FuncDelegate) Finish(ctx *goproxy.Context) {
+	if d.OnFinish != nil {
+		d.OnFinish(ctx)
+	}
+}
+
+func (d *FuncDelegate) ErrorLog(err error) {
+	if d.OnErrorLog != nil {
+		d.OnErrorLog(err)
+	}
+}
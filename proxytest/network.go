@@ -0,0 +1,171 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrListenerClosed 监听已关闭
+var ErrListenerClosed = errors.New("proxytest: listener已关闭")
+
+// Network 内存网络, 使用net.Pipe连接, 不占用端口
+type Network struct {
+	mu        sync.RWMutex
+	listeners map[string]*Listener
+	fallback  map[string]*Listener
+	nextPort  int32
+}
+
+// NewNetwork 创建内存网络
+func NewNetwork() *Network {
+	return &Network{
+		listeners: make(map[string]*Listener),
+		fallback:  make(map[string]*Listener),
+		nextPort:  40000,
+	}
+}
+
+// Listen 监听地址, addr为host:port, host为*时匹配该端口上所有未单独监听的域名
+func (n *Network) Listen(addr string) (*Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := &Listener{
+		network: n,
+		addr:    addr,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	if host == "*" {
+		if _, ok := n.fallback[port]; ok {
+			return nil, fmt.Errorf("proxytest: 地址已被监听: %s", addr)
+		}
+		n.fallback[port] = l
+		return l, nil
+	}
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("proxytest: 地址已被监听: %s", addr)
+	}
+	n.listeners[addr] = l
+
+	return l, nil
+}
+
+// DialContext 连接内存网络中的地址, 签名与net.Dialer.DialContext相同
+func (n *Network) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.RLock()
+	l, ok := n.listeners[addr]
+	if !ok {
+		l, ok = n.fallback[port]
+	}
+	n.mu.RUnlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	clientPort := atomic.AddInt32(&n.nextPort, 1)
+	clientAddr := pipeAddr("127.0.0.1:" + strconv.Itoa(int(clientPort)))
+	serverAddr := pipeAddr(addr)
+	c1, c2 := net.Pipe()
+	client := &pipeConn{Conn: c1, local: clientAddr, remote: serverAddr}
+	server := &pipeConn{Conn: c2, local: serverAddr, remote: clientAddr}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		c1.Close()
+		c2.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	case <-ctx.Done():
+		c1.Close()
+		c2.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (n *Network) remove(l *Listener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners[l.addr] == l {
+		delete(n.listeners, l.addr)
+	}
+	_, port, _ := net.SplitHostPort(l.addr)
+	if n.fallback[port] == l {
+		delete(n.fallback, port)
+	}
+}
+
+var _ net.Listener = &Listener{}
+
+// Listener 内存网络监听
+type Listener struct {
+	network *Network
+	addr    string
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Accept 等待连接
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close 关闭监听
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.remove(l)
+	})
+
+	return nil
+}
+
+// Addr 监听地址
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr(l.addr)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "tcp" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn net.Pipe的地址固定为pipe, 替换为host:port便于代理解析RemoteAddr
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,194 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package proxytest 代理测试辅助, 在内存网络中连接客户端、代理和源站, 类似httptest
+package proxytest
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/ouqiang/goproxy"
+	"github.com/ouqiang/goproxy/cert"
+)
+
+const (
+	// ProxyAddr 代理在内存网络中的地址
+	ProxyAddr = "proxy.test:8080"
+)
+
+// Env 测试环境, 源站监听所有域名的80端口(HTTP)和443端口(HTTPS)
+type Env struct {
+	Network *Network
+	Proxy   *goproxy.Proxy
+	// ProxyURL 代理地址
+	ProxyURL *url.URL
+	// Client 已配置代理的客户端, 信任源站和中间人代理使用的根证书
+	Client *http.Client
+	// RootCAs 客户端信任的根证书
+	RootCAs *x509.CertPool
+
+	servers []*http.Server
+}
+
+// New 创建测试环境, origin处理所有发往源站的请求, opt为代理选项
+// 未通过goproxy.WithDelegate设置delegate时忽略环境变量中的上级代理
+func New(origin http.Handler, opt ...goproxy.Option) *Env {
+	network := NewNetwork()
+	opts := append([]goproxy.Option{
+		goproxy.WithDelegate(&directDelegate{}),
+	}, opt...)
+	opts = append(opts, goproxy.WithDialContext(network.DialContext))
+	proxy := goproxy.New(opts...)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(cert.DefaultRootCAPem())
+	proxyURL := &url.URL{Scheme: "http", Host: ProxyAddr}
+	e := &Env{
+		Network:  network,
+		Proxy:    proxy,
+		ProxyURL: proxyURL,
+		RootCAs:  rootCAs,
+		Client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				DialContext:     network.DialContext,
+				TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+			},
+		},
+	}
+	e.serve(ProxyAddr, proxy, nil)
+	e.serve("*:80", origin, nil)
+	certificate := cert.NewCertificate(nil)
+	e.serve("*:443", origin, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = "origin.test"
+			}
+			c, err := certificate.GenerateTlsConfig(name)
+			if err != nil {
+				return nil, err
+			}
+			return &c.Certificates[0], nil
+		},
+	})
+
+	return e
+}
+
+// Listen 在内存网络中额外启动服务, 如上级代理或特定域名的源站
+func (e *Env) Listen(addr string, handler http.Handler, tlsConfig *tls.Config) {
+	e.serve(addr, handler, tlsConfig)
+}
+
+func (e *Env) serve(addr string, handler http.Handler, tlsConfig *tls.Config) {
+	l, err := e.Network.Listen(addr)
+	if err != nil {
+		panic(fmt.Sprintf("proxytest: %s", err))
+	}
+	srv := &http.Server{Handler: handler}
+	e.servers = append(e.servers, srv)
+	var listener net.Listener = l
+	if handler == e.Proxy {
+		// 同Server, Accept时限制客户端连接数, 见goproxy.WithMaxClientConns
+		listener = e.Proxy.LimitListener(l)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	go srv.Serve(listener)
+}
+
+// Connect 向代理发送CONNECT请求, 返回连接和代理的响应, 响应非200时连接已关闭
+func (e *Env) Connect(target string) (net.Conn, *http.Response, error) {
+	conn, err := e.Network.DialContext(context.Background(), "tcp", ProxyAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, resp, nil
+	}
+
+	return &bufferedConn{Conn: conn, r: br}, resp, nil
+}
+
+// ConnectTLS 建立CONNECT隧道后与目标进行TLS握手
+func (e *Env) ConnectTLS(target string) (*tls.Conn, error) {
+	conn, resp, err := e.Connect(target)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, fmt.Errorf("proxytest: CONNECT失败: %s", resp.Status)
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, RootCAs: e.RootCAs})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// Close 关闭所有服务
+func (e *Env) Close() {
+	for _, srv := range e.servers {
+		srv.Close()
+	}
+	if t, ok := e.Client.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// bufferedConn 读取CONNECT响应时bufio可能已缓存隧道数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// directDelegate 不使用环境变量中的上级代理
+type directDelegate struct {
+	goproxy.DefaultDelegate
+}
+
+func (d *directDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	return nil, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxytest_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ouqiang/goproxy"
+	"github.com/ouqiang/goproxy/proxytest"
+)
+
+func okOrigin() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	})
+}
+
+func get(t *testing.T, client *http.Client, u string) {
+	t.Helper()
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("%s: 响应不符: %d %q", u, resp.StatusCode, body)
+	}
+}
+
+func TestHTTPHooks(t *testing.T) {
+	rec := proxytest.NewRecordingDelegate(nil)
+	env := proxytest.New(okOrigin(), goproxy.WithDelegate(rec))
+	defer env.Close()
+	get(t, env.Client, "http://origin.test/")
+	if !rec.Wait(proxytest.HookFinish, 1, 5*time.Second) {
+		t.Fatal("等待Finish超时")
+	}
+	rec.AssertHooks(t,
+		proxytest.HookConnect,
+		proxytest.HookAuth,
+		proxytest.HookBeforeRequest,
+		proxytest.HookModifyRequest,
+		proxytest.HookResolveHost,
+		proxytest.HookBeforeResponse,
+		proxytest.HookModifyResponse,
+		proxytest.HookComplete,
+		proxytest.HookFinish,
+	)
+	rec.AssertCalled(t, proxytest.HookParentProxy, 1)
+	rec.AssertNoErrors(t)
+	if call := rec.CallsOf(proxytest.HookComplete)[0]; call.StatusCode != http.StatusOK || call.URL != "http://origin.test/" {
+		t.Errorf("Complete记录不符: %d %s", call.StatusCode, call.URL)
+	}
+}
+
+func TestConnectHooks(t *testing.T) {
+	rec := proxytest.NewRecordingDelegate(nil)
+	env := proxytest.New(okOrigin(), goproxy.WithDelegate(rec))
+	defer env.Close()
+	conn, resp, err := env.Connect("origin.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == nil {
+		t.Fatalf("CONNECT失败: %s", resp.Status)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: origin.test\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	conn.Close()
+	if !rec.Wait(proxytest.HookFinish, 1, 5*time.Second) {
+		t.Fatal("等待Finish超时")
+	}
+	rec.AssertHooks(t,
+		proxytest.HookConnect,
+		proxytest.HookAuth,
+		proxytest.HookBeforeTunnel,
+		proxytest.HookResolveHost,
+		proxytest.HookTunnelOpen,
+		proxytest.HookTunnelClosed,
+		proxytest.HookComplete,
+		proxytest.HookFinish,
+	)
+	rec.AssertNotCalled(t, proxytest.HookBeforeRequest)
+	if call := rec.CallsOf(proxytest.HookConnect)[0]; call.Method != http.MethodConnect || call.Host != "origin.test:80" {
+		t.Errorf("Connect记录不符: %s %s", call.Method, call.Host)
+	}
+}
+
+func TestMITMHooks(t *testing.T) {
+	rec := proxytest.NewRecordingDelegate(nil)
+	env := proxytest.New(okOrigin(), goproxy.WithDelegate(rec), goproxy.WithDecryptHTTPS(nil))
+	get(t, env.Client, "https://origin.test/a")
+	get(t, env.Client, "https://origin.test/b")
+	if !rec.Wait(proxytest.HookComplete, 2, 5*time.Second) {
+		t.Fatal("等待Complete超时")
+	}
+	// 关闭客户端连接后CONNECT结束
+	env.Close()
+	if !rec.Wait(proxytest.HookFinish, 1, 5*time.Second) {
+		t.Fatal("等待Finish超时")
+	}
+	request := []string{
+		proxytest.HookBeforeRequest,
+		proxytest.HookModifyRequest,
+		proxytest.HookResolveHost,
+		proxytest.HookBeforeResponse,
+		proxytest.HookModifyResponse,
+		proxytest.HookComplete,
+	}
+	hooks := []string{proxytest.HookConnect, proxytest.HookAuth}
+	hooks = append(hooks, request...)
+	hooks = append(hooks, request[:1]...)
+	// 同一域名复用到源站的连接, 不再解析
+	hooks = append(hooks, request[1], request[3], request[4], request[5])
+	hooks = append(hooks, proxytest.HookComplete, proxytest.HookFinish)
+	rec.AssertHooks(t, hooks...)
+	completes := rec.CallsOf(proxytest.HookComplete)
+	for i, want := range []string{"https://origin.test/a", "https://origin.test/b"} {
+		if completes[i].URL != want {
+			t.Errorf("第%d个解密请求的URL为%s, 期望%s", i+1, completes[i].URL, want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxytest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ouqiang/goproxy"
+)
+
+// 回调名称
+const (
+	HookConnect        = "Connect"
+	HookAuth           = "Auth"
+	HookBeforeRequest  = "BeforeRequest"
+	HookBeforeResponse = "BeforeResponse"
+	HookOnError        = "OnError"
+	HookModifyRequest  = "ModifyRequestBody"
+	HookModifyResponse = "ModifyResponseBody"
+	HookBeforeTunnel   = "BeforeTunnelForward"
+	HookTunnelOpen     = "TunnelEstablished"
+	HookTunnelClosed   = "TunnelClosed"
+	HookResolveHost    = "ResolveHost"
+	HookRouteSNI       = "RouteSNI"
+	HookCircuit        = "CircuitStateChanged"
+	HookLimitExceeded  = "LimitExceeded"
+	HookBodyLimit      = "BodyLimitExceeded"
+	HookBlocked        = "Blocked"
+	HookConnectPort    = "ConnectPortAllowed"
+	HookContentBlocked = "ContentBlocked"
+	HookParentProxy    = "ParentProxy"
+	HookParentCreds    = "ParentProxyCredentials"
+	HookComplete       = "Complete"
+	HookFinish         = "Finish"
+	HookErrorLog       = "ErrorLog"
+)
+
+// TestingT testing.TB的子集
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Call 一次回调调用, 记录调用时Context的快照
+type Call struct {
+	Hook   string
+	Method string
+	URL    string
+	Host   string
+	Header http.Header
+	Data   map[interface{}]interface{}
+	// Aborted 调用结束时是否已中断
+	Aborted bool
+	// StatusCode BeforeResponse收到的响应状态码, Complete收到的返回给客户端的状态码
+	StatusCode int
+	// Err BeforeResponse、Complete、TunnelClosed和ErrorLog收到的错误
+	Err error
+}
+
+var _ goproxy.Delegate = &RecordingDelegate{}
+
+// RecordingDelegate 按顺序记录所有回调调用, 设置Next时记录后继续调用Next
+// 未设置Next时不使用上级代理
+type RecordingDelegate struct {
+	Next goproxy.Delegate
+
+	mu    sync.Mutex
+	calls []Call
+	cond  *sync.Cond
+}
+
+// NewRecordingDelegate 创建RecordingDelegate, next可为nil
+func NewRecordingDelegate(next goproxy.Delegate) *RecordingDelegate {
+	return &RecordingDelegate{Next: next}
+}
+
+func (d *RecordingDelegate) record(call Call) {
+	d.mu.Lock()
+	d.calls = append(d.calls, call)
+	if d.cond != nil {
+		d.cond.Broadcast()
+	}
+	d.mu.Unlock()
+}
+
+func snapshot(hook string, ctx *goproxy.Context) Call {
+	call := Call{Hook: hook, Aborted: ctx.IsAborted()}
+	if ctx.Req != nil {
+		call.Method = ctx.Req.Method
+		call.URL = ctx.Req.URL.String()
+		call.Host = ctx.Req.Host
+		call.Header = goproxy.CloneHeader(ctx.Req.Header)
+	}
+	if ctx.Data != nil {
+		call.Data = make(map[interface{}]interface{}, len(ctx.Data))
+		for k, v := range ctx.Data {
+			call.Data[k] = v
+		}
+	}
+
+	return call
+}
+
+func (d *RecordingDelegate) Connect(ctx *goproxy.Context, rw http.ResponseWriter) {
+	if d.Next != nil {
+		d.Next.Connect(ctx, rw)
+	}
+	d.record(snapshot(HookConnect, ctx))
+}
+
+func (d *RecordingDelegate) Auth(ctx *goproxy.Context, rw http.ResponseWriter) {
+	if d.Next != nil {
+		d.Next.Auth(ctx, rw)
+	}
+	d.record(snapshot(HookAuth, ctx))
+}
+
+func (d *RecordingDelegate) BeforeRequest(ctx *goproxy.Context) {
+	if d.Next != nil {
+		d.Next.BeforeRequest(ctx)
+	}
+	d.record(snapshot(HookBeforeRequest, ctx))
+}
+
+func (d *RecordingDelegate) BeforeResponse(ctx *goproxy.Context, resp *http.Response, err error) {
+	if d.Next != nil {
+		d.Next.BeforeResponse(ctx, resp, err)
+	}
+	call := snapshot(HookBeforeResponse, ctx)
+	call.Err = err
+	if resp != nil {
+		call.StatusCode = resp.StatusCode
+	}
+	d.record(call)
+}
+
+func (d *RecordingDelegate) OnError(ctx *goproxy.Context, rw http.ResponseWriter, err error) {
+	if d.Next != nil {
+		d.Next.OnError(ctx, rw, err)
+	}
+	call := snapshot(HookOnError, ctx)
+	call.Err = err
+	d.record(call)
+}
+
+func (d *RecordingDelegate) ModifyRequestBody(ctx *goproxy.Context, req *http.Request) io.ReadCloser {
+	var body io.ReadCloser
+	if d.Next != nil {
+		body = d.Next.ModifyRequestBody(ctx, req)
+	}
+	d.record(snapshot(HookModifyRequest, ctx))
+
+	return body
+}
+
+func (d *RecordingDelegate) ModifyResponseBody(ctx *goproxy.Context, resp *http.Response) io.ReadCloser {
+	var body io.ReadCloser
+	if d.Next != nil {
+		body = d.Next.ModifyResponseBody(ctx, resp)
+	}
+	call := snapshot(HookModifyResponse, ctx)
+	call.StatusCode = resp.StatusCode
+	d.record(call)
+
+	return body
+}
+
+func (d *RecordingDelegate) BeforeTunnelForward(ctx *goproxy.Context) {
+	if d.Next != nil {
+		d.Next.BeforeTunnelForward(ctx)
+	}
+	d.record(snapshot(HookBeforeTunnel, ctx))
+}
+
+func (d *RecordingDelegate) TunnelEstablished(ctx *goproxy.Context, targetConn net.Conn) {
+	if d.Next != nil {
+		d.Next.TunnelEstablished(ctx, targetConn)
+	}
+	d.record(snapshot(HookTunnelOpen, ctx))
+}
+
+func (d *RecordingDelegate) TunnelClosed(ctx *goproxy.Context, bytesUp, bytesDown int64, err error) {
+	if d.Next != nil {
+		d.Next.TunnelClosed(ctx, bytesUp, bytesDown, err)
+	}
+	call := snapshot(HookTunnelClosed, ctx)
+	call.Err = err
+	d.record(call)
+}
+
+func (d *RecordingDelegate) CircuitStateChanged(host string, state goproxy.CircuitState) {
+	if d.Next != nil {
+		d.Next.CircuitStateChanged(host, state)
+	}
+	d.record(Call{Hook: HookCircuit, Host: host})
+}
+
+func (d *RecordingDelegate) ResolveHost(ctx *goproxy.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var err error
+	if d.Next != nil {
+		ips, err = d.Next.ResolveHost(ctx, host)
+	}
+	call := snapshot(HookResolveHost, ctx)
+	call.Host = host
+	call.Err = err
+	d.record(call)
+
+	return ips, err
+}
+
+func (d *RecordingDelegate) RouteSNI(ctx *goproxy.Context) *goproxy.SNIRule {
+	var rule *goproxy.SNIRule
+	if d.Next != nil {
+		rule = d.Next.RouteSNI(ctx)
+	}
+	d.record(snapshot(HookRouteSNI, ctx))
+
+	return rule
+}
+
+func (d *RecordingDelegate) LimitExceeded(ctx *goproxy.Context, err error, page *goproxy.BlockPage) {
+	if d.Next != nil {
+		d.Next.LimitExceeded(ctx, err, page)
+	}
+	call := snapshot(HookLimitExceeded, ctx)
+	call.StatusCode = page.StatusCode
+	call.Err = err
+	d.record(call)
+}
+
+func (d *RecordingDelegate) BodyLimitExceeded(ctx *goproxy.Context, err error, limit int64) {
+	if d.Next != nil {
+		d.Next.BodyLimitExceeded(ctx, err, limit)
+	}
+	call := snapshot(HookBodyLimit, ctx)
+	call.Err = err
+	d.record(call)
+}
+
+func (d *RecordingDelegate) Blocked(ctx *goproxy.Context, rule *goproxy.ACLRule, page *goproxy.BlockPage) {
+	if d.Next != nil {
+		d.Next.Blocked(ctx, rule, page)
+	}
+	d.record(snapshot(HookBlocked, ctx))
+}
+
+func (d *RecordingDelegate) ConnectPortAllowed(ctx *goproxy.Context, port int, allowed bool) bool {
+	if d.Next != nil {
+		allowed = d.Next.ConnectPortAllowed(ctx, port, allowed)
+	}
+	d.record(snapshot(HookConnectPort, ctx))
+
+	return allowed
+}
+
+func (d *RecordingDelegate) ContentBlocked(ctx *goproxy.Context, rule *goproxy.ContentRule, contentType string, page *goproxy.BlockPage) {
+	if d.Next != nil {
+		d.Next.ContentBlocked(ctx, rule, contentType, page)
+	}
+	d.record(snapshot(HookContentBlocked, ctx))
+}
+
+func (d *RecordingDelegate) ParentProxy(req *http.Request) (*url.URL, error) {
+	d.record(Call{
+		Hook:   HookParentProxy,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Host:   req.Host,
+		Header: goproxy.CloneHeader(req.Header),
+	})
+	if d.Next != nil {
+		return d.Next.ParentProxy(req)
+	}
+
+	return nil, nil
+}
+
+func (d *RecordingDelegate) ParentProxyCredentials(ctx *goproxy.Context, parent *url.URL, attempt int) *goproxy.ParentCredentials {
+	var creds *goproxy.ParentCredentials
+	if d.Next != nil {
+		creds = d.Next.ParentProxyCredentials(ctx, parent, attempt)
+	}
+	d.record(snapshot(HookParentCreds, ctx))
+
+	return creds
+}
+
+func (d *RecordingDelegate) Complete(ctx *goproxy.Context, outcome *goproxy.Outcome) {
+	if d.Next != nil {
+		d.Next.Complete(ctx, outcome)
+	}
+	call := snapshot(HookComplete, ctx)
+	call.StatusCode = outcome.StatusCode
+	call.Err = outcome.Err
+	d.record(call)
+}
+
+func (d *RecordingDelegate) Finish(ctx *goproxy.Context) {
+	if d.Next != nil {
+		d.Next.Finish(ctx)
+	}
+	d.record(snapshot(HookFinish, ctx))
+}
+
+func (d *RecordingDelegate) ErrorLog(err error) {
+	if d.Next != nil {
+		d.Next.ErrorLog(err)
+	}
+	d.record(Call{Hook: HookErrorLog, Err: err})
+}
+
+// Calls 返回所有调用记录的副本
+func (d *RecordingDelegate) Calls() []Call {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	calls := make([]Call, len(d.calls))
+	copy(calls, d.calls)
+
+	return calls
+}
+
+// CallsOf 返回指定回调的调用记录
+func (d *RecordingDelegate) CallsOf(hook string) []Call {
+	var calls []Call
+	for _, call := range d.Calls() {
+		if call.Hook == hook {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+// Hooks 按调用顺序返回回调名称
+func (d *RecordingDelegate) Hooks() []string {
+	calls := d.Calls()
+	hooks := make([]string, len(calls))
+	for i, call := range calls {
+		hooks[i] = call.Hook
+	}
+
+	return hooks
+}
+
+// Reset 清空调用记录
+func (d *RecordingDelegate) Reset() {
+	d.mu.Lock()
+	d.calls = nil
+	d.mu.Unlock()
+}
+
+// Wait 等待回调被调用至少n次, 超时返回false
+// Finish在响应写入客户端后才调用, 断言前需要等待
+func (d *RecordingDelegate) Wait(hook string, n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cond == nil {
+		d.cond = sync.NewCond(&d.mu)
+	}
+	timer := time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	})
+	defer timer.Stop()
+	for {
+		count := 0
+		for _, call := range d.calls {
+			if call.Hook == hook {
+				count++
+			}
+		}
+		if count >= n {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		d.cond.Wait()
+	}
+}
+
+// AssertHooks 断言回调调用顺序, 忽略ErrorLog和ParentProxy
+func (d *RecordingDelegate) AssertHooks(t TestingT, hooks ...string) bool {
+	t.Helper()
+	var actual []string
+	for _, hook := range d.Hooks() {
+		if hook != HookErrorLog && hook != HookParentProxy {
+			actual = append(actual, hook)
+		}
+	}
+	if strings.Join(actual, ",") != strings.Join(hooks, ",") {
+		t.Errorf("回调顺序不符, 期望: %v, 实际: %v", hooks, actual)
+		return false
+	}
+
+	return true
+}
+
+// AssertCalled 断言回调被调用的次数
+func (d *RecordingDelegate) AssertCalled(t TestingT, hook string, times int) bool {
+	t.Helper()
+	if n := len(d.CallsOf(hook)); n != times {
+		t.Errorf("%s 期望调用%d次, 实际%d次", hook, times, n)
+		return false
+	}
+
+	return true
+}
+
+// AssertNotCalled 断言回调未被调用
+func (d *RecordingDelegate) AssertNotCalled(t TestingT, hook string) bool {
+	t.Helper()
+
+	return d.AssertCalled(t, hook, 0)
+}
+
+// AssertNoErrors 断言没有ErrorLog调用
+func (d *RecordingDelegate) AssertNoErrors(t TestingT) bool {
+	t.Helper()
+	calls := d.CallsOf(HookErrorLog)
+	if len(calls) > 0 {
+		t.Errorf("期望没有错误, 实际: %v", calls[0].Err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxytest_test
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/ouqiang/goproxy"
+	"github.com/ouqiang/goproxy/proxytest"
+)
+
+// newArgs 构造调用Delegate方法的参数, 指针参数不为nil
+func newArgs(typ reflect.Type, skip int) []reflect.Value {
+	req := &http.Request{Method: http.MethodGet, URL: &url.URL{Scheme: "http", Host: "origin.test"}, Header: http.Header{}}
+	var args []reflect.Value
+	for i := skip; i < typ.NumIn(); i++ {
+		in := typ.In(i)
+		switch {
+		case in == reflect.TypeOf(req):
+			args = append(args, reflect.ValueOf(req))
+		case in == reflect.TypeOf(&goproxy.Context{}):
+			args = append(args, reflect.ValueOf(&goproxy.Context{Req: req, Data: map[interface{}]interface{}{}}))
+		case in == reflect.TypeOf(&http.Response{}):
+			args = append(args, reflect.ValueOf(&http.Response{StatusCode: http.StatusOK, Header: http.Header{}}))
+		case in.Kind() == reflect.Ptr:
+			args = append(args, reflect.New(in.Elem()))
+		default:
+			args = append(args, reflect.Zero(in))
+		}
+	}
+
+	return args
+}
+
+// funcField FuncDelegate中方法对应的字段, OnError与方法重名, 字段为OnErrorResponse
+func funcField(method string) string {
+	if method == "OnError" {
+		return "OnErrorResponse"
+	}
+
+	return "On" + method
+}
+
+// TestDelegatesCoverAllHooks Delegate增加方法后, FuncDelegate和RecordingDelegate需同步增加
+func TestDelegatesCoverAllHooks(t *testing.T) {
+	iface := reflect.TypeOf((*goproxy.Delegate)(nil)).Elem()
+
+	called := make(map[string]bool)
+	fd := &proxytest.FuncDelegate{}
+	fields := reflect.ValueOf(fd).Elem()
+	if fields.NumField() != iface.NumMethod() {
+		t.Errorf("FuncDelegate有%d个字段, Delegate有%d个方法", fields.NumField(), iface.NumMethod())
+	}
+	for i := 0; i < iface.NumMethod(); i++ {
+		name := iface.Method(i).Name
+		field := fields.FieldByName(funcField(name))
+		if !field.IsValid() {
+			t.Errorf("FuncDelegate缺少字段%s", funcField(name))
+			continue
+		}
+		field.Set(reflect.MakeFunc(field.Type(), func(args []reflect.Value) []reflect.Value {
+			called[name] = true
+			out := make([]reflect.Value, field.Type().NumOut())
+			for j := range out {
+				out[j] = reflect.Zero(field.Type().Out(j))
+			}
+			return out
+		}))
+	}
+
+	rec := proxytest.NewRecordingDelegate(fd)
+	recValue := reflect.ValueOf(goproxy.Delegate(rec))
+	for i := 0; i < iface.NumMethod(); i++ {
+		method := iface.Method(i)
+		rec.Reset()
+		recValue.MethodByName(method.Name).Call(newArgs(method.Type, 0))
+		if !called[method.Name] {
+			t.Errorf("FuncDelegate.%s没有调用%s", method.Name, funcField(method.Name))
+		}
+		calls := rec.Calls()
+		if len(calls) != 1 {
+			t.Errorf("RecordingDelegate.%s记录了%d次调用", method.Name, len(calls))
+			continue
+		}
+		if calls[0].Hook != method.Name {
+			t.Errorf("RecordingDelegate.%s记录的回调名称为%s", method.Name, calls[0].Hook)
+		}
+	}
+}
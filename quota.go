@@ -0,0 +1,520 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQuotaExceeded 用户配额已用完
+var ErrQuotaExceeded = errors.New("用户配额已用完")
+
+const (
+	// 默认限速, 字节/秒
+	defaultQuotaThrottleRate = 4 * 1024
+	// 累计到一定字节数后写入store
+	quotaFlushBytes = 32 * 1024
+	// FileQuotaStore最短写文件间隔
+	quotaSaveInterval = time.Second
+)
+
+// QuotaLimit 用户配额, 为0表示不限制
+type QuotaLimit struct {
+	// Daily、Monthly 上传和下载的总字节数
+	Daily   int64
+	Monthly int64
+	// DailyRequests、MonthlyRequests 请求数
+	DailyRequests   int64
+	MonthlyRequests int64
+}
+
+// period 按天或按月的字节数和请求数配额
+func (l QuotaLimit) period(daily bool) (bytes, requests int64) {
+	if daily {
+		return l.Daily, l.DailyRequests
+	}
+
+	return l.Monthly, l.MonthlyRequests
+}
+
+// UserUsage 用户在一个周期内的用量
+type UserUsage struct {
+	// BytesUp 客户端上传的字节数
+	BytesUp int64 `json:"bytes_up"`
+	// BytesDown 下载到客户端的字节数
+	BytesDown int64 `json:"bytes_down"`
+	// Requests 请求数, HTTPS解密后的每个请求和每个隧道各计一次
+	Requests int64 `json:"requests"`
+}
+
+func (u *UserUsage) add(o UserUsage) {
+	u.BytesUp += o.BytesUp
+	u.BytesDown += o.BytesDown
+	u.Requests += o.Requests
+}
+
+// bytes 配额按上传和下载的总字节数计算
+func (u UserUsage) bytes() int64 {
+	return u.BytesUp + u.BytesDown
+}
+
+// QuotaLimitFunc 返回用户的配额
+type QuotaLimitFunc func(user string) QuotaLimit
+
+// QuotaAction 配额用尽后的处理方式
+type QuotaAction int
+
+const (
+	// QuotaReject 返回429
+	QuotaReject QuotaAction = iota
+	// QuotaForbid 返回403
+	QuotaForbid
+	// QuotaThrottle 不中断, 限速到WithQuotaThrottleRate
+	QuotaThrottle
+)
+
+// QuotaStore 用量存储, period为周期标识, 如2006-01-02(按天)、2006-01(按月)
+// 多实例共享可使用redis.NewQuotaStore, 也可实现为SQL(UPDATE ... SET bytes_up = bytes_up + ?)
+type QuotaStore interface {
+	// Usage 返回用户在周期内的用量
+	Usage(user, period string) (UserUsage, error)
+	// Add 累加用户在周期内的用量
+	Add(user, period string, usage UserUsage) error
+}
+
+// WithUserQuota 按Context.User统计每日/每月的上传、下载字节数和请求数, 并按limit限制
+// store为nil时使用内存存储, 重启后用量清零, 需持久化可使用NewFileQuotaStore
+// limit为nil时只统计不限制, 用量通过Proxy.UserUsage和管理接口查看
+// 未设置Context.User的请求不统计、不受限制
+func WithUserQuota(store QuotaStore, limit QuotaLimitFunc, action QuotaAction) Option {
+	return func(opt *options) {
+		opt.userQuota = true
+		opt.quotaStore = store
+		opt.quotaLimit = limit
+		opt.quotaAction = action
+	}
+}
+
+// WithQuotaThrottleRate QuotaThrottle的限速, 字节/秒, 默认4KB/s
+func WithQuotaThrottleRate(bytesPerSecond int64) Option {
+	return func(opt *options) {
+		opt.quotaThrottleRate = bytesPerSecond
+	}
+}
+
+// quotaManager 检查和累计用户用量
+type quotaManager struct {
+	store  QuotaStore
+	limit  QuotaLimitFunc
+	action QuotaAction
+	rate   int64
+	errLog func(error)
+	// alert 用量更新后调用, 用于配额告警
+	alert func(user, period string, used, limit int64)
+}
+
+func newQuotaManager(store QuotaStore, limit QuotaLimitFunc, action QuotaAction, rate int64, errLog func(error)) *quotaManager {
+	if store == nil {
+		store = NewMemoryQuotaStore()
+	}
+	if rate <= 0 {
+		rate = defaultQuotaThrottleRate
+	}
+
+	return &quotaManager{
+		store:  store,
+		limit:  limit,
+		action: action,
+		rate:   rate,
+		errLog: errLog,
+	}
+}
+
+func quotaPeriods(t time.Time) (daily, monthly string) {
+	return t.Format("2006-01-02"), t.Format("2006-01")
+}
+
+// exceeded 用户配额是否已用完, 没有配额或store出错时不限制
+func (m *quotaManager) exceeded(user string) bool {
+	if m.limit == nil {
+		return false
+	}
+	limit := m.limit(user)
+	daily, monthly := quotaPeriods(time.Now())
+	check := func(period string, isDaily bool) bool {
+		bytes, requests := limit.period(isDaily)
+		if bytes <= 0 && requests <= 0 {
+			return false
+		}
+		used, err := m.store.Usage(user, period)
+		if err != nil {
+			m.errLog(fmt.Errorf("%s - 读取用户用量失败: %s", user, err))
+			return false
+		}
+		return bytes > 0 && used.bytes() >= bytes || requests > 0 && used.Requests >= requests
+	}
+
+	return check(daily, true) || check(monthly, false)
+}
+
+func (m *quotaManager) add(user string, usage UserUsage) {
+	daily, monthly := quotaPeriods(time.Now())
+	for _, period := range []string{daily, monthly} {
+		if err := m.store.Add(user, period, usage); err != nil {
+			m.errLog(fmt.Errorf("%s - 保存用户用量失败: %s", user, err))
+		}
+	}
+	if m.alert == nil || m.limit == nil || usage.bytes() == 0 {
+		return
+	}
+	limit := m.limit(user)
+	for period, max := range map[string]int64{daily: limit.Daily, monthly: limit.Monthly} {
+		if max <= 0 {
+			continue
+		}
+		if used, err := m.store.Usage(user, period); err == nil {
+			m.alert(user, period, used.bytes(), max)
+		}
+	}
+}
+
+// usage 返回用户当天和当月的用量
+func (m *quotaManager) usage(user string) (daily, monthly UserUsage, err error) {
+	d, mon := quotaPeriods(time.Now())
+	if daily, err = m.store.Usage(user, d); err != nil {
+		return
+	}
+	monthly, err = m.store.Usage(user, mon)
+
+	return
+}
+
+// UserUsage 返回用户当天和当月的用量, 未开启WithUserQuota时返回零值
+func (p *Proxy) UserUsage(user string) (daily, monthly UserUsage, err error) {
+	if p.quota == nil {
+		return
+	}
+
+	return p.quota.usage(user)
+}
+
+// statusCode 拒绝请求时的状态码
+func (m *quotaManager) statusCode() int {
+	if m.action == QuotaForbid {
+		return http.StatusForbidden
+	}
+
+	return http.StatusTooManyRequests
+}
+
+// begin 请求开始时检查配额, 返回用于统计本次请求用量的quotaUsage
+func (m *quotaManager) begin(user string) (*quotaUsage, error) {
+	u := &quotaUsage{m: m, user: user}
+	if m.exceeded(user) {
+		if m.action != QuotaThrottle {
+			return nil, ErrQuotaExceeded
+		}
+		u.throttled = 1
+	}
+
+	return u, nil
+}
+
+// quotaUsage 统计单个客户端请求的用量, 隧道两个方向并发读写, 需保证并发安全
+// HTTPS解密后的请求与所在的CONNECT共用, 字节数只在解密的连接上统计
+type quotaUsage struct {
+	m           *quotaManager
+	user        string
+	pendingUp   int64
+	pendingDown int64
+	throttled   int32
+	exhausted   int32
+}
+
+// count 累计n字节, dir为throttleUp或throttleDown, 超过阈值时写入store并重新检查配额
+func (u *quotaUsage) count(dir int, n int) {
+	var pending int64
+	if dir == throttleUp {
+		pending = atomic.AddInt64(&u.pendingUp, int64(n)) + atomic.LoadInt64(&u.pendingDown)
+	} else {
+		pending = atomic.AddInt64(&u.pendingDown, int64(n)) + atomic.LoadInt64(&u.pendingUp)
+	}
+	if pending < quotaFlushBytes {
+		return
+	}
+	u.flush()
+	u.check()
+}
+
+// request 请求结束时累计请求数, 并重新检查配额
+func (u *quotaUsage) request() {
+	u.m.add(u.user, UserUsage{Requests: 1})
+	u.check()
+}
+
+// check 配额用完后限速或中断之后的读写
+func (u *quotaUsage) check() {
+	if atomic.LoadInt32(&u.throttled) == 0 && u.m.exceeded(u.user) {
+		if u.m.action == QuotaThrottle {
+			atomic.StoreInt32(&u.throttled, 1)
+		} else {
+			atomic.StoreInt32(&u.exhausted, 1)
+		}
+	}
+}
+
+func (u *quotaUsage) flush() {
+	usage := UserUsage{
+		BytesUp:   atomic.SwapInt64(&u.pendingUp, 0),
+		BytesDown: atomic.SwapInt64(&u.pendingDown, 0),
+	}
+	if usage.bytes() > 0 {
+		u.m.add(u.user, usage)
+	}
+}
+
+// transfer 包装一次读写, 限速时缩小单次读写大小并按速率等待
+func (u *quotaUsage) transfer(dir int, b []byte, f func([]byte) (int, error)) (int, error) {
+	if atomic.LoadInt32(&u.exhausted) == 1 {
+		return 0, ErrQuotaExceeded
+	}
+	throttled := atomic.LoadInt32(&u.throttled) == 1
+	if throttled && int64(len(b)) > u.m.rate {
+		b = b[:u.m.rate]
+	}
+	n, err := f(b)
+	if n > 0 {
+		u.count(dir, n)
+		if throttled {
+			time.Sleep(time.Duration(int64(n) * int64(time.Second) / u.m.rate))
+		}
+	}
+
+	return n, err
+}
+
+// body 统计body用量, dir为throttleUp时为请求body, throttleDown时为响应body
+// 没有body时不包装, 避免transport把请求当作长度未知
+func (u *quotaUsage) body(rc io.ReadCloser, dir int) io.ReadCloser {
+	if rc == nil || rc == http.NoBody {
+		return rc
+	}
+
+	return &quotaBody{rc: rc, u: u, dir: dir}
+}
+
+// conn 统计连接用量
+func (u *quotaUsage) conn(c net.Conn) net.Conn {
+	return &quotaConn{Conn: c, u: u}
+}
+
+type quotaBody struct {
+	rc  io.ReadCloser
+	u   *quotaUsage
+	dir int
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	return b.u.transfer(b.dir, p, b.rc.Read)
+}
+
+func (b *quotaBody) Close() error {
+	return b.rc.Close()
+}
+
+type quotaConn struct {
+	net.Conn
+	u *quotaUsage
+}
+
+func (c *quotaConn) Read(b []byte) (int, error) {
+	return c.u.transfer(throttleUp, b, c.Conn.Read)
+}
+
+func (c *quotaConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := c.u.transfer(throttleDown, b[written:], c.Conn.Write)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// MemoryQuotaStore 内存用量存储
+type MemoryQuotaStore struct {
+	mu    sync.Mutex
+	usage map[string]map[string]UserUsage
+}
+
+var _ QuotaStore = &MemoryQuotaStore{}
+
+// NewMemoryQuotaStore 创建内存用量存储
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{usage: make(map[string]map[string]UserUsage)}
+}
+
+// Usage 实现QuotaStore接口
+func (s *MemoryQuotaStore) Usage(user, period string) (UserUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usage[user][period], nil
+}
+
+// Add 实现QuotaStore接口, 同一用户只保留最近的日、月周期
+func (s *MemoryQuotaStore) Add(user, period string, usage UserUsage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	periods, ok := s.usage[user]
+	if !ok {
+		periods = make(map[string]UserUsage)
+		s.usage[user] = periods
+	}
+	if _, ok := periods[period]; !ok {
+		for p := range periods {
+			if len(p) == len(period) && p < period {
+				delete(periods, p)
+			}
+		}
+	}
+	u := periods[period]
+	u.add(usage)
+	periods[period] = u
+
+	return nil
+}
+
+// Reset 清除用户用量
+func (s *MemoryQuotaStore) Reset(user string) {
+	s.mu.Lock()
+	delete(s.usage, user)
+	s.mu.Unlock()
+}
+
+// FileQuotaStore 用量保存到JSON文件, 重启后恢复
+// 写入最多每秒一次, 退出前应调用Flush
+type FileQuotaStore struct {
+	*MemoryQuotaStore
+	path string
+
+	saveMu   sync.Mutex
+	dirty    bool
+	lastSave time.Time
+	timer    *time.Timer
+}
+
+var _ QuotaStore = &FileQuotaStore{}
+
+// NewFileQuotaStore 从文件加载用量, 文件不存在时创建新的存储
+func NewFileQuotaStore(path string) (*FileQuotaStore, error) {
+	s := &FileQuotaStore{
+		MemoryQuotaStore: NewMemoryQuotaStore(),
+		path:             path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.usage); err != nil {
+		return nil, fmt.Errorf("解析用户用量文件%s失败: %s", path, err)
+	}
+
+	return s, nil
+}
+
+// Add 实现QuotaStore接口
+func (s *FileQuotaStore) Add(user, period string, usage UserUsage) error {
+	s.MemoryQuotaStore.Add(user, period, usage)
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.dirty = true
+	if s.timer != nil {
+		return nil
+	}
+	if wait := quotaSaveInterval - time.Since(s.lastSave); wait > 0 {
+		s.timer = time.AfterFunc(wait, func() {
+			s.saveMu.Lock()
+			defer s.saveMu.Unlock()
+			s.timer = nil
+			s.save()
+		})
+		return nil
+	}
+
+	return s.save()
+}
+
+// Flush 立即写入文件
+func (s *FileQuotaStore) Flush() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	return s.save()
+}
+
+// save 先写临时文件再重命名, 避免写入中断导致文件损坏, 调用方需持有saveMu
+func (s *FileQuotaStore) save() error {
+	if !s.dirty {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := json.Marshal(s.usage)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.dirty = false
+	s.lastSave = time.Now()
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited 请求过于频繁
+var ErrRateLimited = errors.New("请求过于频繁")
+
+// RateLimiter 按key限制请求速率, 多实例部署时可使用redis.NewRateLimiter共享限额
+type RateLimiter interface {
+	// Allow 消耗一个令牌, 不允许时返回需要等待的时间
+	Allow(key string) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// RateLimitKeyFunc 返回限流的key, 返回空字符串时不限流
+type RateLimitKeyFunc func(ctx *Context) string
+
+// WithRateLimit 在Auth之后限制请求速率, 超出时返回429和Retry-After
+// key为nil时按Context.User限流, 未认证的请求按客户端IP限流
+// CONNECT计为一次请求, HTTPS解密后的请求不再单独计数
+// limiter出错时不限流
+func WithRateLimit(limiter RateLimiter, key RateLimitKeyFunc) Option {
+	return func(opt *options) {
+		opt.rateLimiter = limiter
+		opt.rateLimitKey = key
+	}
+}
+
+func defaultRateLimitKey(ctx *Context) string {
+	if ctx.User != "" {
+		return "user:" + ctx.User
+	}
+
+	return "ip:" + hostname(ctx.Req.RemoteAddr)
+}
+
+// checkRateLimit 超出限制时写入响应并返回false
+func (p *Proxy) checkRateLimit(ctx *Context, rw http.ResponseWriter) bool {
+	limiter := p.runtime().rateLimiter
+	if limiter == nil {
+		return true
+	}
+	keyFunc := p.rateLimitKey
+	if keyFunc == nil {
+		keyFunc = defaultRateLimitKey
+	}
+	key := keyFunc(ctx)
+	if key == "" {
+		return true
+	}
+	allowed, retryAfter, err := limiter.Allow(key)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - 限流检查失败: %s", key, err))
+		return true
+	}
+	if allowed {
+		return true
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	p.writeLimitExceeded(ctx, rw, ErrRateLimited, &BlockPage{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    ErrRateLimited.Error(),
+		Header:     http.Header{"Retry-After": []string{strconv.Itoa(seconds)}},
+	})
+
+	return false
+}
+
+// MemoryRateLimiter 进程内令牌桶限流
+type MemoryRateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// 上次清理空闲桶的时间
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var _ RateLimiter = &MemoryRateLimiter{}
+
+// NewMemoryRateLimiter 每个key每秒rate个令牌, 最多累积burst个
+func NewMemoryRateLimiter(rate float64, burst int) *MemoryRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &MemoryRateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow 实现RateLimiter接口
+func (l *MemoryRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), nil
+}
+
+// sweep 删除已经回满的桶, 避免key过多时占用内存
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < full || now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
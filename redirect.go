@@ -0,0 +1,158 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// RedirectRule 代理自动跟随重定向的规则, 适用于无法处理3xx的客户端
+type RedirectRule struct {
+	// Host 匹配请求的域名, 支持*.example.com
+	Host string
+	// MaxHops 最多跟随次数
+	MaxHops int
+}
+
+// WithFollowRedirects 匹配的请求由代理跟随3xx重定向, 将最终响应返回给客户端
+// 每次重定向的目标都经过WithACL、WithCategorization、WithExtAuthz检查, 拒绝时返回拦截页面
+func WithFollowRedirects(rules ...RedirectRule) Option {
+	return func(opt *options) {
+		opt.redirectRules = append(opt.redirectRules, rules...)
+	}
+}
+
+// 跨域名或从https重定向到http时不转发的header
+var redirectSensitiveHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// followRedirects 按规则跟随重定向, 检测到循环或超出次数时返回错误
+func (p *Proxy) followRedirects(ctx *Context, req *http.Request, resp *http.Response) (*http.Response, error) {
+	maxHops := 0
+	host := hostname(req.URL.Host)
+	for _, rule := range p.redirectRules {
+		if matchHost(rule.Host, host) {
+			maxHops = rule.MaxHops
+			break
+		}
+	}
+	if maxHops <= 0 {
+		return resp, nil
+	}
+	visited := map[string]bool{req.URL.String(): true}
+	for hops := 0; ; hops++ {
+		next := redirectRequest(req, resp)
+		if next == nil {
+			return resp, nil
+		}
+		drainBody(resp.Body)
+		if hops >= maxHops {
+			return nil, fmt.Errorf("重定向次数超过%d次", maxHops)
+		}
+		if visited[next.URL.String()] {
+			return nil, fmt.Errorf("检测到重定向循环: %s", next.URL)
+		}
+		visited[next.URL.String()] = true
+		if page := p.checkRedirect(ctx, next); page != nil {
+			return ctx.BlockPageResponse(page), nil
+		}
+		var err error
+		resp, err = p.roundTrip(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		req = next
+	}
+}
+
+// checkRedirect 重定向的目标与客户端请求一样经过重写、HSTS、WithACL、分类和外部授权, 返回nil时放行
+func (p *Proxy) checkRedirect(ctx *Context, next *http.Request) *BlockPage {
+	p.rewriteHost(next)
+	p.rewriteURL(next)
+	if p.hsts != nil {
+		p.hsts.upgrade(next)
+	}
+	// 检查函数读取ctx.Req, 检查期间替换为重定向请求, 外部授权添加的header写入重定向请求
+	orig := ctx.Req
+	ctx.Req = next
+	defer func() { ctx.Req = orig }()
+	p.lookupTargetGeo(ctx)
+	if page := p.checkACL(ctx); page != nil {
+		return page
+	}
+	if p.categorizer != nil {
+		if page := p.categorize(ctx); page != nil {
+			return page
+		}
+	}
+	if p.extAuthz != nil {
+		if page := p.authorize(ctx); page != nil {
+			return page
+		}
+	}
+
+	return nil
+}
+
+// redirectRequest 根据3xx响应生成下一个请求, 不需要或无法跟随时返回nil
+func redirectRequest(req *http.Request, resp *http.Response) *http.Request {
+	method := req.Method
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != http.MethodGet && method != http.MethodHead {
+			method = http.MethodGet
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		// 需要重发body, 已读取的body无法重放
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	next := req.Clone(req.Context())
+	next.Method = method
+	next.URL = location
+	next.Host = location.Host
+	next.RequestURI = ""
+	if method != req.Method {
+		next.Body = nil
+		next.GetBody = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	} else if req.GetBody != nil {
+		next.Body, _ = req.GetBody()
+	}
+	if hostname(location.Host) != hostname(req.URL.Host) || req.URL.Scheme == "https" && location.Scheme == "http" {
+		for _, h := range redirectSensitiveHeaders {
+			next.Header.Del(h)
+		}
+	}
+
+	return next
+}
+
+// drainBody 读取剩余body后关闭, 以便连接复用
+func drainBody(b io.ReadCloser) {
+	io.CopyN(ioutil.Discard, b, 4<<10)
+	b.Close()
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ouqiang/goproxy"
+)
+
+// tokenBucketScript 令牌桶, 使用Redis服务器时间, 避免各实例时钟不一致
+// KEYS[1] 桶, ARGV[1] 每秒令牌数, ARGV[2] 容量
+// 返回 {是否允许, 需要等待的毫秒数}
+var tokenBucketScript = NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// RateLimiter 基于Redis的令牌桶限流, 所有实例共享同一个桶
+type RateLimiter struct {
+	c      *Client
+	rate   float64
+	burst  int
+	prefix string
+}
+
+var _ goproxy.RateLimiter = &RateLimiter{}
+
+// NewRateLimiter 每个key每秒rate个令牌, 最多累积burst个, Redis key为prefix+key
+func NewRateLimiter(c *Client, rate float64, burst int, prefix string) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{c: c, rate: rate, burst: burst, prefix: prefix}
+}
+
+// Allow 实现goproxy.RateLimiter接口
+func (l *RateLimiter) Allow(key string) (bool, time.Duration, error) {
+	reply, err := l.c.Eval(tokenBucketScript, []string{l.prefix + key}, l.rate, l.burst)
+	if err != nil {
+		return false, 0, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return false, 0, fmt.Errorf("redis: 令牌桶脚本返回值无效: %v", reply)
+	}
+	allowed, err := Int64(items[0], nil)
+	if err != nil {
+		return false, 0, err
+	}
+	wait, err := Int64(items[1], nil)
+	if err != nil {
+		return false, 0, err
+	}
+
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// quotaAddScript 累加用量, 新建的key设置过期时间
+// KEYS[1] 用量, ARGV[1] 上传字节数, ARGV[2] 下载字节数, ARGV[3] 请求数, ARGV[4] 过期秒数
+var quotaAddScript = NewScript(`
+redis.call('HINCRBY', KEYS[1], 'bytes_up', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'bytes_down', ARGV[2])
+redis.call('HINCRBY', KEYS[1], 'requests', ARGV[3])
+if redis.call('TTL', KEYS[1]) < 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[4])
+end
+return 1
+`)
+
+// QuotaStore 基于Redis的用户用量存储, 多实例共享用户配额
+type QuotaStore struct {
+	c      *Client
+	prefix string
+}
+
+var _ goproxy.QuotaStore = &QuotaStore{}
+
+// NewQuotaStore Redis key为prefix+用户+":"+周期, 类型为hash, 周期结束后自动过期
+func NewQuotaStore(c *Client, prefix string) *QuotaStore {
+	return &QuotaStore{c: c, prefix: prefix}
+}
+
+func (s *QuotaStore) key(user, period string) string {
+	return s.prefix + user + ":" + period
+}
+
+// Usage 实现goproxy.QuotaStore接口
+func (s *QuotaStore) Usage(user, period string) (goproxy.UserUsage, error) {
+	var usage goproxy.UserUsage
+	reply, err := s.c.Do("HMGET", s.key(user, period), "bytes_up", "bytes_down", "requests")
+	if err != nil {
+		return usage, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 3 {
+		return usage, fmt.Errorf("redis: HMGET返回值无效: %v", reply)
+	}
+	for i, v := range []*int64{&usage.BytesUp, &usage.BytesDown, &usage.Requests} {
+		// 不存在的字段为nil
+		if items[i] == nil {
+			continue
+		}
+		if *v, err = Int64(items[i], nil); err != nil {
+			return usage, err
+		}
+	}
+
+	return usage, nil
+}
+
+// Add 实现goproxy.QuotaStore接口
+func (s *QuotaStore) Add(user, period string, usage goproxy.UserUsage) error {
+	// 按天的周期保留2天, 按月的保留32天
+	ttl := 2 * 24 * time.Hour
+	if len(period) == len("2006-01") {
+		ttl = 32 * 24 * time.Hour
+	}
+	_, err := s.c.Eval(quotaAddScript, []string{s.key(user, period)},
+		usage.BytesUp, usage.BytesDown, usage.Requests, int64(ttl/time.Second))
+
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package redis
+
+import (
+	"sync"
+	"time"
+)
+
+// 订阅连接断开后的重连间隔
+const resubscribeInterval = time.Second
+
+// Subscribe 订阅频道, 使用单独的连接, 断开后自动重连, 重连期间发布的消息会丢失
+// 返回的stop用于取消订阅
+func (c *Client) Subscribe(channel string, handler func(msg []byte)) (stop func(), err error) {
+	cn, err := c.subscribe(channel)
+	if err != nil {
+		return nil, err
+	}
+	s := &subscription{done: make(chan struct{}), cn: cn}
+	go func() {
+		for {
+			s.receive(handler)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(resubscribeInterval):
+			}
+			cn, err := c.subscribe(channel)
+			if err != nil {
+				continue
+			}
+			if !s.setConn(cn) {
+				cn.Close()
+				return
+			}
+		}
+	}()
+
+	return s.stop, nil
+}
+
+func (c *Client) subscribe(channel string) (*conn, error) {
+	cn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cn.do(c.opts.timeout, "SUBSCRIBE", channel); err != nil {
+		cn.Close()
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+type subscription struct {
+	mu      sync.Mutex
+	cn      *conn
+	stopped bool
+	done    chan struct{}
+}
+
+// receive 读取消息直到连接断开
+func (s *subscription) receive(handler func(msg []byte)) {
+	s.mu.Lock()
+	cn := s.cn
+	s.mu.Unlock()
+	if cn == nil {
+		return
+	}
+	// 订阅连接没有读超时
+	cn.SetDeadline(time.Time{})
+	for {
+		reply, err := readReply(cn.r)
+		if err != nil {
+			cn.Close()
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].(string); kind != "message" {
+			continue
+		}
+		if payload, ok := items[2].(string); ok {
+			handler([]byte(payload))
+		}
+	}
+}
+
+func (s *subscription) setConn(cn *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.cn = cn
+
+	return true
+}
+
+func (s *subscription) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	close(s.done)
+	if s.cn != nil {
+		s.cn.Close()
+	}
+}
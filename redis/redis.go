@@ -0,0 +1,357 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package redis 精简的Redis客户端(RESP2), 以及基于Redis的限流和流量配额存储, 用于多实例共享限额
+package redis
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPoolSize = 10
+	defaultTimeout  = 3 * time.Second
+)
+
+// ErrNil 返回值为空(nil bulk string或nil array)
+var ErrNil = errors.New("redis: nil")
+
+// Error Redis返回的错误, 如ERR、NOSCRIPT
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+type options struct {
+	username  string
+	password  string
+	db        int
+	tlsConfig *tls.Config
+	poolSize  int
+	timeout   time.Duration
+}
+
+type Option func(*options)
+
+// WithAuth 认证, username为空时使用AUTH password
+func WithAuth(username, password string) Option {
+	return func(opt *options) {
+		opt.username = username
+		opt.password = password
+	}
+}
+
+// WithDB 选择数据库
+func WithDB(db int) Option {
+	return func(opt *options) {
+		opt.db = db
+	}
+}
+
+// WithTLSConfig 使用TLS连接
+func WithTLSConfig(c *tls.Config) Option {
+	return func(opt *options) {
+		opt.tlsConfig = c
+	}
+}
+
+// WithPoolSize 最多保留的空闲连接数, 默认10
+func WithPoolSize(n int) Option {
+	return func(opt *options) {
+		opt.poolSize = n
+	}
+}
+
+// WithTimeout 连接和单条命令的超时时间, 默认3秒
+func WithTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.timeout = d
+	}
+}
+
+// Client Redis客户端, 并发安全, 连接按需建立
+type Client struct {
+	addr string
+	opts *options
+	idle chan *conn
+}
+
+// New 创建客户端, 不立即连接
+func New(addr string, opt ...Option) *Client {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+	if opts.poolSize <= 0 {
+		opts.poolSize = defaultPoolSize
+	}
+	if opts.timeout <= 0 {
+		opts.timeout = defaultTimeout
+	}
+
+	return &Client{
+		addr: addr,
+		opts: opts,
+		idle: make(chan *conn, opts.poolSize),
+	}
+}
+
+// Do 执行命令, 参数支持string、[]byte、整数和浮点数
+// 返回值类型: string(简单字符串和bulk string)、int64、[]interface{}, 空值返回ErrNil, 错误回复返回Error
+func (c *Client) Do(args ...interface{}) (interface{}, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(c.opts.timeout, args...)
+	c.put(cn, err)
+
+	return reply, err
+}
+
+// Close 关闭空闲连接
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	return c.dial()
+}
+
+// dial 建立新连接并完成认证和选择数据库
+func (c *Client) dial() (*conn, error) {
+	dialer := &net.Dialer{Timeout: c.opts.timeout}
+	var nc net.Conn
+	var err error
+	if c.opts.tlsConfig != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.opts.tlsConfig)
+	} else {
+		nc, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.opts.password != "" {
+		args := []interface{}{"AUTH", c.opts.password}
+		if c.opts.username != "" {
+			args = []interface{}{"AUTH", c.opts.username, c.opts.password}
+		}
+		if _, err := cn.do(c.opts.timeout, args...); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.opts.db != 0 {
+		if _, err := cn.do(c.opts.timeout, "SELECT", c.opts.db); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+// put 放回连接池, 网络错误后连接状态未知, 直接关闭
+func (c *Client) put(cn *conn, err error) {
+	if err != nil && err != ErrNil {
+		if _, ok := err.(Error); !ok {
+			cn.Close()
+			return
+		}
+	}
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (cn *conn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	cn.SetDeadline(time.Now().Add(timeout))
+	if _, err := cn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+
+	return readReply(cn.r)
+}
+
+// encodeCommand 编码为RESP数组
+func encodeCommand(args []interface{}) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			s = fmt.Sprint(v)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(s)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, s...)
+		buf = append(buf, "\r\n"...)
+	}
+
+	return buf
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: 无效的回复: %q", line)
+	}
+
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: 无效的长度: %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: 无效的长度: %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readReply(r)
+			if err != nil && err != ErrNil {
+				if _, ok := err.(Error); !ok {
+					return nil, err
+				}
+			}
+			if err == nil {
+				items[i] = item
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redis: 无效的回复: %q", line)
+}
+
+// Script Lua脚本, 优先使用EVALSHA, 服务器未缓存时使用EVAL
+type Script struct {
+	src string
+	sha string
+}
+
+// NewScript 创建脚本
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+
+	return &Script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// Eval 执行脚本
+func (c *Client) Eval(s *Script, keys []string, args ...interface{}) (interface{}, error) {
+	cmd := make([]interface{}, 0, 3+len(keys)+len(args))
+	cmd = append(cmd, "EVALSHA", s.sha, len(keys))
+	for _, k := range keys {
+		cmd = append(cmd, k)
+	}
+	cmd = append(cmd, args...)
+	reply, err := c.Do(cmd...)
+	if e, ok := err.(Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", s.src
+		return c.Do(cmd...)
+	}
+
+	return reply, err
+}
+
+// Int64 转换Do的返回值
+func Int64(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+
+	return 0, fmt.Errorf("redis: 返回值类型%T不是整数", reply)
+}
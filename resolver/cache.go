@@ -0,0 +1,181 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxTTL      = time.Hour
+	defaultNegativeTTL = 10 * time.Second
+	defaultCacheSize   = 10000
+	// next不返回TTL(如net.DefaultResolver)时的缓存时间
+	defaultCacheTTL = time.Minute
+)
+
+var _ Resolver = &Cache{}
+
+// Cache 缓存解析结果, 按记录的TTL过期, 同一域名的并发查询合并为一次
+// next实现TTLResolver时使用记录的TTL, 否则缓存1分钟(受WithTTL限制)
+// 与Hosts同时使用时应为NewHosts(NewCache(...)), hosts映射修改后立即生效
+type Cache struct {
+	next        Resolver
+	timeout     time.Duration
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	size        int
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheCall
+}
+
+type cacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+type cacheCall struct {
+	done  chan struct{}
+	addrs []net.IPAddr
+	err   error
+}
+
+// NewCache 创建缓存, next为nil时使用系统DNS
+func NewCache(next Resolver, opt ...Option) *Cache {
+	opts := newOptions(opt)
+	if next == nil {
+		next = net.DefaultResolver
+	}
+	if opts.maxTTL <= 0 {
+		opts.maxTTL = defaultMaxTTL
+	}
+	if opts.negativeTTL == 0 {
+		opts.negativeTTL = defaultNegativeTTL
+	}
+	if opts.cacheSize <= 0 {
+		opts.cacheSize = defaultCacheSize
+	}
+
+	return &Cache{
+		next:        next,
+		timeout:     opts.timeout,
+		minTTL:      opts.minTTL,
+		maxTTL:      opts.maxTTL,
+		negativeTTL: opts.negativeTTL,
+		size:        opts.cacheSize,
+		entries:     make(map[string]*cacheEntry),
+		inflight:    make(map[string]*cacheCall),
+	}
+}
+
+// LookupIPAddr 解析域名, 优先使用未过期的缓存
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.addrs, e.err
+	}
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &cacheCall{done: make(chan struct{})}
+		c.inflight[key] = call
+		// 查询不受发起者取消的影响, 其他等待者仍可使用结果
+		go c.lookup(context.WithoutCancel(ctx), key, call)
+	}
+	c.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.addrs, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Cache) lookup(ctx context.Context, key string, call *cacheCall) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	ttl := defaultCacheTTL
+	if r, ok := c.next.(TTLResolver); ok {
+		call.addrs, ttl, call.err = r.LookupIPAddrTTL(ctx, key)
+	} else {
+		call.addrs, call.err = c.next.LookupIPAddr(ctx, key)
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if call.err != nil {
+		ttl = 0
+		if dnsErr, ok := call.err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			ttl = c.negativeTTL
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if ttl > 0 {
+		c.store(key, &cacheEntry{addrs: call.addrs, err: call.err, expires: time.Now().Add(ttl)})
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// store 缓存已满时先删除过期的记录, 仍然已满时随机删除一条
+func (c *Cache) store(key string, e *cacheEntry) {
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+// Flush 清空缓存
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*cacheEntry)
+	c.mu.Unlock()
+}
+
+// Len 缓存的域名数, 包括已过期未删除的
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// DNS默认端口
+const defaultDNSPort = "53"
+
+var _ TTLResolver = &DNS{}
+
+// DNS 向指定的DNS服务器查询, 使用UDP, 应答被截断时改用TCP, 多个服务器按顺序故障转移
+type DNS struct {
+	servers []string
+	timeout time.Duration
+	dialer  *net.Dialer
+}
+
+// NewDNS 创建DNS解析器, servers如8.8.8.8, 192.168.1.1:5353, 未指定端口时使用53
+func NewDNS(servers []string, opt ...Option) *DNS {
+	opts := newOptions(opt)
+	d := &DNS{
+		timeout: opts.timeout,
+		dialer:  &net.Dialer{Timeout: opts.timeout},
+	}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, defaultDNSPort)
+		}
+		d.servers = append(d.servers, s)
+	}
+
+	return d
+}
+
+// LookupIPAddr 解析域名
+func (d *DNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := d.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+// LookupIPAddrTTL 解析域名, 同时返回记录的最小TTL
+func (d *DNS) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return lookupBoth(ctx, host, d.query)
+}
+
+func (d *DNS) query(ctx context.Context, name string, qtype uint16) ([]net.IP, uint32, error) {
+	if len(d.servers) == 0 {
+		return nil, 0, errors.New("DNS未配置服务器")
+	}
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, server := range d.servers {
+		resp, err := d.exchange(ctx, server, msg)
+		if err != nil {
+			lastErr = fmt.Errorf("DNS请求%s失败: %s", server, err)
+			continue
+		}
+		ips, ttl, err := parseResponse(resp, id, qtype)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				dnsErr.Name = name
+				return nil, 0, dnsErr
+			}
+			lastErr = err
+			continue
+		}
+		return ips, ttl, nil
+	}
+
+	return nil, 0, lastErr
+}
+
+// exchange UDP查询, 应答设置了TC标志时使用TCP重新查询
+func (d *DNS) exchange(ctx context.Context, server string, msg []byte) ([]byte, error) {
+	conn, err := d.dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		// 忽略ID不匹配的应答, 可能是之前超时查询的应答或伪造的应答
+		if n < headerLen || binary.BigEndian.Uint16(resp) != binary.BigEndian.Uint16(msg) {
+			continue
+		}
+		if binary.BigEndian.Uint16(resp[2:])&0x0200 == 0 {
+			return resp, nil
+		}
+		break
+	}
+	tcpConn, err := d.dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+
+	return roundTrip(tcpConn, msg, d.timeout)
+}
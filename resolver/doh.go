@@ -0,0 +1,121 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const dnsMessageContentType = "application/dns-message"
+
+// 应答报文最大长度
+const maxMessageSize = 65535
+
+var _ Resolver = &DoH{}
+
+// DoH DNS-over-HTTPS解析(RFC 8484)
+type DoH struct {
+	endpoints []string
+	client    *http.Client
+}
+
+// NewDoH 创建DoH解析器, endpoints如https://1.1.1.1/dns-query, 按顺序尝试
+func NewDoH(endpoints []string, opt ...Option) *DoH {
+	opts := newOptions(opt)
+	transport := &http.Transport{
+		DialContext:         bootstrapDialContext(opts.bootstrap, opts.timeout),
+		TLSHandshakeTimeout: opts.timeout,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+
+	return &DoH{
+		endpoints: endpoints,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.timeout,
+		},
+	}
+}
+
+// LookupIPAddr 解析域名
+func (d *DoH) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := d.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+// LookupIPAddrTTL 解析域名, 同时返回记录的最小TTL
+func (d *DoH) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return lookupBoth(ctx, host, d.query)
+}
+
+func (d *DoH) query(ctx context.Context, name string, qtype uint16) ([]net.IP, uint32, error) {
+	if len(d.endpoints) == 0 {
+		return nil, 0, errors.New("DoH未配置服务器")
+	}
+	// RFC 8484建议ID为0, 以便HTTP缓存
+	msg, err := buildQuery(0, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, endpoint := range d.endpoints {
+		ips, ttl, err := d.exchange(ctx, endpoint, msg, qtype)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			dnsErr.Name = name
+			return nil, 0, dnsErr
+		}
+		lastErr = err
+	}
+
+	return nil, 0, lastErr
+}
+
+func (d *DoH) exchange(ctx context.Context, endpoint string, msg []byte, qtype uint16) ([]net.IP, uint32, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("DoH请求%s失败: %s", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, 0, fmt.Errorf("DoH请求%s失败, 状态码: %d", endpoint, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return parseResponse(body, 0, qtype)
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DoT默认端口
+	defaultDoTPort = "853"
+	// 每个服务器最多保留的空闲连接数
+	maxIdleConnsPerServer = 2
+)
+
+var _ Resolver = &DoT{}
+
+// DoT DNS-over-TLS解析(RFC 7858), 复用TLS连接, 多个服务器按顺序故障转移
+type DoT struct {
+	servers []*dotServer
+	timeout time.Duration
+}
+
+type dotServer struct {
+	addr       string
+	serverName string
+	dial       func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+// NewDoT 创建DoT解析器, servers如dns.google:853, 1.1.1.1, 未指定端口时使用853
+func NewDoT(servers []string, opt ...Option) *DoT {
+	opts := newOptions(opt)
+	d := &DoT{timeout: opts.timeout}
+	dial := bootstrapDialContext(opts.bootstrap, opts.timeout)
+	for _, s := range servers {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			host, port = s, defaultDoTPort
+		}
+		d.servers = append(d.servers, &dotServer{
+			addr:       net.JoinHostPort(host, port),
+			serverName: host,
+			dial:       dial,
+		})
+	}
+
+	return d
+}
+
+// LookupIPAddr 解析域名
+func (d *DoT) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := d.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+// LookupIPAddrTTL 解析域名, 同时返回记录的最小TTL
+func (d *DoT) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return lookupBoth(ctx, host, d.query)
+}
+
+func (d *DoT) query(ctx context.Context, name string, qtype uint16) ([]net.IP, uint32, error) {
+	if len(d.servers) == 0 {
+		return nil, 0, errors.New("DoT未配置服务器")
+	}
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, s := range d.servers {
+		resp, err := s.exchange(ctx, msg, d.timeout)
+		if err != nil {
+			lastErr = fmt.Errorf("DoT请求%s失败: %s", s.addr, err)
+			continue
+		}
+		ips, ttl, err := parseResponse(resp, id, qtype)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				dnsErr.Name = name
+				return nil, 0, dnsErr
+			}
+			lastErr = err
+			continue
+		}
+		return ips, ttl, nil
+	}
+
+	return nil, 0, lastErr
+}
+
+// exchange 发送查询, 优先复用空闲连接, 复用连接失败时重新建立连接重试一次
+func (s *dotServer) exchange(ctx context.Context, msg []byte, timeout time.Duration) ([]byte, error) {
+	if conn := s.getIdle(); conn != nil {
+		resp, err := roundTrip(conn, msg, timeout)
+		if err == nil {
+			s.putIdle(conn)
+			return resp, nil
+		}
+		conn.Close()
+	}
+	conn, err := s.connect(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := roundTrip(conn, msg, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.putIdle(conn)
+
+	return resp, nil
+}
+
+func (s *dotServer) connect(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+	rawConn, err := s.dial(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, &tls.Config{ServerName: s.serverName})
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (s *dotServer) getIdle() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.idle)
+	if n == 0 {
+		return nil
+	}
+	conn := s.idle[n-1]
+	s.idle = s.idle[:n-1]
+
+	return conn
+}
+
+func (s *dotServer) putIdle(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= maxIdleConnsPerServer {
+		conn.Close()
+		return
+	}
+	s.idle = append(s.idle, conn)
+}
+
+// roundTrip TCP传输的DNS报文带2字节长度前缀
+func roundTrip(conn net.Conn, msg []byte, timeout time.Duration) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Resolver = &Hosts{}
+
+// Hosts 静态hosts映射, 优先于DNS查询, 支持通配符*.example.com
+// 映射到0.0.0.0或::可用于屏蔽域名
+type Hosts struct {
+	next Resolver
+
+	mu       sync.RWMutex
+	exact    map[string][]net.IPAddr
+	wildcard map[string][]net.IPAddr
+}
+
+// NewHosts 创建hosts映射, 未命中时使用next解析, next为nil时使用系统DNS
+func NewHosts(next Resolver) *Hosts {
+	if next == nil {
+		next = net.DefaultResolver
+	}
+
+	return &Hosts{
+		next:     next,
+		exact:    make(map[string][]net.IPAddr),
+		wildcard: make(map[string][]net.IPAddr),
+	}
+}
+
+// LookupIPAddr 解析域名
+func (h *Hosts) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs := h.Lookup(host); addrs != nil {
+		return addrs, nil
+	}
+
+	return h.next.LookupIPAddr(ctx, host)
+}
+
+// Lookup 查找映射, 未命中返回nil
+func (h *Hosts) Lookup(host string) []net.IPAddr {
+	host = normalizeHost(host)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if addrs, ok := h.exact[host]; ok {
+		return addrs
+	}
+	// 从最长的父域开始匹配通配符
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if addrs, ok := h.wildcard[host]; ok {
+			return addrs
+		}
+	}
+
+	return nil
+}
+
+// Set 整体替换映射表, key为域名或*.域名
+func (h *Hosts) Set(table map[string][]string) error {
+	exact := make(map[string][]net.IPAddr)
+	wildcard := make(map[string][]net.IPAddr)
+	for name, ips := range table {
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("hosts: %s 无效的IP: %s", name, s)
+			}
+			addHost(exact, wildcard, name, ip)
+		}
+	}
+	h.swap(exact, wildcard)
+
+	return nil
+}
+
+// Load 从hosts文件格式加载并替换映射表, 每行: IP 域名1 域名2 ...
+func (h *Hosts) Load(r io.Reader) error {
+	exact := make(map[string][]net.IPAddr)
+	wildcard := make(map[string][]net.IPAddr)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("hosts: 第%d行格式错误", lineNum)
+		}
+		for _, name := range fields[1:] {
+			addHost(exact, wildcard, name, ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.swap(exact, wildcard)
+
+	return nil
+}
+
+// LoadFile 从文件加载并替换映射表
+func (h *Hosts) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return h.Load(f)
+}
+
+// WatchFile 定时检查文件修改时间, 变化后重新加载, 加载失败时保留原映射表
+// 返回的函数用于停止监听
+func (h *Hosts) WatchFile(path string, interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		var lastMod time.Time
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if fi, err := os.Stat(path); err != nil {
+				if onError != nil {
+					onError(err)
+				}
+			} else if !fi.ModTime().Equal(lastMod) {
+				if err := h.LoadFile(path); err != nil {
+					if onError != nil {
+						onError(err)
+					}
+				} else {
+					lastMod = fi.ModTime()
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (h *Hosts) swap(exact, wildcard map[string][]net.IPAddr) {
+	h.mu.Lock()
+	h.exact = exact
+	h.wildcard = wildcard
+	h.mu.Unlock()
+}
+
+func addHost(exact, wildcard map[string][]net.IPAddr, name string, ip net.IP) {
+	name = normalizeHost(name)
+	if strings.HasPrefix(name, "*.") {
+		name = name[2:]
+		wildcard[name] = append(wildcard[name], net.IPAddr{IP: ip})
+		return
+	}
+	exact[name] = append(exact[name], net.IPAddr{IP: ip})
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS报文编解码, 只支持A/AAAA查询
+
+const (
+	typeA    uint16 = 1
+	typeAAAA uint16 = 28
+	classIN  uint16 = 1
+
+	headerLen = 12
+)
+
+var errMessageTruncated = errors.New("DNS报文不完整")
+
+// buildQuery 构造查询报文
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	b := make([]byte, headerLen, headerLen+len(name)+6)
+	binary.BigEndian.PutUint16(b[0:], id)
+	// RD 期望递归查询
+	binary.BigEndian.PutUint16(b[2:], 0x0100)
+	// QDCOUNT
+	binary.BigEndian.PutUint16(b[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("无效的域名: %s", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = append(b, byte(qtype>>8), byte(qtype), byte(classIN>>8), byte(classIN))
+
+	return b, nil
+}
+
+// parseResponse 解析应答报文, 返回IP列表和最小TTL
+func parseResponse(b []byte, id uint16, qtype uint16) ([]net.IP, uint32, error) {
+	if len(b) < headerLen {
+		return nil, 0, errMessageTruncated
+	}
+	if binary.BigEndian.Uint16(b[0:]) != id {
+		return nil, 0, errors.New("DNS应答ID不匹配")
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	if flags&0x8000 == 0 {
+		return nil, 0, errors.New("DNS报文不是应答")
+	}
+	rcode := flags & 0x000f
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	anCount := int(binary.BigEndian.Uint16(b[6:]))
+	switch rcode {
+	case 0:
+	case 3:
+		return nil, 0, &net.DNSError{Err: "no such host", IsNotFound: true}
+	default:
+		return nil, 0, fmt.Errorf("DNS查询失败, rcode: %d", rcode)
+	}
+
+	off := headerLen
+	var err error
+	for i := 0; i < qdCount; i++ {
+		if off, err = skipName(b, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+	var ips []net.IP
+	var minTTL uint32
+	for i := 0; i < anCount; i++ {
+		if off, err = skipName(b, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(b) {
+			return nil, 0, errMessageTruncated
+		}
+		rrType := binary.BigEndian.Uint16(b[off:])
+		ttl := binary.BigEndian.Uint32(b[off+4:])
+		rdLen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdLen > len(b) {
+			return nil, 0, errMessageTruncated
+		}
+		rdata := b[off : off+rdLen]
+		off += rdLen
+		if rrType != qtype {
+			// CNAME等记录跳过, 递归服务器已给出最终结果
+			continue
+		}
+		switch {
+		case qtype == typeA && rdLen == net.IPv4len:
+			ips = append(ips, net.IPv4(rdata[0], rdata[1], rdata[2], rdata[3]))
+		case qtype == typeAAAA && rdLen == net.IPv6len:
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, rdata)
+			ips = append(ips, ip)
+		default:
+			continue
+		}
+		if minTTL == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+
+	return ips, minTTL, nil
+}
+
+// skipName 跳过报文中的域名, 支持压缩指针
+func skipName(b []byte, off int) (int, error) {
+	for {
+		if off >= len(b) {
+			return 0, errMessageTruncated
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += n + 1
+		}
+	}
+}
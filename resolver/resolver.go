@@ -0,0 +1,169 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package resolver DNS解析
+package resolver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	// 默认查询超时时间
+	defaultTimeout = 5 * time.Second
+)
+
+// Resolver 域名解析接口, net.DefaultResolver已实现该接口
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var _ Resolver = net.DefaultResolver
+
+// TTLResolver 同时返回记录的TTL, DNS、DoH、DoT已实现, Cache按TTL决定缓存时间
+type TTLResolver interface {
+	Resolver
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+type options struct {
+	bootstrap   []string
+	timeout     time.Duration
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	cacheSize   int
+}
+
+type Option func(*options)
+
+// WithBootstrap 解析服务器自身域名使用的IP, 不经过系统DNS
+func WithBootstrap(ip ...string) Option {
+	return func(opt *options) {
+		opt.bootstrap = ip
+	}
+}
+
+// WithTimeout 单次查询超时时间
+func WithTimeout(d time.Duration) Option {
+	return func(opt *options) {
+		opt.timeout = d
+	}
+}
+
+// WithTTL Cache的缓存时间范围, 记录的TTL小于min时按min缓存, 大于max时按max缓存, 默认0到1小时
+func WithTTL(min, max time.Duration) Option {
+	return func(opt *options) {
+		opt.minTTL = min
+		opt.maxTTL = max
+	}
+}
+
+// WithNegativeTTL Cache缓存域名不存在的时间, 默认10秒, 小于0时不缓存
+func WithNegativeTTL(d time.Duration) Option {
+	return func(opt *options) {
+		opt.negativeTTL = d
+	}
+}
+
+// WithCacheSize Cache最多缓存的域名数, 默认10000
+func WithCacheSize(n int) Option {
+	return func(opt *options) {
+		opt.cacheSize = n
+	}
+}
+
+func newOptions(opt []Option) *options {
+	opts := &options{}
+	for _, o := range opt {
+		o(opts)
+	}
+	if opts.timeout <= 0 {
+		opts.timeout = defaultTimeout
+	}
+
+	return opts
+}
+
+// bootstrapDialContext 连接addr时使用bootstrap IP替换域名
+func bootstrapDialContext(bootstrap []string, timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if len(bootstrap) == 0 {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, ip := range bootstrap {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+
+		return nil, lastErr
+	}
+}
+
+// queryFunc 查询一种记录, 返回IP列表和最小TTL(秒)
+type queryFunc func(ctx context.Context, name string, qtype uint16) ([]net.IP, uint32, error)
+
+// lookupBoth 并发查询A和AAAA记录, 返回两者中较小的TTL
+func lookupBoth(ctx context.Context, host string, query queryFunc) ([]net.IPAddr, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, 0, nil
+	}
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	ch := make(chan result, 2)
+	for _, qtype := range []uint16{typeA, typeAAAA} {
+		go func(qtype uint16) {
+			ips, ttl, err := query(ctx, host, qtype)
+			ch <- result{ips, ttl, err}
+		}(qtype)
+	}
+	var addrs []net.IPAddr
+	var minTTL uint32
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		for _, ip := range r.ips {
+			addrs = append(addrs, net.IPAddr{IP: ip})
+		}
+		if len(r.ips) > 0 && (minTTL == 0 || r.ttl < minTTL) {
+			minTTL = r.ttl
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, 0, lastErr
+	}
+
+	return addrs, time.Duration(minTTL) * time.Second, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Respond 以resp作为本次请求的响应并中断执行, 由proxy写入客户端, resp.Body由proxy关闭
+// 可在Connect、Auth、BeforeTunnelForward、BeforeRequest中调用, 用于返回拦截页面、缓存命中的响应等, 调用后不要再写入rw
+// 在BeforeRequest中调用时不连接目标服务器, 不调用BeforeResponse, HTTPS解密后的连接保持可用
+func (c *Context) Respond(resp *http.Response) {
+	c.response = resp
+	c.abort = true
+}
+
+// takeResponse 取出Respond设置的响应并补全状态行和body
+func (c *Context) takeResponse() *http.Response {
+	resp := c.response
+	if resp == nil {
+		return nil
+	}
+	c.response = nil
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	if resp.Status == "" {
+		resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+	if resp.ProtoMajor == 0 {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	if resp.Request == nil {
+		resp.Request = c.Req
+	}
+
+	return resp
+}
+
+// writeResponse Connect、Auth、BeforeTunnelForward中调用Respond时写入客户端
+func (c *Context) writeResponse(rw http.ResponseWriter) {
+	resp := c.takeResponse()
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	CopyHeader(rw.Header(), resp.Header)
+	rw.WriteHeader(resp.StatusCode)
+	io.Copy(rw, resp.Body)
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+)
+
+// RetryPolicy 连接目标服务器或上级代理失败时的重试策略
+// 只重试连接阶段的错误(如连接被拒绝、连接超时), 请求已发送后的错误不重试
+type RetryPolicy struct {
+	// MaxAttempts 最多尝试次数, 包括第一次, 小于2时不重试
+	MaxAttempts int
+	// Backoff 第一次重试前的等待时间, 之后每次翻倍, 默认100ms
+	Backoff time.Duration
+	// MaxBackoff 最长等待时间, 默认2秒
+	MaxBackoff time.Duration
+	// Methods 允许重试的请求方法, 默认为幂等方法GET、HEAD、OPTIONS、TRACE、PUT、DELETE
+	Methods []string
+}
+
+// WithRetry 连接失败时按策略重试, 有body的请求需要支持GetBody, Context.Attempts记录发送次数
+// 与WithUpstreamPool同时使用时, 每次尝试内部仍会切换上级代理
+func WithRetry(policy RetryPolicy) Option {
+	return func(opt *options) {
+		opt.retry = &policy
+	}
+}
+
+type retrier struct {
+	policy  RetryPolicy
+	methods map[string]bool
+}
+
+func newRetrier(policy RetryPolicy) *retrier {
+	if policy.Backoff <= 0 {
+		policy.Backoff = defaultRetryBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaultRetryMaxBackoff
+	}
+	methods := policy.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete}
+	}
+	r := &retrier{policy: policy, methods: make(map[string]bool)}
+	for _, m := range methods {
+		r.methods[m] = true
+	}
+
+	return r
+}
+
+// do 发送请求, 失败时等待后重试
+func (r *retrier) do(ctx *Context, req *http.Request, send func(*Context, *http.Request) (*http.Response, error), errorLog func(error)) (*http.Response, error) {
+	backoff := r.policy.Backoff
+	for attempts := 1; ; attempts++ {
+		resp, err := send(ctx, req)
+		if err == nil || attempts >= r.policy.MaxAttempts || !r.methods[req.Method] || !canFailover(req, err) {
+			return resp, err
+		}
+		if req.GetBody != nil {
+			body, gerr := req.GetBody()
+			if gerr != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		errorLog(fmt.Errorf("%s - 第%d次请求失败, %s后重试: %s", req.URL.Host, attempts, backoff, err))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, err
+		}
+		if backoff *= 2; backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
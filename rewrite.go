@@ -0,0 +1,119 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// HostRewriteRule Host重写规则
+type HostRewriteRule struct {
+	// Match 匹配请求的域名, 支持*.example.com
+	Match string
+	// Host 新的Host header, 可带端口
+	Host string
+	// RewriteURL 是否同时修改URL中的域名, 即改为连接Host, Host不带端口时保留原端口
+	RewriteURL bool
+}
+
+// WithHostRewriteRules 转发前重写Host, 按顺序匹配第一条规则
+func WithHostRewriteRules(rules ...HostRewriteRule) Option {
+	return func(opt *options) {
+		opt.hostRewriteRules = append(opt.hostRewriteRules, rules...)
+	}
+}
+
+// rewriteHost 应用Host重写规则
+func (p *Proxy) rewriteHost(req *http.Request) {
+	host := hostname(req.URL.Host)
+	for _, rule := range p.runtime().hostRewriteRules {
+		if !matchHost(rule.Match, host) {
+			continue
+		}
+		newHost := rule.Host
+		if ip := net.ParseIP(newHost); ip != nil && ip.To4() == nil {
+			// 不带方括号的IPv6地址
+			newHost = "[" + newHost + "]"
+		}
+		req.Host = newHost
+		if rule.RewriteURL {
+			if _, _, err := net.SplitHostPort(newHost); err != nil {
+				if port := req.URL.Port(); port != "" {
+					newHost = net.JoinHostPort(hostname(newHost), port)
+				}
+			}
+			req.URL.Host = newHost
+		}
+		return
+	}
+}
+
+// URLRewriteRule URL重写规则, 作用于path和query
+type URLRewriteRule struct {
+	// Host 限定域名, 支持*.example.com, 为空时匹配所有域名
+	Host string
+	// Pattern 匹配path?query的正则表达式
+	Pattern *regexp.Regexp
+	// Replacement 替换内容, 支持$1、${name}引用分组
+	Replacement string
+	// DryRun 只记录重写结果, 不修改请求
+	DryRun bool
+}
+
+// WithURLRewriteRules 转发前重写URL的path和query, 按顺序匹配第一条规则
+func WithURLRewriteRules(rules ...URLRewriteRule) Option {
+	return func(opt *options) {
+		opt.urlRewriteRules = append(opt.urlRewriteRules, rules...)
+	}
+}
+
+// rewriteURL 应用URL重写规则
+func (p *Proxy) rewriteURL(req *http.Request) {
+	rules := p.runtime().urlRewriteRules
+	if len(rules) == 0 {
+		return
+	}
+	host := hostname(req.URL.Host)
+	uri := req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		uri += "?" + req.URL.RawQuery
+	}
+	for _, rule := range rules {
+		if rule.Host != "" && !matchHost(rule.Host, host) {
+			continue
+		}
+		if !rule.Pattern.MatchString(uri) {
+			continue
+		}
+		newURI := rule.Pattern.ReplaceAllString(uri, rule.Replacement)
+		if rule.DryRun {
+			p.delegate.ErrorLog(fmt.Errorf("%s - URL重写(dry-run): %s -> %s", req.URL.Host, uri, newURI))
+			return
+		}
+		u, err := url.ParseRequestURI(newURI)
+		if err != nil {
+			p.delegate.ErrorLog(fmt.Errorf("%s - URL重写结果无效: %s -> %s, %s", req.URL.Host, uri, newURI, err))
+			return
+		}
+		req.URL.Path = u.Path
+		req.URL.RawPath = u.RawPath
+		req.URL.RawQuery = u.RawQuery
+		return
+	}
+}
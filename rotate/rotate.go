@@ -0,0 +1,359 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package rotate 按大小和时间切割的日志文件, 支持压缩和保留策略
+//
+//	w, err := rotate.New("/var/log/goproxy/access.log",
+//		rotate.WithMaxSize(100<<20), rotate.WithInterval(24*time.Hour),
+//		rotate.WithCompress(), rotate.WithMaxBackups(30))
+//	proxy := goproxy.New(goproxy.WithAccessLog(w, goproxy.AccessLogJSON))
+package rotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 切割后文件名中的时间格式
+const backupTimeFormat = "20060102-150405"
+
+type options struct {
+	maxSize    int64
+	interval   time.Duration
+	compress   bool
+	maxBackups int
+	maxAge     time.Duration
+	perm       os.FileMode
+}
+
+type Option func(*options)
+
+// WithMaxSize 文件超过maxSize字节时切割, 为0不按大小切割
+func WithMaxSize(maxSize int64) Option {
+	return func(opt *options) {
+		opt.maxSize = maxSize
+	}
+}
+
+// WithInterval 按时间间隔切割, 以本地时间对齐, 如24小时在每天零点切割
+func WithInterval(d time.Duration) Option {
+	return func(opt *options) {
+		opt.interval = d
+	}
+}
+
+// WithCompress 切割后的文件使用gzip压缩
+func WithCompress() Option {
+	return func(opt *options) {
+		opt.compress = true
+	}
+}
+
+// WithMaxBackups 最多保留的切割文件数, 为0不限制
+func WithMaxBackups(n int) Option {
+	return func(opt *options) {
+		opt.maxBackups = n
+	}
+}
+
+// WithMaxAge 切割文件最长保留时间, 为0不限制
+func WithMaxAge(d time.Duration) Option {
+	return func(opt *options) {
+		opt.maxAge = d
+	}
+}
+
+// WithPerm 新建文件的权限, 默认0644
+func WithPerm(perm os.FileMode) Option {
+	return func(opt *options) {
+		opt.perm = perm
+	}
+}
+
+// Writer 自动切割的日志文件, 并发安全
+type Writer struct {
+	path string
+	opts *options
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	deadline time.Time
+	// 压缩和清理在后台串行执行
+	cleanup chan struct{}
+	done    chan struct{}
+}
+
+var _ io.WriteCloser = &Writer{}
+
+// New 打开日志文件, 文件已存在时追加
+func New(path string, opt ...Option) (*Writer, error) {
+	opts := &options{perm: 0644}
+	for _, o := range opt {
+		o(opts)
+	}
+	w := &Writer{
+		path:    path,
+		opts:    opts,
+		cleanup: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.cleanupLoop()
+	w.scheduleCleanup()
+
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, w.opts.perm)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	if w.opts.interval > 0 {
+		w.deadline = nextDeadline(time.Now(), w.opts.interval)
+	}
+
+	return nil
+}
+
+// nextDeadline 下一个按本地时间对齐的切割时间
+func nextDeadline(now time.Time, interval time.Duration) time.Time {
+	_, offset := now.Zone()
+	shift := time.Duration(offset) * time.Second
+
+	return now.Add(shift).Truncate(interval).Add(interval).Add(-shift)
+}
+
+// Write 写入数据, 需要时先切割
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+func (w *Writer) shouldRotate(n int64) bool {
+	if w.opts.maxSize > 0 && w.size > 0 && w.size+n > w.opts.maxSize {
+		return true
+	}
+
+	return !w.deadline.IsZero() && !time.Now().Before(w.deadline)
+}
+
+// Rotate 立即切割, 如收到SIGHUP时调用
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+
+	return w.rotate()
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	backup := w.backupName(time.Now())
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.scheduleCleanup()
+
+	return nil
+}
+
+// backupName 如access.log切割为access-20060102-150405.log, 同一秒内重复切割时追加序号
+func (w *Writer) backupName(t time.Time) string {
+	dir, ext := filepath.Dir(w.path), filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(filepath.Base(w.path), ext)
+	name := filepath.Join(dir, fmt.Sprintf("%s-%s%s", prefix, t.Format(backupTimeFormat), ext))
+	for i := 1; ; i++ {
+		if !exists(name) && !exists(name+".gz") {
+			return name
+		}
+		name = filepath.Join(dir, fmt.Sprintf("%s-%s.%d%s", prefix, t.Format(backupTimeFormat), i, ext))
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+
+	return err == nil
+}
+
+func (w *Writer) scheduleCleanup() {
+	select {
+	case w.cleanup <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Writer) cleanupLoop() {
+	for {
+		select {
+		case <-w.cleanup:
+			w.compressAndRemove()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+type backup struct {
+	path string
+	time time.Time
+	seq  int
+}
+
+// backups 按时间从新到旧返回切割文件
+func (w *Writer) backups() []backup {
+	dir, ext := filepath.Dir(w.path), filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(filepath.Base(w.path), ext) + "-"
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var list []backup
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		ts := strings.TrimPrefix(name, prefix)
+		if len(ts) < len(backupTimeFormat) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, ts[:len(backupTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		// 同一秒内切割的序号, 如access-20060102-150405.1.log
+		seq := 0
+		if rest := ts[len(backupTimeFormat):]; strings.HasPrefix(rest, ".") {
+			fmt.Sscanf(rest[1:], "%d", &seq)
+		}
+		list = append(list, backup{path: filepath.Join(dir, name), time: t, seq: seq})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].time.Equal(list[j].time) {
+			return list[i].seq > list[j].seq
+		}
+		return list[i].time.After(list[j].time)
+	})
+
+	return list
+}
+
+func (w *Writer) compressAndRemove() {
+	list := w.backups()
+	var kept []backup
+	for i, b := range list {
+		expired := w.opts.maxAge > 0 && time.Since(b.time) > w.opts.maxAge
+		if expired || (w.opts.maxBackups > 0 && i >= w.opts.maxBackups) {
+			os.Remove(b.path)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	if !w.opts.compress {
+		return
+	}
+	for _, b := range kept {
+		if strings.HasSuffix(b.path, ".gz") {
+			continue
+		}
+		if err := compressFile(b.path); err == nil {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// compressFile 先写临时文件, 完成后再重命名
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path+".gz")
+}
+
+// Close 关闭文件
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	close(w.done)
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RouteRule 路由规则, 修改请求的目标域名、端口和path, 或返回重定向
+type RouteRule struct {
+	// Host 匹配请求的域名, 支持*.example.com, 为空时匹配所有域名
+	Host string `json:"host,omitempty"`
+	// Port 匹配请求的端口, 0匹配所有端口
+	Port int `json:"port,omitempty"`
+	// PathPrefix 匹配path前缀, CONNECT隧道没有path, 设置PathPrefix的规则不匹配隧道
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// To 新的目标地址, 格式为host、host:port或:port, 不带端口时保留原端口, 为空时不修改
+	To string `json:"to,omitempty"`
+	// RewritePath 替换PathPrefix匹配的部分, 如PathPrefix为/api/、RewritePath为/时/api/users改为/users, 为空时不修改path
+	RewritePath string `json:"rewrite_path,omitempty"`
+	// PreserveHost 保留原Host header, 默认Host header与新的目标地址一致
+	PreserveHost bool `json:"preserve_host,omitempty"`
+	// Redirect 重定向状态码(301、302、307、308), 不转发请求, 返回重定向到新地址, 不适用于CONNECT隧道
+	Redirect int `json:"redirect,omitempty"`
+}
+
+// RouteTable 路由表, 按顺序匹配第一条规则, 并发安全, 可在运行时修改
+type RouteTable struct {
+	mu    sync.RWMutex
+	rules []RouteRule
+}
+
+// NewRouteTable 创建路由表
+func NewRouteTable(rules ...RouteRule) *RouteTable {
+	t := &RouteTable{}
+	t.SetRules(rules)
+
+	return t
+}
+
+// LoadRouteTable 从r读取JSON格式的规则数组
+func LoadRouteTable(r io.Reader) (*RouteTable, error) {
+	t := &RouteTable{}
+	if err := t.Load(r); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Load 从r读取JSON格式的规则数组, 替换所有规则, 读取失败时保留原规则
+func (t *RouteTable) Load(r io.Reader) error {
+	var rules []RouteRule
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return fmt.Errorf("解析路由规则错误: %s", err)
+	}
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("第%d条路由规则错误: %s", i+1, err)
+		}
+	}
+	t.SetRules(rules)
+
+	return nil
+}
+
+// SetRules 替换所有规则
+func (t *RouteTable) SetRules(rules []RouteRule) {
+	rules = append([]RouteRule(nil), rules...)
+	t.mu.Lock()
+	t.rules = rules
+	t.mu.Unlock()
+}
+
+// Rules 返回当前规则的副本
+func (t *RouteTable) Rules() []RouteRule {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return append([]RouteRule(nil), t.rules...)
+}
+
+// WithRoutes 按路由表修改请求目标, 在Host和URL重写规则之前应用
+// HTTP请求(包括HTTPS解密后的请求)修改URL, CONNECT隧道修改连接的目标地址
+func WithRoutes(table *RouteTable) Option {
+	return func(opt *options) {
+		opt.routes = table
+	}
+}
+
+func (r *RouteRule) validate() error {
+	if r.Redirect != 0 && (r.Redirect < 300 || r.Redirect > 399) {
+		return fmt.Errorf("无效的重定向状态码: %d", r.Redirect)
+	}
+	if r.To == "" {
+		return nil
+	}
+	if strings.HasPrefix(r.To, ":") {
+		if _, err := strconv.ParseUint(r.To[1:], 10, 16); err != nil {
+			return fmt.Errorf("无效的目标端口: %s", r.To)
+		}
+	}
+
+	return nil
+}
+
+// match 返回第一条匹配的规则
+func (t *RouteTable) match(method, host, path string) (RouteRule, bool) {
+	port, _ := strconv.Atoi(portOf(host, "0"))
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, rule := range t.rules {
+		if rule.Host != "" && !matchHost(rule.Host, host) {
+			continue
+		}
+		if rule.Port != 0 && rule.Port != port {
+			continue
+		}
+		if rule.PathPrefix != "" && (method == http.MethodConnect || !strings.HasPrefix(path, rule.PathPrefix)) {
+			continue
+		}
+		return rule, true
+	}
+
+	return RouteRule{}, false
+}
+
+// target 新的目标地址, addr为原地址
+func (r *RouteRule) target(addr string) string {
+	switch {
+	case r.To == "":
+		return addr
+	case strings.HasPrefix(r.To, ":"):
+		return net.JoinHostPort(hostname(addr), r.To[1:])
+	}
+	if _, _, err := net.SplitHostPort(r.To); err == nil {
+		return r.To
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(hostname(r.To), port)
+	}
+	if ip := net.ParseIP(r.To); ip != nil && ip.To4() == nil {
+		return "[" + r.To + "]"
+	}
+
+	return r.To
+}
+
+// route 应用路由规则, 需要重定向时返回重定向响应
+func (p *Proxy) route(ctx *Context) *http.Response {
+	routes := p.runtime().routes
+	if routes == nil {
+		return nil
+	}
+	req := ctx.Req
+	addr := req.URL.Host
+	if req.Method != http.MethodConnect {
+		addr = ensurePort(addr, defaultPort(req.URL.Scheme))
+	}
+	rule, ok := routes.match(req.Method, addr, req.URL.Path)
+	if !ok {
+		return nil
+	}
+	if req.Method == http.MethodConnect {
+		if rule.Redirect == 0 {
+			req.URL.Host = rule.target(req.URL.Host)
+			req.Host = req.URL.Host
+		}
+		return nil
+	}
+	u := *req.URL
+	u.Host = rule.target(req.URL.Host)
+	if rule.PathPrefix != "" && rule.RewritePath != "" {
+		u.Path = rule.RewritePath + strings.TrimPrefix(u.Path, rule.PathPrefix)
+		u.RawPath = ""
+	}
+	if rule.Redirect != 0 {
+		return &http.Response{
+			StatusCode: rule.Redirect,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Location": {u.String()}},
+			Body:       http.NoBody,
+			Request:    req,
+		}
+	}
+	*req.URL = u
+	if !rule.PreserveHost {
+		req.Host = u.Host
+	}
+
+	return nil
+}
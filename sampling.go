@@ -0,0 +1,310 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSampleBodySize      = 1 << 20
+	defaultSampleMaxConcurrent = 16
+)
+
+// Capture 采样请求的完整记录, 包括请求和响应的header、body
+type Capture struct {
+	Time time.Time `json:"time"`
+	// Duration 从开始处理请求到响应body关闭的耗时
+	Duration time.Duration `json:"-"`
+	// Timing 连接目标服务器和等待响应的耗时
+	Timing        Timing      `json:"-"`
+	RequestID     string      `json:"request_id,omitempty"`
+	ClientIP      string      `json:"client_ip"`
+	User          string      `json:"user,omitempty"`
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Proto         string      `json:"proto,omitempty"`
+	RequestHeader http.Header `json:"request_header"`
+	// RequestBody 发送到目标服务器的body(经过请求body转换), 超过MaxBodySize的部分丢弃
+	RequestBody      []byte `json:"request_body,omitempty"`
+	RequestTruncated bool   `json:"request_truncated,omitempty"`
+	// Status 目标服务器的状态码, 请求失败时为0
+	Status         int         `json:"status"`
+	ResponseProto  string      `json:"response_proto,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	// ResponseBody 响应body(经过响应body转换, 压缩前), 超过MaxBodySize的部分丢弃
+	ResponseBody      []byte `json:"response_body,omitempty"`
+	ResponseTruncated bool   `json:"response_truncated,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+// MarshalJSON 耗时以毫秒输出
+func (c *Capture) MarshalJSON() ([]byte, error) {
+	type capture Capture
+	return json.Marshal(&struct {
+		*capture
+		DurationMs float64 `json:"duration_ms"`
+	}{
+		capture:    (*capture)(c),
+		DurationMs: float64(c.Duration) / float64(time.Millisecond),
+	})
+}
+
+// CaptureSink 接收采样记录, 在响应body关闭时同步调用, 应尽快返回
+type CaptureSink interface {
+	Capture(c *Capture)
+}
+
+// CaptureSinkFunc 函数形式的CaptureSink
+type CaptureSinkFunc func(c *Capture)
+
+func (f CaptureSinkFunc) Capture(c *Capture) {
+	f(c)
+}
+
+// NewJSONCaptureSink 每条记录一行JSON写入w, body以base64编码
+func NewJSONCaptureSink(w io.Writer) CaptureSink {
+	return &jsonCaptureSink{w: w}
+}
+
+type jsonCaptureSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *jsonCaptureSink) Capture(c *Capture) {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	s.w.Write(line)
+	s.mu.Unlock()
+}
+
+// SampleMatcher 返回true的请求总是采样(仍受MaxConcurrent限制), 在BeforeRequest之前调用
+type SampleMatcher func(ctx *Context) bool
+
+// SampleHosts 匹配指定域名的请求, 规则同MatchHost
+func SampleHosts(patterns ...string) SampleMatcher {
+	return func(ctx *Context) bool {
+		for _, pattern := range patterns {
+			if matchHost(pattern, ctx.Req.URL.Host) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SamplingConfig 流量采样配置
+type SamplingConfig struct {
+	// Rate 随机采样的比例, 0到1之间
+	Rate float64
+	// Matchers 匹配任一规则的请求总是采样
+	Matchers []SampleMatcher
+	// MaxBodySize 请求和响应body各自最多记录的字节数, 默认1MB
+	MaxBodySize int64
+	// MaxConcurrent 同时采样的请求数上限, 默认16, 超过时不采样, 用于限制内存占用
+	MaxConcurrent int
+	// Sink 接收采样记录, 为nil时只设置Context.Sampled, 由Delegate自行处理
+	Sink CaptureSink
+}
+
+// WithTrafficSampling 流量采样, 按比例或规则选出部分HTTP请求(包括HTTPS解密后的请求)完整记录请求和响应,
+// 其余请求只做计数统计, 被采样的请求在BeforeRequest之前设置Context.Sampled,
+// Delegate和body转换可据此只对采样请求执行开销较大的处理
+func WithTrafficSampling(config SamplingConfig) Option {
+	return func(opt *options) {
+		opt.sampling = &config
+	}
+}
+
+type sampler struct {
+	config SamplingConfig
+	// 可用的采样名额
+	slots   chan struct{}
+	sampled int64
+	dropped int64
+}
+
+func newSampler(config SamplingConfig) *sampler {
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultSampleBodySize
+	}
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = defaultSampleMaxConcurrent
+	}
+
+	return &sampler{
+		config: config,
+		slots:  make(chan struct{}, config.MaxConcurrent),
+	}
+}
+
+// start 判断是否采样, 采样时设置ctx.Sampled并返回记录, 否则返回nil
+func (s *sampler) start(ctx *Context) *sampleCapture {
+	if !s.match(ctx) {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return nil
+	}
+	atomic.AddInt64(&s.sampled, 1)
+	ctx.Sampled = true
+	req := ctx.Req
+	c := &sampleCapture{
+		sampler: s,
+		start:   time.Now(),
+		capture: Capture{
+			RequestID: ctx.RequestID,
+			User:      ctx.User,
+			Method:    req.Method,
+			URL:       req.URL.String(),
+			ClientIP:  req.RemoteAddr,
+		},
+	}
+	c.capture.Time = c.start
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		c.capture.ClientIP = ip
+	}
+
+	return c
+}
+
+func (s *sampler) match(ctx *Context) bool {
+	for _, m := range s.config.Matchers {
+		if m(ctx) {
+			return true
+		}
+	}
+
+	return s.config.Rate > 0 && rand.Float64() < s.config.Rate
+}
+
+// sampleCapture 一次采样, 响应body关闭或DoRequest结束时输出记录并释放名额
+type sampleCapture struct {
+	sampler  *sampler
+	start    time.Time
+	capture  Capture
+	reqBody  *captureBuffer
+	respBody *captureBuffer
+	// 是否由响应body关闭时结束
+	pending bool
+	once    sync.Once
+}
+
+// request 记录请求header, 并在body被读取时记录内容
+func (c *sampleCapture) request(req *http.Request) {
+	c.capture.Proto = req.Proto
+	c.capture.RequestHeader = CloneHeader(req.Header)
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	c.reqBody = &captureBuffer{limit: c.sampler.config.MaxBodySize}
+	req.Body = &captureReader{rc: req.Body, buf: c.reqBody}
+}
+
+// response 记录响应, err不为nil时立即结束, 否则在响应body关闭时结束
+func (c *sampleCapture) response(ctx *Context, resp *http.Response, err error) {
+	c.capture.Timing = ctx.Timing
+	if err != nil {
+		c.capture.Error = err.Error()
+		return
+	}
+	c.capture.Status = resp.StatusCode
+	c.capture.ResponseProto = resp.Proto
+	c.capture.ResponseHeader = CloneHeader(resp.Header)
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	c.pending = true
+	c.respBody = &captureBuffer{limit: c.sampler.config.MaxBodySize}
+	resp.Body = &captureReader{rc: resp.Body, buf: c.respBody, done: c.finish}
+}
+
+// end DoRequest结束时调用, 响应body仍在读取时等待关闭
+func (c *sampleCapture) end() {
+	if !c.pending {
+		c.finish()
+	}
+}
+
+func (c *sampleCapture) finish() {
+	c.once.Do(func() {
+		<-c.sampler.slots
+		c.capture.Duration = time.Since(c.start)
+		if c.reqBody != nil {
+			c.capture.RequestBody, c.capture.RequestTruncated = c.reqBody.Bytes(), c.reqBody.truncated
+		}
+		if c.respBody != nil {
+			c.capture.ResponseBody, c.capture.ResponseTruncated = c.respBody.Bytes(), c.respBody.truncated
+		}
+		if c.sampler.config.Sink != nil {
+			c.sampler.config.Sink.Capture(&c.capture)
+		}
+	})
+}
+
+// captureBuffer 最多保存limit字节
+type captureBuffer struct {
+	bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (b *captureBuffer) write(p []byte) {
+	if n := b.limit - int64(b.Len()); int64(len(p)) > n {
+		p = p[:n]
+		b.truncated = true
+	}
+	b.Write(p)
+}
+
+type captureReader struct {
+	rc   io.ReadCloser
+	buf  *captureBuffer
+	done func()
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if n > 0 {
+		r.buf.write(p[:n])
+	}
+
+	return n, err
+}
+
+func (r *captureReader) Close() error {
+	err := r.rc.Close()
+	if r.done != nil {
+		r.done()
+	}
+
+	return err
+}
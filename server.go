@@ -0,0 +1,270 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ListenerKind Server监听的协议
+type ListenerKind int
+
+const (
+	// ListenerHTTP 普通HTTP代理
+	ListenerHTTP ListenerKind = iota
+	// ListenerTLS 客户端通过TLS连接代理, 同ListenAndServeTLS
+	ListenerTLS
+	// ListenerSOCKS5 SOCKS5代理, 同ServeSOCKS5
+	ListenerSOCKS5
+)
+
+// ListenerConfig Server的一个监听及其策略, 策略为空时使用Proxy的配置
+type ListenerConfig struct {
+	// Name 监听名称, 设置到Context.Listener, 用于Delegate区分请求来源
+	Name string
+	// Addr 监听地址, 如":8080"
+	Addr string
+	// Listener 已有的监听, 不为nil时忽略Addr, 如NewProxyProtocolListener
+	Listener net.Listener
+	Kind     ListenerKind
+	// CertFile、KeyFile ListenerTLS使用的证书
+	CertFile string
+	KeyFile  string
+	// Delegate 该监听的请求使用的Delegate, 为nil时使用WithDelegate
+	// ErrorLog和CircuitStateChanged与请求无关, 总是使用WithDelegate
+	Delegate Delegate
+	// AuthRealm、Auth 该监听的Basic认证, 同WithBasicAuth, Auth为nil时使用WithBasicAuth
+	AuthRealm string
+	Auth      BasicAuthFunc
+	// ACL 该监听的访问控制, 为nil时使用WithACL或配置文件中的ACL
+	ACL *ACLConfig
+}
+
+// listenerPolicy 监听的策略, 通过请求的context传递到Context
+type listenerPolicy struct {
+	name      string
+	delegate  Delegate
+	basicAuth *basicAuth
+	acl       *acl
+}
+
+type listenerKey struct{}
+
+func listenerOf(c context.Context) *listenerPolicy {
+	l, _ := c.Value(listenerKey{}).(*listenerPolicy)
+	return l
+}
+
+// delegateOf 请求所在监听的Delegate
+func (p *Proxy) delegateOf(ctx *Context) Delegate {
+	if ctx != nil && ctx.listener != nil && ctx.listener.delegate != nil {
+		return ctx.listener.delegate
+	}
+
+	return p.delegate
+}
+
+// basicAuthOf 请求所在监听的Basic认证
+func (p *Proxy) basicAuthOf(l *listenerPolicy) *basicAuth {
+	if l != nil && l.basicAuth != nil {
+		return l.basicAuth
+	}
+
+	return p.basicAuth
+}
+
+// Server 在多个监听上运行同一个Proxy, 如:8080 HTTP、:8443 TLS、:1080 SOCKS5
+// 各监听可使用不同的Delegate、认证和ACL, transport、连接池、统计、配额等与Proxy共享, 通过Shutdown统一停止
+type Server struct {
+	proxy     *Proxy
+	listeners []*serverListener
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type serverListener struct {
+	config ListenerConfig
+	policy *listenerPolicy
+	ln     net.Listener
+	// SOCKS5监听为nil
+	server *http.Server
+}
+
+// NewServer 创建使用p处理请求的Server, 调用ListenAndServe开始监听
+func NewServer(p *Proxy, listeners ...ListenerConfig) *Server {
+	s := &Server{proxy: p}
+	for _, config := range listeners {
+		l := &serverListener{
+			config: config,
+			policy: &listenerPolicy{name: config.Name, delegate: config.Delegate},
+			ln:     config.Listener,
+		}
+		if config.Auth != nil {
+			l.policy.basicAuth = &basicAuth{realm: config.AuthRealm, validate: config.Auth}
+		}
+		if config.ACL != nil {
+			l.policy.acl = newACL(*config.ACL)
+		}
+		base := func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerKey{}, l.policy)
+		}
+		switch config.Kind {
+		case ListenerHTTP:
+			l.server = &http.Server{Handler: p, BaseContext: base}
+		case ListenerTLS:
+			l.server = p.tlsServer()
+			l.server.BaseContext = base
+		}
+		s.listeners = append(s.listeners, l)
+	}
+
+	return s
+}
+
+// ListenAndServe 监听所有地址并处理请求, 任一地址监听失败时关闭已有监听并返回错误
+// 任一监听出错时关闭其他监听并返回该错误, 调用Shutdown或Close后返回http.ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+	errc := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		go func(l *serverListener) {
+			errc <- s.serve(l)
+		}(l)
+	}
+	err := <-errc
+	if s.isClosed() {
+		return http.ErrServerClosed
+	}
+	s.closeListeners()
+
+	return err
+}
+
+func (s *Server) listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return http.ErrServerClosed
+	}
+	for i, l := range s.listeners {
+		if l.ln != nil {
+			continue
+		}
+		ln, err := net.Listen("tcp", l.config.Addr)
+		if err != nil {
+			for _, opened := range s.listeners[:i] {
+				if opened.config.Listener == nil {
+					opened.ln.Close()
+					opened.ln = nil
+				}
+			}
+			return fmt.Errorf("监听%s失败: %w", l.config.Addr, err)
+		}
+		l.ln = ln
+	}
+
+	return nil
+}
+
+func (s *Server) serve(l *serverListener) error {
+	switch l.config.Kind {
+	case ListenerHTTP:
+		return l.server.Serve(s.proxy.LimitListener(l.ln))
+	case ListenerTLS:
+		return l.server.ServeTLS(s.proxy.limitListener(l.ln, false), l.config.CertFile, l.config.KeyFile)
+	case ListenerSOCKS5:
+		return s.proxy.serveSOCKS5(l.ln, l.policy)
+	}
+
+	return fmt.Errorf("监听%s: 不支持的类型%d", l.config.Name, l.config.Kind)
+}
+
+// Addrs 各监听的地址, 顺序与NewServer的参数相同, 未开始监听时为nil
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		if l.ln != nil {
+			addrs[i] = l.ln.Addr()
+		}
+	}
+
+	return addrs
+}
+
+// Shutdown 停止所有监听, 等待正在处理的请求、隧道和HTTPS解密连接结束, 见Proxy.Shutdown
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.markClosed()
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.listeners)+1)
+	for i, l := range s.listeners {
+		if l.server == nil {
+			if l.ln != nil {
+				l.ln.Close()
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, server *http.Server) {
+			defer wg.Done()
+			errs[i] = server.Shutdown(ctx)
+		}(i, l.server)
+	}
+	errs[len(s.listeners)] = s.proxy.Shutdown(ctx)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Close 关闭所有监听和连接, 见Proxy.Close
+func (s *Server) Close() error {
+	s.markClosed()
+	s.closeListeners()
+
+	return s.proxy.Close()
+}
+
+func (s *Server) markClosed() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		if l.server != nil {
+			l.server.Close()
+		}
+		if l.ln != nil {
+			l.ln.Close()
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 签名时缓存请求body的上限
+const maxSignBodySize = 10 << 20
+
+// RequestSigner 发送到目标服务器前对请求签名, 如设置Authorization
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// RequestSignerFunc 函数形式的RequestSigner
+type RequestSignerFunc func(req *http.Request) error
+
+// Sign 实现RequestSigner接口
+func (f RequestSignerFunc) Sign(req *http.Request) error {
+	return f(req)
+}
+
+// SigningRule 签名规则
+type SigningRule struct {
+	// Host 匹配目标域名, 支持*.example.com
+	Host   string
+	Signer RequestSigner
+}
+
+// WithRequestSigners 按目标域名对转发的请求签名, 按顺序匹配第一条规则, 客户端无需持有凭证
+// 在请求body转换之后执行, 重定向后的请求重新签名, 签名失败时返回502
+func WithRequestSigners(rules ...SigningRule) Option {
+	return func(opt *options) {
+		opt.signingRules = append(opt.signingRules, rules...)
+	}
+}
+
+// signRequest 应用第一条匹配的签名规则
+func (p *Proxy) signRequest(req *http.Request) error {
+	for _, rule := range p.signingRules {
+		if matchHost(rule.Host, req.URL.Host) {
+			if err := rule.Signer.Sign(req); err != nil {
+				return fmt.Errorf("请求签名失败: %s", err)
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// BufferBody 读取请求body并替换为可重复读取的body, 用于需要对body签名的RequestSigner
+// body超过10MB时返回ErrBodyTooLarge
+func BufferBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignBodySize+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+
+	return body, nil
+}
+
+// requestHost 请求的Host, 未设置时使用URL中的域名
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+
+	return req.URL.Host
+}
+
+// uriEncode RFC 3986编码, 只保留非保留字符
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// SigV4Signer AWS Signature Version 4签名
+type SigV4Signer struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken 临时凭证的token, 设置到X-Amz-Security-Token
+	SessionToken string
+	Region       string
+	Service      string
+	// UnsignedPayload 不计算body的哈希, 用于S3上传大文件
+	UnsignedPayload bool
+	// SignHeaders 额外参与签名的头, 如Range, 默认只签名host、content-type、content-md5和x-amz-*
+	SignHeaders []string
+	// Now 用于测试, 默认time.Now
+	Now func() time.Time
+}
+
+var _ RequestSigner = &SigV4Signer{}
+
+// Sign 实现RequestSigner接口
+func (s *SigV4Signer) Sign(req *http.Request) error {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := "UNSIGNED-PAYLOAD"
+	if !s.UnsignedPayload {
+		body, err := BufferBody(req)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	extra := make(map[string]bool, len(s.SignHeaders))
+	for _, h := range s.SignHeaders {
+		extra[strings.ToLower(h)] = true
+	}
+	headers := map[string]string{"host": requestHost(req)}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "content-md5" || strings.HasPrefix(lower, "x-amz-") || extra[lower] {
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			headers[lower] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if s.Service != "s3" {
+		// 除S3外路径需要编码两次
+		path = uriEncode(path, false)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+
+	return nil
+}
+
+// canonicalQuery 按key和value排序并编码
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// HMACSigner 使用HMAC-SHA256的HTTP Signatures签名(draft-cavage-http-signatures)
+// 设置Date、Digest和Signature头
+type HMACSigner struct {
+	KeyID  string
+	Secret []byte
+	// Headers 参与签名的头, 默认(request-target) host date digest
+	Headers []string
+	// Now 用于测试, 默认time.Now
+	Now func() time.Time
+}
+
+var _ RequestSigner = &HMACSigner{}
+
+// Sign 实现RequestSigner接口
+func (s *HMACSigner) Sign(req *http.Request) error {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	body, err := BufferBody(req)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	if req.Header.Get("Date") == "" {
+		req.Header.Set("Date", now().UTC().Format(http.TimeFormat))
+	}
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	if len(s.Headers) > 0 {
+		headers = append([]string(nil), s.Headers...)
+	}
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		h = strings.ToLower(h)
+		headers[i] = h
+		switch h {
+		case "(request-target)":
+			lines[i] = h + ": " + strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			lines[i] = h + ": " + requestHost(req)
+		default:
+			lines[i] = h + ": " + strings.Join(req.Header.Values(h), ", ")
+		}
+	}
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(s.Secret, strings.Join(lines, "\n")))
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="hmac-sha256",headers="%s",signature="%s"`,
+		s.KeyID, strings.Join(headers, " "), signature))
+
+	return nil
+}
+
+// OAuth1Signer OAuth 1.0a HMAC-SHA1签名(RFC 5849), 设置Authorization
+type OAuth1Signer struct {
+	ConsumerKey    string
+	ConsumerSecret string
+	Token          string
+	TokenSecret    string
+	// Now 用于测试, 默认time.Now
+	Now func() time.Time
+	// Nonce 用于测试, 默认随机生成
+	Nonce func() string
+}
+
+var _ RequestSigner = &OAuth1Signer{}
+
+// Sign 实现RequestSigner接口
+func (s *OAuth1Signer) Sign(req *http.Request) error {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	nonce := s.Nonce
+	if nonce == nil {
+		nonce = func() string {
+			b := make([]byte, 16)
+			rand.Read(b)
+			return hex.EncodeToString(b)
+		}
+	}
+	oauth := map[string]string{
+		"oauth_consumer_key":     s.ConsumerKey,
+		"oauth_nonce":            nonce(),
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        strconv.FormatInt(now().Unix(), 10),
+		"oauth_version":          "1.0",
+	}
+	if s.Token != "" {
+		oauth["oauth_token"] = s.Token
+	}
+	params := req.URL.Query()
+	for k, v := range oauth {
+		params.Add(k, v)
+	}
+	// application/x-www-form-urlencoded的body参与签名
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		body, err := BufferBody(req)
+		if err != nil {
+			return err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		for k, values := range form {
+			for _, v := range values {
+				params.Add(k, v)
+			}
+		}
+	}
+	host := strings.ToLower(requestHost(req))
+	scheme := strings.ToLower(req.URL.Scheme)
+	if scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	} else if scheme == "https" {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	baseURL := scheme + "://" + host + path
+	base := req.Method + "&" + uriEncode(baseURL, true) + "&" + uriEncode(canonicalQuery(params), true)
+	key := uriEncode(s.ConsumerSecret, true) + "&" + uriEncode(s.TokenSecret, true)
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(base))
+	oauth["oauth_signature"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	names := make([]string, 0, len(oauth))
+	for k := range oauth {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, uriEncode(k, true), uriEncode(oauth[k], true))
+	}
+	req.Header.Set("Authorization", "OAuth "+strings.Join(pairs, ", "))
+
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultSNITimeout = 10 * time.Second
+
+// SNIAction SNI路由规则的处理方式
+type SNIAction int
+
+const (
+	// SNIRouteDefault 以SNI作为域名调用Delegate.ParentProxy
+	SNIRouteDefault SNIAction = iota
+	// SNIRouteDirect 直连
+	SNIRouteDirect
+	// SNIRouteParent 使用SNIRule.Parent
+	SNIRouteParent
+	// SNIRouteBlock 关闭连接
+	SNIRouteBlock
+)
+
+// SNIRule SNI路由规则
+type SNIRule struct {
+	// Match 匹配SNI, 支持*.example.com
+	Match  string
+	Action SNIAction
+	// Parent 上级代理, Action为SNIRouteParent时使用
+	Parent *url.URL
+}
+
+// WithSNIRouting 隧道转发(未开启HTTPS解密)时, 先通知客户端隧道已建立, 读取客户端ClientHello中的SNI和ALPN,
+// 再按SNI选择上级代理、直连或拦截, Delegate.RouteSNI优先, 其次按顺序匹配第一条规则, 没有匹配的规则时以SNI作为域名调用Delegate.ParentProxy
+// 客户端发送的不是TLS或没有SNI时按CONNECT地址处理
+// 用于CONNECT目标为共享IP或CDN地址时仍能按网站路由
+func WithSNIRouting(rules ...SNIRule) Option {
+	return func(opt *options) {
+		opt.sniRouting = true
+		opt.sniRules = append(opt.sniRules, rules...)
+	}
+}
+
+var errClientHelloRead = errors.New("ClientHello已读取")
+
+// sniffConn 只读取数据, 用于解析ClientHello
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// replayConn 先返回已读取的数据
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// sniffClientHello 读取并解析ClientHello, 返回的连接会重新发送已读取的数据
+func sniffClientHello(conn net.Conn, timeout time.Duration) (*tls.ClientHelloInfo, net.Conn, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	err := tls.Server(&sniffConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	replay := &replayConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+	if hello == nil {
+		return nil, replay, err
+	}
+
+	return hello, replay, nil
+}
+
+// routeBySNI 通知客户端隧道已建立后按SNI选择上级代理
+// resolved为false时按CONNECT地址选择, ok为false时关闭连接
+func (p *Proxy) routeBySNI(ctx *Context, clientConn net.Conn) (conn net.Conn, parent *url.URL, resolved bool, ok bool) {
+	if err := ctx.writeTunnelEstablished(clientConn); err != nil {
+		p.recordError(ctx, ErrorClassClient, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - 隧道通知客户端错误: %s", ctx.Req.URL.Host, err))
+		return nil, nil, false, false
+	}
+	ctx.status = http.StatusOK
+	hello, conn, err := sniffClientHello(clientConn, defaultSNITimeout)
+	if err != nil && isTimeout(err) {
+		p.recordError(ctx, ErrorClassClient, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - 读取ClientHello超时", ctx.Req.URL.Host))
+		return nil, nil, false, false
+	}
+	if hello == nil {
+		return conn, nil, false, true
+	}
+	ctx.SNI = hello.ServerName
+	ctx.ALPN = hello.SupportedProtos
+	rule := p.callRouteSNI(ctx)
+	if rule == nil && ctx.SNI != "" {
+		rule = p.sniRule(ctx.SNI)
+	}
+	if rule != nil {
+		switch rule.Action {
+		case SNIRouteDirect:
+			return conn, nil, true, true
+		case SNIRouteParent:
+			return conn, rule.Parent, true, true
+		case SNIRouteBlock:
+			ctx.status = http.StatusForbidden
+			host := ctx.SNI
+			if host == "" {
+				host = ctx.Req.URL.Host
+			}
+			ctx.ReportPolicyEvent(&PolicyEvent{
+				Type:   PolicyEventBlocked,
+				Host:   host,
+				Status: http.StatusForbidden,
+				Reason: "SNI规则拦截",
+			})
+			return nil, nil, false, false
+		}
+	}
+	if ctx.SNI == "" {
+		return conn, nil, false, true
+	}
+	if p.runtime().upstreams != nil {
+		// 由上级代理池选择
+		return conn, nil, false, true
+	}
+	req := new(http.Request)
+	*req = *ctx.Req
+	req.URL = &url.URL{Host: net.JoinHostPort(ctx.SNI, portOf(ctx.Req.URL.Host, "443"))}
+	req.Host = req.URL.Host
+	parent, err = p.callParentProxy(req)
+	if err != nil {
+		p.recordError(ctx, ErrorClassParent, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - SNI %s 解析代理地址错误: %s", ctx.Req.URL.Host, ctx.SNI, err))
+		return nil, nil, false, false
+	}
+
+	return conn, parent, true, true
+}
+
+func (p *Proxy) sniRule(serverName string) *SNIRule {
+	for i := range p.sniRules {
+		if matchHost(p.sniRules[i].Match, serverName) {
+			return &p.sniRules[i]
+		}
+	}
+
+	return nil
+}
+
+func portOf(addr, defaultPort string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return port
+	}
+
+	return defaultPort
+}
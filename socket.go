@@ -0,0 +1,131 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SocketOptions 隧道客户端连接和目标服务器连接的TCP参数, 零值字段使用系统或Go的默认值
+// 经过NAT、防火墙的长时间空闲隧道可设置KeepAlive、UserTimeout及时探测和清理失效连接
+type SocketOptions struct {
+	// KeepAlive TCP keep-alive探测间隔, 小于0时关闭keep-alive
+	KeepAlive time.Duration
+	// DisableNoDelay 关闭TCP_NODELAY, 小数据包合并发送
+	DisableNoDelay bool
+	// ReadBuffer 套接字接收缓冲区大小, 字节
+	ReadBuffer int
+	// WriteBuffer 套接字发送缓冲区大小, 字节
+	WriteBuffer int
+	// UserTimeout TCP_USER_TIMEOUT, 已发送的数据超过该时间未被确认时关闭连接, 只在Linux上生效
+	UserTimeout time.Duration
+}
+
+// WithTunnelSocketOptions 隧道转发(未解密的CONNECT)连接的TCP参数, 可通过Context.TunnelSocket按请求覆盖
+// 经过SSH上级代理的连接和HTTP/2的CONNECT不是TCP连接, 只设置另一端
+func WithTunnelSocketOptions(o SocketOptions) Option {
+	return func(opt *options) {
+		opt.tunnelSocket = &o
+	}
+}
+
+// tunnelSocketOptions 本次隧道使用的TCP参数, 没有设置时返回nil
+func (p *Proxy) tunnelSocketOptions(ctx *Context) *SocketOptions {
+	if ctx.TunnelSocket != nil {
+		return ctx.TunnelSocket
+	}
+
+	return p.tunnelSocket
+}
+
+// applySocketOptions 设置conn底层TCP连接的参数, 不是TCP连接时忽略
+func (p *Proxy) applySocketOptions(ctx *Context, conn net.Conn) {
+	o := p.tunnelSocketOptions(ctx)
+	if o == nil {
+		return
+	}
+	tcp := tcpConnOf(conn)
+	if tcp == nil {
+		return
+	}
+	if err := o.apply(tcp); err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - 设置TCP参数失败: %s", ctx.Req.URL.Host, err))
+	}
+}
+
+func (o *SocketOptions) apply(conn *net.TCPConn) error {
+	if o.KeepAlive < 0 {
+		if err := conn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.KeepAlive > 0 {
+		// 空闲时间和探测间隔相同
+		err := conn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: o.KeepAlive, Interval: o.KeepAlive})
+		if err != nil {
+			return err
+		}
+	}
+	if o.DisableNoDelay {
+		if err := conn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	if o.UserTimeout > 0 {
+		return setUserTimeout(conn, o.UserTimeout)
+	}
+
+	return nil
+}
+
+// tcpConnOf 去掉proxy添加的包装, 返回底层的TCP连接
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *transparentConn:
+			conn = c.Conn
+		case *replayConn:
+			conn = c.Conn
+		case *sniffConn:
+			conn = c.Conn
+		case *proxyProtocolConn:
+			conn = c.Conn
+		case *socksConn:
+			conn = c.Conn
+		case *countConn:
+			conn = c.Conn
+		case *idleTimeoutConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const socksVersion = 5
+
+// SOCKS5认证方式
+const (
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+)
+
+// SOCKS5地址类型
+const (
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+)
+
+// socks5连接失败的原因, 下标为REP字段
+var socksReplies = []string{
+	"成功",
+	"服务器错误",
+	"规则不允许连接",
+	"网络不可达",
+	"主机不可达",
+	"连接被拒绝",
+	"TTL过期",
+	"不支持的命令",
+	"不支持的地址类型",
+}
+
+// isSOCKS 是否为socks5://或socks5h://上级代理
+// socks5在本地解析域名后发送IP, socks5h由上级代理解析域名
+func isSOCKS(parent *url.URL) bool {
+	return parent != nil && (parent.Scheme == "socks5" || parent.Scheme == "socks5h")
+}
+
+// dialSOCKS 通过SOCKS5上级代理连接目标地址, URL中的用户名密码用于用户名/密码认证(RFC 1929)
+func (p *Proxy) dialSOCKS(ctx context.Context, parent *url.URL, network, addr string) (net.Conn, error) {
+	conn, err := p.dialContext(ctx, "tcp", ensurePort(parent.Host, "1080"))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(p.connectTimeout))
+	}
+	if err = p.socksHandshake(ctx, conn, parent, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5上级代理%s: %s", parent.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (p *Proxy) socksHandshake(ctx context.Context, conn net.Conn, parent *url.URL, addr string) error {
+	methods := []byte{socksAuthNone}
+	if parent.User != nil {
+		methods = []byte{socksAuthNone, socksAuthPassword}
+	}
+	req := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("无效的版本号%d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthNoAcceptable:
+		return errors.New("没有可用的认证方式")
+	case socksAuthPassword:
+		if parent.User == nil {
+			return errors.New("需要用户名密码认证")
+		}
+		if err := socksAuthenticate(conn, parent.User); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("不支持的认证方式%d", reply[1])
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("无效的端口%s", portStr)
+	}
+	req = []byte{socksVersion, 0x01, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && parent.Scheme == "socks5" {
+		if ip, err = p.lookupIP(ctx, host); err != nil {
+			return err
+		}
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("域名过长: %s", host)
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply = make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("无效的版本号%d", reply[0])
+	}
+	if code := int(reply[1]); code != 0 {
+		if code < len(socksReplies) {
+			return fmt.Errorf("连接%s失败: %s", addr, socksReplies[code])
+		}
+		return fmt.Errorf("连接%s失败: 错误码%d", addr, code)
+	}
+	// 跳过绑定地址
+	var n int
+	switch reply[3] {
+	case socksAddrIPv4:
+		n = net.IPv4len
+	case socksAddrIPv6:
+		n = net.IPv6len
+	case socksAddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("无效的地址类型%d", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(n+2))
+
+	return err
+}
+
+// socksAuthenticate 用户名/密码认证
+func socksAuthenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("用户名或密码过长")
+	}
+	req := []byte{0x01, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("用户名或密码错误")
+	}
+
+	return nil
+}
+
+// lookupIP 本地解析域名, 使用WithResolver设置的解析器
+func (p *Proxy) lookupIP(ctx context.Context, host string) (net.IP, error) {
+	var ips []net.IPAddr
+	var err error
+	if p.resolver != nil {
+		ips, err = p.resolver.LookupIPAddr(ctx, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s 没有可用的IP地址", host)
+	}
+
+	return ips[0].IP, nil
+}
+
+// socksTransport 每个SOCKS5上级代理使用独立的transport, 连接目标时先完成SOCKS5握手
+func (p *Proxy) socksTransport(parent *url.URL, base *http.Transport) *http.Transport {
+	key := parent.String()
+	if t, ok := p.socksTransports.Load(key); ok {
+		return t.(*http.Transport)
+	}
+	t := base.Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dialSOCKS(ctx, parent, network, addr)
+	}
+	actual, _ := p.socksTransports.LoadOrStore(key, t)
+
+	return actual.(*http.Transport)
+}
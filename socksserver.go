@@ -0,0 +1,355 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5客户端完成握手的时间
+const socksHandshakeTimeout = 10 * time.Second
+
+// SOCKS5命令和应答
+const (
+	socksCmdConnect = 0x01
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyTTLExpired          = 0x06
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddrNotSupported    = 0x08
+)
+
+type socksKey struct{}
+
+// isSOCKSRequest 是否为SOCKS5客户端的CONNECT, 按TCP隧道转发, 不能HTTPS解密
+func isSOCKSRequest(req *http.Request) bool {
+	return req.Context().Value(socksKey{}) != nil
+}
+
+// ListenAndServeSOCKS5 监听SOCKS5客户端, 见ServeSOCKS5
+func (p *Proxy) ListenAndServeSOCKS5(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	return p.ServeSOCKS5(ln)
+}
+
+// ServeSOCKS5 接收SOCKS5客户端(RFC 1928), 支持CONNECT命令和用户名/密码认证(RFC 1929), 返回ln.Accept的错误
+// 请求转换为CONNECT后使用与HTTP代理相同的流程, 包括Delegate、WithACL、上级代理、用户配额和用量统计, 按隧道转发, 不进行HTTPS解密
+// 用户名密码以Proxy-Authorization传递给WithBasicAuth和Delegate.Auth, 设置WithBasicAuth时要求客户端认证
+// 拒绝连接时返回SOCKS5错误码, 403、407为规则不允许, 502为主机不可达, 504为TTL过期, 其他为服务器错误
+func (p *Proxy) ServeSOCKS5(ln net.Listener) error {
+	return p.serveSOCKS5(ln, nil)
+}
+
+// serveSOCKS5 l为Server监听的策略, 直接调用ServeSOCKS5时为nil
+func (p *Proxy) serveSOCKS5(ln net.Listener, l *listenerPolicy) error {
+	ln = p.limitListener(ln, false)
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				delay = acceptBackoff(delay)
+				p.delegate.ErrorLog(fmt.Errorf("SOCKS5接受连接错误: %s, %s后重试", err, delay))
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go p.serveSOCKSConn(conn, l)
+	}
+}
+
+func (p *Proxy) serveSOCKSConn(conn net.Conn, l *listenerPolicy) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	user, err := p.socksNegotiate(br, conn, p.basicAuthOf(l))
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - SOCKS5握手失败: %s", conn.RemoteAddr(), err))
+		conn.Close()
+		return
+	}
+	addr, reply, err := readSOCKSRequest(br)
+	if err != nil {
+		p.delegate.ErrorLog(fmt.Errorf("%s - SOCKS5读取请求失败: %s", conn.RemoteAddr(), err))
+		if reply != 0 {
+			writeSOCKSReply(conn, reply, nil)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	sc := &socksConn{Conn: &replayConn{Conn: conn, r: br}}
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	base := context.Background()
+	if l != nil {
+		base = context.WithValue(base, listenerKey{}, l)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(base, socksKey{}, true))
+	defer cancel()
+	rw := &socksResponseWriter{conn: sc, header: make(http.Header)}
+	p.ServeHTTP(rw, req.WithContext(ctx))
+	if !rw.hijacked {
+		sc.reply(socksReplyGeneralFailure)
+		conn.Close()
+	}
+}
+
+// socksNegotiate 选择认证方式, 返回客户端的用户名密码
+// 设置WithBasicAuth时只接受用户名/密码认证并在此时校验, 否则优先不认证
+func (p *Proxy) socksNegotiate(br *bufio.Reader, conn net.Conn, auth *basicAuth) (*url.Userinfo, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("无效的版本号%d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, err
+	}
+	offered := func(m byte) bool {
+		for _, v := range methods {
+			if v == m {
+				return true
+			}
+		}
+		return false
+	}
+	method := byte(socksAuthNoAcceptable)
+	switch {
+	case auth == nil && offered(socksAuthNone):
+		method = socksAuthNone
+	case offered(socksAuthPassword):
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	switch method {
+	case socksAuthNone:
+		return nil, nil
+	case socksAuthNoAcceptable:
+		return nil, errors.New("没有可用的认证方式")
+	}
+
+	user, err := readSOCKSCredentials(br)
+	if err != nil {
+		return nil, err
+	}
+	password, _ := user.Password()
+	if auth != nil && !auth.validate(user.Username(), password) {
+		conn.Write([]byte{0x01, 0x01})
+		return nil, fmt.Errorf("用户%s认证失败", user.Username())
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// readSOCKSCredentials 读取用户名/密码认证请求
+func readSOCKSCredentials(br *bufio.Reader) (*url.Userinfo, error) {
+	readField := func() (string, error) {
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != 0x01 {
+		return nil, fmt.Errorf("无效的认证版本号%d", version)
+	}
+	username, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	password, err := readField()
+	if err != nil {
+		return nil, err
+	}
+
+	return url.UserPassword(username, password), nil
+}
+
+// readSOCKSRequest 读取CONNECT请求的目标地址, 失败时返回需要发送的错误码
+func readSOCKSRequest(br *bufio.Reader) (string, byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("无效的版本号%d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		return "", socksReplyCommandNotSupported, fmt.Errorf("不支持的命令%d", header[1])
+	}
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return "", 0, err
+		}
+		host = string(b)
+	default:
+		return "", socksReplyAddrNotSupported, fmt.Errorf("不支持的地址类型%d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", 0, err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), 0, nil
+}
+
+// writeSOCKSReply 发送应答, bound为nil时绑定地址为0.0.0.0:0
+func writeSOCKSReply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0x00}
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socksAddrIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socksAddrIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+
+	return err
+}
+
+// socksReplyCode 拒绝CONNECT的状态码对应的SOCKS5错误码
+func socksReplyCode(status int) byte {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusUnavailableForLegalReasons:
+		return socksReplyNotAllowed
+	case http.StatusBadGateway:
+		return socksReplyHostUnreachable
+	case http.StatusGatewayTimeout:
+		return socksReplyTTLExpired
+	}
+
+	return socksReplyGeneralFailure
+}
+
+// socksConn SOCKS5客户端连接, 隧道建立或失败时发送一次应答
+type socksConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	replied bool
+}
+
+func (c *socksConn) reply(code byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replied {
+		return nil
+	}
+	c.replied = true
+
+	return writeSOCKSReply(c.Conn, code, c.Conn.LocalAddr())
+}
+
+// socksResponseWriter Hijack前写入的状态码(如403、407)转换为SOCKS5错误码
+type socksResponseWriter struct {
+	conn     *socksConn
+	header   http.Header
+	hijacked bool
+}
+
+func (w *socksResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *socksResponseWriter) WriteHeader(code int) {
+	if code != http.StatusOK {
+		w.conn.reply(socksReplyCode(code))
+	}
+}
+
+func (w *socksResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *socksResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ssh连接保活间隔
+const sshKeepAliveInterval = 30 * time.Second
+
+// SSHConfigFunc 根据上级代理地址生成SSH客户端配置
+type SSHConfigFunc func(parent *url.URL) (*ssh.ClientConfig, error)
+
+// WithSSHConfig 自定义ssh://上级代理的认证和主机密钥校验, 默认使用DefaultSSHConfig
+func WithSSHConfig(f SSHConfigFunc) Option {
+	return func(opt *options) {
+		opt.sshConfig = f
+	}
+}
+
+// DefaultSSHConfig 默认SSH配置
+// 认证方式依次为: URL中的密码, SSH_AUTH_SOCK agent, 私钥文件(URL参数identity, 默认~/.ssh/id_*)
+// 主机密钥使用known_hosts校验(URL参数known_hosts, 默认~/.ssh/known_hosts)
+// 例: ssh://user@bastion:22?identity=/path/to/id_ed25519
+func DefaultSSHConfig(parent *url.URL) (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+	query := parent.Query()
+	var auths []ssh.AuthMethod
+	if password, ok := parent.User.Password(); ok {
+		auths = append(auths, ssh.Password(password))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if signers, err := sshAgentSigners(sock); err == nil {
+			auths = append(auths, ssh.PublicKeys(signers...))
+		}
+	}
+	identities := query["identity"]
+	if len(identities) == 0 && home != "" {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identities = append(identities, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range identities {
+		key, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("解析SSH私钥%s失败: %s", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auths = append(auths, ssh.PublicKeys(signers...))
+	}
+
+	knownHostsFile := query.Get("known_hosts")
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载known_hosts失败: %s", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            parent.User.Username(),
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         defaultTargetConnectTimeout,
+	}, nil
+}
+
+// sshAgentSigners 读取agent中的公钥后关闭连接, 签名时重新连接agent, 重连上级代理时不泄漏连接
+func sshAgentSigners(sock string) ([]ssh.Signer, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]ssh.Signer, 0, len(keys))
+	for _, key := range keys {
+		signers = append(signers, &sshAgentSigner{sock: sock, pub: key})
+	}
+
+	return signers, nil
+}
+
+// sshAgentSigner 使用agent中的私钥签名, 每次签名连接agent, 完成后关闭
+type sshAgentSigner struct {
+	sock string
+	pub  ssh.PublicKey
+}
+
+func (s *sshAgentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *sshAgentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+// SignWithAlgorithm 实现ssh.AlgorithmSigner, RSA私钥可使用rsa-sha2-256、rsa-sha2-512签名
+func (s *sshAgentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	conn, err := net.Dial("unix", s.sock)
+	if err != nil {
+		return nil, fmt.Errorf("连接SSH agent失败: %s", err)
+	}
+	defer conn.Close()
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, err
+	}
+	pub := s.pub.Marshal()
+	for _, signer := range signers {
+		if !bytes.Equal(signer.PublicKey().Marshal(), pub) {
+			continue
+		}
+		if as, ok := signer.(ssh.AlgorithmSigner); ok && algorithm != "" {
+			return as.SignWithAlgorithm(rand, data, algorithm)
+		}
+		return signer.Sign(rand, data)
+	}
+
+	return nil, errors.New("SSH agent中没有对应的私钥")
+}
+
+// sshManager 维护到ssh://上级代理的长连接, 通过direct-tcpip通道连接目标
+type sshManager struct {
+	configFunc SSHConfigFunc
+	dial       func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu         sync.Mutex
+	clients    map[string]*ssh.Client
+	transports map[string]*http.Transport
+}
+
+func newSSHManager(configFunc SSHConfigFunc, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *sshManager {
+	if configFunc == nil {
+		configFunc = DefaultSSHConfig
+	}
+
+	return &sshManager{
+		configFunc: configFunc,
+		dial:       dial,
+		clients:    make(map[string]*ssh.Client),
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+func sshKey(parent *url.URL) string {
+	host := parent.Host
+	if parent.Port() == "" {
+		host = net.JoinHostPort(parent.Hostname(), "22")
+	}
+
+	return parent.User.Username() + "@" + host
+}
+
+// DialContext 通过SSH连接目标地址, 连接断开时重建SSH会话后重试一次
+func (m *sshManager) DialContext(ctx context.Context, parent *url.URL, network, addr string) (net.Conn, error) {
+	client, err := m.client(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, network, addr)
+	if err == nil {
+		return conn, nil
+	}
+	if _, ok := err.(*ssh.OpenChannelError); ok {
+		// SSH服务器拒绝连接目标, 会话本身正常
+		return nil, err
+	}
+	m.remove(parent, client)
+	client, err = m.client(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.DialContext(ctx, network, addr)
+}
+
+// transport 每个SSH上级代理使用独立的transport, 避免与直连共用连接池
+func (m *sshManager) transport(parent *url.URL, base *http.Transport) *http.Transport {
+	key := sshKey(parent)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.transports[key]; ok {
+		return t
+	}
+	t := base.Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return m.DialContext(ctx, parent, network, addr)
+	}
+	m.transports[key] = t
+
+	return t
+}
+
+func (m *sshManager) client(ctx context.Context, parent *url.URL) (*ssh.Client, error) {
+	key := sshKey(parent)
+	m.mu.Lock()
+	client, ok := m.clients[key]
+	m.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	config, err := m.configFunc(parent)
+	if err != nil {
+		return nil, err
+	}
+	addr := key[len(parent.User.Username())+1:]
+	conn, err := m.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("连接SSH服务器%s失败: %s", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH握手%s失败: %s", addr, err)
+	}
+	client = ssh.NewClient(c, chans, reqs)
+
+	m.mu.Lock()
+	if existing, ok := m.clients[key]; ok {
+		// 并发建立了连接, 使用先建立的
+		m.mu.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	m.clients[key] = client
+	m.mu.Unlock()
+	go m.keepAlive(parent, client)
+
+	return client, nil
+}
+
+// keepAlive 定时发送保活请求, 失败时关闭连接
+func (m *sshManager) keepAlive(parent *url.URL, client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			m.remove(parent, client)
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				m.remove(parent, client)
+				return
+			}
+		}
+	}
+}
+
+func (m *sshManager) remove(parent *url.URL, client *ssh.Client) {
+	key := sshKey(parent)
+	m.mu.Lock()
+	if m.clients[key] == client {
+		delete(m.clients, key)
+	}
+	m.mu.Unlock()
+	client.Close()
+}
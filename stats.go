@@ -0,0 +1,182 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorClass 错误分类
+type ErrorClass int
+
+const (
+	// ErrorClassClient 读写客户端连接失败
+	ErrorClassClient ErrorClass = iota
+	// ErrorClassTLS HTTPS解密生成证书或握手失败
+	ErrorClassTLS
+	// ErrorClassParent 获取上级代理失败
+	ErrorClassParent
+	// ErrorClassConnect 隧道连接目标服务器或上级代理失败
+	ErrorClassConnect
+	// ErrorClassUpstream HTTP请求目标服务器失败
+	ErrorClassUpstream
+	// ErrorClassLimit 超出并发连接数限制
+	ErrorClassLimit
+	// ErrorClassQuota 超出用户配额
+	ErrorClassQuota
+
+	errorClassNum
+)
+
+var errorClassNames = [errorClassNum]string{
+	ErrorClassClient:   "client",
+	ErrorClassTLS:      "tls",
+	ErrorClassParent:   "parent",
+	ErrorClassConnect:  "connect",
+	ErrorClassUpstream: "upstream",
+	ErrorClassLimit:    "limit",
+	ErrorClassQuota:    "quota",
+}
+
+func (c ErrorClass) String() string {
+	if c < 0 || c >= errorClassNum {
+		return "unknown"
+	}
+
+	return errorClassNames[c]
+}
+
+// MarshalText 实现encoding.TextMarshaler, JSON中使用分类名称
+func (c ErrorClass) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// Stats 代理运行状态快照
+type Stats struct {
+	// Uptime 运行时长
+	Uptime time.Duration
+	// TotalRequests 收到的客户端请求总数, CONNECT计为一次, HTTPS解密后的请求分别计数
+	TotalRequests int64
+	// ActiveRequests 正在处理的客户端请求数
+	ActiveRequests int64
+	// ActiveTunnels 正在转发的隧道和HTTPS解密连接数
+	ActiveTunnels int64
+	// BytesIn 从客户端接收的字节数, HTTP请求只统计body
+	BytesIn int64
+	// BytesOut 发送到客户端的字节数, HTTP响应只统计body
+	BytesOut int64
+	// Errors 按分类统计的错误数
+	Errors map[ErrorClass]int64
+	// ParentProxies 上级代理状态
+	ParentProxies []ParentProxyStatus
+	// Hooks 扩展点的执行耗时, 键为Delegate方法名(如Auth、BeforeRequest),
+	// 或"RequestBodyTransformer[序号] 类型"、"ContentAdapter.AdaptRequest[序号] 类型"等
+	// body转换的耗时不包括读取原body的时间
+	Hooks map[string]HookStats
+	// SampledRequests 被流量采样完整记录的请求数, SampleDropped 因超过MaxConcurrent未采样的请求数
+	SampledRequests int64
+	SampleDropped   int64
+	// BufferPool 隧道转发和响应body复制的缓冲区池
+	BufferPool BufferPoolStats
+	// Admission 开启WithAdmissionControl时的并发数和队列深度
+	Admission AdmissionStats
+	// ParentConns 开启WithParentConnPool时的空闲连接数和连接复用次数
+	ParentConns ParentConnStats
+	// DeadlineExceeded 超过端到端截止时间的请求和隧道数
+	DeadlineExceeded int64
+}
+
+// Snapshot 获取运行状态
+func (p *Proxy) Snapshot() Stats {
+	s := &p.stats
+	stats := Stats{
+		Uptime:         time.Since(s.start),
+		TotalRequests:  atomic.LoadInt64(&s.totalRequests),
+		ActiveRequests: int64(atomic.LoadInt32(&p.clientConnNum)),
+		ActiveTunnels:  atomic.LoadInt64(&s.activeTunnels),
+		BytesIn:        atomic.LoadInt64(&s.bytesIn),
+		BytesOut:       atomic.LoadInt64(&s.bytesOut),
+		Errors:         make(map[ErrorClass]int64),
+		ParentProxies:  p.ParentProxyStats(),
+		Hooks:          p.hooks.snapshot(),
+		BufferPool:     p.buffers.stats(),
+	}
+	stats.DeadlineExceeded = atomic.LoadInt64(&s.deadlineExceeded)
+	if p.sampler != nil {
+		stats.SampledRequests = atomic.LoadInt64(&p.sampler.sampled)
+		stats.SampleDropped = atomic.LoadInt64(&p.sampler.dropped)
+	}
+	if p.admission != nil {
+		stats.Admission = p.admission.stats()
+	}
+	if p.parentConns != nil {
+		stats.ParentConns = p.parentConns.stats()
+	}
+	for i := range s.errors {
+		if n := atomic.LoadInt64(&s.errors[i]); n > 0 {
+			stats.Errors[ErrorClass(i)] = n
+		}
+	}
+
+	return stats
+}
+
+type stats struct {
+	start         time.Time
+	totalRequests int64
+	activeTunnels int64
+	bytesIn       int64
+	bytesOut      int64
+	errors        [errorClassNum]int64
+	// 超过端到端截止时间的请求和隧道数
+	deadlineExceeded int64
+}
+
+func (s *stats) error(class ErrorClass) {
+	atomic.AddInt64(&s.errors[class], 1)
+}
+
+// upstreamErrorClass HTTP请求错误的分类
+func upstreamErrorClass(err error) ErrorClass {
+	switch err {
+	case ErrHostConnLimit, ErrClientConnLimit, ErrPerClientRequestLimit, ErrPerClientConnLimit, ErrQueueFull, ErrQueueTimeout:
+		return ErrorClassLimit
+	case ErrCircuitOpen:
+		return ErrorClassConnect
+	}
+	if errors.Is(err, ErrRequestBodyTooLarge) || errors.Is(err, ErrResponseBodyTooLarge) {
+		return ErrorClassLimit
+	}
+
+	return ErrorClassUpstream
+}
+
+// recordError 统计错误, 并记录到Context用于访问日志
+func (p *Proxy) recordError(ctx *Context, class ErrorClass, err error) {
+	p.stats.error(class)
+	ctx.errorClass = class
+	ctx.err = err
+}
+
+// tunnel 隧道开始, 返回结束时调用的函数
+func (s *stats) tunnel() func() {
+	atomic.AddInt64(&s.activeTunnels, 1)
+
+	return func() {
+		atomic.AddInt64(&s.activeTunnels, -1)
+	}
+}
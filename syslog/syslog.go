@@ -0,0 +1,349 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package syslog RFC 5424格式的syslog输出, 支持本地和远程(udp、tcp、tls)
+//
+//	w, err := syslog.Dial("udp", "siem.example.com:514", syslog.WithFacility(syslog.Local3))
+//	// 错误日志
+//	func (e *EventHandler) ErrorLog(err error) { w.ErrorLog(err) }
+//	// 访问日志等按行写入的日志, 每次Write为一条消息
+//	log.SetOutput(w)
+package syslog
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Facility 日志来源
+type Facility int
+
+const (
+	Kern Facility = iota
+	User
+	Mail
+	Daemon
+	Auth
+	Syslog
+	Lpr
+	News
+	Uucp
+	Cron
+	Authpriv
+	Ftp
+	Local0 Facility = iota + 4
+	Local1
+	Local2
+	Local3
+	Local4
+	Local5
+	Local6
+	Local7
+)
+
+// Severity 日志级别
+type Severity int
+
+const (
+	Emergency Severity = iota
+	Alert
+	Critical
+	Error
+	Warning
+	Notice
+	Informational
+	Debug
+)
+
+// StructuredData RFC 5424结构化数据, ID自定义时应使用name@<企业编号>格式
+type StructuredData struct {
+	ID     string
+	Params map[string]string
+}
+
+type options struct {
+	facility  Facility
+	appName   string
+	hostname  string
+	tlsConfig *tls.Config
+	severity  Severity
+	sd        []StructuredData
+}
+
+type Option func(*options)
+
+// WithFacility 默认Daemon
+func WithFacility(f Facility) Option {
+	return func(opt *options) {
+		opt.facility = f
+	}
+}
+
+// WithAppName 默认为程序名
+func WithAppName(name string) Option {
+	return func(opt *options) {
+		opt.appName = name
+	}
+}
+
+// WithHostname 默认为本机主机名
+func WithHostname(name string) Option {
+	return func(opt *options) {
+		opt.hostname = name
+	}
+}
+
+// WithTLSConfig network为tls时使用的TLS配置
+func WithTLSConfig(c *tls.Config) Option {
+	return func(opt *options) {
+		opt.tlsConfig = c
+	}
+}
+
+// WithSeverity Write写入消息的级别, 默认Informational
+func WithSeverity(s Severity) Option {
+	return func(opt *options) {
+		opt.severity = s
+	}
+}
+
+// WithStructuredData 每条消息都附带的结构化数据, 如部署环境、实例ID
+func WithStructuredData(sd ...StructuredData) Option {
+	return func(opt *options) {
+		opt.sd = append(opt.sd, sd...)
+	}
+}
+
+// 本地syslog socket
+var localSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Writer syslog输出, 并发安全, 写入失败时重连一次
+type Writer struct {
+	network string
+	addr    string
+	opts    *options
+	procID  string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Dial 连接syslog服务器, network为udp、tcp、tls、unix、unixgram, network和addr为空时连接本地syslog
+func Dial(network, addr string, opt ...Option) (*Writer, error) {
+	opts := &options{
+		facility: Daemon,
+		severity: Informational,
+	}
+	for _, o := range opt {
+		o(opts)
+	}
+	if opts.appName == "" {
+		opts.appName = filepath.Base(os.Args[0])
+	}
+	if opts.hostname == "" {
+		opts.hostname, _ = os.Hostname()
+	}
+	w := &Writer{
+		network: network,
+		addr:    addr,
+		opts:    opts,
+		procID:  strconv.Itoa(os.Getpid()),
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	var err error
+	switch w.network {
+	case "":
+		for _, path := range localSockets {
+			for _, network := range []string{"unixgram", "unix"} {
+				if w.conn, err = net.Dial(network, path); err == nil {
+					return nil
+				}
+			}
+		}
+		return errors.New("syslog: 连接本地syslog失败")
+	case "tls":
+		w.conn, err = tls.Dial("tcp", w.addr, w.opts.tlsConfig)
+	default:
+		w.conn, err = net.DialTimeout(w.network, w.addr, 5*time.Second)
+	}
+
+	return err
+}
+
+// stream 流式连接需要按RFC 6587/5425使用长度前缀分隔消息
+func (w *Writer) stream() bool {
+	switch w.network {
+	case "tcp", "tcp4", "tcp6", "tls", "unix":
+		return true
+	case "":
+		return w.conn != nil && w.conn.LocalAddr().Network() == "unix"
+	}
+
+	return false
+}
+
+// Log 写入一条消息
+func (w *Writer) Log(severity Severity, msgID string, sd []StructuredData, msg string) error {
+	line := w.format(time.Now(), severity, msgID, sd, msg)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		if err := w.connect(); err != nil {
+			return err
+		}
+	}
+	if err := w.write(line); err != nil {
+		if err := w.connect(); err != nil {
+			return err
+		}
+		return w.write(line)
+	}
+
+	return nil
+}
+
+func (w *Writer) write(line string) error {
+	if w.stream() {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+	_, err := w.conn.Write([]byte(line))
+
+	return err
+}
+
+// Write 每次写入为一条消息, 去掉末尾换行, 实现io.Writer
+func (w *Writer) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\r\n")
+	if err := w.Log(w.opts.severity, "", nil, msg); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// ErrorLog 以Error级别记录错误, 用于Delegate.ErrorLog
+func (w *Writer) ErrorLog(err error) {
+	w.Log(Error, "error", nil, err.Error())
+}
+
+// Close 关闭连接
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+
+	return err
+}
+
+// format 生成RFC 5424消息: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+func (w *Writer) format(t time.Time, severity Severity, msgID string, sd []StructuredData, msg string) string {
+	var b strings.Builder
+	pri := int(w.opts.facility)*8 + int(severity)
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ",
+		pri,
+		t.Format("2006-01-02T15:04:05.000000Z07:00"),
+		header(w.opts.hostname, 255),
+		header(w.opts.appName, 48),
+		header(w.procID, 128),
+		header(msgID, 32),
+	)
+	all := append(append([]StructuredData(nil), w.opts.sd...), sd...)
+	if len(all) == 0 {
+		b.WriteString("-")
+	}
+	for _, item := range all {
+		b.WriteString("[")
+		b.WriteString(sdName(item.ID))
+		keys := make([]string, 0, len(item.Params))
+		for k := range item.Params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, ` %s="%s"`, sdName(k), escapeParam(item.Params[k]))
+		}
+		b.WriteString("]")
+	}
+	if msg != "" {
+		b.WriteString(" ")
+		b.WriteString(msg)
+	}
+
+	return b.String()
+}
+
+// header 头部字段只能是可打印ASCII且不含空格, 为空时使用-
+func header(s string, max int) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r > 32 && r < 127 {
+			b.WriteRune(r)
+		}
+		if b.Len() >= max {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+
+	return b.String()
+}
+
+// sdName SD-ID和参数名不能包含=、空格、]、"
+func sdName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > 32 {
+		s = s[:32]
+	}
+
+	return s
+}
+
+var paramEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeParam(s string) string {
+	return paramEscaper.Replace(s)
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TeeDirection 复制的body方向
+type TeeDirection string
+
+const (
+	TeeRequest  TeeDirection = "request"
+	TeeResponse TeeDirection = "response"
+)
+
+// TeeInfo 复制的body所属的请求
+type TeeInfo struct {
+	RequestID string
+	Direction TeeDirection
+	Method    string
+	URL       string
+	// Status 响应状态码, 复制请求body时为0
+	Status int
+	// Header 发送到目标服务器的请求header或返回给客户端的响应header
+	Header http.Header
+}
+
+// TeeSink 接收请求和响应body的副本, 每个body调用一次Open, 返回nil时不复制该body
+// 写入在proxy读取body时同步进行, 写入较慢会降低转发速度, body读完或中断时关闭
+type TeeSink interface {
+	Open(ctx *Context, info *TeeInfo) (io.WriteCloser, error)
+}
+
+// TeeSinkFunc 函数形式的TeeSink, 可返回对象存储的分段上传writer等
+type TeeSinkFunc func(ctx *Context, info *TeeInfo) (io.WriteCloser, error)
+
+func (f TeeSinkFunc) Open(ctx *Context, info *TeeInfo) (io.WriteCloser, error) {
+	return f(ctx, info)
+}
+
+// TeeConfig body复制配置
+type TeeConfig struct {
+	// Sinks 接收body副本, 每个sink独立写入
+	Sinks []TeeSink
+	// Match 返回true的请求才复制, 为nil时复制全部, 在BeforeRequest之后调用
+	Match func(ctx *Context) bool
+	// ContentTypes 复制的Content-Type, 以/结尾时按前缀匹配, 为空时不限制
+	ContentTypes []string
+	// MaxBodySize 每个body最多复制的字节数, 超过的部分不写入sink, 0时不限制
+	MaxBodySize int64
+	// DisableRequest 不复制请求body
+	DisableRequest bool
+	// DisableResponse 不复制响应body
+	DisableResponse bool
+}
+
+// WithTee 将HTTP请求(包括HTTPS解密后的请求)的请求和响应body边转发边复制到sink, 用于合规存档
+// 请求body为请求body转换之后的内容, 响应body为响应body转换之后、压缩前的内容, 不缓存完整body
+// sink写入失败时记录错误并停止复制该body, 不影响转发
+func WithTee(config TeeConfig) Option {
+	return func(opt *options) {
+		opt.tee = &config
+	}
+}
+
+type tee struct {
+	config TeeConfig
+	errLog func(error)
+}
+
+func newTee(config TeeConfig, errLog func(error)) *tee {
+	return &tee{config: config, errLog: errLog}
+}
+
+func (t *tee) match(ctx *Context) bool {
+	return t.config.Match == nil || t.config.Match(ctx)
+}
+
+func (t *tee) contentTypeAllowed(header http.Header) bool {
+	if len(t.config.ContentTypes) == 0 {
+		return true
+	}
+	contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	for _, c := range t.config.ContentTypes {
+		if contentType == c || (strings.HasSuffix(c, "/") && strings.HasPrefix(contentType, c)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *tee) request(ctx *Context, req *http.Request) {
+	if t.config.DisableRequest || req.Body == nil || req.Body == http.NoBody || !t.contentTypeAllowed(req.Header) {
+		return
+	}
+	info := &TeeInfo{
+		RequestID: ctx.RequestID,
+		Direction: TeeRequest,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Header:    CloneHeader(req.Header),
+	}
+	req.Body = t.open(ctx, info, req.Body)
+}
+
+func (t *tee) response(ctx *Context, resp *http.Response) {
+	if t.config.DisableResponse || resp.Body == nil || resp.Body == http.NoBody || !t.contentTypeAllowed(resp.Header) {
+		return
+	}
+	info := &TeeInfo{
+		RequestID: ctx.RequestID,
+		Direction: TeeResponse,
+		Method:    ctx.Req.Method,
+		URL:       ctx.Req.URL.String(),
+		Status:    resp.StatusCode,
+		Header:    CloneHeader(resp.Header),
+	}
+	resp.Body = t.open(ctx, info, resp.Body)
+}
+
+// open 打开所有sink, 没有sink接收时返回原body
+func (t *tee) open(ctx *Context, info *TeeInfo, body io.ReadCloser) io.ReadCloser {
+	var writers []*teeSinkWriter
+	for _, sink := range t.config.Sinks {
+		w, err := sink.Open(ctx, info)
+		if err != nil {
+			t.errLog(fmt.Errorf("%s - 打开body复制%T失败: %s", info.URL, sink, err))
+			continue
+		}
+		if w != nil {
+			writers = append(writers, &teeSinkWriter{w: w, remaining: t.config.MaxBodySize})
+		}
+	}
+	if len(writers) == 0 {
+		return body
+	}
+
+	return &teeBody{rc: body, writers: writers, url: info.URL, errLog: t.errLog}
+}
+
+type teeSinkWriter struct {
+	w io.WriteCloser
+	// remaining 剩余可写入的字节数, 0表示不限制
+	remaining int64
+	// full 达到MaxBodySize或写入失败
+	full bool
+}
+
+func (w *teeSinkWriter) write(p []byte) error {
+	if w.full {
+		return nil
+	}
+	if w.remaining > 0 {
+		if int64(len(p)) >= w.remaining {
+			p = p[:w.remaining]
+			w.full = true
+		}
+		w.remaining -= int64(len(p))
+	}
+	if _, err := w.w.Write(p); err != nil {
+		w.full = true
+		return err
+	}
+
+	return nil
+}
+
+// teeBody 读取body时写入sink, 关闭时关闭所有sink
+type teeBody struct {
+	rc      io.ReadCloser
+	writers []*teeSinkWriter
+	url     string
+	errLog  func(error)
+	once    sync.Once
+}
+
+func (r *teeBody) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if n > 0 {
+		for _, w := range r.writers {
+			if werr := w.write(p[:n]); werr != nil {
+				r.errLog(fmt.Errorf("%s - body复制写入失败: %s", r.url, werr))
+			}
+		}
+	}
+
+	return n, err
+}
+
+func (r *teeBody) Close() error {
+	err := r.rc.Close()
+	r.once.Do(func() {
+		for _, w := range r.writers {
+			if cerr := w.w.Close(); cerr != nil {
+				r.errLog(fmt.Errorf("%s - body复制关闭失败: %s", r.url, cerr))
+			}
+		}
+	})
+
+	return err
+}
+
+// NewFileTeeSink 每个body写入dir下的一个文件, 文件名为"请求ID.request"或"请求ID.response"
+func NewFileTeeSink(dir string) TeeSink {
+	return TeeSinkFunc(func(ctx *Context, info *TeeInfo) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(dir, info.RequestID+"."+string(info.Direction)))
+	})
+}
+
+// TeeChunk 通过channel发送的body片段, Data不会被proxy复用
+type TeeChunk struct {
+	Info *TeeInfo
+	Data []byte
+	// EOF body结束, Data为空
+	EOF bool
+}
+
+// NewChanTeeSink 将body片段发送到ch, channel阻塞时转发同样阻塞, 应使用带缓冲的channel并及时接收
+func NewChanTeeSink(ch chan<- TeeChunk) TeeSink {
+	return TeeSinkFunc(func(ctx *Context, info *TeeInfo) (io.WriteCloser, error) {
+		return &chanTeeWriter{ch: ch, info: info}, nil
+	})
+}
+
+type chanTeeWriter struct {
+	ch   chan<- TeeChunk
+	info *TeeInfo
+}
+
+func (w *chanTeeWriter) Write(p []byte) (int, error) {
+	w.ch <- TeeChunk{Info: w.info, Data: append([]byte(nil), p...)}
+	return len(p), nil
+}
+
+func (w *chanTeeWriter) Close() error {
+	w.ch <- TeeChunk{Info: w.info, EOF: true}
+	return nil
+}
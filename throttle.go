@@ -0,0 +1,282 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 单次读写的最大字节数, 避免一次读写消耗过多令牌导致长时间等待
+const maxThrottleChunk = 32 * 1024
+
+// BandwidthConfig 带宽限制, 单位字节/秒, 为0时不限制, 上传和下载分别计算
+type BandwidthConfig struct {
+	// Global 所有客户端共享的带宽
+	Global int64
+	// PerUser 每个认证用户(Context.User)的带宽, 同一用户的请求和隧道共享
+	PerUser int64
+	// PerIP 每个客户端IP的带宽
+	PerIP int64
+}
+
+// WithBandwidthLimit 令牌桶限速, 作用于HTTP请求和响应的body、隧道、HTTPS解密和WebSocket连接
+// 开启后也可通过Context.Bandwidth设置单个请求或隧道的带宽, 多项限制同时生效
+func WithBandwidthLimit(config BandwidthConfig) Option {
+	return func(opt *options) {
+		opt.bandwidth = &config
+	}
+}
+
+// 传输方向
+const (
+	throttleUp = iota
+	throttleDown
+)
+
+type throttleKey struct {
+	key string
+	dir int
+}
+
+type throttler struct {
+	config BandwidthConfig
+	global [2]*byteBucket
+
+	mu        sync.Mutex
+	buckets   map[throttleKey]*byteBucket
+	lastSweep time.Time
+}
+
+func newThrottler(config BandwidthConfig) *throttler {
+	t := &throttler{
+		config:    config,
+		buckets:   make(map[throttleKey]*byteBucket),
+		lastSweep: time.Now(),
+	}
+	if config.Global > 0 {
+		t.global = [2]*byteBucket{newByteBucket(config.Global), newByteBucket(config.Global)}
+	}
+
+	return t
+}
+
+// resolve 本次请求适用的上传和下载令牌桶
+func (t *throttler) resolve(ctx *Context) (up, down []*byteBucket) {
+	if t.global[0] != nil {
+		up, down = append(up, t.global[throttleUp]), append(down, t.global[throttleDown])
+	}
+	shared := func(key string, rate int64) {
+		if rate <= 0 {
+			return
+		}
+		up = append(up, t.bucket(key, throttleUp, rate))
+		down = append(down, t.bucket(key, throttleDown, rate))
+	}
+	if ctx.User != "" {
+		shared("user:"+ctx.User, t.config.PerUser)
+	}
+	shared("ip:"+hostname(ctx.Req.RemoteAddr), t.config.PerIP)
+	if ctx.Bandwidth > 0 {
+		up = append(up, newByteBucket(ctx.Bandwidth))
+		down = append(down, newByteBucket(ctx.Bandwidth))
+	}
+
+	return up, down
+}
+
+func (t *throttler) bucket(key string, dir int, rate int64) *byteBucket {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	k := throttleKey{key: key, dir: dir}
+	b, ok := t.buckets[k]
+	if !ok {
+		b = newByteBucket(rate)
+		t.buckets[k] = b
+	}
+
+	return b
+}
+
+// sweep 每分钟删除空闲超过一分钟的桶
+func (t *throttler) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for k, b := range t.buckets {
+		if b.idle(now) >= time.Minute {
+			delete(t.buckets, k)
+		}
+	}
+}
+
+// byteBucket 按字节计数的令牌桶, 令牌不足时允许透支, 由调用方等待透支的时间
+type byteBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newByteBucket 最多累积1秒的令牌
+func newByteBucket(rate int64) *byteBucket {
+	return &byteBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve 消耗n个令牌, 返回需要等待的时间
+func (b *byteBucket) reserve(n int) time.Duration {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *byteBucket) idle(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return now.Sub(b.last)
+}
+
+// throttle 单个请求或连接的限速, 第一次读写时确定令牌桶, 以便使用Auth、BeforeRequest中设置的User和Bandwidth
+type throttle struct {
+	t   *throttler
+	ctx *Context
+
+	once  sync.Once
+	up    []*byteBucket
+	down  []*byteBucket
+	chunk int
+}
+
+func (p *Proxy) newThrottle(ctx *Context) *throttle {
+	return &throttle{t: p.throttler, ctx: ctx}
+}
+
+func (th *throttle) buckets(dir int) ([]*byteBucket, int) {
+	th.once.Do(func() {
+		th.up, th.down = th.t.resolve(th.ctx)
+		th.chunk = maxThrottleChunk
+		for _, b := range th.up {
+			if int(b.burst) < th.chunk {
+				th.chunk = int(b.burst)
+			}
+		}
+		if th.chunk < 1 {
+			th.chunk = 1
+		}
+	})
+	if dir == throttleUp {
+		return th.up, th.chunk
+	}
+
+	return th.down, th.chunk
+}
+
+// transfer 限制单次读写的大小, 按透支的令牌等待
+func (th *throttle) transfer(dir int, b []byte, f func([]byte) (int, error)) (int, error) {
+	buckets, chunk := th.buckets(dir)
+	if len(buckets) == 0 {
+		return f(b)
+	}
+	if len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := f(b)
+	if n > 0 {
+		var wait time.Duration
+		for _, bucket := range buckets {
+			if d := bucket.reserve(n); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	return n, err
+}
+
+// body 限速body, dir为throttleUp时限制请求body, throttleDown时限制响应body
+func (th *throttle) body(rc io.ReadCloser, dir int) io.ReadCloser {
+	if rc == nil || rc == http.NoBody {
+		return rc
+	}
+
+	return &throttleBody{rc: rc, th: th, dir: dir}
+}
+
+// conn 限速客户端连接, 读取为上传, 写入为下载
+func (th *throttle) conn(c net.Conn) net.Conn {
+	return &throttleConn{Conn: c, th: th}
+}
+
+type throttleBody struct {
+	rc  io.ReadCloser
+	th  *throttle
+	dir int
+}
+
+func (b *throttleBody) Read(p []byte) (int, error) {
+	return b.th.transfer(b.dir, p, b.rc.Read)
+}
+
+func (b *throttleBody) Close() error {
+	return b.rc.Close()
+}
+
+type throttleConn struct {
+	net.Conn
+	th *throttle
+}
+
+func (c *throttleConn) Read(b []byte) (int, error) {
+	return c.th.transfer(throttleUp, b, c.Conn.Read)
+}
+
+func (c *throttleConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := c.th.transfer(throttleDown, b[written:], c.Conn.Write)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
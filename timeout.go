@@ -0,0 +1,179 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrResponseHeaderTimeout 等待目标服务器响应头超时
+var ErrResponseHeaderTimeout = errors.New("等待响应头超时")
+
+// Timeouts 单个请求或隧道的超时设置, 在BeforeRequest或BeforeTunnelForward中修改Context.Timeouts, 为0时使用默认设置
+type Timeouts struct {
+	// Dial 连接目标服务器或上级代理的超时时间, HTTP请求不能超过transport拨号器的超时时间
+	Dial time.Duration
+	// ResponseHeader 发送请求后等待响应头的超时时间, 只用于HTTP请求
+	ResponseHeader time.Duration
+	// Total HTTP请求从发送到读完响应body的总时间, 隧道的最长持续时间
+	Total time.Duration
+	// TunnelIdle 隧道空闲超时时间, 同时作用于客户端和目标服务器连接, 优先于其他设置
+	TunnelIdle time.Duration
+	// ClientReadWrite 隧道客户端连接的空闲超时时间, 覆盖WithTunnelIdleTimeout和WithClientReadWriteTimeout, 小于0时不超时
+	ClientReadWrite time.Duration
+	// TargetReadWrite 隧道目标服务器连接的空闲超时时间, 覆盖WithTunnelIdleTimeout和WithTargetReadWriteTimeout, 小于0时不超时
+	TargetReadWrite time.Duration
+}
+
+// tunnelIdleTimeouts 隧道客户端和目标服务器连接的空闲超时时间
+func (p *Proxy) tunnelIdleTimeouts(t Timeouts) (client, target time.Duration) {
+	if t.TunnelIdle > 0 {
+		return t.TunnelIdle, t.TunnelIdle
+	}
+	client, target = p.clientRWTimeout, p.targetRWTimeout
+	if p.tunnelIdleTimeout > 0 {
+		client, target = p.tunnelIdleTimeout, p.tunnelIdleTimeout
+	}
+	if t.ClientReadWrite != 0 {
+		client = t.ClientReadWrite
+	}
+	if t.TargetReadWrite != 0 {
+		target = t.TargetReadWrite
+	}
+
+	return client, target
+}
+
+// withIdleTimeout 读写后延长deadline, d小于等于0时不超时
+func withIdleTimeout(conn net.Conn, d time.Duration) net.Conn {
+	if d <= 0 {
+		conn.SetDeadline(time.Time{})
+		return conn
+	}
+
+	return newIdleTimeoutConn(conn, d)
+}
+
+// setDeadline d大于0时设置读写截止时间, 否则清除截止时间
+func setDeadline(conn net.Conn, d time.Duration) {
+	if d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+		return
+	}
+	conn.SetDeadline(time.Time{})
+}
+
+type dialTimeoutKey struct{}
+
+// withDialTimeout 通过context传递本次请求的拨号超时时间
+func withDialTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, dialTimeoutKey{}, d)
+}
+
+// timeoutDialer 在transport拨号时应用context中的拨号超时时间
+func timeoutDialer(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if d, ok := ctx.Value(dialTimeoutKey{}).(time.Duration); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// requestDeadline 应用Timeouts中的HTTP请求超时, 返回的函数在得到响应头后调用
+// 设置了Total或ResponseHeader时, 响应body关闭后释放context
+func requestDeadline(ctx *Context, req *http.Request) (*http.Request, func(*http.Response, error) (*http.Response, error)) {
+	t := ctx.Timeouts
+	reqCtx := withDialTimeout(req.Context(), t.Dial)
+	if t.Total <= 0 && t.ResponseHeader <= 0 {
+		if reqCtx == req.Context() {
+			return req, nil
+		}
+		return req.WithContext(reqCtx), nil
+	}
+	var cancel context.CancelFunc
+	if t.Total > 0 {
+		reqCtx, cancel = context.WithTimeout(reqCtx, t.Total)
+	} else {
+		reqCtx, cancel = context.WithCancel(reqCtx)
+	}
+	var timer *time.Timer
+	var headerTimeout bool
+	var mu sync.Mutex
+	if t.ResponseHeader > 0 {
+		timer = time.AfterFunc(t.ResponseHeader, func() {
+			mu.Lock()
+			headerTimeout = true
+			mu.Unlock()
+			cancel()
+		})
+	}
+
+	return req.WithContext(reqCtx), func(resp *http.Response, err error) (*http.Response, error) {
+		if timer != nil {
+			timer.Stop()
+		}
+		mu.Lock()
+		timedOut := headerTimeout
+		mu.Unlock()
+		if err != nil {
+			cancel()
+			if timedOut {
+				return nil, ErrResponseHeaderTimeout
+			}
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// 协议升级后body是双向连接, 总时长由spliceUpgrade控制
+			return resp, nil
+		}
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+}
+
+// cancelBody 关闭body时释放context
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// dialTimeoutContext 隧道拨号使用的context, parent取消(客户端断开)时同样取消拨号
+func dialTimeoutContext(parent context.Context, t Timeouts) (context.Context, context.CancelFunc) {
+	if t.Dial > 0 {
+		return context.WithTimeout(parent, t.Dial)
+	}
+
+	return context.WithCancel(parent)
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Timing 连接目标服务器和等待响应的耗时, 复用连接时Dial和TLSHandshake为0
+// 使用上级代理时Dial为连接上级代理的耗时, 隧道的TTFB为0
+type Timing struct {
+	// Dial 建立TCP连接的耗时, 隧道包括上级代理CONNECT握手
+	Dial time.Duration
+	// TLSHandshake 与目标服务器TLS握手的耗时
+	TLSHandshake time.Duration
+	// TTFB 开始发送请求到收到响应首字节的耗时
+	TTFB time.Duration
+}
+
+// newRequestID 生成16位十六进制的请求ID
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+
+	return hex.EncodeToString(b[:])
+}
+
+// requestTrace 记录transport的连接耗时
+// 放弃的拨号可能在RoundTrip返回后才结束, 所以先记录在这里, RoundTrip返回后复制到Context
+type requestTrace struct {
+	mu    sync.Mutex
+	start time.Time
+	dial  time.Time
+	tls   time.Time
+	// 以下字段用于WithTracing的子span
+	dialDone  time.Time
+	dialAddr  string
+	dialErr   error
+	tlsDone   time.Time
+	tlsErr    error
+	firstByte time.Time
+	timing    Timing
+	finished  bool
+}
+
+// traceRequest 返回记录耗时的请求, interim不为nil时接收1xx响应
+func traceRequest(req *http.Request, interim func(code int, header http.Header)) (*http.Request, *requestTrace) {
+	t := &requestTrace{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.set(func() { t.dial = time.Now() })
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.set(func() {
+				t.dialDone, t.dialAddr, t.dialErr = time.Now(), addr, err
+				if err == nil && !t.dial.IsZero() {
+					t.timing.Dial = t.dialDone.Sub(t.dial)
+				}
+			})
+		},
+		TLSHandshakeStart: func() {
+			t.set(func() { t.tls = time.Now() })
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			t.set(func() {
+				t.tlsDone, t.tlsErr = time.Now(), err
+				if !t.tls.IsZero() {
+					t.timing.TLSHandshake = t.tlsDone.Sub(t.tls)
+				}
+			})
+		},
+		GotFirstResponseByte: func() {
+			t.set(func() {
+				t.firstByte = time.Now()
+				t.timing.TTFB = t.firstByte.Sub(t.start)
+			})
+		},
+	}
+	if interim != nil {
+		trace.Got1xxResponse = func(code int, header textproto.MIMEHeader) error {
+			interim(code, http.Header(header))
+			return nil
+		}
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+func (t *requestTrace) set(f func()) {
+	t.mu.Lock()
+	if !t.finished {
+		f()
+	}
+	t.mu.Unlock()
+}
+
+// finish 停止记录并返回耗时
+func (t *requestTrace) finish() Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = true
+
+	return t.timing
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// TLSHandshaker 自定义与目标服务器的TLS握手, 用于控制ClientHello的密码套件顺序、扩展等
+// 如使用uTLS模拟浏览器的JA3指纹, 避免HTTPS解密后的请求因Go默认的TLS指纹被目标服务器的反爬虫系统识别
+// conn为已建立的TCP连接, config为transport TLSClientConfig的副本, 已设置ServerName
+// 返回*tls.Conn时支持HTTP/2, 返回其他连接时transport使用HTTP/1.1, ClientHello的ALPN不能包含h2
+type TLSHandshaker interface {
+	Handshake(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error)
+}
+
+// TLSHandshakerFunc 函数形式的TLSHandshaker
+type TLSHandshakerFunc func(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error)
+
+func (f TLSHandshakerFunc) Handshake(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	return f(ctx, conn, config)
+}
+
+// WithUpstreamTLSHandshaker 使用h与目标服务器进行TLS握手, 用于HTTPS请求和HTTPS解密后的请求
+// 直连和经过SOCKS5、SSH上级代理时生效, 经过HTTP上级代理时由transport在CONNECT之后握手, 不使用h
+func WithUpstreamTLSHandshaker(h TLSHandshaker) Option {
+	return func(opt *options) {
+		opt.tlsHandshaker = h
+	}
+}
+
+// handshakeTransport 使用TLSHandshaker握手的transport, 连接池与crypto/tls握手的transport隔离
+func (p *Proxy) handshakeTransport(base *http.Transport) *http.Transport {
+	if t, ok := p.handshakeTransports.Load(base); ok {
+		return t.(*http.Transport)
+	}
+	t := base.Clone()
+	dial := base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{}
+		if t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = hostname(addr)
+		}
+		tlsConn, err := p.handshake(ctx, conn, config, t.TLSHandshakeTimeout)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+	actual, _ := p.handshakeTransports.LoadOrStore(base, t)
+
+	return actual.(*http.Transport)
+}
+
+// handshake 调用TLSHandshaker, 自定义TLS dialer时transport不统计TLS握手耗时, 在这里记录
+func (p *Proxy) handshake(ctx context.Context, conn net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	tlsConn, err := p.tlsHandshaker.Handshake(ctx, conn, config)
+	var state tls.ConnectionState
+	if s, ok := tlsConn.(interface{ ConnectionState() tls.ConnectionState }); ok && err == nil {
+		state = s.ConnectionState()
+		if _, std := tlsConn.(*tls.Conn); !std && state.NegotiatedProtocol == "h2" {
+			tlsConn.Close()
+			err = errors.New("自定义TLS握手协商了h2, 只支持HTTP/1.1, ClientHello的ALPN不能包含h2")
+		}
+	}
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(state, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
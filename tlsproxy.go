@@ -0,0 +1,168 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ListenAndServeTLS 以TLS监听, 客户端通过TLS连接代理(浏览器中的HTTPS代理), 支持HTTP/2, 包括HTTP/2的CONNECT
+// 普通监听仍使用http.Server和Proxy作为http.Handler, 配置WithClientCertAuth时要求客户端证书
+func (p *Proxy) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	if addr == "" {
+		addr = ":https"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return p.ServeTLS(ln, certFile, keyFile)
+}
+
+// ServeTLS 同ListenAndServeTLS, 使用已有的监听, 如NewProxyProtocolListener
+func (p *Proxy) ServeTLS(ln net.Listener, certFile, keyFile string) error {
+	return p.tlsServer().ServeTLS(p.limitListener(ln, false), certFile, keyFile)
+}
+
+func (p *Proxy) tlsServer() *http.Server {
+	return &http.Server{
+		Handler:     p,
+		TLSConfig:   p.tlsServerConfig(),
+		ConnContext: saveTLSConn,
+	}
+}
+
+// h2ConnectWriter HTTP/2的CONNECT不能Hijack, 将stream包装为连接
+type h2ConnectWriter struct {
+	http.ResponseWriter
+	req      *http.Request
+	hijacked bool
+}
+
+func (w *h2ConnectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+	conn := &h2StreamConn{
+		rw:     w.ResponseWriter,
+		rc:     http.NewResponseController(w.ResponseWriter),
+		body:   w.req.Body,
+		remote: stringAddr(w.req.RemoteAddr),
+	}
+
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// Unwrap 用于http.ResponseController
+func (w *h2ConnectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// h2StreamConn HTTP/2 CONNECT的stream, 请求body为读取方向, 响应body为写入方向
+// 隧道建立后才发送200响应头, 失败时可返回其他状态码
+type h2StreamConn struct {
+	rw     http.ResponseWriter
+	rc     *http.ResponseController
+	body   io.ReadCloser
+	remote net.Addr
+
+	mu       sync.Mutex
+	answered bool
+}
+
+// writeStatus 发送响应头, 只发送一次
+func (c *h2StreamConn) writeStatus(code int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answered {
+		return nil
+	}
+	c.answered = true
+	c.rw.WriteHeader(code)
+
+	return c.rc.Flush()
+}
+
+func (c *h2StreamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *h2StreamConn) Write(b []byte) (int, error) {
+	if err := c.writeStatus(http.StatusOK); err != nil {
+		return 0, err
+	}
+	n, err := c.rw.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.rc.Flush()
+}
+
+// Close 关闭读取方向, 处理函数返回后stream结束
+func (c *h2StreamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr {
+	return stringAddr("")
+}
+
+func (c *h2StreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	c.rc.SetReadDeadline(t)
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+type stringAddr string
+
+func (a stringAddr) Network() string {
+	return "tcp"
+}
+
+func (a stringAddr) String() string {
+	return string(a)
+}
+
+// writeTunnelStatus 隧道建立前失败时返回状态码, SOCKS5客户端返回对应的错误码
+func (c *Context) writeTunnelStatus(conn net.Conn, code int) {
+	switch sc := c.clientConn.(type) {
+	case *h2StreamConn:
+		sc.writeStatus(code)
+		return
+	case *socksConn:
+		sc.reply(socksReplyCode(code))
+		return
+	}
+	conn.Write(makeStatusResponse(code))
+}
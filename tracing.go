@@ -0,0 +1,222 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpanKind span类型
+type SpanKind int
+
+const (
+	// SpanKindInternal 代理内部的操作, 如TTFB
+	SpanKindInternal SpanKind = iota
+	// SpanKindServer 代理收到的请求或隧道
+	SpanKindServer
+	// SpanKindClient 代理发起的连接, 如拨号、TLS握手
+	SpanKindClient
+)
+
+// SpanContext 跟踪上下文, 对应W3C traceparent
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+// IsValid TraceID和SpanID都不为0
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// traceparent W3C traceparent header的值
+func (sc SpanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent 解析W3C traceparent, 格式错误时返回无效的SpanContext
+func parseTraceparent(s string) SpanContext {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || !sc.IsValid() {
+		return SpanContext{}
+	}
+	sc.Sampled = flags&1 == 1
+
+	return sc
+}
+
+// Attribute span属性, Value为string、int64、bool或float64
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanConfig 开始span的参数
+type SpanConfig struct {
+	Kind SpanKind
+	// Start 开始时间, 拨号等子span在结束后创建, 使用记录的时间
+	Start time.Time
+	// Remote 客户端traceparent中的父span, 有效时作为父span, 否则使用parent中的span
+	Remote     SpanContext
+	Attributes []Attribute
+}
+
+// Span 一个span, 由TracerProvider创建
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError 记录错误并将span状态设置为错误
+	RecordError(err error)
+	End(t time.Time)
+	SpanContext() SpanContext
+}
+
+// TracerProvider 创建span, 不依赖OpenTelemetry, 可用少量代码适配, 如
+//
+//	type otelProvider struct{ tracer trace.Tracer }
+//
+//	func (p otelProvider) Start(parent context.Context, name string, c goproxy.SpanConfig) (context.Context, goproxy.Span) {
+//		if c.Remote.IsValid() {
+//			parent = trace.ContextWithRemoteSpanContext(parent, trace.NewSpanContext(trace.SpanContextConfig{
+//				TraceID: c.Remote.TraceID, SpanID: c.Remote.SpanID, TraceFlags: flags(c.Remote.Sampled), Remote: true,
+//			}))
+//		}
+//		ctx, span := p.tracer.Start(parent, name, trace.WithSpanKind(kind(c.Kind)), trace.WithTimestamp(c.Start), trace.WithAttributes(attrs(c.Attributes)...))
+//		return ctx, otelSpan{span}
+//	}
+type TracerProvider interface {
+	// Start 开始span, parent为父span所在的context, 返回包含新span的context
+	Start(parent context.Context, name string, config SpanConfig) (context.Context, Span)
+}
+
+// TracingConfig 跟踪设置
+type TracingConfig struct {
+	Provider TracerProvider
+	// Propagate 向目标服务器发送traceparent, 父span为代理的span, 默认保留客户端发送的traceparent
+	Propagate bool
+}
+
+// WithTracing 为每个HTTP请求(包括HTTPS解密后的请求)和隧道创建span, 客户端发送traceparent时作为父span
+// 子span: dial(建立连接)、tls_handshake(与目标服务器TLS握手)、ttfb(发送请求到收到响应首字节), 复用连接时没有dial和tls_handshake
+// HTTPS解密的连接为CONNECT span, 解密后的请求没有traceparent时作为其子span, Context.Span可在Delegate中添加属性
+func WithTracing(config TracingConfig) Option {
+	return func(opt *options) {
+		if config.Provider != nil {
+			opt.tracing = &config
+		}
+	}
+}
+
+// Span 当前请求或隧道的span, 未开启WithTracing时为nil
+func (c *Context) Span() Span {
+	return c.span
+}
+
+// startSpan 开始请求或隧道的span, 返回的finish结束span并恢复之前的span
+func (p *Proxy) startSpan(ctx *Context, name string, attrs ...Attribute) (finish func(status int, err error)) {
+	prevCtx, prevSpan := ctx.traceCtx, ctx.span
+	parent := prevCtx
+	if parent == nil {
+		parent = ctx.Req.Context()
+	}
+	remote := parseTraceparent(ctx.Req.Header.Get("Traceparent"))
+	remote.TraceState = ctx.Req.Header.Get("Tracestate")
+	attrs = append(attrs,
+		Attribute{Key: "client.address", Value: ctx.ClientIP},
+		Attribute{Key: "goproxy.request_id", Value: ctx.RequestID},
+	)
+	traceCtx, span := p.tracing.Provider.Start(parent, name, SpanConfig{
+		Kind:       SpanKindServer,
+		Start:      time.Now(),
+		Remote:     remote,
+		Attributes: attrs,
+	})
+	ctx.traceCtx, ctx.span = traceCtx, span
+	if p.tracing.Propagate {
+		if sc := span.SpanContext(); sc.IsValid() {
+			ctx.Req.Header.Set("Traceparent", sc.traceparent())
+			if sc.TraceState != "" {
+				ctx.Req.Header.Set("Tracestate", sc.TraceState)
+			}
+		}
+	}
+
+	return func(status int, err error) {
+		if status != 0 {
+			span.SetAttributes(Attribute{Key: "http.response.status_code", Value: int64(status)})
+		}
+		if ctx.User != "" {
+			span.SetAttributes(Attribute{Key: "user.name", Value: ctx.User})
+		}
+		if err == nil && status >= http.StatusInternalServerError {
+			err = errors.New(http.StatusText(status))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End(time.Now())
+		ctx.traceCtx, ctx.span = prevCtx, prevSpan
+	}
+}
+
+// childSpan 创建已结束的子span
+func (p *Proxy) childSpan(ctx *Context, name string, kind SpanKind, start, end time.Time, err error, attrs ...Attribute) {
+	if ctx.span == nil || start.IsZero() || end.IsZero() {
+		return
+	}
+	_, span := p.tracing.Provider.Start(ctx.traceCtx, name, SpanConfig{Kind: kind, Start: start, Attributes: attrs})
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End(end)
+}
+
+// connectionSpans 根据transport的连接耗时创建子span
+func (p *Proxy) connectionSpans(ctx *Context, t *requestTrace) {
+	if ctx.span == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.childSpan(ctx, "dial", SpanKindClient, t.dial, t.dialDone, t.dialErr, Attribute{Key: "network.peer.address", Value: t.dialAddr})
+	p.childSpan(ctx, "tls_handshake", SpanKindClient, t.tls, t.tlsDone, t.tlsErr)
+	p.childSpan(ctx, "ttfb", SpanKindInternal, t.start, t.firstByte, nil)
+}
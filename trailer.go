@@ -0,0 +1,49 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// keepTETrailers 客户端声明接受trailer时(TE: trailers, 如gRPC)转发给目标服务器, TE的其他值按逐跳头删除
+func keepTETrailers(dst, src http.Header) {
+	if headerContainsToken(src, "Te", "trailers") {
+		dst.Set("Te", "trailers")
+	}
+}
+
+// announceTrailers 写入响应头前声明trailer, 删除长度使HTTP/1.1客户端按chunked接收
+func announceTrailers(h http.Header, resp *http.Response) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.Set("Trailer", strings.Join(keys, ", "))
+	h.Del("Content-Length")
+}
+
+// copyTrailers body写入完成后复制trailer, 使用http.TrailerPrefix, 包括响应头中未声明的trailer
+func copyTrailers(h http.Header, resp *http.Response) {
+	for k, vv := range resp.Trailer {
+		h[http.TrailerPrefix+k] = vv
+	}
+}
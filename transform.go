@@ -0,0 +1,244 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrBodyTooLarge body超过大小限制
+var ErrBodyTooLarge = errors.New("body超过大小限制")
+
+// BodyTransformer 流式body转换
+// 返回的body替换原body, 关闭返回的body时需关闭原body, header可按需修改(如Content-Encoding)
+type BodyTransformer interface {
+	Transform(ctx *Context, header http.Header, body io.ReadCloser) (io.ReadCloser, error)
+}
+
+// BodyTransformerFunc 函数形式的BodyTransformer
+type BodyTransformerFunc func(ctx *Context, header http.Header, body io.ReadCloser) (io.ReadCloser, error)
+
+// Transform 实现BodyTransformer接口
+func (f BodyTransformerFunc) Transform(ctx *Context, header http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+	return f(ctx, header, body)
+}
+
+// WithRequestBodyTransformers 请求body转换, 在BeforeRequest之后按顺序执行
+func WithRequestBodyTransformers(t ...BodyTransformer) Option {
+	return func(opt *options) {
+		opt.requestTransformers = append(opt.requestTransformers, t...)
+	}
+}
+
+// WithResponseBodyTransformers 响应body转换, 在BeforeResponse之后按顺序执行
+func WithResponseBodyTransformers(t ...BodyTransformer) Option {
+	return func(opt *options) {
+		opt.responseTransformers = append(opt.responseTransformers, t...)
+	}
+}
+
+// transformBody 按顺序执行转换, 有转换时body长度未知, 删除Content-Length
+// stats与transformers一一对应, 统计每个转换的耗时
+func transformBody(ctx *Context, transformers []BodyTransformer, stats []*hookStat, header http.Header, body io.ReadCloser) (io.ReadCloser, bool, error) {
+	if len(transformers) == 0 || body == nil || body == http.NoBody {
+		return body, false, nil
+	}
+	for i, t := range transformers {
+		input := &timedReader{rc: body}
+		start := time.Now()
+		newBody, err := t.Transform(ctx, header, input)
+		if err != nil {
+			stats[i].since(start)
+			body.Close()
+			return nil, false, err
+		}
+		body = &transformTimer{timedReader: timedReader{rc: newBody}, input: input, setup: time.Since(start), stat: stats[i]}
+	}
+	header.Del("Content-Length")
+
+	return body, true, nil
+}
+
+// LimitBody 限制body大小, 超过时读取返回ErrBodyTooLarge
+func LimitBody(n int64) BodyTransformer {
+	return BodyTransformerFunc(func(ctx *Context, header http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+		return &limitReader{rc: body, remaining: n}, nil
+	})
+}
+
+type limitReader struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (l *limitReader) Read(b []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// 多读1字节用于判断是否超出
+	if int64(len(b)) > l.remaining+1 {
+		b = b[:l.remaining+1]
+	}
+	n, err := l.rc.Read(b)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), ErrBodyTooLarge
+	}
+
+	return n, err
+}
+
+func (l *limitReader) Close() error {
+	return l.rc.Close()
+}
+
+// TeeBody 读取body的同时写入newWriter返回的writer, body关闭时关闭writer, newWriter返回nil时不复制
+func TeeBody(newWriter func(ctx *Context, header http.Header) io.WriteCloser) BodyTransformer {
+	return BodyTransformerFunc(func(ctx *Context, header http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+		w := newWriter(ctx, header)
+		if w == nil {
+			return body, nil
+		}
+		return &teeReader{rc: body, w: w}, nil
+	})
+}
+
+type teeReader struct {
+	rc  io.ReadCloser
+	w   io.WriteCloser
+	err error
+}
+
+func (t *teeReader) Read(b []byte) (int, error) {
+	n, err := t.rc.Read(b)
+	// 写入失败不影响转发
+	if n > 0 && t.err == nil {
+		_, t.err = t.w.Write(b[:n])
+	}
+
+	return n, err
+}
+
+func (t *teeReader) Close() error {
+	t.w.Close()
+
+	return t.rc.Close()
+}
+
+// ReplaceBody 流式替换body中的内容
+func ReplaceBody(old, new []byte) BodyTransformer {
+	return BodyTransformerFunc(func(ctx *Context, header http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+		if len(old) == 0 {
+			return body, nil
+		}
+		return &replaceReader{rc: body, old: old, new: new}, nil
+	})
+}
+
+// replaceReader 保留len(old)-1字节的尾部, 避免匹配内容跨越两次读取
+type replaceReader struct {
+	rc       io.ReadCloser
+	old, new []byte
+	buf      []byte
+	pending  []byte
+	out      bytes.Buffer
+	eof      bool
+	err      error
+}
+
+func (r *replaceReader) Read(b []byte) (int, error) {
+	if r.buf == nil {
+		r.buf = make([]byte, 32*1024)
+	}
+	for r.out.Len() == 0 {
+		if r.eof {
+			if r.err != nil {
+				return 0, r.err
+			}
+			return 0, io.EOF
+		}
+		n, err := r.rc.Read(r.buf)
+		r.pending = append(r.pending, r.buf[:n]...)
+		if err != nil {
+			r.eof = true
+			if err != io.EOF {
+				r.err = err
+			}
+			r.out.Write(bytes.Replace(r.pending, r.old, r.new, -1))
+			r.pending = nil
+			continue
+		}
+		idx := lastSafeIndex(r.pending, r.old)
+		r.out.Write(bytes.Replace(r.pending[:idx], r.old, r.new, -1))
+		r.pending = append(r.pending[:0:0], r.pending[idx:]...)
+	}
+
+	return r.out.Read(b)
+}
+
+// lastSafeIndex 返回可以安全输出的位置, 之后的数据可能是old的前缀
+func lastSafeIndex(data, old []byte) int {
+	end := len(data)
+	// 最后一个完整匹配之后的数据才可能包含不完整的匹配
+	last := bytes.LastIndex(data, old)
+	start := 0
+	if last >= 0 {
+		start = last + len(old)
+	}
+	keep := len(old) - 1
+	if end-start <= keep {
+		return start
+	}
+
+	return end - keep
+}
+
+func (r *replaceReader) Close() error {
+	return r.rc.Close()
+}
+
+// GzipBody 使用gzip重新压缩body并设置Content-Encoding, 已压缩的body不处理
+func GzipBody() BodyTransformer {
+	return BodyTransformerFunc(func(ctx *Context, header http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+		if len(contentEncodings(header)) > 0 {
+			return body, nil
+		}
+		header.Set("Content-Encoding", "gzip")
+		pr, pw := io.Pipe()
+		go func() {
+			gz := gzip.NewWriter(pw)
+			_, err := io.Copy(gz, body)
+			if err == nil {
+				err = gz.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return &readCloser{Reader: pr, Closer: closerFunc(func() error {
+			pr.Close()
+			return body.Close()
+		})}, nil
+	})
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,291 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 透明代理等待客户端发送首个字节的时间, 超时按TCP隧道处理(如SSH、SMTP等服务端先发送数据的协议)
+const transparentPeekTimeout = 3 * time.Second
+
+type transparentKey struct{}
+
+// transparentInfo 透明代理连接的信息, 通过请求context传递给ServeHTTP
+type transparentInfo struct {
+	dst  string
+	sni  string
+	alpn []string
+	// raw 不是TLS或HTTP, 只能按TCP隧道转发
+	raw bool
+}
+
+func transparentOf(req *http.Request) *transparentInfo {
+	info, _ := req.Context().Value(transparentKey{}).(*transparentInfo)
+	return info
+}
+
+// isRawTransparent 透明代理的非TLS、非HTTP连接, 不能HTTPS解密
+func isRawTransparent(req *http.Request) bool {
+	info := transparentOf(req)
+	return info != nil && info.raw
+}
+
+// ServeTransparent 透明代理模式, 接收iptables REDIRECT或TPROXY转发的TCP连接, 返回ln.Accept的错误
+// 原始目标地址通过SO_ORIGINAL_DST获取(仅Linux), 获取失败时使用连接的本地地址(TPROXY)
+// TLS连接按ClientHello中的SNI(没有SNI时为原始目标地址)生成CONNECT请求, 开启HTTPS解密时同样解密
+// HTTP连接按Host头(为空时为原始目标地址)处理, 其他协议按CONNECT原始目标地址转发
+// 与显式代理使用相同的Delegate流程, Context.OriginalDst为原始目标地址
+func (p *Proxy) ServeTransparent(ln net.Listener) error {
+	ln = p.limitListener(ln, false)
+	httpLn := newConnListener(ln.Addr())
+	defer httpLn.Close()
+	server := &http.Server{
+		Handler: http.HandlerFunc(p.serveTransparentHTTP),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if tc, ok := c.(*transparentConn); ok {
+				return context.WithValue(ctx, transparentKey{}, &transparentInfo{dst: tc.dst})
+			}
+			return ctx
+		},
+	}
+	go server.Serve(httpLn)
+	defer server.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				delay = acceptBackoff(delay)
+				p.delegate.ErrorLog(fmt.Errorf("透明代理接受连接错误: %s, %s后重试", err, delay))
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go p.serveTransparentConn(conn, httpLn)
+	}
+}
+
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+
+	return delay
+}
+
+// serveTransparentConn 获取原始目标地址, 按首个字节区分TLS、HTTP和其他协议
+func (p *Proxy) serveTransparentConn(conn net.Conn, httpLn *connListener) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		dst = conn.LocalAddr().String()
+	}
+	if isListenerAddr(dst, httpLn.addr) {
+		// 直接连接代理端口的请求, 转发会回到代理自身
+		p.delegate.ErrorLog(fmt.Errorf("%s - 透明代理无法获取原始目标地址", conn.RemoteAddr()))
+		conn.Close()
+		return
+	}
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	first, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && !isTimeout(err) {
+		conn.Close()
+		return
+	}
+	tc := &transparentConn{Conn: &replayConn{Conn: conn, r: br}, dst: dst}
+	switch {
+	case len(first) == 1 && first[0] == 0x16:
+		p.serveTransparentTunnel(tc, false)
+	case len(first) == 1 && first[0] >= 'A' && first[0] <= 'Z':
+		if !httpLn.push(tc) {
+			conn.Close()
+		}
+	default:
+		p.serveTransparentTunnel(tc, true)
+	}
+}
+
+func isListenerAddr(dst string, ln net.Addr) bool {
+	la, ok := ln.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil || port != strconv.Itoa(la.Port) {
+		return false
+	}
+
+	return la.IP == nil || la.IP.IsUnspecified() || la.IP.Equal(net.ParseIP(host))
+}
+
+// serveTransparentHTTP 透明代理的HTTP请求, 补全为代理请求的绝对地址
+func (p *Proxy) serveTransparentHTTP(rw http.ResponseWriter, req *http.Request) {
+	info := transparentOf(req)
+	if req.Host == "" && info != nil {
+		req.Host = info.dst
+	}
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+	p.ServeHTTP(rw, req)
+}
+
+// serveTransparentTunnel 生成CONNECT请求, 由ServeHTTP按隧道或HTTPS解密处理
+func (p *Proxy) serveTransparentTunnel(conn *transparentConn, raw bool) {
+	info := &transparentInfo{dst: conn.dst, raw: raw}
+	var c net.Conn = conn
+	if !raw {
+		hello, replay, err := sniffClientHello(conn, defaultSNITimeout)
+		if err != nil && isTimeout(err) {
+			p.delegate.ErrorLog(fmt.Errorf("%s - 透明代理读取ClientHello超时", conn.dst))
+			conn.Close()
+			return
+		}
+		if hello != nil {
+			info.sni = hello.ServerName
+			info.alpn = hello.SupportedProtos
+		}
+		c = replay
+	}
+	host := info.dst
+	if info.sni != "" {
+		host = net.JoinHostPort(info.sni, portOf(info.dst, "443"))
+	}
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: host},
+		Host:       host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), transparentKey{}, info))
+	defer cancel()
+	rw := &transparentResponseWriter{conn: c, header: make(http.Header)}
+	p.ServeHTTP(rw, req.WithContext(ctx))
+	if !rw.hijacked {
+		c.Close()
+	}
+}
+
+// transparentConn 记录原始目标地址的客户端连接
+type transparentConn struct {
+	net.Conn
+	dst string
+}
+
+// transparentResponseWriter 透明代理的CONNECT请求没有HTTP客户端, 拒绝时直接关闭连接
+type transparentResponseWriter struct {
+	conn     net.Conn
+	header   http.Header
+	hijacked bool
+}
+
+func (w *transparentResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *transparentResponseWriter) WriteHeader(int) {}
+
+func (w *transparentResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *transparentResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// connListener 把已接受的连接交给http.Server
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *connListener) push(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// writeTunnelEstablished 通知客户端隧道已建立, 透明代理的客户端没有发送CONNECT, 不需要通知
+// HTTP/2的CONNECT发送200响应头, SOCKS5客户端发送成功应答
+func (c *Context) writeTunnelEstablished(conn net.Conn) error {
+	if c.OriginalDst != "" {
+		return nil
+	}
+	switch sc := c.clientConn.(type) {
+	case *h2StreamConn:
+		return sc.writeStatus(http.StatusOK)
+	case *socksConn:
+		return sc.reply(socksReplySucceeded)
+	}
+	_, err := conn.Write(tunnelEstablishedResponseLine)
+
+	return err
+}
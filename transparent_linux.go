@@ -0,0 +1,88 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// netfilter的SO_ORIGINAL_DST和IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// originalDst 读取iptables REDIRECT前的目标地址
+func originalDst(conn net.Conn) (string, error) {
+	for {
+		switch c := conn.(type) {
+		case *transparentConn:
+			conn = c.Conn
+			continue
+		case *replayConn:
+			conn = c.Conn
+			continue
+		case *limitConn:
+			conn = c.Conn
+			continue
+		}
+		break
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return "", errors.New("连接不支持读取原始目标地址")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	var dst string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// sockaddr_in6的端口为网络字节序
+			port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+			dst = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+			return
+		}
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// sockaddr_in: family(2) port(2, 网络字节序) addr(4)
+		port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+		dst = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(int(port)))
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+//go:build !linux
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst 只有Linux支持SO_ORIGINAL_DST, 其他系统使用连接的本地地址
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("当前系统不支持读取原始目标地址")
+}
@@ -0,0 +1,375 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUpstreamHealthCheckInterval = 10 * time.Second
+	defaultUpstreamHealthCheckTimeout  = 5 * time.Second
+	defaultUpstreamFailureThreshold    = 3
+	defaultUpstreamOpenTimeout         = 30 * time.Second
+)
+
+// ErrNoUpstream 上级代理池中没有可用的上级代理
+var ErrNoUpstream = errors.New("没有可用的上级代理")
+
+// UpstreamStrategy 上级代理池的选择策略
+type UpstreamStrategy int
+
+const (
+	// UpstreamRoundRobin 轮询
+	UpstreamRoundRobin UpstreamStrategy = iota
+	// UpstreamWeighted 按Upstream.Weight平滑加权轮询
+	UpstreamWeighted
+	// UpstreamLeastConn 选择正在进行的请求和隧道最少的上级代理
+	UpstreamLeastConn
+)
+
+// Upstream 上级代理池的成员
+type Upstream struct {
+	// URL 上级代理地址, 支持http://、ssh://、socks5://和socks5h://
+	URL *url.URL
+	// Weight 权重, 默认1, UpstreamWeighted时有效
+	Weight int
+	// Geo 只用于地理位置匹配的请求和隧道, 需要开启WithGeoIP, 为空时用于所有请求
+	Geo GeoMatch
+}
+
+// UpstreamPoolConfig 上级代理池设置
+type UpstreamPoolConfig struct {
+	Upstreams []Upstream
+	Strategy  UpstreamStrategy
+	// HealthCheckInterval 主动健康检查的间隔, 默认10秒, 小于0时只根据请求结果判断
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout 单次健康检查的超时时间, 默认5秒
+	HealthCheckTimeout time.Duration
+	// HealthCheck 健康检查, 返回错误时视为失败, 默认与上级代理建立TCP连接
+	HealthCheck func(ctx context.Context, u *url.URL) error
+	// FailureThreshold 连续失败达到该次数后熔断, 不再选择该上级代理, 默认3
+	FailureThreshold int
+	// OpenTimeout 熔断的时间, 默认30秒, 之后允许一个请求或健康检查试探, 成功后恢复
+	OpenTimeout time.Duration
+}
+
+// WithUpstreamPool 上级代理池, 开启后不再调用Delegate.ParentProxy
+// 连接上级代理失败时换用其他可用的上级代理, HTTP请求只在body可以重新读取时切换
+func WithUpstreamPool(config UpstreamPoolConfig) Option {
+	return func(opt *options) {
+		opt.upstreamPool = &config
+	}
+}
+
+// 熔断状态
+const (
+	upstreamClosed = iota
+	upstreamOpen
+	upstreamHalfOpen
+)
+
+type upstreamMember struct {
+	url    *url.URL
+	weight int
+	geo    GeoMatch
+
+	// 以下字段由upstreamPool.mu保护
+	current  int
+	inFlight int
+	failures int
+	state    int
+	openedAt time.Time
+}
+
+type upstreamPool struct {
+	config   UpstreamPoolConfig
+	members  []*upstreamMember
+	errorLog func(error)
+
+	mu   sync.Mutex
+	next int
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func newUpstreamPool(config UpstreamPoolConfig, check func(ctx context.Context, u *url.URL) error, errorLog func(error)) *upstreamPool {
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = defaultUpstreamHealthCheckInterval
+	}
+	if config.HealthCheckTimeout <= 0 {
+		config.HealthCheckTimeout = defaultUpstreamHealthCheckTimeout
+	}
+	if config.HealthCheck == nil {
+		config.HealthCheck = check
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaultUpstreamFailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = defaultUpstreamOpenTimeout
+	}
+	pool := &upstreamPool{config: config, errorLog: errorLog, stopCh: make(chan struct{})}
+	for _, u := range config.Upstreams {
+		weight := u.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.members = append(pool.members, &upstreamMember{url: u.URL, weight: weight, geo: u.Geo})
+	}
+	if config.HealthCheckInterval > 0 && len(pool.members) > 0 {
+		go pool.run()
+	}
+
+	return pool
+}
+
+// pick 选择一个未尝试过、地理位置匹配的可用上级代理, 返回的成员需要调用release
+func (pool *upstreamPool) pick(ctx *Context, tried []*upstreamMember) (*upstreamMember, error) {
+	now := time.Now()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	candidates := make([]*upstreamMember, 0, len(pool.members))
+	for _, m := range pool.members {
+		if !containsMember(tried, m) && m.geo.match(ctx) && pool.available(m, now) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoUpstream
+	}
+	var m *upstreamMember
+	switch {
+	case ctx.ParentSession != "":
+		m = stickyMember(ctx.ParentSession, candidates)
+	case pool.config.Strategy == UpstreamWeighted:
+		total := 0
+		for _, c := range candidates {
+			c.current += c.weight
+			total += c.weight
+			if m == nil || c.current > m.current {
+				m = c
+			}
+		}
+		m.current -= total
+	case pool.config.Strategy == UpstreamLeastConn:
+		start := pool.next % len(candidates)
+		pool.next++
+		for i := range candidates {
+			c := candidates[(start+i)%len(candidates)]
+			if m == nil || c.inFlight < m.inFlight {
+				m = c
+			}
+		}
+	default:
+		m = candidates[pool.next%len(candidates)]
+		pool.next++
+	}
+	if m.state == upstreamOpen {
+		m.state = upstreamHalfOpen
+	}
+	m.inFlight++
+
+	return m, nil
+}
+
+// available 未熔断, 或熔断时间已过且没有正在试探的请求, 调用方需持有mu
+func (pool *upstreamPool) available(m *upstreamMember, now time.Time) bool {
+	switch m.state {
+	case upstreamOpen:
+		return now.Sub(m.openedAt) >= pool.config.OpenTimeout
+	case upstreamHalfOpen:
+		return false
+	}
+
+	return true
+}
+
+// observe 记录请求或健康检查的结果
+func (pool *upstreamPool) observe(m *upstreamMember, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if err == nil {
+		m.failures = 0
+		m.state = upstreamClosed
+		return
+	}
+	m.failures++
+	if m.state == upstreamHalfOpen || m.failures >= pool.config.FailureThreshold {
+		m.state = upstreamOpen
+		m.openedAt = time.Now()
+	}
+}
+
+func (pool *upstreamPool) release(m *upstreamMember) {
+	pool.mu.Lock()
+	m.inFlight--
+	pool.mu.Unlock()
+}
+
+// body 响应body关闭时释放
+func (pool *upstreamPool) body(m *upstreamMember, rc io.ReadCloser) io.ReadCloser {
+	var once sync.Once
+	return &readCloser{Reader: rc, Closer: closerFunc(func() error {
+		once.Do(func() { pool.release(m) })
+		return rc.Close()
+	})}
+}
+
+// healthy 是否未熔断, 用于ParentProxyStats
+func (pool *upstreamPool) healthy(key string) (healthy bool, weight int, ok bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, m := range pool.members {
+		if parentStatsKey(m.url) == key {
+			if m.state != upstreamClosed {
+				return false, 0, true
+			}
+			return true, m.weight, true
+		}
+	}
+
+	return false, 0, false
+}
+
+func (pool *upstreamPool) run() {
+	ticker := time.NewTicker(pool.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.stopCh:
+			return
+		case <-ticker.C:
+			pool.checkAll()
+		}
+	}
+}
+
+// checkAll 检查所有上级代理, 熔断中的上级代理在熔断时间过后才检查
+func (pool *upstreamPool) checkAll() {
+	var wg sync.WaitGroup
+	now := time.Now()
+	for _, m := range pool.members {
+		pool.mu.Lock()
+		skip := m.state == upstreamHalfOpen || m.state == upstreamOpen && now.Sub(m.openedAt) < pool.config.OpenTimeout
+		if m.state == upstreamOpen && !skip {
+			m.state = upstreamHalfOpen
+		}
+		pool.mu.Unlock()
+		if skip {
+			continue
+		}
+		wg.Add(1)
+		go func(m *upstreamMember) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), pool.config.HealthCheckTimeout)
+			err := pool.config.HealthCheck(ctx, m.url)
+			cancel()
+			if err != nil {
+				pool.errorLog(fmt.Errorf("上级代理%s健康检查失败: %s", m.url.Host, err))
+			}
+			pool.observe(m, err)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (pool *upstreamPool) stop() {
+	pool.stopOnce.Do(func() {
+		close(pool.stopCh)
+	})
+}
+
+func containsMember(list []*upstreamMember, m *upstreamMember) bool {
+	for _, item := range list {
+		if item == m {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkUpstream 默认健康检查, 与上级代理建立TCP连接
+func (p *Proxy) checkUpstream(ctx context.Context, u *url.URL) error {
+	conn, err := p.dialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// canFailover 请求未发送到上级代理, 并且body可以重新读取
+func canFailover(req *http.Request, err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" && opErr.Op != "proxyconnect" {
+		return false
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// roundTripUpstream 从上级代理池选择上级代理发送请求, 连接失败时换用其他上级代理
+func (p *Proxy) roundTripUpstream(ctx *Context, req *http.Request, pool *upstreamPool) (*http.Response, error) {
+	var tried []*upstreamMember
+	var lastErr error
+	for {
+		m, err := pool.pick(ctx, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		tried = append(tried, m)
+		if lastErr != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				pool.release(m)
+				return nil, lastErr
+			}
+			req.Body = body
+		}
+		resp, err := p.roundTripParent(ctx, req, m.url)
+		pool.observe(m, err)
+		if err == nil {
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				pool.release(m)
+				return resp, nil
+			}
+			resp.Body = pool.body(m, resp.Body)
+			return resp, nil
+		}
+		pool.release(m)
+		if !canFailover(req, err) {
+			return nil, err
+		}
+		p.delegate.ErrorLog(fmt.Errorf("%s - 上级代理%s连接失败, 尝试其他上级代理: %s", req.URL.Host, m.url.Host, err))
+		lastErr = err
+	}
+}
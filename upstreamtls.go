@@ -0,0 +1,92 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+)
+
+// UpstreamTLSConfig 与目标服务器的TLS设置, 用于HTTPS请求和HTTPS解密后的请求
+type UpstreamTLSConfig struct {
+	// RootCAs 验证目标服务器证书的根证书, 为nil时使用系统根证书
+	RootCAs *x509.CertPool
+	// Certificates 目标服务器要求客户端证书(mTLS)时提供, 按服务器接受的CA选择
+	// 需要在运行时替换证书时使用WithUpstreamClientCertificate
+	Certificates []tls.Certificate
+	// MinVersion 最低TLS版本, 如tls.VersionTLS12, 为0时使用crypto/tls的默认值
+	MinVersion uint16
+	// InsecureSkipVerify 不验证所有目标服务器的证书
+	InsecureSkipVerify bool
+	// InsecureSkipVerifyHosts 不验证证书的目标域名, 规则同MatchHost, 如使用自签名证书的内网服务
+	InsecureSkipVerifyHosts []string
+}
+
+// WithUpstreamTLS 设置与目标服务器的TLS, 修改默认transport或WithTransport设置的transport的TLSClientConfig
+// 默认transport不验证目标服务器的证书, 设置后按InsecureSkipVerify和InsecureSkipVerifyHosts验证
+func WithUpstreamTLS(config UpstreamTLSConfig) Option {
+	return func(opt *options) {
+		opt.upstreamTLS = &config
+	}
+}
+
+// apply 设置到transport的TLSClientConfig
+func (c *UpstreamTLSConfig) apply(t *http.Transport) {
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	if c.RootCAs != nil {
+		cfg.RootCAs = c.RootCAs
+	}
+	if len(c.Certificates) > 0 {
+		cfg.Certificates = c.Certificates
+	}
+	if c.MinVersion != 0 {
+		cfg.MinVersion = c.MinVersion
+	}
+	cfg.InsecureSkipVerify = c.InsecureSkipVerify
+	t.TLSClientConfig = cfg
+}
+
+// insecureHost 是否不验证目标域名的证书
+func (c *UpstreamTLSConfig) insecureHost(host string) bool {
+	if c == nil || c.InsecureSkipVerify {
+		return false
+	}
+	for _, pattern := range c.InsecureSkipVerifyHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// insecureTransport 不验证证书的transport, 连接池与验证证书的transport隔离
+func (p *Proxy) insecureTransport(base *http.Transport) *http.Transport {
+	if t, ok := p.insecureTransports.Load(base); ok {
+		return t.(*http.Transport)
+	}
+	t := base.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.InsecureSkipVerify = true
+	actual, _ := p.insecureTransports.LoadOrStore(base, t)
+
+	return actual.(*http.Transport)
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 ouqiang authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebSocketCompression WebSocket压缩扩展(permessage-deflate)的协商方式
+// 不支持在代理终止压缩(与客户端协商压缩、与目标服务器不压缩并逐帧解压和重新压缩):
+// 协议升级后代理只双向转发字节, 没有逐帧检查的hook, 需要看到未压缩的帧时使用WebSocketCompressionStrip
+type WebSocketCompression int
+
+const (
+	// WebSocketCompressionPass 原样转发客户端的扩展协商
+	WebSocketCompressionPass WebSocketCompression = iota
+	// WebSocketCompressionStrip 从握手请求中去掉permessage-deflate, 两端都不压缩, 代理看到的帧都是未压缩的
+	WebSocketCompressionStrip
+)
+
+// WithWebSocketCompression 设置WebSocket压缩扩展的协商方式, 默认WebSocketCompressionPass
+func WithWebSocketCompression(mode WebSocketCompression) Option {
+	return func(opt *options) {
+		opt.webSocketCompression = mode
+	}
+}
+
+// isWebSocketUpgrade 是否为WebSocket握手请求
+func isWebSocketUpgrade(h http.Header) bool {
+	return headerContainsToken(h, "Connection", "upgrade") && headerContainsToken(h, "Upgrade", "websocket")
+}
+
+// headerContainsToken header中逗号分隔的值是否包含token, 不区分大小写
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// negotiateWebSocketExtensions 按压缩方式修改握手请求的Sec-WebSocket-Extensions
+func negotiateWebSocketExtensions(h http.Header, mode WebSocketCompression) {
+	if mode != WebSocketCompressionStrip {
+		return
+	}
+	const key = "Sec-Websocket-Extensions"
+	var kept []string
+	for _, v := range h[key] {
+		for _, ext := range strings.Split(v, ",") {
+			ext = strings.TrimSpace(ext)
+			if ext == "" {
+				continue
+			}
+			name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") || strings.EqualFold(name, "x-webkit-deflate-frame") {
+				continue
+			}
+			kept = append(kept, ext)
+		}
+	}
+	h.Del(key)
+	if len(kept) > 0 {
+		h.Set(key, strings.Join(kept, ", "))
+	}
+}
+
+// keepUpgradeHeaders 删除逐跳header后恢复WebSocket握手需要的Connection和Upgrade
+func keepUpgradeHeaders(dst, src http.Header) {
+	upgrade := src.Get("Upgrade")
+	dst.Set("Connection", "Upgrade")
+	dst.Set("Upgrade", upgrade)
+}
+
+// upgradeBody 协议升级后的响应body是到目标服务器的双向连接
+func upgradeBody(resp *http.Response) (io.ReadWriteCloser, error) {
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, errors.New("协议升级的响应body不支持写入")
+	}
+
+	return rwc, nil
+}
+
+// writeUpgradeResponse 写入101响应头
+func writeUpgradeResponse(w io.Writer, resp *http.Response) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(bw)
+	bw.WriteString("\r\n")
+
+	return bw.Flush()
+}
+
+// forwardUpgrade HTTP代理收到101后劫持客户端连接, 与目标服务器双向转发
+func (p *Proxy) forwardUpgrade(ctx *Context, rw http.ResponseWriter, resp *http.Response) {
+	upstream, err := upgradeBody(resp)
+	if err != nil {
+		p.recordError(ctx, ErrorClassUpstream, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - %s", ctx.Req.URL, err))
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		err = errors.New("web server不支持Hijacker")
+		p.recordError(ctx, ErrorClassClient, err)
+		p.delegate.ErrorLog(err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		p.recordError(ctx, ErrorClassClient, err)
+		p.delegate.ErrorLog(fmt.Errorf("hijacker错误: %s", err))
+		return
+	}
+	defer conn.Close()
+	ctx.clientConn = conn
+	p.conns.add(conn, ctx, TunnelTypeWebSocket)
+	defer p.conns.remove(conn)
+	var clientConn net.Conn = conn
+	if brw.Reader.Buffered() > 0 {
+		// 客户端在101之前发送的数据
+		clientConn = &replayConn{Conn: conn, r: brw.Reader}
+	}
+	clientConn = newCountConn(clientConn,
+		[]*int64{&p.stats.bytesIn, &ctx.Bytes.ClientRead},
+		[]*int64{&p.stats.bytesOut, &ctx.Bytes.ClientWritten})
+	if ctx.quota != nil {
+		clientConn = ctx.quota.conn(clientConn)
+	}
+	if ctx.throttle != nil {
+		clientConn = ctx.throttle.conn(clientConn)
+	}
+	ctx.status = resp.StatusCode
+	if err = writeUpgradeResponse(clientConn, resp); err != nil {
+		p.recordError(ctx, ErrorClassClient, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - 协议升级, 通知客户端失败: %s", ctx.Req.URL, err))
+		return
+	}
+	p.spliceUpgrade(ctx, clientConn, upstream)
+}
+
+// spliceUpgrade 协议升级后双向转发, 空闲超时和总时长与隧道相同
+func (p *Proxy) spliceUpgrade(ctx *Context, clientConn net.Conn, upstream io.ReadWriteCloser) {
+	upstream = &countReadWriteCloser{ReadWriteCloser: upstream, read: []*int64{&ctx.Bytes.UpstreamRead}, written: []*int64{&ctx.Bytes.UpstreamWritten}}
+	clientIdle, _ := p.tunnelIdleTimeouts(ctx.Timeouts)
+	clientConn = withIdleTimeout(clientConn, clientIdle)
+	if ctx.Timeouts.Total > 0 {
+		timer := time.AfterFunc(ctx.Timeouts.Total, func() {
+			clientConn.Close()
+			upstream.Close()
+		})
+		defer timer.Stop()
+	}
+
+	p.transfer(clientConn, upstream)
+}
+
+type countReadWriteCloser struct {
+	io.ReadWriteCloser
+	read    []*int64
+	written []*int64
+}
+
+func (c *countReadWriteCloser) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	addCounters(c.read, n)
+
+	return n, err
+}
+
+func (c *countReadWriteCloser) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	addCounters(c.written, n)
+
+	return n, err
+}
+
+// forwardHTTPSUpgrade HTTPS解密后的请求收到101, 在TLS连接上双向转发
+func (p *Proxy) forwardHTTPSUpgrade(ctx *Context, tlsConn net.Conn, br *bufio.Reader, resp *http.Response) {
+	upstream, err := upgradeBody(resp)
+	if err != nil {
+		p.recordError(ctx, ErrorClassUpstream, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, %s", ctx.Req.URL, err))
+		tlsConn.Write(makeStatusResponse(http.StatusBadGateway))
+		return
+	}
+	defer upstream.Close()
+	if err = writeUpgradeResponse(tlsConn, resp); err != nil {
+		p.recordError(ctx, ErrorClassClient, err)
+		p.delegate.ErrorLog(fmt.Errorf("%s - HTTPS解密, 协议升级, 通知客户端失败: %s", ctx.Req.URL, err))
+		return
+	}
+	clientConn := tlsConn
+	if br.Buffered() > 0 {
+		clientConn = &replayConn{Conn: tlsConn, r: br}
+	}
+	p.spliceUpgrade(ctx, clientConn, upstream)
+}